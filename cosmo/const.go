@@ -5,4 +5,5 @@ const (
 	MpcMks  = 3.08560e+22
 	MSunMks = 1.98900e+30
 	CMks    = 2.99792e+08
+	YearMks = 3.15576e+07
 )
@@ -0,0 +1,105 @@
+package cosmo
+
+const (
+	// Number of Simpson's rule steps used by integrals over redshift and
+	// scale factor.
+	integralSteps = 2000
+	// Fractional precision of RedshiftFromDistance.
+	redshiftTol = 1e-10
+)
+
+// HubbleDistance returns c/H0 in Mpc/h.
+func HubbleDistance() float64 {
+	return CMks / 1e5
+}
+
+// HubbleTime returns 1/H0 in Gyr. H0 is in km/s/Mpc.
+func HubbleTime(H0 float64) float64 {
+	return MpcMks / (H0 * 1000) / (YearMks * 1e9)
+}
+
+// ComovingDistance returns the line-of-sight comoving distance to redshift
+// z in Mpc/h. Assumes a flat universe.
+func ComovingDistance(omegaM, omegaL, z float64) float64 {
+	return HubbleDistance() * simpson(0, z, func(zz float64) float64 {
+		return 1 / HubbleFrac(omegaM, omegaL, zz)
+	})
+}
+
+// AngularDiameterDistance returns the angular diameter distance to redshift
+// z in Mpc/h. Assumes a flat universe.
+func AngularDiameterDistance(omegaM, omegaL, z float64) float64 {
+	return ComovingDistance(omegaM, omegaL, z) / (1 + z)
+}
+
+// LuminosityDistance returns the luminosity distance to redshift z in
+// Mpc/h. Assumes a flat universe.
+func LuminosityDistance(omegaM, omegaL, z float64) float64 {
+	return ComovingDistance(omegaM, omegaL, z) * (1 + z)
+}
+
+// LookbackTime returns the time between redshift z and today in Gyr. H0 is
+// in km/s/Mpc.
+func LookbackTime(H0, omegaM, omegaL, z float64) float64 {
+	return HubbleTime(H0) * simpson(0, z, func(zz float64) float64 {
+		return 1 / ((1 + zz) * HubbleFrac(omegaM, omegaL, zz))
+	})
+}
+
+// GrowthFactor returns the linear growth factor, D(z), normalized so that
+// D(0) = 1. Assumes a flat universe with no radiation.
+func GrowthFactor(omegaM, omegaL, z float64) float64 {
+	return unnormalizedGrowth(omegaM, omegaL, 1 / (1 + z)) /
+		unnormalizedGrowth(omegaM, omegaL, 1)
+}
+
+// unnormalizedGrowth evaluates the growing mode of the linear growth
+// equation, D(a) ~ h(a) * int_0^a da' / (a' h(a'))^3.
+func unnormalizedGrowth(omegaM, omegaL, a float64) float64 {
+	hFrac := func(a float64) float64 {
+		return HubbleFrac(omegaM, omegaL, 1/a - 1)
+	}
+
+	integral := simpson(0, a, func(aa float64) float64 {
+		if aa == 0 { return 0 }
+		ah := aa * hFrac(aa)
+		return 1 / (ah * ah * ah)
+	})
+	return 2.5 * omegaM * hFrac(a) * integral
+}
+
+// RedshiftFromDistance returns the redshift at which the comoving distance
+// is d Mpc/h. This is the inverse of ComovingDistance.
+func RedshiftFromDistance(omegaM, omegaL, d float64) float64 {
+	if d <= 0 { return 0 }
+
+	// Bracket the root, then bisect.
+	low, high := 0.0, 1.0
+	for ComovingDistance(omegaM, omegaL, high) < d {
+		low, high = high, 2 * high
+	}
+
+	for (high - low) > redshiftTol * high {
+		mid := (low + high) / 2
+		if ComovingDistance(omegaM, omegaL, mid) < d {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return (low + high) / 2
+}
+
+// simpson integrates f from low to high using Simpson's rule.
+func simpson(low, high float64, f func(float64) float64) float64 {
+	if high == low { return 0 }
+
+	dx := (high - low) / integralSteps
+	sum := f(low) + f(high)
+	for i := 1; i < integralSteps; i++ {
+		w := 2.0
+		if i % 2 == 1 { w = 4.0 }
+		sum += w * f(low + float64(i) * dx)
+	}
+	return sum * dx / 3
+}
@@ -0,0 +1,104 @@
+package cosmo
+
+import (
+	"math"
+	"testing"
+)
+
+// Reference values are for a flat cosmology with H0 = 70 km/s/Mpc and
+// OmegaM = 0.3 (e.g. astropy's FlatLambdaCDM(H0=70, Om0=0.3)).
+const (
+	testH0 = 70.0
+	testH100 = 0.7
+	testOmegaM = 0.3
+	testOmegaL = 0.7
+)
+
+func almostEqual(x, y, frac float64) bool {
+	return math.Abs(x - y) <= frac * math.Abs(y)
+}
+
+func TestDistances(t *testing.T) {
+	table := []struct {
+		name string
+		f func(omegaM, omegaL, z float64) float64
+		z, mpc float64
+	}{
+		{ "ComovingDistance", ComovingDistance, 0.5, 1888.6 },
+		{ "ComovingDistance", ComovingDistance, 1, 3303.8 },
+		{ "AngularDiameterDistance", AngularDiameterDistance, 1, 1651.9 },
+		{ "LuminosityDistance", LuminosityDistance, 1, 6607.7 },
+	}
+
+	for _, test := range table {
+		// Distances are in Mpc/h.
+		d := test.f(testOmegaM, testOmegaL, test.z) / testH100
+		if !almostEqual(d, test.mpc, 1e-3) {
+			t.Errorf(
+				"%s(%g) = %g Mpc, expected %g Mpc.",
+				test.name, test.z, d, test.mpc,
+			)
+		}
+	}
+
+	if d := ComovingDistance(testOmegaM, testOmegaL, 0); d != 0 {
+		t.Errorf("ComovingDistance(0) = %g, expected 0.", d)
+	}
+}
+
+func TestLookbackTime(t *testing.T) {
+	table := []struct {
+		z, gyr float64
+	}{
+		{ 1, 7.715 },
+	}
+
+	for _, test := range table {
+		lt := LookbackTime(testH0, testOmegaM, testOmegaL, test.z)
+		if !almostEqual(lt, test.gyr, 1e-3) {
+			t.Errorf(
+				"LookbackTime(%g) = %g Gyr, expected %g Gyr.",
+				test.z, lt, test.gyr,
+			)
+		}
+	}
+}
+
+// cptGrowth is the growth factor approximation from Carroll, Press, &
+// Turner (1992), which is accurate to about a percent.
+func cptGrowth(omegaM, omegaL, z float64) float64 {
+	g := func(z float64) float64 {
+		e2 := omegaM * math.Pow(1 + z, 3) + omegaL
+		om, ol := omegaM * math.Pow(1 + z, 3) / e2, omegaL / e2
+		return 2.5 * om / (math.Pow(om, 4.0/7) - ol + (1 + om/2)*(1 + ol/70))
+	}
+	return g(z) / g(0) / (1 + z)
+}
+
+func TestGrowthFactor(t *testing.T) {
+	for _, z := range []float64{ 0, 0.5, 1, 2, 5 } {
+		// Einstein-de Sitter growth is exactly D = a.
+		d := GrowthFactor(1, 0, z)
+		if !almostEqual(d, 1 / (1 + z), 1e-4) {
+			t.Errorf("EdS GrowthFactor(%g) = %g, expected %g.", z, d, 1/(1+z))
+		}
+
+		d = GrowthFactor(testOmegaM, testOmegaL, z)
+		cpt := cptGrowth(testOmegaM, testOmegaL, z)
+		if !almostEqual(d, cpt, 1e-2) {
+			t.Errorf(
+				"GrowthFactor(%g) = %g, but Carroll et al. give %g.", z, d, cpt,
+			)
+		}
+	}
+}
+
+func TestRedshiftFromDistance(t *testing.T) {
+	for _, z := range []float64{ 0, 0.01, 0.5, 1, 3, 10 } {
+		d := ComovingDistance(testOmegaM, testOmegaL, z)
+		zz := RedshiftFromDistance(testOmegaM, testOmegaL, d)
+		if math.Abs(zz - z) > 1e-6 * (1 + z) {
+			t.Errorf("RedshiftFromDistance(%g) = %g, expected %g.", d, zz, z)
+		}
+	}
+}
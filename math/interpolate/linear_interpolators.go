@@ -294,7 +294,7 @@ func NewUniformTriLinear(
 func (tri *TriLinear) Eval(x, y, z float64) float64 {
 	ix := tri.xs.search(x)
 	iy := tri.ys.search(y)
-	iz := tri.ys.search(z)
+	iz := tri.zs.search(z)
 
 	var i, dix, diy, diz int
 	switch tri.byteOrder {
@@ -319,7 +319,7 @@ func (tri *TriLinear) Eval(x, y, z float64) float64 {
 
 	x1, x2 := tri.xs.val(ix), tri.xs.val(ix+1)
 	y1, y2 := tri.ys.val(iy), tri.ys.val(iy+1)
-	z1, z2 := tri.ys.val(iz), tri.ys.val(iz+1)
+	z1, z2 := tri.zs.val(iz), tri.zs.val(iz+1)
 
 	xd := (x - x1) / (x2 - x1)
 	yd := (y - y1) / (y2 - y1)
@@ -472,10 +472,10 @@ func NewUniformTriLinearMulti(
 func (tri *TriLinearMulti) Eval(x, y, z float64) []float64 {
 	ix := tri.xs.search(x)
 	iy := tri.ys.search(y)
-	iz := tri.ys.search(z)
+	iz := tri.zs.search(z)
 	x1, x2 := tri.xs.val(ix), tri.xs.val(ix+1)
 	y1, y2 := tri.ys.val(iy), tri.ys.val(iy+1)
-	z1, z2 := tri.ys.val(iz), tri.ys.val(iz+1)
+	z1, z2 := tri.zs.val(iz), tri.zs.val(iz+1)
 	xd := (x - x1) / (x2 - x1)
 	yd := (y - y1) / (y2 - y1)
 	zd := (z - z1) / (z2 - z1)
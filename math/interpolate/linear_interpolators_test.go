@@ -2,6 +2,7 @@ package interpolate
 
 import (
 	"encoding/binary"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -101,3 +102,38 @@ func TestUniformTriLinearMulti(t *testing.T) {
 	assert.Equal(t, value(0, 0, 0), interp.Eval(0, 0, 0)[0], "grid edge")
 	assert.Equal(t, value(0.01, 0, 0), interp.Eval(0.01, 0, 0)[0], "grid edge nearby x")
 }
+
+func TestUniformTriLinearNonCubic(t *testing.T) {
+	nx, ny, nz := 4, 6, 9
+	x0, y0, z0 := 1.0, -2.0, 0.5
+	dx, dy, dz := 0.5, 0.25, 2.0
+	vals := make([]float64, nx*ny*nz)
+	idx := 0
+	for k := 0; k < nz; k++ {
+		for j := 0; j < ny; j++ {
+			for i := 0; i < nx; i++ {
+				vals[idx] = value(
+					x0+float64(i)*dx, y0+float64(j)*dy, z0+float64(k)*dz,
+				)
+				idx++
+			}
+		}
+	}
+	interp := NewUniformTriLinear(
+		x0, dx, nx,
+		y0, dy, ny,
+		z0, dz, nz,
+		vals, binary.LittleEndian,
+	)
+
+	pts := [][3]float64{
+		{1.1, -1.9, 0.7}, {2.4, -0.8, 16.4}, {1.0, -2.0, 0.5}, {2.5, -0.75, 16.5},
+	}
+	for _, p := range pts {
+		got, exp := interp.Eval(p[0], p[1], p[2]), value(p[0], p[1], p[2])
+		if math.Abs(got-exp) > 1e-10 {
+			t.Errorf("Eval(%g, %g, %g) = %g, expected %g.",
+				p[0], p[1], p[2], got, exp)
+		}
+	}
+}
@@ -8,6 +8,7 @@ Supported functions:
 
 read_header(filename) -> gotetra.Header
 read_grid(filename) -> numpy.ndarray
+read_hist(filename) -> (gotetra.HistHeader, numpy.ndarray)
 
 Supported classes:
 
@@ -17,6 +18,8 @@ Header
   RenderInfo
   LocationInfo
   VelocityInfo
+HistHeader
+  HistAxis
 """
 
 import array
@@ -31,6 +34,14 @@ VELOCITY            = 2
 VELOCITY_DIVERGENCE = 3
 VELOCITY_CURL       = 4
 
+HIST_QUANTITIES = [
+    "Density", "StreamCount", "RadialVelocity",
+    "VelocityMagnitude", "VelocityDivergence", "Radius", "StreamDensity",
+]
+HIST_NORMALIZATIONS = ["Counts", "MassPDF", "VolumePDF"]
+HIST_HEADER_SIZE = 184
+HIST_AXIS_SIZE = 40
+
 class Sizes(object):
     def __init__(self, ver):
         if ver == 1:
@@ -46,6 +57,13 @@ class Sizes(object):
             self.render_info = 40
             self.location_info = 104
             self.velocity_info = 104
+        elif ver == 3:
+            self.header = 344
+            self.type_info = 32
+            self.cosmo_info = 64
+            self.render_info = 40
+            self.location_info = 104
+            self.velocity_info = 104
         else:
             print("Unrecognized gotetra output version, %d." % ver)
             exit(1)
@@ -135,6 +153,101 @@ def read_grid(filename):
             xs = np.reshape(xs, (hd.dim[k], hd.dim[j]))
         return xs
 
+def read_hist(filename):
+    """ read_hist returns the header and bin counts of a .ghist histogram
+    written by TetraHist as a (HistHeader, numpy.ndarray) tuple. If the file
+    contains volume weights, they're stored in the weights and weights2
+    fields of the header.
+
+    The numpy arrays use a C-like element order, meaning the last index
+    corresponds to the first histogram axis.
+    """
+    with open(filename, "rb") as fp:
+        s = fp.read(HIST_HEADER_SIZE)
+        end = _read_endianness_flag(s[0:8])
+        hd = HistHeader(s, end)
+        hd.axes = [HistAxis(fp.read(HIST_AXIS_SIZE), end)
+                   for _ in range(hd.dims)]
+
+        n = 1
+        for ax in hd.axes: n *= ax.bins
+        dtype = "<i8" if little_endian(end) else ">i8"
+        counts = np.frombuffer(fp.read(8 * n), dtype=dtype)
+
+        shape = tuple(ax.bins for ax in reversed(hd.axes))
+        if hd.has_weights:
+            dtype = "<f8" if little_endian(end) else ">f8"
+            hd.weights = np.reshape(
+                np.frombuffer(fp.read(8 * n), dtype=dtype), shape)
+            hd.weights2 = np.reshape(
+                np.frombuffer(fp.read(8 * n), dtype=dtype), shape)
+
+    return hd, np.reshape(counts, shape)
+
+class HistHeader(object):
+    """ HistHeader contains header information from a .ghist file. It
+    contains the fields:
+        cosmo            : CosmoInfo
+        particles        : int - Number of points per tetrahedron.
+        subsample_length : int - Level of subsampling used.
+        origin           : float numpy.array - Bottommost corner of the
+                                               histogrammed region. Units are
+                                               Mpc / h.
+        span             : float numpy.array - Dimensions of the region.
+                                               Units are Mpc / h.
+        dims             : int - Number of histogram axes.
+        axes             : list of HistAxis
+        normalization    : str - Normalization of the text output. The
+                                 counts are always raw.
+        cumulative       : bool - True if the text output was cumulative.
+        poisson_errors   : bool - True if the text output had errors.
+        has_weights      : bool - True if the file has volume weights.
+        weights          : numpy.ndarray - Summed volume weights of each
+                                           bin, or None.
+        weights2         : numpy.ndarray - Summed squares of the volume
+                                           weights of each bin, or None.
+    """
+    def __init__(self, s, end):
+        assert len(s) == HIST_HEADER_SIZE
+        self.header_size, self.dims = endian_unpack("qq", s[8:24], end)
+        self.cosmo = CosmoInfo(s[24:88], end)
+        data = endian_unpack("qq" + "d" * 6, s[88:152], end)
+        self.particles, self.subsample_length = data[0], data[1]
+        self.origin = np.array(data[2:5])
+        self.span = np.array(data[5:8])
+        data = endian_unpack("qqqq", s[152:184], end)
+        self.normalization = HIST_NORMALIZATIONS[data[0]]
+        self.cumulative = data[1] != 0
+        self.poisson_errors = data[2] != 0
+        self.has_weights = data[3] != 0
+        self.weights, self.weights2 = None, None
+        self.axes = []
+
+class HistAxis(object):
+    """ HistAxis describes the binning of one histogram axis. Its fields are:
+        quantity : str   - The quantity binned along the axis.
+        min, max : float - The edges of the axis.
+        bins     : int   - The number of bins.
+        is_log   : bool  - True if the bins are logarithmically spaced.
+
+    The bin centers can be found with centers().
+    """
+    def __init__(self, s, end):
+        data = endian_unpack("qddqq", s, end)
+        self.quantity = HIST_QUANTITIES[data[0]]
+        self.min, self.max = data[1], data[2]
+        self.bins = data[3]
+        self.is_log = data[4] != 0
+
+    def centers(self):
+        """ centers returns the centers of the bins as a numpy array. """
+        if self.is_log:
+            edges = np.logspace(np.log10(self.min), np.log10(self.max),
+                                self.bins + 1)
+            return np.sqrt(edges[1:] * edges[:-1])
+        edges = np.linspace(self.min, self.max, self.bins + 1)
+        return (edges[1:] + edges[:-1]) / 2
+
 class Header(object):
     """ Header contains header information from a gotetra header file. It
     contains the fields:
@@ -222,17 +335,22 @@ class TypeInfo(object):
                                     information stored in the file.
             is_vector_grid  : bool - Flag indicating whether the file is a
                                      vector field or a scalar field.
+            is_angular      : bool - Flag indicating whether the pixels are
+                                     spaced in angle (in degrees), like
+                                     light cone maps. Always False before
+                                     version 3.
     """
     def __init__(self, s, end):
         self.endianness_flag = end
 
-        fmt = "qqq"
+        fmt = "q" * (len(s) // 8)
         data = endian_unpack(fmt, s, self.endianness_flag)
 
         self.header_size = data[0]
         self.grid_type = data[1]
         self.is_vector_grid = not (self.grid_type == DENSITY or 
                                    self.grid_type == VELOCITY_DIVERGENCE)
+        self.is_angular = len(data) > 3 and data[3] != 0
 
     def __str__(self):
         return "\n".join([
@@ -240,6 +358,7 @@ class TypeInfo(object):
             "    header_size     = %d" % self.header_size,
             "    grid_type       = %s" % self.grid_type_str(),
             "    is_vector_grid  = %r" % self.is_vector_grid,
+            "    is_angular      = %r" % self.is_angular,
         ])
 
 
@@ -0,0 +1,616 @@
+package render
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+	"github.com/phil-mansfield/gotetra/render/geom"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// Options contains the settings used by RenderBoxes. These are the same as
+// the variables in [Render] config files.
+type Options struct {
+	Quantity density.Quantity
+
+	// Exactly one of TotalPixels, the number of pixels across the whole
+	// simulation, and ImagePixels, the number of pixels across the longest
+	// side of each box, should be set. ImagePixels takes precedence.
+	TotalPixels, ImagePixels int
+
+	// Particles is the number of points used per tetrahedron. If
+	// ProjectionDepth or AutoParticles is set, it's chosen from the depth of
+	// the projection instead.
+	Particles int
+	AutoParticles bool
+	ProjectionDepth int
+
+	// SubsampleLength must be a power of two which evenly divides the
+	// segment width of the sheets. It defaults to 1.
+	SubsampleLength int
+
+	// The remaining fields apply to the whole render and are ignored in
+	// BoxSpec.Options.
+
+	// Boxes which are wider than TileWidth pixels are split into tiles, and
+	// TilesPerPass tiles are rendered during each pass through the sheets.
+	// Tiles which intersect the same sheet files are grouped into the same
+	// pass, so each of those files is only read once for all of them.
+	// Tiling is turned off if TileWidth is zero.
+	TileWidth, TilesPerPass int
+
+	// If MemoryLimitMB is set, RenderBoxes fails before doing any work if
+	// it's estimated to need more memory than this.
+	MemoryLimitMB int
+
+	// If CheckpointFile is set, checkpoints are written every
+	// CheckpointInterval files and, if Resume is set, the render picks up
+	// from any existing checkpoints. Boxes which were finished before a
+	// checkpoint was written are only passed to Write once, so Write should
+	// be set when checkpointing.
+	CheckpointFile string
+	CheckpointInterval int
+	Resume bool
+
+	// Events is an optional event log and Log turns on the standard logger.
+	Events *EventLog
+	Log bool
+
+	// If Write is set, it's called on each Result as soon as its grid is
+	// finished. The grid is freed afterwards, so Results returned by
+	// RenderBoxes won't contain grids.
+	Write func(res *Result) error
+}
+
+// BoxSpec is a box which will be rendered by RenderBoxes. Positions and widths
+// are in comoving Mpc/h.
+type BoxSpec struct {
+	Name string
+	X, Y, Z float64
+	XWidth, YWidth, ZWidth float64
+	// ProjectionAxis is "X", "Y", or "Z" for projected images and "" for
+	// volumes.
+	ProjectionAxis string
+
+	// If Options is non-nil, its per-box settings are used instead of the
+	// ones in the Options passed to RenderBoxes.
+	Options *Options
+}
+
+// Result is a rendered box or a tile of one.
+type Result struct {
+	// Name is the name of the box or tile and Index is the index of the
+	// BoxSpec it came from. For tiles, Tile is the index of the tile along
+	// each axis and Tiles is the number of tiles the box was split into.
+	// Tile is nil for boxes which weren't split.
+	Name string
+	Index int
+	Tile []int
+	Tiles int
+
+	Quantity density.Quantity
+	// Cells is the number of pixels across the simulation and Points is the
+	// number of points used per tetrahedron.
+	Cells, Points int
+	// Grid contains the rendered values. It's nil if Options.Write is set.
+	Grid density.Buffer
+
+	// Header information. BoxLoc is the location of the full box, which is
+	// different from Loc for tiles.
+	Cosmo io.CosmoInfo
+	Render io.RenderInfo
+	Loc, BoxLoc io.LocationInfo
+}
+
+// renderJob is a single box which will be rendered by a Manager. This is
+// either one of the BoxSpecs or a tile of one of them.
+type renderJob struct {
+	box io.BoxConfig
+	res *Result
+	skip int
+}
+
+// renderPlan contains everything needed to render a set of BoxSpecs. Every
+// pass through the sheet files is set up before rendering so that the memory
+// and time needed can be checked before doing any work.
+type renderPlan struct {
+	results []Result
+	jobs []renderJob
+	// passes contains the indices of the jobs rendered by each Manager.
+	passes [][]int
+	mans []*Manager
+	boxes [][]Box
+}
+
+// RenderBoxes renders the given boxes from the sheet files in sheetDir and
+// returns one Result for each box, or for each tile of boxes which are split
+// into tiles. If ctx is cancelled, rendering stops after the current file
+// and ctx.Err() is returned.
+func RenderBoxes(
+	ctx context.Context, sheetDir string, specs []BoxSpec, opts Options,
+) ([]Result, error) {
+	p, err := newRenderPlan(sheetDir, specs, &opts)
+	if err != nil { return nil, err }
+
+	rs := p.resources()
+	if opts.Log {
+		for i, r := range rs { log.Printf("Pass %d/%d: %s", i + 1, len(rs), r) }
+	}
+	peak, _ := PeakResources(rs)
+	if opts.MemoryLimitMB > 0 && peak > int64(opts.MemoryLimitMB) << 20 {
+		return nil, fmt.Errorf(
+			"Estimated peak memory, %d MB, is larger than MemoryLimitMB, " +
+				"%d MB. Try setting a smaller TileWidth or TilesPerPass.",
+			peak >> 20, opts.MemoryLimitMB,
+		)
+	}
+
+	for pi, man := range p.mans {
+		if opts.CheckpointFile != "" {
+			name := CheckpointName(opts.CheckpointFile, pi)
+			man.SetCheckpoint(name, opts.CheckpointInterval)
+			if _, err := os.Stat(name); opts.Resume && err == nil {
+				if err := man.Resume(name); err != nil { return nil, err }
+			}
+		}
+
+		pass, boxes := p.passes[pi], p.boxes[pi]
+		if opts.Write != nil {
+			man.SetFlush(func(i int) error {
+				res := *p.jobs[pass[i]].res
+				res.Grid = boxes[i].Vals()
+				return opts.Write(&res)
+			})
+		}
+
+		if err := man.RenderDensityContext(ctx); err != nil { return nil, err }
+
+		if opts.Write == nil {
+			for i, ji := range pass { p.jobs[ji].res.Grid = boxes[i].Vals() }
+		}
+	}
+
+	// Checkpoints are only needed until every pass is finished.
+	if opts.CheckpointFile != "" {
+		for pi := range p.mans {
+			os.Remove(CheckpointName(opts.CheckpointFile, pi))
+		}
+	}
+
+	return p.results, nil
+}
+
+// EstimateBoxes estimates the resources RenderBoxes would need for each pass
+// through the sheet files without rendering anything.
+func EstimateBoxes(
+	sheetDir string, specs []BoxSpec, opts Options,
+) ([]*Resources, error) {
+	p, err := newRenderPlan(sheetDir, specs, &opts)
+	if err != nil { return nil, err }
+	return p.resources(), nil
+}
+
+// PeakResources returns the largest memory usage in bytes and the total run
+// time in seconds of a set of passes.
+func PeakResources(rs []*Resources) (peak int64, seconds float64) {
+	for _, r := range rs {
+		if r.Bytes() > peak { peak = r.Bytes() }
+		seconds += r.Seconds
+	}
+	return peak, seconds
+}
+
+// SheetFiles returns the names of the sheet files in a directory.
+func SheetFiles(sheetDir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(sheetDir)
+	if err != nil { return nil, err }
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("Sheet directory '%s' is empty.", sheetDir)
+	}
+
+	files := make([]string, len(infos))
+	for i := range infos { files[i] = path.Join(sheetDir, infos[i].Name()) }
+	return files, nil
+}
+
+// CheckpointName returns the name of the checkpoint file for a pass.
+func CheckpointName(file string, pass int) string {
+	return fmt.Sprintf("%s.%d", file, pass)
+}
+
+func (p *renderPlan) resources() []*Resources {
+	rs := make([]*Resources, len(p.mans))
+	for i, man := range p.mans { rs[i] = man.Resources() }
+	return rs
+}
+
+// newRenderPlan splits the specs into jobs and passes and creates the
+// Managers which will render them.
+func newRenderPlan(
+	sheetDir string, specs []BoxSpec, opts *Options,
+) (*renderPlan, error) {
+	if opts.TilesPerPass <= 0 { opts.TilesPerPass = 1 }
+	if opts.CheckpointInterval <= 0 { opts.CheckpointInterval = 16 }
+	if opts.TileWidth < 0 {
+		return nil, fmt.Errorf("Invalid TileWidth, %d.", opts.TileWidth)
+	} else if len(specs) == 0 {
+		return nil, fmt.Errorf("No boxes were given.")
+	}
+
+	files, err := SheetFiles(sheetDir)
+	if err != nil { return nil, err }
+	hd := &io.SheetHeader{ }
+	if err = io.ReadSheetHeaderAt(files[0], hd); err != nil { return nil, err }
+	cos := io.NewCosmoInfo(
+		hd.Cosmo.H100 * 100, hd.Cosmo.OmegaM,
+		hd.Cosmo.OmegaL, hd.Cosmo.Z, hd.TotalWidth,
+	)
+
+	// Figure out cell sizes and particle counts for each box and split large
+	// boxes into tiles. Results are stored separately from the jobs until
+	// every tile is known so that the jobs can point into p.results.
+	p := &renderPlan{ }
+	jobs, results := []renderJob{ }, []Result{ }
+	for i := range specs {
+		o := specs[i].options(opts)
+		if err := o.validate(specs[i].Name, hd); err != nil { return nil, err }
+
+		config := specs[i].config()
+		err := config.CheckInit(specs[i].Name, hd.TotalWidth)
+		if err != nil { return nil, err }
+
+		cells, err := totalPixels(o, &config, hd.TotalWidth)
+		if err != nil { return nil, err }
+		pts := particles(o, &config, hd.TotalWidth, cells)
+
+		origin, span := boxPixels(&config, cells, hd.TotalWidth)
+		cellWidth := hd.TotalWidth / float64(cells)
+		boxes, tiles := splitBox(&config, opts, cells, o.Quantity, hd.TotalWidth)
+		for j := range boxes {
+			tileOrigin, tileSpan := boxPixels(&boxes[j], cells, hd.TotalWidth)
+			results = append(results, Result{
+				Name: boxes[j].Name, Index: i,
+				Tile: tiles[j], Tiles: len(boxes),
+				Quantity: o.Quantity, Cells: cells, Points: pts,
+				Cosmo: cos,
+				Render: io.NewRenderInfo(
+					pts, cells, o.SubsampleLength, config.ProjectionAxis,
+				),
+				Loc: io.NewLocationInfo(tileOrigin, tileSpan, cellWidth),
+				BoxLoc: io.NewLocationInfo(origin, span, cellWidth),
+			})
+			jobs = append(jobs, renderJob{ boxes[j], nil, o.SubsampleLength })
+		}
+	}
+
+	p.results, p.jobs = results, jobs
+	for i := range p.jobs { p.jobs[i].res = &p.results[i] }
+	jobFiles, err := renderJobFiles(files, p.jobs, hd.TotalWidth)
+	if err != nil { return nil, err }
+	p.passes = renderPasses(p.jobs, jobFiles, opts.TilesPerPass)
+
+	p.mans = make([]*Manager, len(p.passes))
+	p.boxes = make([][]Box, len(p.passes))
+	for pi, pass := range p.passes {
+		boxes := make([]Box, len(pass))
+		for i, ji := range pass {
+			job := &p.jobs[ji]
+			boxes[i] = NewBox(
+				hd.TotalWidth, job.res.Points, job.res.Cells,
+				job.res.Quantity, &job.box,
+			)
+			if opts.Log {
+				log.Println(
+					"Rendering", job.res.Quantity, "to box:",
+					boxes[i].CellSpan(), "pixels,", job.res.Points,
+					"particles per tetrahedron",
+				)
+			}
+		}
+
+		man, err := NewManager(files, boxes, opts.Log)
+		if err != nil { return nil, err }
+		man.SetEventLog(opts.Events)
+		for i, ji := range pass {
+			err := man.SubsampleBox(i, p.jobs[ji].skip)
+			if err != nil { return nil, err }
+		}
+
+		p.mans[pi], p.boxes[pi] = man, boxes
+	}
+
+	return p, nil
+}
+
+// options returns the Options used to render the box.
+func (spec *BoxSpec) options(opts *Options) *Options {
+	o := *opts
+	if spec.Options != nil {
+		o.Quantity = spec.Options.Quantity
+		o.TotalPixels = spec.Options.TotalPixels
+		o.ImagePixels = spec.Options.ImagePixels
+		o.Particles = spec.Options.Particles
+		o.AutoParticles = spec.Options.AutoParticles
+		o.ProjectionDepth = spec.Options.ProjectionDepth
+		o.SubsampleLength = spec.Options.SubsampleLength
+	}
+	if o.SubsampleLength == 0 { o.SubsampleLength = 1 }
+	return &o
+}
+
+// validate returns the first problem with the per-box settings of o when
+// rendering the sheets described by hd.
+func (o *Options) validate(name string, hd *io.SheetHeader) error {
+	if o.Quantity < 0 || o.Quantity >= density.EndQuantity {
+		return fmt.Errorf(
+			"Box '%s' has an invalid Quantity, %d.", name, o.Quantity,
+		)
+	} else if o.ImagePixels <= 0 && o.TotalPixels <= 0 {
+		return fmt.Errorf(
+			"Box '%s' needs either a positive ImagePixels or TotalPixels.",
+			name,
+		)
+	} else if o.Particles <= 0 && o.ProjectionDepth <= 0 && !o.AutoParticles {
+		return fmt.Errorf(
+			"Box '%s' needs either a positive Particles or " +
+				"ProjectionDepth or AutoParticles.", name,
+		)
+	} else if err := checkSubsample(hd, o.SubsampleLength); err != nil {
+		return fmt.Errorf("Box '%s': %s", name, err.Error())
+	}
+	return nil
+}
+
+// config converts a BoxSpec to a BoxConfig.
+func (spec *BoxSpec) config() io.BoxConfig {
+	return io.BoxConfig{
+		X: spec.X, Y: spec.Y, Z: spec.Z,
+		XWidth: spec.XWidth, YWidth: spec.YWidth, ZWidth: spec.ZWidth,
+		ProjectionAxis: strings.ToUpper(spec.ProjectionAxis),
+		Name: spec.Name,
+	}
+}
+
+// totalPixels returns the number of pixels across the simulation box.
+func totalPixels(
+	o *Options, box *io.BoxConfig, boxWidth float64,
+) (int, error) {
+	if o.ImagePixels > 0 {
+		w := maxWidth(box)
+		if w > boxWidth {
+			return 0, fmt.Errorf(
+				"Requested dimensions of '%s' are larger than the " +
+					"simulation box.", box.Name,
+			)
+		}
+
+		return round(boxWidth / w * float64(o.ImagePixels)), nil
+	}
+	return o.TotalPixels, nil
+}
+
+// maxWidth returns the dimension of box width the largest width.
+func maxWidth(box *io.BoxConfig) float64 {
+	var max float64
+	if box.XWidth > box.YWidth {
+		max = box.XWidth
+	} else {
+		max = box.YWidth
+	}
+
+	if max > box.ZWidth {
+		return max
+	} else {
+		return box.ZWidth
+	}
+}
+
+// particles computes the number of particles (Monte Carlo samples) which will
+// be used per tetrahedron.
+func particles(
+	o *Options, box *io.BoxConfig, boxWidth float64, cells int,
+) int {
+	depth := o.ProjectionDepth
+	if o.AutoParticles {
+		cellWidth := boxWidth / float64(cells)
+
+		if box.ProjectionAxis == "X" {
+			depth = int(math.Ceil(box.XWidth / cellWidth))
+		} else if box.ProjectionAxis == "Y" {
+			depth = int(math.Ceil(box.YWidth / cellWidth))
+		} else if box.ProjectionAxis == "Z" {
+			depth = int(math.Ceil(box.ZWidth / cellWidth))
+		} else {
+			depth = 1
+		}
+	}
+
+	if depth > 0 {
+		refPixels := 500.0
+		refParticles := 5.0
+		refDepth := 1.0
+		refSubsample := 1.0
+		return int(math.Ceil(
+			refParticles * math.Pow(float64(cells) / refPixels, 3) *
+			math.Pow(float64(o.SubsampleLength) / refSubsample, 3) *
+			(refDepth / float64(depth)),
+		))
+	}
+
+	return o.Particles
+}
+
+// round rounds x to the nearest integer
+func round(x float64) int {
+	floor, ceil := math.Floor(x), math.Ceil(x)
+	if ceil - x < x - floor {
+		return int(ceil)
+	} else {
+		return int(floor)
+	}
+}
+
+// splitBox returns the boxes needed to render config. If tiling is turned on
+// and the box is larger than a tile, it will be split into pixel-aligned
+// tiles and tiles will contain the index of each one. Otherwise, the box is
+// returned as-is and its tile is nil.
+func splitBox(
+	config *io.BoxConfig, opts *Options, cells int,
+	q density.Quantity, boxWidth float64,
+) (boxes []io.BoxConfig, tiles [][]int) {
+	untiled := []io.BoxConfig{ *config }
+	if opts.TileWidth <= 0 { return untiled, [][]int{ nil } }
+
+	// Projected boxes are never split along their projection axis.
+	origin, span := boxPixels(config, cells, boxWidth)
+	tileCounts := [3]int{ }
+	isTiled := false
+	proj := projectionAxis(config, q)
+	for k := 0; k < 3; k++ {
+		if k == proj {
+			tileCounts[k] = 1
+		} else {
+			tileCounts[k] = (span[k] + opts.TileWidth - 1) / opts.TileWidth
+		}
+		isTiled = isTiled || tileCounts[k] > 1
+	}
+	if !isTiled { return untiled, [][]int{ nil } }
+
+	if opts.Log {
+		log.Printf(
+			"Splitting '%s' into %d x %d x %d tiles.", config.Name,
+			tileCounts[0], tileCounts[1], tileCounts[2],
+		)
+	}
+
+	cellWidth := boxWidth / float64(cells)
+	for tz := 0; tz < tileCounts[2]; tz++ {
+		for ty := 0; ty < tileCounts[1]; ty++ {
+			for tx := 0; tx < tileCounts[0]; tx++ {
+				tile := []int{ tx, ty, tz }
+				box := *config
+				box.Name = fmt.Sprintf(
+					"%s_tile_%d_%d_%d", config.Name, tx, ty, tz,
+				)
+
+				xs := []*float64{ &box.X, &box.Y, &box.Z }
+				widths := []*float64{ &box.XWidth, &box.YWidth, &box.ZWidth }
+				for k := 0; k < 3; k++ {
+					if k == proj { continue }
+					start := tile[k] * opts.TileWidth
+					w := opts.TileWidth
+					if start + w > span[k] { w = span[k] - start }
+
+					// Place the edges in the middle of pixels so that the
+					// tile covers exactly w pixels.
+					*xs[k] = (float64(origin[k] + start) + 0.5) * cellWidth
+					*widths[k] = float64(w - 1) * cellWidth
+				}
+
+				boxes = append(boxes, box)
+				tiles = append(tiles, tile)
+			}
+		}
+	}
+
+	return boxes, tiles
+}
+
+// boxPixels returns the pixel origin and span which NewBox will assign to
+// the given config.
+func boxPixels(
+	config *io.BoxConfig, cells int, boxWidth float64,
+) (origin, span [3]int) {
+	cellWidth := boxWidth / float64(cells)
+	xs := [3]float64{ config.X, config.Y, config.Z }
+	widths := [3]float64{ config.XWidth, config.YWidth, config.ZWidth }
+	for k := 0; k < 3; k++ {
+		origin[k] = int(math.Floor(xs[k] / cellWidth))
+		span[k] = 1 + int(math.Floor((xs[k] + widths[k]) / cellWidth))
+		span[k] -= origin[k]
+	}
+	return origin, span
+}
+
+// projectionAxis returns the index of the axis a box will be projected
+// along, or -1 if it won't be projected.
+func projectionAxis(config *io.BoxConfig, q density.Quantity) int {
+	if !config.IsProjection() || !q.CanProject() { return -1 }
+	switch config.ProjectionAxis {
+	case "X": return 0
+	case "Y": return 1
+	case "Z": return 2
+	}
+	return -1
+}
+
+// renderJobFiles returns the indices of the sheet files which intersect
+// each job.
+func renderJobFiles(
+	files []string, jobs []renderJob, boxWidth float64,
+) ([][]int, error) {
+	jobFiles := make([][]int, len(jobs))
+	hd := &io.SheetHeader{ }
+	for fi, file := range files {
+		if err := io.ReadSheetHeaderAt(file, hd); err != nil { return nil, err }
+		for ji := range jobs {
+			cells := jobs[ji].res.Cells
+			origin, span := boxPixels(&jobs[ji].box, cells, boxWidth)
+			cb := geom.CellBounds{ Origin: origin, Width: span }
+			if hd.CellBounds(cells).Intersect(&cb, cells) {
+				jobFiles[ji] = append(jobFiles[ji], fi)
+			}
+		}
+	}
+	return jobFiles, nil
+}
+
+// renderPasses groups jobs into the sets of boxes which are rendered during
+// each pass through the input files. All untiled boxes are rendered
+// together. Tiles are grouped tilesPerPass at a time: each pass starts with
+// the first remaining tile and repeatedly adds the tile which shares the
+// most sheet files, given by jobFiles, with the tiles already in the pass.
+func renderPasses(jobs []renderJob, jobFiles [][]int, tilesPerPass int) [][]int {
+	passes := [][]int{ }
+	untiled, tiled := []int{ }, []int{ }
+	for i := range jobs {
+		if jobs[i].res.Tile == nil {
+			untiled = append(untiled, i)
+		} else {
+			tiled = append(tiled, i)
+		}
+	}
+
+	if len(untiled) > 0 { passes = append(passes, untiled) }
+	for len(tiled) > 0 {
+		pass := []int{ tiled[0] }
+		passFiles := map[int]bool{ }
+		for _, fi := range jobFiles[tiled[0]] { passFiles[fi] = true }
+		tiled = tiled[1:]
+
+		for len(pass) < tilesPerPass && len(tiled) > 0 {
+			best, bestShared := 0, -1
+			for i, ji := range tiled {
+				shared := 0
+				for _, fi := range jobFiles[ji] {
+					if passFiles[fi] { shared++ }
+				}
+				if shared > bestShared { best, bestShared = i, shared }
+			}
+
+			ji := tiled[best]
+			pass = append(pass, ji)
+			for _, fi := range jobFiles[ji] { passFiles[fi] = true }
+			tiled = append(tiled[:best], tiled[best + 1:]...)
+		}
+		passes = append(passes, pass)
+	}
+	return passes
+}
@@ -0,0 +1,270 @@
+package render
+
+import (
+	"context"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+func TestRenderPasses(t *testing.T) {
+	tile := &Result{ Tile: []int{ 0, 0, 0 } }
+	untiled := &Result{ }
+	jobs := []renderJob{
+		{ res: tile }, { res: untiled }, { res: tile }, { res: tile },
+		{ res: tile }, { res: untiled }, { res: tile },
+	}
+	// Tiles 0, 3, and 6 share files with each other, as do tiles 2 and 4.
+	jobFiles := [][]int{
+		{ 0, 1 }, { 0 }, { 4, 5 }, { 1, 2 }, { 5, 6 }, { 7 }, { 2, 3 },
+	}
+
+	table := []struct {
+		tilesPerPass int
+		passes [][]int
+	}{
+		{ 1, [][]int{ { 1, 5 }, { 0 }, { 2 }, { 3 }, { 4 }, { 6 } } },
+		{ 2, [][]int{ { 1, 5 }, { 0, 3 }, { 2, 4 }, { 6 } } },
+		{ 3, [][]int{ { 1, 5 }, { 0, 3, 6 }, { 2, 4 } } },
+		{ 10, [][]int{ { 1, 5 }, { 0, 3, 6, 2, 4 } } },
+	}
+
+	for i := range table {
+		passes := renderPasses(jobs, jobFiles, table[i].tilesPerPass)
+		if !passesEqual(passes, table[i].passes) {
+			t.Errorf(
+				"%d) Expected passes %v with %d tiles per pass, got %v.",
+				i, table[i].passes, table[i].tilesPerPass, passes,
+			)
+		}
+	}
+}
+
+func passesEqual(a, b [][]int) bool {
+	if len(a) != len(b) { return false }
+	for i := range a {
+		if len(a[i]) != len(b[i]) { return false }
+		for j := range a[i] {
+			if a[i][j] != b[i][j] { return false }
+		}
+	}
+	return true
+}
+
+func TestTiledGridWriter(t *testing.T) {
+	sheetDir, outDir := latticeDir(t), latticeDir(t)
+	defer os.RemoveAll(sheetDir)
+	defer os.RemoveAll(outDir)
+	writeLatticeSheets(sheetDir, 16, 2, 16)
+
+	spec := BoxSpec{
+		Name: "box", X: 2.5, Y: 3.5, Z: 1.5,
+		XWidth: 9, YWidth: 7, ZWidth: 5,
+	}
+	opts := Options{
+		Quantity: density.Density, TotalPixels: 16, Particles: 200,
+	}
+	full, err := RenderBoxes(context.Background(), sheetDir,
+		[]BoxSpec{ spec }, opts)
+	if err != nil { t.Fatal(err.Error()) }
+
+	opts.TileWidth, opts.TilesPerPass = 4, 2
+	tiles, err := RenderBoxes(context.Background(), sheetDir,
+		[]BoxSpec{ spec }, opts)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(tiles) != 3 * 2 * 2 {
+		t.Fatalf("Box was split into %d tiles, expected 12.", len(tiles))
+	}
+
+	// Write the tiles in reverse order, reopening the file for each one.
+	name := path.Join(outDir, "box.gtet")
+	for i := len(tiles) - 1; i >= 0; i-- {
+		res := &tiles[i]
+		var w *io.TiledGridWriter
+		if i == len(tiles) - 1 {
+			w, err = io.NewTiledGridWriter(
+				name, res.Quantity, res.Cosmo, res.Render, res.BoxLoc,
+			)
+		} else {
+			w, err = io.OpenTiledGridWriter(name)
+		}
+		if err != nil { t.Fatal(err.Error()) }
+		if err = w.WriteTile(res.Grid, res.Loc); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err = w.Close(); err != nil { t.Fatal(err.Error()) }
+	}
+
+	g, err := io.ReadGridFile(name)
+	if err != nil { t.Fatal(err.Error()) }
+	if g.Header.Loc != full[0].Loc {
+		t.Fatalf("Assembled grid has location %v, expected %v.",
+			g.Header.Loc, full[0].Loc)
+	}
+
+	// Every tile must be written to exactly the right place.
+	for i := range tiles {
+		loc := &tiles[i].Loc
+		origin, span := [3]int{ }, [3]int{ }
+		for k := 0; k < 3; k++ {
+			origin[k] = int(loc.PixelOrigin[k] - g.Header.Loc.PixelOrigin[k])
+			span[k] = int(loc.PixelSpan[k])
+		}
+		crop, err := g.Crop(origin, span)
+		if err != nil { t.Fatal(err.Error()) }
+
+		vals, _ := tiles[i].Grid.FinalizedScalarBuffer()
+		for j := range vals {
+			if crop.Vals[0][j] != vals[j] {
+				t.Errorf("Tile %v pixel %d is %g in the assembled grid, " +
+					"expected %g.", tiles[i].Tile, j, crop.Vals[0][j], vals[j])
+				break
+			}
+		}
+	}
+
+	// Rendering uses random points in each tetrahedron, so the assembled
+	// grid only matches the single-box render up to noise.
+	fullVals, _ := full[0].Grid.FinalizedScalarBuffer()
+	for i := range fullVals {
+		if fullVals[i] <= 0 {
+			t.Fatalf("Pixel %d of the single-box render is %g.", i, fullVals[i])
+		}
+		if math.Abs(float64(g.Vals[0][i] / fullVals[i]) - 1) > 0.1 {
+			t.Errorf("Pixel %d of the assembled grid is %g, but is %g in " +
+				"the single-box render.", i, g.Vals[0][i], fullVals[i])
+		}
+	}
+}
+
+func TestRenderBoxesOverrides(t *testing.T) {
+	sheetDir := latticeDir(t)
+	defer os.RemoveAll(sheetDir)
+	// The sheet segments are 8 particles wide.
+	writeLatticeSheets(sheetDir, 16, 2, 16)
+
+	opts := Options{
+		Quantity: density.Density, TotalPixels: 16, Particles: 20,
+	}
+	specs := []BoxSpec{
+		{ Name: "a", X: 4, Y: 4, Z: 4, XWidth: 8, YWidth: 8, ZWidth: 8 },
+		{
+			Name: "b", X: 4, Y: 4, Z: 4, XWidth: 8, YWidth: 8, ZWidth: 8,
+			Options: &Options{
+				Quantity: density.Density, TotalPixels: 16, Particles: 50,
+				SubsampleLength: 2,
+			},
+		},
+	}
+
+	p, err := newRenderPlan(sheetDir, specs, &opts)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(p.mans) != 1 {
+		t.Fatalf("Boxes were rendered in %d passes, expected 1.", len(p.mans))
+	}
+	table := []struct {
+		pts, skip int
+	}{ { 20, 1 }, { 50, 2 } }
+	for i := range table {
+		res, r := &p.results[i], &p.mans[0].renderers[i]
+		if res.Points != table[i].pts || r.skip != table[i].skip ||
+			res.Render.SubsampleLength != int64(table[i].skip) {
+			t.Errorf(
+				"Box %d uses %d points and subsample lengths %d and %d, " +
+					"expected %d and %d.", i, res.Points, r.skip,
+				res.Render.SubsampleLength, table[i].pts, table[i].skip,
+			)
+		}
+	}
+
+	// Both boxes cover the same part of the lattice, so they should have the
+	// same mass up to Monte Carlo noise.
+	rs, err := RenderBoxes(context.Background(), sheetDir, specs, opts)
+	if err != nil { t.Fatal(err.Error()) }
+	mass := []float64{ 0, 0 }
+	for i := range rs {
+		vals, _ := rs[i].Grid.FinalizedScalarBuffer()
+		for _, x := range vals { mass[i] += float64(x) }
+	}
+	if mass[0] <= 0 || math.Abs(mass[1] / mass[0] - 1) > 0.05 {
+		t.Errorf("Boxes have masses %g and %g.", mass[0], mass[1])
+	}
+
+	// Subsample lengths which don't fit the sheet segments are rejected
+	// before rendering.
+	for _, skip := range []int{ 3, 16 } {
+		specs[1].Options.SubsampleLength = skip
+		if _, err := newRenderPlan(sheetDir, specs, &opts); err == nil {
+			t.Errorf("SubsampleLength = %d didn't cause an error.", skip)
+		}
+	}
+
+	man := p.mans[0]
+	if err = man.Subsample(2); err != nil { t.Fatal(err.Error()) }
+	if err = man.SubsampleBox(0, 1); err == nil {
+		t.Errorf("SubsampleBox accepted a length below the global one.")
+	}
+	if err = man.SubsampleBox(0, 4); err != nil || man.renderers[0].skip != 4 {
+		t.Errorf("SubsampleBox(0, 4) failed: %v.", err)
+	}
+}
+
+func TestRenderBoxes(t *testing.T) {
+	sheetDir := latticeDir(t)
+	defer os.RemoveAll(sheetDir)
+	writeLatticeSheets(sheetDir, 16, 2, 16)
+
+	spec := BoxSpec{
+		Name: "box", X: 2, Y: 3, Z: 4, XWidth: 6, YWidth: 4, ZWidth: 8,
+	}
+	written := []*Result{ }
+	opts := Options{
+		Quantity: density.Density, TotalPixels: 16, Particles: 100,
+		Write: func(res *Result) error {
+			written = append(written, res)
+			return nil
+		},
+	}
+	rs, err := RenderBoxes(context.Background(), sheetDir,
+		[]BoxSpec{ spec }, opts)
+	if err != nil { t.Fatal(err.Error()) }
+
+	if len(rs) != 1 || len(written) != 1 {
+		t.Fatalf("Rendering one box gave %d results and %d writes.",
+			len(rs), len(written))
+	}
+	res := written[0]
+	if res.Name != "box" || res.Index != 0 || res.Tile != nil ||
+		res.Cells != 16 || res.Points != 100 {
+		t.Errorf("Result has name '%s', index %d, tile %v, %d cells, and " +
+			"%d points.", res.Name, res.Index, res.Tile, res.Cells, res.Points)
+	}
+	if rs[0].Grid != nil {
+		t.Errorf("Returned grid wasn't freed after being written.")
+	}
+
+	// Boxes include the pixel which their upper edge falls in.
+	loc := &res.Loc
+	if loc.PixelOrigin != (io.IntVector{ 2, 3, 4 }) ||
+		loc.PixelSpan != (io.IntVector{ 7, 5, 9 }) || loc.PixelWidth != 1 {
+		t.Errorf("Result covers pixels %v + %v with width %g, expected " +
+			"[2 3 4] + [7 5 9] with width 1.",
+			loc.PixelOrigin, loc.PixelSpan, loc.PixelWidth)
+	}
+
+	// The lattice is unperturbed, so every pixel has the mean density.
+	vals, ok := res.Grid.FinalizedScalarBuffer()
+	if !ok || len(vals) != 7 * 5 * 9 {
+		t.Fatalf("Result has %d pixels, expected %d.", len(vals), 7 * 5 * 9)
+	}
+	for i := range vals {
+		if math.Abs(float64(vals[i]) - 1) > 0.1 {
+			t.Errorf("Pixel %d has density %g, expected 1.", i, vals[i])
+			break
+		}
+	}
+}
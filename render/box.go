@@ -20,8 +20,13 @@ type Box interface {
 	CellWidth() float64
 	Cells() int
 	Points() int
+	Quantity() density.Quantity
 
+	// Vals returns the box's grid, allocating it if needed. Free releases
+	// the grid. ValsBytes is the size of the grid in bytes.
 	Vals() density.Buffer
+	Free()
+	ValsBytes() int64
 
 	ProjectionAxis() (dim int, ok bool)
 }
@@ -53,6 +58,11 @@ type baseBox struct {
 	pts, cells int
 	cellWidth float64
 	q density.Quantity
+
+	// Grids aren't allocated until they're first used, so large numbers of
+	// boxes can be created at once.
+	len int
+	g *geom.GridLocation
 }
 
 func (b *baseBox) CellOrigin() [3]int { return b.cb.Origin }
@@ -60,7 +70,15 @@ func (b *baseBox) CellSpan() [3]int { return b.cb.Width }
 func (b *baseBox) CellWidth() float64 { return b.cellWidth }
 func (b *baseBox) Cells() int {return b.cells }
 func (b *baseBox) Points() int { return b.pts }
-func (b *baseBox) Vals() density.Buffer { return b.bvals }
+func (b *baseBox) Quantity() density.Quantity { return b.q }
+func (b *baseBox) Vals() density.Buffer {
+	if b.bvals == nil { b.bvals = density.NewBuffer(b.q, b.len, b.pts, b.g) }
+	return b.bvals
+}
+func (b *baseBox) Free() { b.bvals = nil }
+func (b *baseBox) ValsBytes() int64 {
+	return density.BufferBytes(b.q, b.len, b.pts)
+}
 
 type box2D struct {
 	baseBox
@@ -173,10 +191,8 @@ func newBox2D(
 	if b.proj == 0 { iDim, jDim = 1, 2 }
 	if b.proj == 1 { iDim, jDim = 0, 2 }
 
-	len := b.cb.Width[iDim] * b.cb.Width[jDim]
-
-	g := geom.NewGridLocation(b.cb.Origin, b.cb.Width, boxWidth, cells)
-	b.bvals = density.NewBuffer(q, len, b.pts, g)
+	b.len = b.cb.Width[iDim] * b.cb.Width[jDim]
+	b.g = geom.NewGridLocation(b.cb.Origin, b.cb.Width, boxWidth, cells)
 	b.q = q
 
 	return b
@@ -205,9 +221,9 @@ func newBox3D(
 	b.pts = pts
 	b.cellWidth = cellWidth
 
-	len := b.cb.Width[0] * b.cb.Width[1] * b.cb.Width[2]
-	g := geom.NewGridLocation(b.cb.Origin, b.cb.Width, boxWidth, cells)
-	b.bvals = density.NewBuffer(q, len, b.pts, g)
+	b.len = b.cb.Width[0] * b.cb.Width[1] * b.cb.Width[2]
+	b.g = geom.NewGridLocation(b.cb.Origin, b.cb.Width, boxWidth, cells)
+	b.q = q
 
 	return b
 }
@@ -0,0 +1,276 @@
+package render
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+)
+
+const checkpointVersion = 2
+
+// maxCheckpointName is the longest file name a checkpoint may contain. Longer
+// names mean that the checkpoint is corrupt.
+const maxCheckpointName = 1 << 16
+
+var checkpointEnd = binary.LittleEndian
+
+// checkpointBox is the header written for each box in a checkpoint file.
+// Only boxes with Stored != 0 are followed by the contents of their grids.
+type checkpointBox struct {
+	Stored int64
+	Origin, Span [3]int64
+	Quantity, Particles, SubsampleLength int64
+	Scalars, Vectors, Counts int64
+}
+
+// newCheckpointBox returns the header describing a renderer's box.
+func newCheckpointBox(r *renderer) checkpointBox {
+	cb := checkpointBox{
+		Quantity: int64(r.box.Quantity()),
+		Particles: int64(r.box.Points()),
+		SubsampleLength: int64(r.skip),
+	}
+	origin, span := r.box.CellOrigin(), r.box.CellSpan()
+	for k := 0; k < 3; k++ {
+		cb.Origin[k], cb.Span[k] = int64(origin[k]), int64(span[k])
+	}
+	return cb
+}
+
+// matches returns an error if the box in a checkpoint was rendered
+// differently than the box described by expected.
+func (cb *checkpointBox) matches(expected *checkpointBox) error {
+	if cb.Origin != expected.Origin || cb.Span != expected.Span {
+		return fmt.Errorf(
+			"has pixel origin %v and span %v, but the box being rendered " +
+				"has %v and %v", cb.Origin, cb.Span,
+			expected.Origin, expected.Span,
+		)
+	} else if cb.Quantity != expected.Quantity {
+		return fmt.Errorf(
+			"renders the quantity %d, but the box being rendered " +
+				"uses %d", cb.Quantity, expected.Quantity,
+		)
+	} else if cb.Particles != expected.Particles {
+		return fmt.Errorf(
+			"uses %d particles per tetrahedron, but the box being rendered " +
+				"uses %d", cb.Particles, expected.Particles,
+		)
+	} else if cb.SubsampleLength != expected.SubsampleLength {
+		return fmt.Errorf(
+			"has a SubsampleLength of %d, but the box being rendered " +
+				"has %d", cb.SubsampleLength, expected.SubsampleLength,
+		)
+	}
+	return nil
+}
+
+// SetCheckpoint makes RenderDensity write the partially rendered grids and
+// the list of processed sheet files to file after every interval files.
+func (man *Manager) SetCheckpoint(file string, interval int) {
+	man.checkpointFile = file
+	man.checkpointInterval = interval
+}
+
+// Resume restores a checkpoint written by a Manager with the same files and
+// boxes. Every box must have the same location, quantity, particle count,
+// and subsample length as when the checkpoint was written. RenderDensity
+// will then continue from the first unprocessed file. Boxes which were
+// finished before the checkpoint was written are not flushed again.
+func (man *Manager) Resume(file string) error {
+	f, err := os.Open(file)
+	if err != nil { return err }
+	defer f.Close()
+	rd := bufio.NewReader(f)
+
+	// Truncated and corrupt files show up as read errors.
+	read := func(x interface{}) error {
+		if err := binary.Read(rd, checkpointEnd, x); err != nil {
+			return fmt.Errorf("Could not read checkpoint %s: %s", file, err)
+		}
+		return nil
+	}
+
+	var version, boxes, files int64
+	if err = read(&version); err != nil { return err }
+	if version != checkpointVersion {
+		return fmt.Errorf(
+			"Checkpoint %s has version %d, but version %d is required.",
+			file, version, checkpointVersion,
+		)
+	}
+
+	if err = read(&boxes); err != nil { return err }
+	if int(boxes) != len(man.renderers) {
+		return fmt.Errorf(
+			"Checkpoint %s contains %d boxes, but %d are being rendered.",
+			file, boxes, len(man.renderers),
+		)
+	}
+
+	valid := map[string]bool{ }
+	for _, name := range man.files { valid[name] = true }
+
+	if err = read(&files); err != nil { return err }
+	if files < 0 || files > int64(len(man.files)) {
+		return fmt.Errorf(
+			"Checkpoint %s is corrupt: it lists %d processed files.",
+			file, files,
+		)
+	}
+	processed := map[string]bool{ }
+	for i := int64(0); i < files; i++ {
+		var n int64
+		if err = read(&n); err != nil { return err }
+		if n <= 0 || n > maxCheckpointName {
+			return fmt.Errorf(
+				"Checkpoint %s is corrupt: it contains a file name of " +
+					"length %d.", file, n,
+			)
+		}
+		name := make([]byte, n)
+		if err = read(name); err != nil { return err }
+		if !valid[string(name)] {
+			return fmt.Errorf(
+				"Checkpoint %s processed the file %s, which isn't being " +
+					"rendered.", file, name,
+			)
+		}
+		processed[string(name)] = true
+	}
+
+	for ri := range man.renderers {
+		r := &man.renderers[ri]
+		cb := checkpointBox{ }
+		if err = read(&cb); err != nil { return err }
+
+		expected := newCheckpointBox(r)
+		if err = cb.matches(&expected); err != nil {
+			return fmt.Errorf("Box %d in checkpoint %s %s.", ri, file, err)
+		}
+
+		if cb.Stored == 0 { continue }
+		if err = readCheckpointGrid(rd, r.box, &cb); err != nil {
+			return fmt.Errorf("Box %d in checkpoint %s: %s", ri, file, err)
+		}
+		r.touched = true
+	}
+
+	if _, err = rd.ReadByte(); err == nil {
+		return fmt.Errorf(
+			"Checkpoint %s is corrupt: it continues past its last box.", file,
+		)
+	}
+
+	man.processed, man.resumed = processed, true
+	if man.log {
+		log.Printf(
+			"Resuming from %s with %d/%d files processed",
+			file, len(processed), len(man.files),
+		)
+	}
+
+	return nil
+}
+
+// readCheckpointGrid reads the accumulated values of a box's grid.
+func readCheckpointGrid(
+	rd *bufio.Reader, box Box, cb *checkpointBox,
+) error {
+	vals := box.Vals()
+
+	if xs, ok := vals.ScalarBuffer(); ok {
+		if int64(len(xs)) != cb.Scalars {
+			return fmt.Errorf("Grid has an unexpected length.")
+		}
+		if err := binary.Read(rd, checkpointEnd, xs); err != nil { return err }
+	}
+	if vs, ok := vals.VectorBuffer(); ok {
+		if int64(len(vs)) != cb.Vectors {
+			return fmt.Errorf("Grid has an unexpected length.")
+		}
+		if err := binary.Read(rd, checkpointEnd, vs); err != nil { return err }
+	}
+	if ns, ok := vals.CountBuffer(); ok {
+		if int64(len(ns)) != cb.Counts {
+			return fmt.Errorf("Grid has an unexpected length.")
+		}
+		ns64 := make([]int64, len(ns))
+		if err := binary.Read(rd, checkpointEnd, ns64); err != nil {
+			return err
+		}
+		for i := range ns { ns[i] = int(ns64[i]) }
+	}
+
+	return nil
+}
+
+// writeCheckpoint writes the current state of the render. remaining is the
+// number of unprocessed files which intersect each box. The checkpoint is
+// written to a temporary file first so that a killed job never leaves a
+// partially written checkpoint behind.
+func (man *Manager) writeCheckpoint(remaining []int) error {
+	tmp := man.checkpointFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil { return err }
+	wr := bufio.NewWriter(f)
+
+	write := func(x interface{}) {
+		if err == nil { err = binary.Write(wr, checkpointEnd, x) }
+	}
+
+	write(int64(checkpointVersion))
+	write(int64(len(man.renderers)))
+	write(int64(len(man.processed)))
+	for _, file := range man.files {
+		if !man.processed[file] { continue }
+		write(int64(len(file)))
+		write([]byte(file))
+	}
+
+	for ri := range man.renderers {
+		r := &man.renderers[ri]
+		cb := newCheckpointBox(r)
+
+		// Finished boxes have already been flushed, unless there's nothing
+		// to flush them to.
+		live := remaining[ri] > 0 || man.flush == nil
+		if !live || !r.touched {
+			write(&cb)
+			continue
+		}
+
+		vals := r.box.Vals()
+		xs, _ := vals.ScalarBuffer()
+		vs, _ := vals.VectorBuffer()
+		ns, _ := vals.CountBuffer()
+		cb.Stored = 1
+		cb.Scalars, cb.Vectors, cb.Counts =
+			int64(len(xs)), int64(len(vs)), int64(len(ns))
+
+		write(&cb)
+		if xs != nil { write(xs) }
+		if vs != nil { write(vs) }
+		if ns != nil {
+			ns64 := make([]int64, len(ns))
+			for i := range ns { ns64[i] = int64(ns[i]) }
+			write(ns64)
+		}
+	}
+
+	if err == nil { err = wr.Flush() }
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil { return err }
+
+	if man.log { log.Printf("Writing checkpoint %s", man.checkpointFile) }
+	if err = os.Rename(tmp, man.checkpointFile); err != nil { return err }
+	man.events.Emit("checkpoint", Event{
+		"file": man.checkpointFile, "files_done": len(man.processed),
+	})
+	return nil
+}
@@ -0,0 +1,118 @@
+package render
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// checkpointManager creates a Manager which renders two boxes from files.
+func checkpointManager(
+	t *testing.T, files []string, q density.Quantity, pts, skip int,
+) *Manager {
+	configs := []io.BoxConfig{
+		{ X: 1, Y: 1, Z: 1, XWidth: 4, YWidth: 4, ZWidth: 4, Name: "a" },
+		{ X: 9, Y: 2, Z: 5, XWidth: 3, YWidth: 5, ZWidth: 2, Name: "b" },
+	}
+	boxes := make([]Box, len(configs))
+	for i := range configs {
+		boxes[i] = NewBox(16, pts, 16, q, &configs[i])
+	}
+
+	man, err := NewManager(files, boxes, false)
+	if err != nil { t.Fatal(err.Error()) }
+	for i := range boxes {
+		if err = man.SubsampleBox(i, skip); err != nil { t.Fatal(err.Error()) }
+	}
+	return man
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	sheetDir := path.Join(dir, "sheets")
+	if err := os.Mkdir(sheetDir, 0755); err != nil { t.Fatal(err.Error()) }
+	files := writeLatticeSheets(sheetDir, 16, 2, 16)
+	file := path.Join(dir, "checkpoint")
+
+	man := checkpointManager(t, files, density.Density, 10, 2)
+	man.SetCheckpoint(file, 1)
+	man.processed[files[0]], man.processed[files[3]] = true, true
+	for ri := range man.renderers {
+		xs, _ := man.renderers[ri].box.Vals().ScalarBuffer()
+		for i := range xs { xs[i] = float64(i + 100*ri) }
+		man.renderers[ri].touched = true
+	}
+	err := man.writeCheckpoint([]int{ 1, 1 })
+	if err != nil { t.Fatal(err.Error()) }
+
+	res := checkpointManager(t, files, density.Density, 10, 2)
+	if err = res.Resume(file); err != nil { t.Fatal(err.Error()) }
+	if len(res.processed) != 2 || !res.processed[files[0]] ||
+		!res.processed[files[3]] {
+		t.Errorf("Resumed with processed files %v.", res.processed)
+	}
+	for ri := range res.renderers {
+		xs, _ := res.renderers[ri].box.Vals().ScalarBuffer()
+		for i := range xs {
+			if xs[i] != float64(i + 100*ri) {
+				t.Errorf("Pixel %d of box %d is %g after resuming, " +
+					"expected %d.", i, ri, xs[i], i + 100*ri)
+				break
+			}
+		}
+	}
+
+	table := []struct {
+		name string
+		q density.Quantity
+		pts, skip int
+	}{
+		{ "quantity", density.Velocity, 10, 2 },
+		{ "particles", density.Density, 20, 2 },
+		{ "subsample length", density.Density, 10, 1 },
+	}
+	for i := range table {
+		man := checkpointManager(
+			t, files, table[i].q, table[i].pts, table[i].skip,
+		)
+		if err := man.Resume(file); err == nil {
+			t.Errorf("Expected an error when resuming with a different %s.",
+				table[i].name)
+		}
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil { t.Fatal(err.Error()) }
+	bad := path.Join(dir, "bad_checkpoint")
+	corrupt := func(name string, data []byte) {
+		err := ioutil.WriteFile(bad, data, 0644)
+		if err != nil { t.Fatal(err.Error()) }
+		man := checkpointManager(t, files, density.Density, 10, 2)
+		if err := man.Resume(bad); err == nil {
+			t.Errorf("Expected an error when resuming from a %s checkpoint.",
+				name)
+		}
+	}
+
+	for _, n := range []int{ 0, 4, 8, 20, len(data) / 2, len(data) - 1 } {
+		corrupt("truncated", data[:n])
+	}
+	corrupt("padded", append(append([]byte{ }, data...), 0))
+
+	// The version is the first eight bytes and the number of processed files
+	// follows the box count. The first name length follows that.
+	version := append([]byte{ }, data...)
+	version[0] = 99
+	corrupt("wrong version", version)
+	count := append([]byte{ }, data...)
+	count[16] = 99
+	corrupt("bad file count", count)
+	length := append([]byte{ }, data...)
+	length[30] = 0x7f
+	corrupt("bad name length", length)
+}
@@ -63,6 +63,19 @@ func NewBuffer(q Quantity, len, wlen int, g *geom.GridLocation) Buffer {
 	panic(":3")
 }
 
+// BufferBytes returns the number of bytes allocated by NewBuffer for the
+// given arguments.
+func BufferBytes(q Quantity, len, wlen int) int64 {
+	switch q {
+	case Density, DensityGradient:
+		return 8 * int64(len)
+	case Velocity, VelocityDivergence, VelocityCurl:
+		return (24 + 8) * int64(len) + 24 * int64(wlen)
+	default:
+		panic(fmt.Sprintf("Unrecognized Quantity %v", q))
+	}
+}
+
 func WrapperDensityBuffer(rhos []float64) Buffer {
 	return &densityBuffer{ scalarBuffer{ rhos } }
 }
@@ -0,0 +1,58 @@
+package render
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Event contains the fields of a single entry in an EventLog.
+type Event map[string]interface{}
+
+// EventLog writes machine-readable progress events as JSON lines so that
+// long-running jobs can be tracked by other programs. Every event has an
+// "event" name, the "time" it was emitted, the seconds "elapsed" since the
+// log was created, and the current memory usage in "alloc_mb" and "sys_mb".
+//
+// All methods can be called on a nil *EventLog, which discards everything.
+type EventLog struct {
+	mu sync.Mutex
+	w io.Writer
+	start time.Time
+	ms runtime.MemStats
+}
+
+// NewEventLog creates an EventLog which writes to w.
+func NewEventLog(w io.Writer) *EventLog {
+	return &EventLog{ w: w, start: time.Now() }
+}
+
+// Emit writes an event with the given name and fields.
+func (el *EventLog) Emit(name string, fields Event) {
+	if el == nil { return }
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	now := time.Now()
+	runtime.ReadMemStats(&el.ms)
+	e := Event{
+		"event": name,
+		"time": now.Format(time.RFC3339Nano),
+		"elapsed": now.Sub(el.start).Seconds(),
+		"alloc_mb": el.ms.Alloc >> 20,
+		"sys_mb": el.ms.Sys >> 20,
+	}
+	for key, val := range fields { e[key] = val }
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Could not write %s event: %s", name, err.Error())
+		return
+	}
+	if _, err = el.w.Write(append(b, '\n')); err != nil {
+		log.Printf("Could not write %s event: %s", name, err.Error())
+	}
+}
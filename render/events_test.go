@@ -0,0 +1,67 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEventLog(t *testing.T) {
+	buf := &bytes.Buffer{ }
+	el := NewEventLog(buf)
+	el.Emit("file_start", Event{ "file": "a.dat", "index": 3 })
+	el.Emit("file_finish", Event{ "file": "a.dat", "bytes_read": 1024 })
+
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) != 2 { t.Fatalf("Wrote %d lines, expected 2.", len(lines)) }
+
+	names := []string{ "file_start", "file_finish" }
+	for i, line := range lines {
+		e := map[string]interface{}{ }
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Line %d, '%s', isn't valid JSON: %s", i, line, err)
+		}
+		if e["event"] != names[i] {
+			t.Errorf("Line %d has event %v, expected %s.", i, e["event"], names[i])
+		}
+		if e["file"] != "a.dat" {
+			t.Errorf("Line %d has file %v, expected a.dat.", i, e["file"])
+		}
+		for _, key := range []string{ "time", "elapsed", "alloc_mb", "sys_mb" } {
+			if _, ok := e[key]; !ok {
+				t.Errorf("Line %d is missing the field '%s'.", i, key)
+			}
+		}
+		if elapsed, ok := e["elapsed"].(float64); !ok || elapsed < 0 {
+			t.Errorf("Line %d has elapsed time %v.", i, e["elapsed"])
+		}
+	}
+
+	e := map[string]interface{}{ }
+	json.Unmarshal([]byte(lines[0]), &e)
+	if e["index"] != 3.0 {
+		t.Errorf("file_start has index %v, expected 3.", e["index"])
+	}
+	json.Unmarshal([]byte(lines[1]), &e)
+	if e["bytes_read"] != 1024.0 {
+		t.Errorf("file_finish has bytes_read %v, expected 1024.", e["bytes_read"])
+	}
+
+	// Events which can't be encoded are dropped instead of breaking the log.
+	buf.Reset()
+	el.Emit("bad", Event{ "value": make(chan int) })
+	if buf.Len() != 0 {
+		t.Errorf("Unencodable event wrote '%s'.", buf.String())
+	}
+}
+
+func TestNilEventLog(t *testing.T) {
+	var el *EventLog
+	el.Emit("file_start", Event{ "file": "a.dat" })
+
+	// Managers without an event log must run without one.
+	man := &HistManager{ }
+	man.SetEventLog(nil)
+	man.events.Emit("file_finish", nil)
+}
@@ -0,0 +1,38 @@
+package halo
+
+import (
+	"fmt"
+
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// RockstarCatalog reads the Rockstar catalogs referred to by the Catalog
+// sections of bounds files. It implements io.HaloCatalog.
+type RockstarCatalog struct{ }
+
+// Halos reads the halos in the catalog described by con. Masses and radii
+// use the definition given by con.RadiusType.
+func (RockstarCatalog) Halos(
+	con *io.CatalogConfig, cosmo *io.CosmologyHeader,
+) (*io.CatalogHalos, error) {
+	rType, ok := RadiusFromString(con.RadiusType)
+	if !ok {
+		return nil, fmt.Errorf(
+			"'%s' is not a recognized halo radius type.", con.RadiusType,
+		)
+	}
+	mVal, rVal := rType.RockstarVals()
+
+	read := ReadRockstarVals
+	if con.Binary { read = ReadBinaryRockstarVals }
+	ids, vals, err := read(con.File, cosmo, PID, X, Y, Z, mVal, rVal)
+	if err != nil { return nil, err }
+
+	pids := make([]int, len(ids))
+	for i := range pids { pids[i] = int(vals[0][i]) }
+
+	return &io.CatalogHalos{
+		IDs: ids, PIDs: pids,
+		X: vals[1], Y: vals[2], Z: vals[3], M: vals[4], R: vals[5],
+	}, nil
+}
@@ -126,3 +126,21 @@ func (r Radius) RockstarMass() bool {
 	}
 	panic(":3")
 }
+
+// RockstarVals returns the Rockstar values corresponding to the mass and
+// radius of this halo definition.
+func (r Radius) RockstarVals() (mass, radius Val) {
+	switch r {
+	case RVirial:
+		return MVir, RadVir
+	case R200c:
+		return M200c, Rad200c
+	case R200m:
+		return M200b, Rad200b
+	case R500c:
+		return M500c, Rad500c
+	case R2500c:
+		return M2500c, Rad2500c
+	}
+	panic(":3")
+}
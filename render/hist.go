@@ -4,138 +4,500 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"math/rand"
 	"runtime"
 	"strings"
 
+	"github.com/phil-mansfield/gotetra/math/rand"
 	"github.com/phil-mansfield/gotetra/render/geom"
 	"github.com/phil-mansfield/gotetra/render/io"
 )
 
+// HistInfo describes the binning of one axis of a histogram.
 type HistInfo struct {
 	Min, Max float64
 	Bins int
 	Scale string
 }
 
+// histBinner finds the bins of values along a single histogram axis.
+type histBinner struct {
+	min, dx, bins float64
+	isLog bool
+}
+
+func newHistBinner(info *HistInfo) histBinner {
+	b := histBinner{ bins: float64(info.Bins) }
+	min, max := info.Min, info.Max
+	b.isLog = strings.ToLower(info.Scale) == "log"
+	if b.isLog { min, max = math.Log10(min), math.Log10(max) }
+	b.min, b.dx = min, (max - min) / b.bins
+	return b
+}
+
+// bin returns the bin containing x or -1 if x is outside the histogram.
+func (b *histBinner) bin(x float64) int {
+	if b.isLog {
+		if x <= 0 { return -1 }
+		x = math.Log10(x)
+	}
+	idx := (x - b.min) / b.dx
+	if idx < 0 || idx >= b.bins { return -1 }
+	return int(idx)
+}
+
+// HistBox is a region which a histogram is computed in. Centers contains the
+// bin centers of each axis and Counts contains the bin counts, with the first
+// axis varying fastest.
 type HistBox struct {
 	Origin, Span [3]float64
 
-	Centers []float64
+	// If Spherical is true, the region is further restricted to the shell
+	// between RMin and RMax of the center of the box.
+	Spherical bool
+	RMin, RMax float64
+
+	// If maskHd is non-nil, the region is further restricted to the cells
+	// of mask which are positive.
+	maskHd *io.GridHeader
+	mask []float64
+
+	// index contains the tetrahedra which intersect the box when densities
+	// are computed without a density grid.
+	index *tetraIndex
+
+	Centers [][]float64
 	Counts []int
+	// Weights contains the summed volume weights of the points in each bin
+	// and Weights2 contains the sums of their squares. They're only computed
+	// for volume-weighted histograms.
+	Weights, Weights2 []float64
 }
 
-func NewHistBox(con *io.BoxConfig, bins int) HistBox {
+// NewHistBox creates a HistBox from a box in a bounds file, reading its mask
+// if it has one.
+func NewHistBox(con *io.BoxConfig) (HistBox, error) {
 	box := HistBox{
 		Origin: [3]float64{con.X, con.Y, con.Z},
 		Span: [3]float64{con.XWidth, con.YWidth, con.ZWidth},
-		Centers: make([]float64, bins),
-		Counts: make([]int, bins),
 	}
-	return box
+	box.RMin, box.RMax, box.Spherical = con.Shell()
+	if con.MaskFile != "" {
+		if err := box.SetMask(con.MaskFile); err != nil { return box, err }
+	}
+	return box, nil
+}
+
+// SetMask restricts the box to the positive cells of the scalar .gtet grid
+// in the given file.
+func (box *HistBox) SetMask(file string) error {
+	var err error
+	box.maskHd, err = io.ReadGridHeader(file)
+	if err != nil { return err }
+	box.mask, err = io.ReadGrid(file)
+	return err
 }
 
+// Center returns the center of the box within a periodic box of width L.
+func (box *HistBox) Center(L float64) geom.Vec {
+	center := geom.Vec{ }
+	for k := 0; k < 3; k++ {
+		c := box.Origin[k] + box.Span[k]/2
+		if c >= L { c -= L }
+		center[k] = float32(c)
+	}
+	return center
+}
+
+// Contains returns true if the region contains v within a periodic box of
+// width L.
 func(box *HistBox) Contains(v geom.Vec, L float64) bool {
 	for k := 0; k < 3; k++ {
 		if !contains1D(box.Origin[k], box.Span[k], float64(v[k]), L) {
 			return false
 		}
 	}
+
+	if box.Spherical {
+		r := radius(v, box.Center(L), float32(L))
+		if r < box.RMin || r >= box.RMax { return false }
+	}
+
+	if box.maskHd != nil {
+		idx := gridIndex(box.maskHd, v)
+		if idx < 0 || box.mask[idx] <= 0 { return false }
+	}
+
 	return true
 }
 
+// histRequiresVelocity returns true if the given quantity is computed from
+// particle velocities.
+func histRequiresVelocity(quantity string) bool {
+	switch strings.ToLower(quantity) {
+	case "radialvelocity", "velocitymagnitude", "velocitydivergence":
+		return true
+	}
+	return false
+}
+
+// histRequiresGrid returns true if the given quantity is looked up on a
+// rendered density grid. If there is no grid, these quantities are computed
+// by summing over every tetrahedron which contains each point.
+func histRequiresGrid(quantity string) bool {
+	return strings.ToLower(quantity) == "density"
+}
+
+// histRequiresIndex returns true if the given quantity is always computed
+// from the tetrahedra which contain each point, even if there's a density
+// grid. A grid only holds the total density, so it can't count streams.
+func histRequiresIndex(quantity string) bool {
+	return strings.ToLower(quantity) == "streamcount"
+}
+
 // HistManager is a struct which manages constructing 
 type HistManager struct {
-	xs []geom.Vec
+	xs, vs []geom.Vec
 	hd io.SheetHeader
 	files []string
 
 	boxes []HistBox
 	unitBufs [][]geom.Vec
 
-	// workspaces
-	hists [][]int
-	qs [][]float64
-	inBox [][]bool
-	vecBufs [][]geom.Vec
+	workspaces []histWorkspace
 	
 	skip int
 
-	quantity string
+	quantities []string
 
 	workers int
 
+	gridFile, interp string
 	gridHd *io.GridHeader
 	grid []float64
+	lookup *gridLookup
+	// needIndex is true if densities or stream counts are computed from
+	// the tetrahedra instead of a grid.
+	needIndex bool
+	// volume is true if points are weighted by volume instead of mass.
+	volume bool
+	// indexBytes is the most memory which the indices of the boxes may use
+	// at once. There's no limit if it's zero.
+	indexBytes int64
+
+	events *EventLog
+	bytesRead int64
+}
+
+// histWorkspace contains the buffers used by a single histogram worker.
+type histWorkspace struct {
+	hist []int
+	wHist, w2Hist []float64
+	binners []histBinner
+
+	// Buffers for the Monte Carlo samples of a single tetrahedron.
+	qs [][]float64
+	inBox []bool
+	vecBuf []geom.Vec
+	velBuf [][3]float64
+	wBuf []float64
+	gen *rand.Generator
 }
 
-// NewHistmanager creates a new HistManager.
+// NewHistmanager creates a new HistManager which computes joint histograms
+// of the given quantities, one per histogram axis.
 func NewHistManager(
 	files []string, boxes []HistBox, points int,
-	quantity string, gridFile string,
+	quantities []string, gridFile string,
 ) (*HistManager, error) {
+	if len(quantities) == 0 {
+		return nil, fmt.Errorf("No histogram quantities were given.")
+	}
+	reqVel, reqGrid, reqIndex := false, false, false
+	for _, q := range quantities {
+		if io.HistQuantityIndex(q) == -1 {
+			return nil, fmt.Errorf("Unrecognized histogram quantity '%s'.", q)
+		}
+		reqVel = reqVel || histRequiresVelocity(q)
+		reqGrid = reqGrid || histRequiresGrid(q)
+		reqIndex = reqIndex || histRequiresIndex(q)
+	}
+
 	man := &HistManager{
 		files: files,
-		quantity: quantity,
+		quantities: quantities,
 		skip: 1,
+		gridFile: gridFile, interp: "NGP",
+		needIndex: reqIndex || (reqGrid && gridFile == ""),
 	}
 	err := io.ReadSheetHeaderAt(files[0], &man.hd)
 	if err != nil { return nil, err }
 	man.xs = make([]geom.Vec, man.hd.GridCount)
+	if reqVel { man.vs = make([]geom.Vec, man.hd.GridCount) }
 
 	// Create the unit cubes used to populate tetrahedra with points.
 	man.unitBufs = unitBufs(UnitBufCount, points)
 
 	// Set number of workers to number of available cores.
 	man.workers = NumCores
+	if man.workers <= 0 { man.workers = runtime.NumCPU() }
 	runtime.GOMAXPROCS(man.workers)
 
-	man.gridHd, err = io.ReadGridHeader(gridFile)
-	if err != nil { return nil, err }
-	man.grid, err = io.ReadGrid(gridFile)
-	if err != nil { return nil, err }
+	if reqGrid && gridFile != "" {
+		if err = man.loadGrid(); err != nil { return nil, err }
+	}
 
 	man.boxes = boxes
 
 	return man, nil
 }
 
-func (man *HistManager) Subsample(skip int) {
-	if !isPowTwo(man.skip) {
-		log.Fatalf("Skip ingrement is %d, must be power of two.", man.skip)
+// loadGrid reads the density grid.
+func (man *HistManager) loadGrid() error {
+	var err error
+	man.gridHd, err = io.ReadGridHeader(man.gridFile)
+	if err != nil { return err }
+	man.grid, err = io.ReadGrid(man.gridFile)
+	if err != nil { return err }
+	man.lookup, err = newGridLookup(man.gridHd, man.grid, man.interp)
+	return err
+}
+
+// SetGridInterpolation sets the method used to look up values on the density
+// grid. It must be one of GridInterpolations. The default is NGP.
+func (man *HistManager) SetGridInterpolation(method string) error {
+	man.interp = method
+	if man.gridHd == nil { return nil }
+	lookup, err := newGridLookup(man.gridHd, man.grid, method)
+	if err != nil { return err }
+	man.lookup = lookup
+	return nil
+}
+
+// WeightByVolume makes the HistManager compute volume-weighted histograms in
+// addition to mass-weighted ones by weighting each point by the inverse of
+// the total density at its position. The weights are stored in the Weights
+// and Weights2 fields of each box. Densities are read from the density grid
+// if there is one and are computed from the tetrahedra otherwise.
+func (man *HistManager) WeightByVolume() error {
+	man.volume = true
+	if man.gridFile == "" {
+		man.needIndex = true
+	} else if man.gridHd == nil {
+		return man.loadGrid()
 	}
+	return nil
+}
 
+// Subsample makes the HistManager only use every skip-th particle along each
+// axis. skip must be a power of two which evenly divides the segment width of
+// the sheets.
+func (man *HistManager) Subsample(skip int) error {
+	if err := checkSubsample(&man.hd, skip); err != nil { return err }
 	man.skip = skip
+	return nil
+}
+
+// SetEventLog makes the HistManager write progress events to events.
+func (man *HistManager) SetEventLog(events *EventLog) { man.events = events }
+
+// SetIndexMemory limits the memory used by the tetrahedron indices which
+// stream counts, and densities when there's no density grid, are computed
+// from to mb megabytes.
+// Boxes are indexed and analyzed in batches which fit in this limit. If mb
+// is zero, every box is indexed at once.
+func (man *HistManager) SetIndexMemory(mb int) {
+	man.indexBytes = int64(mb) << 20
 }
 
 // Hist uses HistManager to compute a histogram with the given properties.
-func (man *HistManager) Hist(info *HistInfo) error {
-	// Set up workspaces.
-	man.hists = make([][]int, man.workers)
-	man.qs = make([][]float64, man.workers)
-	man.inBox = make([][]bool, man.workers)
-	man.vecBufs = make([][]geom.Vec, man.workers)
+// info contains the binning of each axis.
+func (man *HistManager) Hist(info []HistInfo) error {
+	if len(info) != len(man.quantities) {
+		return fmt.Errorf(
+			"%d histogram axes were given for %d quantities.",
+			len(info), len(man.quantities),
+		)
+	}
+	bins := 1
+	for i := range info { bins *= info[i].Bins }
 
+	// Set up workspaces.
 	pts := len(man.unitBufs[0])
-	for i := 0; i < man.workers; i++ {
-		man.hists[i] = make([]int, info.Bins)
-		man.qs[i] = make([]float64, pts)
-		man.inBox[i] = make([]bool, pts)
-		man.vecBufs[i] = make([]geom.Vec, pts)
+	man.workspaces = make([]histWorkspace, man.workers)
+	for id := range man.workspaces {
+		w := &man.workspaces[id]
+		w.hist = make([]int, bins)
+		if man.volume {
+			w.wHist = make([]float64, bins)
+			w.w2Hist = make([]float64, bins)
+			w.wBuf = make([]float64, pts)
+		}
+		w.binners = make([]histBinner, len(info))
+		for k := range info { w.binners[k] = newHistBinner(&info[k]) }
+
+		w.qs = make([][]float64, len(info))
+		for k := range info { w.qs[k] = make([]float64, pts) }
+		w.inBox = make([]bool, pts)
+		w.vecBuf = make([]geom.Vec, pts)
+		w.velBuf = make([][3]float64, pts)
+		w.gen = rand.NewTimeSeed(rand.Xorshift)
 	}
 
 	// Initialize Box output.
 	for i := range man.boxes {
-		man.boxes[i].Counts = make([]int, info.Bins)
-		man.boxes[i].Centers = histCenters(info)
+		man.boxes[i].Counts = make([]int, bins)
+		if man.volume {
+			man.boxes[i].Weights = make([]float64, bins)
+			man.boxes[i].Weights2 = make([]float64, bins)
+		}
+		man.boxes[i].Centers = make([][]float64, len(info))
+		for k := range info {
+			man.boxes[i].Centers[k] = histCenters(&info[k])
+		}
 	}
 
-	// Loop over files and do work.
-	for i, file := range man.files {
-		log.Printf("Analyzed files %d/%d", i, len(man.files))
-		err := man.HistFromFile(file, info)
+	man.events.Emit("hist_start", Event{
+		"files": len(man.files), "boxes": len(man.boxes),
+	})
+
+	batches := [][2]int{ { 0, len(man.boxes) } }
+	if man.needIndex {
+		var err error
+		batches, err = man.indexBatches()
 		if err != nil { return err }
 	}
+
+	// Each batch of boxes is indexed and then analyzed, with man.boxes
+	// temporarily set to the batch.
+	boxes := man.boxes
+	defer func() { man.boxes = boxes }()
+	for bi, batch := range batches {
+		man.boxes = boxes[batch[0]:batch[1]]
+		if len(batches) > 1 {
+			log.Printf(
+				"Analyzing boxes %d-%d (batch %d/%d)",
+				batch[0], batch[1] - 1, bi + 1, len(batches),
+			)
+		}
+
+		if man.needIndex {
+			if err := man.indexFiles(); err != nil { return err }
+		}
+		if err := man.histFiles(info); err != nil { return err }
+		for i := range man.boxes { man.boxes[i].index = nil }
+	}
+
+	man.events.Emit("hist_finish", Event{
+		"files": len(man.files), "boxes": len(boxes),
+		"total_bytes_read": man.bytesRead,
+	})
+	return nil
+}
+
+// histFiles adds every file to the histograms of the current boxes.
+func (man *HistManager) histFiles(info []HistInfo) error {
+	return analyzeFiles(
+		man.files, man.events, &man.bytesRead,
+		func(file string) error { return man.HistFromFile(file, info) },
+	)
+}
+
+// newIndices creates an empty tetrahedron index for each of the current
+// boxes.
+func (man *HistManager) newIndices() {
+	L := man.hd.TotalWidth
+	cellWidth := float64(man.skip) * L / float64(man.hd.CountWidth)
+	for i := range man.boxes {
+		man.boxes[i].index = newTetraIndex(&man.boxes[i], L, cellWidth)
+	}
+}
+
+// indexBatches splits the boxes into consecutive batches, [start, end),
+// whose indices fit within the index memory limit together. The size of
+// each index is measured with an extra pass through the files, which is
+// skipped if there's no limit.
+func (man *HistManager) indexBatches() ([][2]int, error) {
+	if man.indexBytes <= 0 { return [][2]int{ { 0, len(man.boxes) } }, nil }
+
+	man.newIndices()
+	for i, file := range man.files {
+		log.Printf("Measured index sizes in files %d/%d", i, len(man.files))
+		if err := man.indexFile(file, true); err != nil { return nil, err }
+	}
+
+	batches := [][2]int{ }
+	start, bytes := 0, int64(0)
+	for i := range man.boxes {
+		b := man.boxes[i].index.Bytes()
+		man.boxes[i].index = nil
+		if b > man.indexBytes {
+			return nil, fmt.Errorf(
+				"The tetrahedron index of box %d needs %d MB, which is more " +
+					"than the index memory limit, %d MB. Try a larger " +
+					"limit, a larger SubsampleLength, or a density grid.",
+				i, b >> 20, man.indexBytes >> 20,
+			)
+		}
+
+		if bytes + b > man.indexBytes {
+			batches = append(batches, [2]int{ start, i })
+			start, bytes = i, 0
+		}
+		bytes += b
+	}
+	return append(batches, [2]int{ start, len(man.boxes) }), nil
+}
+
+// indexFiles reads every file and builds the tetrahedron index of each of
+// the current boxes. This requires an extra pass through the files, but
+// doesn't need a density grid.
+func (man *HistManager) indexFiles() error {
+	man.newIndices()
+	for i := range man.boxes { man.boxes[i].index.Allocate() }
+
+	for i, file := range man.files {
+		log.Printf("Indexed files %d/%d", i, len(man.files))
+		if err := man.indexFile(file, false); err != nil { return err }
+	}
+
+	bytes := int64(0)
+	for i := range man.boxes { bytes += man.boxes[i].index.Bytes() }
+	log.Printf("Tetrahedron indices use %d MB", bytes >> 20)
+	return nil
+}
+
+// indexFile adds the tetrahedra in the given file to the indices of every box
+// which the file intersects. If count is true, the tetrahedra are only
+// counted.
+func (man *HistManager) indexFile(file string, count bool) error {
+	err := io.ReadSheetHeaderAt(file, &man.hd)
+	if err != nil { return err }
+	boxes := man.intersectingBoxes()
+	if len(boxes) == 0 { return nil }
+
+	bytes, err := loadSheet(file, &man.hd, man.xs, nil)
+	man.bytesRead += bytes
+	if err != nil { return err }
+
+	L := float32(man.hd.TotalWidth)
+	tet, idxBuf := geom.Tetra{ }, geom.TetraIdxs{ }
+
+	forCubes(&man.hd, man.skip, 0, 1, func(idx, _, _, _ int) {
+		for dir := 0; dir < geom.TetraDirCount; dir++ {
+			idxBuf.Init(int64(idx), man.hd.GridWidth, int64(man.skip), dir)
+			tet.Init(
+				&man.xs[idxBuf[0]], &man.xs[idxBuf[1]],
+				&man.xs[idxBuf[2]], &man.xs[idxBuf[3]],
+			)
+			periodizeTetra(&tet, L)
+			if count {
+				for _, box := range boxes { box.index.Count(&tet) }
+				continue
+			}
+			rho := man.tetraDensity(&tet)
+			for _, box := range boxes { box.index.Add(&tet, rho) }
+		}
+	})
 	return nil
 }
 
@@ -157,38 +519,138 @@ func histCenters(info *HistInfo) []float64 {
 	return centers
 }
 
-// HistFromFile updates the histograms of each box using only the particles in
-// the given file.
-func (man *HistManager) HistFromFile(file string, info *HistInfo) error {
-	err := io.ReadSheetHeaderAt(file, &man.hd)
-	if err != nil { return  err }
-	out := make(chan int, man.workers)
+// HistNormalizations lists the ways which a histogram can be normalized.
+// Counts leaves the bins as raw counts, while MassPDF and VolumePDF are mass-
+// and volume-weighted probability densities with a unit integral over the
+// range of the histogram.
+var HistNormalizations = io.HistNormalizations
+
+// Normalize returns the value of each bin of the box's histogram under the
+// given normalization along with its Poisson error. If cumulative is true,
+// each bin instead contains the sum over every bin at or below it along every
+// axis, so normalized cumulative distributions go to 1. Densities are taken
+// with respect to log10 of the quantity along log-scaled axes. VolumePDF
+// requires the histogram to have been computed with WeightByVolume.
+func (box *HistBox) Normalize(
+	info []HistInfo, norm string, cumulative bool,
+) (vals, errs []float64, err error) {
+	sum := make([]float64, len(box.Counts))
+	sum2 := make([]float64, len(box.Counts))
+
+	switch strings.ToLower(norm) {
+	case "counts", "masspdf":
+		for j := range box.Counts {
+			sum[j], sum2[j] = float64(box.Counts[j]), float64(box.Counts[j])
+		}
+	case "volumepdf":
+		if box.Weights == nil {
+			return nil, nil, fmt.Errorf(
+				"The histogram must be volume-weighted to be normalized as " +
+					"a VolumePDF.",
+			)
+		}
+		copy(sum, box.Weights)
+		copy(sum2, box.Weights2)
+	default:
+		return nil, nil, fmt.Errorf(
+			"Unrecognized histogram normalization '%s'. Only recognized " +
+				"normalizations are %s.", norm,
+			strings.Join(HistNormalizations, ", "),
+		)
+	}
 
-	for bi := range man.boxes {
-		if !histIntersect(&man.hd, &man.boxes[bi]) { continue }
+	scale := 1.0
+	if strings.ToLower(norm) != "counts" {
+		total := 0.0
+		for j := range sum { total += sum[j] }
+		if total > 0 { scale /= total } else { scale = 0 }
+		if !cumulative { scale /= binVolume(info) }
+	}
 
-		io.ReadSheetPositionsAt(file, man.xs)
+	if cumulative {
+		cumulate(sum, info)
+		cumulate(sum2, info)
+	}
 
-		for id := 0; id < man.workers; id++ {
-			go man.chanHistogram(id, &man.boxes[bi], info, out)
-		}
+	vals, errs = make([]float64, len(sum)), make([]float64, len(sum))
+	for j := range sum {
+		vals[j] = sum[j] * scale
+		errs[j] = math.Sqrt(sum2[j]) * scale
+	}
+	return vals, errs, nil
+}
 
-		// merge worker histograms into the box histogram.
-		for i := 0; i < man.workers; i++ {
-			id := <-out
-			for j := 0; j < info.Bins; j++ {
-				man.boxes[bi].Counts[j] += man.hists[id][j]
-			}			
-		}
+// binVolume returns the volume of a single histogram bin. Log-scaled axes
+// are measured in log10 of their quantity.
+func binVolume(info []HistInfo) float64 {
+	vol := 1.0
+	for k := range info {
+		b := newHistBinner(&info[k])
+		vol *= b.dx
+	}
+	return vol
+}
 
-		sum := 0
-		for i := range man.boxes[bi].Counts {
-			sum += man.boxes[bi].Counts[i]
+// cumulate replaces each bin of a histogram with the sum of every bin which
+// is at or below it along every axis.
+func cumulate(x []float64, info []HistInfo) {
+	stride := 1
+	for k := range info {
+		bins := info[k].Bins
+		for j := range x {
+			if (j / stride) % bins != 0 { x[j] += x[j - stride] }
 		}
+		stride *= bins
+	}
+}
+
+// HistFromFile updates the histograms of each box using only the particles in
+// the given file. The file is read once and is skipped entirely if it doesn't
+// intersect any boxes.
+func (man *HistManager) HistFromFile(file string, info []HistInfo) error {
+	err := io.ReadSheetHeaderAt(file, &man.hd)
+	if err != nil { return  err }
+	boxes := man.intersectingBoxes()
+	if len(boxes) == 0 { return nil }
+
+	if err = man.loadFile(file); err != nil { return err }
+
+	for _, box := range boxes {
+		runWorkers(man.workers, func(id int) {
+			man.workerHistogram(id, box, info)
+		}, func(id int) {
+			// Merge worker histograms into the box histogram.
+			w := &man.workspaces[id]
+			for j := range box.Counts { box.Counts[j] += w.hist[j] }
+			for j := range box.Weights {
+				box.Weights[j] += w.wHist[j]
+				box.Weights2[j] += w.w2Hist[j]
+			}
+		})
 	}
 	return nil
 }
 
+// intersectingBoxes returns the boxes which intersect the currently loaded
+// sheet header.
+func (man *HistManager) intersectingBoxes() []*HistBox {
+	boxes := []*HistBox{ }
+	for bi := range man.boxes {
+		if histIntersect(&man.hd, &man.boxes[bi]) {
+			boxes = append(boxes, &man.boxes[bi])
+		}
+	}
+	return boxes
+}
+
+// loadFile reads the positions of the particles in file and their velocities,
+// if they're needed.
+func (man *HistManager) loadFile(file string) error {
+	bytes, err := loadSheet(file, &man.hd, man.xs, man.vs)
+	man.bytesRead += bytes
+	return err
+}
+
 // Returns true if sheet intersects with box and false otherwise.
 func histIntersect(sheet *io.SheetHeader, box *HistBox) bool {
 	for k := 0; k < 3; k++ {
@@ -217,54 +679,37 @@ func intersect1D(a, aSpan, b, bSpan, L float64) bool {
 // can be within [0, 2*L).
 func contains1D(a, aSpan, b, L float64) bool {
 	if b >= L { b -= L }
-	return (b > a && a + aSpan > b) ||
+	return (b >= a && a + aSpan > b) ||
 		(b < a && a + aSpan - L > b)
 }
 
-// chanHistogram is a worker function run on a single thread which constructs
-// a histogram using the buffers associated with the worker ID. This ID is sent
-// to the out channel. 
-func (man *HistManager) chanHistogram(
-	worker int, box *HistBox, info *HistInfo, out chan<- int,
+// workerHistogram is a worker function run on a single thread which
+// constructs a histogram of box using the workspace associated with the
+// worker ID.
+func (man *HistManager) workerHistogram(
+	id int, box *HistBox, info []HistInfo,
 ) {
-	// Clear the histogram buffer.
-	for i := range man.hists[worker] { man.hists[worker][i] = 0 }	
-
-	// Convenience variables.
-	gridWidth := int(man.hd.GridWidth)
-	segWidth := int(man.hd.SegmentWidth)
-	hist, qs, inBox := man.hists[worker], man.qs[worker], man.inBox[worker]
-	vecBuf := man.vecBufs[worker]
-
-	// Evaluate whatever quantity is being measured.
-	switch strings.ToLower(man.quantity) {
-	case strings.ToLower("Density"):
-		for z := 0; z < segWidth; z += man.skip {
-			for y := 0; y < segWidth; y += man.skip {
-				for x := 0; x < segWidth; x += man.skip {
-					idx := x + y*gridWidth + z*gridWidth*gridWidth
-					if idx%(man.skip*man.skip*man.skip*man.workers) != worker {
-						continue
-					}
-
-					if !man.cubeIntersects(idx) { continue }
-					for dir := 0; dir < geom.TetraDirCount; dir++ {
-						man.getDensities(idx, dir, box, vecBuf, qs, inBox)
-						histogram(qs, inBox, info, hist)
-					}
-				}
-			}
+	w := &man.workspaces[id]
+
+	// Clear the histogram buffers.
+	for i := range w.hist { w.hist[i] = 0 }
+	for i := range w.wHist { w.wHist[i], w.w2Hist[i] = 0, 0 }
+
+	forCubes(&man.hd, man.skip, id, man.workers, func(idx, _, _, _ int) {
+		if !man.cubeIntersects(idx, box) { return }
+		for dir := 0; dir < geom.TetraDirCount; dir++ {
+			man.getValues(idx, dir, box, w)
+			histogram(
+				w.qs, w.inBox, w.wBuf, w.binners, info,
+				w.hist, w.wHist, w.w2Hist,
+			)
 		}
-	default:
-		panic("Non-implemented quantity: " + man.quantity)
-	}
-
-	out <- worker
+	})
 }
 
-// tetIntersects returns true if the cube at idx intersects with the currently
-// loaded sheet.
-func (man *HistManager) cubeIntersects(idx int) bool {
+// cubeIntersects returns true if the Lagrangian cube whose lowermost corner
+// is the particle at idx intersects box.
+func (man *HistManager) cubeIntersects(idx int, box *HistBox) bool {
 	w := int(man.hd.GridWidth)
 	ix := idx % w
 	iy := (idx / w) % w
@@ -274,15 +719,15 @@ func (man *HistManager) cubeIntersects(idx int) bool {
 	if ix < 0 || man.skip + ix >= w ||
 		iy < 0 || man.skip + iy >= w ||
 		iz < 0 || man.skip + iz >= w {
-		panic(fmt.Sprint("Internal inconsistency: attempting to analyze " + 
-			"particle (%d %d %d), but SegmentWidth = %d", ix, iy, iz, w))
+		panic(fmt.Sprintf("Internal inconsistency: attempting to analyze " + 
+			"particle (%d %d %d), but GridWidth = %d", ix, iy, iz, w))
 	}
 
-	origin, span := man.cubeBoundingBox(ix, iy, iz)
+	origin, span := cubeBoundingBox(&man.hd, man.xs, man.skip, ix, iy, iz)
 
 	for k := 0; k < 3; k++ {
 		if !intersect1D(
-			float64(man.hd.Origin[k]), float64(man.hd.Width[k]),
+			box.Origin[k], box.Span[k],
 			float64(origin[k]), float64(span[k]), man.hd.TotalWidth,
 		) {
 			return false
@@ -291,19 +736,22 @@ func (man *HistManager) cubeIntersects(idx int) bool {
 	return true
 }
 
-func (man *HistManager) cubeBoundingBox(
-	ix, iy, iz int,
+// cubeBoundingBox returns the bounding box of the Lagrangian cube with width
+// skip whose lowermost corner is the particle at (ix, iy, iz) in the sheet
+// segment with header hd and positions xs.
+func cubeBoundingBox(
+	hd *io.SheetHeader, xs []geom.Vec, skip, ix, iy, iz int,
 ) (origin, span geom.Vec) {
-	jump := man.skip
-	w, L := int(man.hd.GridWidth), float32(man.hd.TotalWidth)
-	origin, span = man.xs[ix + iy*w + iz*w*w], geom.Vec{ }
+	jump := skip
+	w, L := int(hd.GridWidth), float32(hd.TotalWidth)
+	origin, span = xs[ix + iy*w + iz*w*w], geom.Vec{ }
 
-	for dz := 0; dz < jump; dz += jump {
-		for dy := 0; dy < jump; dy += jump {
-			for dx := 0; dx < jump; dx += jump {
+	for dz := 0; dz <= jump; dz += jump {
+		for dy := 0; dy <= jump; dy += jump {
+			for dx := 0; dx <= jump; dx += jump {
 				// Get the vector in each corner of the Lagrangian cube.
 				x, y, z := ix + dx, iy + dy, iz + dz
-				vec := man.xs[x + y*w + z*w*w]
+				vec := xs[x + y*w + z*w*w]
 
 				// Update origin and span in each dimension.
 				for k := 0; k < 3; k++ {
@@ -314,12 +762,12 @@ func (man *HistManager) cubeBoundingBox(
 						delta += L 
 					}
 
-					if delta > 0 && delta > span[k] {
+					if delta > span[k] {
 						span[k] = delta
 					} else if delta < 0 {
-						origin[k] -= delta
+						origin[k] += delta
 						if origin[k] < 0 { origin[k] += L }
-						span[k] += delta
+						span[k] -= delta
 					}
 				}
 			}
@@ -328,20 +776,18 @@ func (man *HistManager) cubeBoundingBox(
 	return origin, span
 }
 
-// getDensities computes the mass-weighted densities of the dir tetrahedron
-// associated with the ith particle in the file. densities are written to the
-// densities array and inBox specifies whether the Monte Carlo samples are
-// inside box. If inBox[i] is false, densities[i] is set to -1.
-func (man *HistManager) getDensities(
-	i, dir int, box *HistBox,
-	vecBuf []geom.Vec,
-	densities []float64, inBox []bool,
+// getValues computes the mass-weighted values of each histogram quantity for
+// the dir tetrahedron associated with the ith particle in the file. The values
+// of the kth quantity are written to qs[k] and inBox specifies whether the
+// Monte Carlo samples are inside box. If inBox[i] is false, qs[k][i] is set
+// to -1. The values are written to the buffers of the workspace w, and the
+// volume weights of the samples are written to w.wBuf if the histograms are
+// volume-weighted.
+func (man *HistManager) getValues(
+	i, dir int, box *HistBox, w *histWorkspace,
 ) {
-	// Precompute float32 conversions.
-	L, origin, span := float32(man.hd.TotalWidth), geom.Vec{ }, geom.Vec{ }
-	for k := 0; k < 3; k++ {
-		origin[k], span[k] = float32(box.Origin[k]), float32(box.Span[k])
-	}
+	L := float32(man.hd.TotalWidth)
+	vecBuf, velBuf, qs, inBox := w.vecBuf, w.velBuf, w.qs, w.inBox
 
 	// Buffers
 	tet, idxBuf := geom.Tetra{ }, geom.TetraIdxs{ }
@@ -352,8 +798,9 @@ func (man *HistManager) getDensities(
 		&man.xs[idxBuf[0]], &man.xs[idxBuf[1]],
 		&man.xs[idxBuf[2]], &man.xs[idxBuf[3]],
 	)
+	periodizeTetra(&tet, L)
 	
-	bufIdx := rand.Int63n(int64(len(man.unitBufs)))
+	bufIdx := w.gen.UniformInt(0, len(man.unitBufs))
 	tet.DistributeTetra(man.unitBufs[bufIdx], vecBuf)
 
 	for i := range vecBuf {
@@ -364,25 +811,223 @@ func (man *HistManager) getDensities(
 		}
 
 		// Check if the point is in range, otherwise throw it out.
-		if !box.Contains(vecBuf[i], man.hd.TotalWidth) {
-			densities[i] = -1
+		inBox[i] = box.Contains(vecBuf[i], man.hd.TotalWidth)
+	}
+
+	if man.volume { man.volumeWeights(box, &tet, vecBuf, w.wBuf, inBox) }
+
+	velSampled := false
+	for k, quantity := range man.quantities {
+		q := qs[k]
+		for i := range q { q[i] = -1 }
+
+		switch strings.ToLower(quantity) {
+		case "density":
+			if man.lookup != nil {
+				man.gridValues(vecBuf, q, inBox, 1)
+			} else {
+				man.streamValues(box, &tet, vecBuf, q, inBox, false)
+			}
+		case "streamcount":
+			man.streamValues(box, &tet, vecBuf, q, inBox, true)
+		case "streamdensity":
+			rho := man.tetraDensity(&tet)
+			for i := range vecBuf {
+				if inBox[i] { q[i] = rho }
+			}
+		case "radialvelocity":
+			if !velSampled {
+				man.sampleVelocities(&idxBuf, bufIdx, velBuf)
+				velSampled = true
+			}
+			center := box.Center(man.hd.TotalWidth)
+			for i := range vecBuf {
+				if !inBox[i] { continue }
+				q[i] = radialVelocity(vecBuf[i], center, velBuf[i], L)
+			}
+		case "velocitymagnitude":
+			if !velSampled {
+				man.sampleVelocities(&idxBuf, bufIdx, velBuf)
+				velSampled = true
+			}
+			for i := range vecBuf {
+				if !inBox[i] { continue }
+				v := velBuf[i]
+				q[i] = math.Sqrt(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])
+			}
+		case "velocitydivergence":
+			div := tetraDivergence(&tet, &idxBuf, man.vs)
+			for i := range vecBuf {
+				if inBox[i] { q[i] = div }
+			}
+		case "radius":
+			center := box.Center(man.hd.TotalWidth)
+			for i := range vecBuf {
+				if inBox[i] { q[i] = radius(vecBuf[i], center, L) }
+			}
+		default:
+			panic("Non-implemented quantity: " + quantity)
+		}
+	}
+}
+
+// gridValues looks up the density grid at each point in vecBuf which is
+// inside the box and multiplies it by mult.
+func (man *HistManager) gridValues(
+	vecBuf []geom.Vec, qs []float64, inBox []bool, mult float64,
+) {
+	for i := range vecBuf {
+		if !inBox[i] { continue }
+
+		val, ok := man.lookup.Value(vecBuf[i])
+		if ok {
+			qs[i] = val * mult
+		} else {
 			inBox[i] = false
-			continue
 		}
+	}
+}
+
+// volumeWeights sets w to the inverse of the total density at each point in
+// vecBuf which is inside the box. Points where the density isn't positive are
+// removed from the box.
+func (man *HistManager) volumeWeights(
+	box *HistBox, tet *geom.Tetra,
+	vecBuf []geom.Vec, w []float64, inBox []bool,
+) {
+	if man.lookup != nil {
+		man.gridValues(vecBuf, w, inBox, 1)
+	} else {
+		man.streamValues(box, tet, vecBuf, w, inBox, false)
+	}
 
-		// Finally, interpolate off the density grid.
-		idx := gridIndex(man.gridHd, vecBuf[i])
-		if idx >= 0 {
-			densities[i] = man.grid[idx]
-			//densities[i] = cloudInCell(man.grid, man.gridHd, idx, vecBuf[i])
-			inBox[i] = true
+	for i := range w {
+		if !inBox[i] { continue }
+		if w[i] > 0 {
+			w[i] = 1 / w[i]
 		} else {
-			densities[i] = -1
 			inBox[i] = false
 		}
 	}
 }
 
+// streamValues finds the summed density of every stream at each point in
+// vecBuf which is inside the box, or the number of streams if count is true.
+// tet is the tetrahedron which the points were drawn from. The points are
+// always counted as being inside tet, even if floating point errors say
+// otherwise.
+func (man *HistManager) streamValues(
+	box *HistBox, tet *geom.Tetra,
+	vecBuf []geom.Vec, qs []float64, inBox []bool, count bool,
+) {
+	rhoTet, work := man.tetraDensity(tet), geom.Tetra{ }
+	for i := range vecBuf {
+		if !inBox[i] { continue }
+
+		rho, n := box.index.Streams(vecBuf[i], &work)
+		if n == 0 { rho, n = rhoTet, 1 }
+		if count {
+			qs[i] = float64(n)
+		} else {
+			qs[i] = rho
+		}
+	}
+}
+
+// sampleVelocities linearly interpolates the velocities of the corners of a
+// tetrahedron onto the Monte Carlo points drawn from the bufIdx unit buffer.
+func (man *HistManager) sampleVelocities(
+	idxBuf *geom.TetraIdxs, bufIdx int, velBuf [][3]float64,
+) {
+	vtet := geom.Tetra{ }
+	vtet.Init(
+		&man.vs[idxBuf[0]], &man.vs[idxBuf[1]],
+		&man.vs[idxBuf[2]], &man.vs[idxBuf[3]],
+	)
+	vtet.DistributeTetra64(man.unitBufs[bufIdx], velBuf)
+}
+
+// tetraDensity returns the single-stream density of a tetrahedron in units
+// of the mean density, the same units used by rendered density grids.
+func (man *HistManager) tetraDensity(tet *geom.Tetra) float64 {
+	// Each tetrahedron is a sixth of a Lagrangian cube.
+	dx := float64(man.skip) * man.hd.TotalWidth / float64(man.hd.CountWidth)
+	return dx*dx*dx / 6 / tet.Volume()
+}
+
+// radius returns the distance between x and center within a periodic box of
+// width L.
+func radius(x, center geom.Vec, L float32) float64 {
+	r2 := 0.0
+	for k := 0; k < 3; k++ {
+		dx := x[k] - center[k]
+		if dx > L/2 { dx -= L }
+		if dx < -L/2 { dx += L }
+		r2 += float64(dx)*float64(dx)
+	}
+	return math.Sqrt(r2)
+}
+
+// radialVelocity returns the component of v pointing away from center for a
+// point at x within a periodic box of width L.
+func radialVelocity(x, center geom.Vec, v [3]float64, L float32) float64 {
+	r := [3]float64{ }
+	r2 := 0.0
+	for k := 0; k < 3; k++ {
+		dx := x[k] - center[k]
+		if dx > L/2 { dx -= L }
+		if dx < -L/2 { dx += L }
+		r[k] = float64(dx)
+		r2 += r[k]*r[k]
+	}
+	if r2 == 0 { return 0 }
+	return (r[0]*v[0] + r[1]*v[1] + r[2]*v[2]) / math.Sqrt(r2)
+}
+
+// tetraDivergence returns the divergence of the velocity field within a
+// tetrahedron. The velocity field is linear across the tetrahedron, so its
+// divergence is constant: the trace of the Jacobian dv/dx = DV * DX^-1, where
+// the columns of DX and DV are the edges leaving the first corner. tet must
+// already have been periodized.
+func tetraDivergence(tet *geom.Tetra, idxBuf *geom.TetraIdxs, vs []geom.Vec) float64 {
+	dx, dv := [3][3]float64{ }, [3][3]float64{ }
+	v0 := &vs[idxBuf[0]]
+	for j := 0; j < 3; j++ {
+		vj := &vs[idxBuf[j + 1]]
+		for k := 0; k < 3; k++ {
+			dx[k][j] = float64(tet.Corners[j + 1][k] - tet.Corners[0][k])
+			dv[k][j] = float64(vj[k] - v0[k])
+		}
+	}
+
+	inv, ok := invert3(&dx)
+	if !ok { return 0 }
+
+	div := 0.0
+	for k := 0; k < 3; k++ {
+		for j := 0; j < 3; j++ { div += dv[k][j] * inv[j][k] }
+	}
+	return div
+}
+
+// invert3 inverts a 3 x 3 matrix. ok is false if the matrix is singular.
+func invert3(m *[3][3]float64) (inv [3][3]float64, ok bool) {
+	det := m[0][0]*(m[1][1]*m[2][2] - m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2] - m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1] - m[1][1]*m[2][0])
+	if det == 0 { return inv, false }
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// Cofactor of m[j][i], which gives the transpose.
+			r0, r1 := (j + 1) % 3, (j + 2) % 3
+			c0, c1 := (i + 1) % 3, (i + 2) % 3
+			inv[i][j] = (m[r0][c0]*m[r1][c1] - m[r0][c1]*m[r1][c0]) / det
+		}
+	}
+	return inv, true
+}
+
 func gridIndex(hd *io.GridHeader, vec geom.Vec) int {
 	idx := [3]int{ }
 	L := hd.Cosmo.BoxWidth
@@ -400,43 +1045,32 @@ func gridIndex(hd *io.GridHeader, vec geom.Vec) int {
 		idx[2]*int(hd.Loc.PixelSpan[0]*hd.Loc.PixelSpan[1])
 }
 
-func (man *HistManager) periodizeTetra(tet *geom.Tetra, L float32) {
-	for i := 1; i < 4; i++ {
-		for k := 0; k < 3; k++ {
-			delta := tet.Corners[i][k] - tet.Corners[i][0]
-			if delta > L/2 { tet.Corners[i][k] -= L }
-			if delta < -L/2 { tet.Corners[i][k] += L }
+// histogram adds the points which are inside the box to counts. x[k] holds
+// the values of the kth axis. If weights is non-nil, the weight of each point,
+// w, is added to weights and its square is added to weights2.
+func histogram(
+	x [][]float64, ok []bool, w []float64, binners []histBinner,
+	info []HistInfo, counts []int, weights, weights2 []float64,
+) {
+	for i := range ok {
+		if !ok[i] { continue }
+
+		idx, stride := 0, 1
+		for k := range binners {
+			bin := binners[k].bin(x[k][i])
+			if bin == -1 {
+				idx = -1
+				break
+			}
+			idx += bin*stride
+			stride *= info[k].Bins
 		}
-	}
-} 
 
-func histogram(x []float64, ok []bool, info *HistInfo, counts []int) {
-	// Avoid unneeded dereferences and conversions
-	min, max := info.Min, info.Max
-	fBins := float64(info.Bins)
-
-	if strings.ToLower(info.Scale) == "log" {
-		min, max := math.Log10(min), math.Log10(max)
-		dx := (max - min) / fBins
-
-		for i := range x {
-			if !ok[i] { continue }
-
-			idx := (math.Log10(x[i]) - min) / dx
-			if idx < 0 || idx >= fBins { continue }
-
-			counts[int(idx)]++
-			
-		}
-	} else {
-		dx := (max - min) / fBins
-		
-		for i := range x {
-			if !ok[i] { continue }
-
-			idx := (x[i] - min) / dx
-			if idx < 0 || idx >= fBins { continue }
-			counts[int(idx)]++	
+		if idx < 0 { continue }
+		counts[idx]++
+		if weights != nil {
+			weights[idx] += w[i]
+			weights2[idx] += w[i]*w[i]
 		}
 	}
 }
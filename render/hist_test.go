@@ -0,0 +1,491 @@
+package render
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/math/rand"
+	"github.com/phil-mansfield/gotetra/render/geom"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// writeLatticeSheets writes the sheet files of an unperturbed lattice of n^3
+// particles in a box of width L, split into cells^3 files. It returns the
+// names of the files.
+func writeLatticeSheets(dir string, n, cells int, L float32) []string {
+	seg := n / cells
+	gw := seg + 1
+	dx := L / float32(n)
+	xs, vs := make([]geom.Vec, gw*gw*gw), make([]geom.Vec, gw*gw*gw)
+
+	files := []string{ }
+	for cz := 0; cz < cells; cz++ {
+		for cy := 0; cy < cells; cy++ {
+			for cx := 0; cx < cells; cx++ {
+				hd := &io.SheetHeader{
+					Count: int64(n*n*n), CountWidth: int64(n),
+					SegmentWidth: int64(seg), GridWidth: int64(gw),
+					GridCount: int64(gw*gw*gw),
+					Idx: int64(cx + cy*cells + cz*cells*cells),
+					Cells: int64(cells), TotalWidth: float64(L),
+				}
+				c := [3]int{ cx, cy, cz }
+				for k := 0; k < 3; k++ {
+					hd.Origin[k] = float32(c[k]*seg) * dx
+					hd.Width[k] = float32(seg) * dx
+				}
+
+				for z := 0; z < gw; z++ {
+					for y := 0; y < gw; y++ {
+						for x := 0; x < gw; x++ {
+							i := x + y*gw + z*gw*gw
+							q := [3]int{ x, y, z }
+							for k := 0; k < 3; k++ {
+								xs[i][k] = float32((c[k]*seg + q[k]) % n) * dx
+							}
+						}
+					}
+				}
+
+				file := path.Join(dir, fmt.Sprintf("sheet%d.dat", hd.Idx))
+				io.WriteSheet(file, hd, xs, vs)
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+func latticeDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gotetra")
+	if err != nil { t.Fatal(err.Error()) }
+	return dir
+}
+
+func TestHistSubsample(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	files := writeLatticeSheets(dir, 8, 2, 16)
+
+	man, err := NewHistManager(files, nil, 1, []string{ "Radius" }, "")
+	if err != nil { t.Fatal(err.Error()) }
+
+	table := []struct {
+		skip int
+		valid bool
+	}{
+		{ 1, true }, { 2, true }, { 4, true }, { 3, false },
+		{ 0, false }, { -2, false }, { 8, false },
+	}
+	for i := range table {
+		err := man.Subsample(table[i].skip)
+		if (err == nil) != table[i].valid {
+			t.Errorf(
+				"Expected Subsample(%d) to be valid = %v, got error %v.",
+				table[i].skip, table[i].valid, err,
+			)
+		}
+	}
+}
+
+func TestCubeBoundingBox(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	files := writeLatticeSheets(dir, 8, 1, 16)
+
+	man, err := NewHistManager(files, nil, 1, []string{ "Radius" }, "")
+	if err != nil { t.Fatal(err.Error()) }
+	if err = man.Subsample(2); err != nil { t.Fatal(err.Error()) }
+	if err = man.loadFile(files[0]); err != nil { t.Fatal(err.Error()) }
+
+	table := []struct {
+		ix, iy, iz int
+		origin, span geom.Vec
+	}{
+		{ 0, 0, 0, geom.Vec{ 0, 0, 0 }, geom.Vec{ 4, 4, 4 } },
+		{ 2, 4, 0, geom.Vec{ 4, 8, 0 }, geom.Vec{ 4, 4, 4 } },
+		// The upper corners of this cube wrap around the box.
+		{ 6, 0, 6, geom.Vec{ 12, 0, 12 }, geom.Vec{ 4, 4, 4 } },
+	}
+	for i := range table {
+		origin, span := cubeBoundingBox(
+			&man.hd, man.xs, man.skip, table[i].ix, table[i].iy, table[i].iz,
+		)
+		if origin != table[i].origin || span != table[i].span {
+			t.Errorf(
+				"Bounding box of cube (%d %d %d) is %v %v, expected %v %v.",
+				table[i].ix, table[i].iy, table[i].iz,
+				origin, span, table[i].origin, table[i].span,
+			)
+		}
+	}
+}
+
+func TestHistLattice(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	// dx = 2 Mpc/h.
+	files := writeLatticeSheets(dir, 16, 2, 32)
+
+	defer func(n int) { NumCores = n }(NumCores)
+
+	points := 10
+	table := []struct {
+		workers, skip int
+		quantities []string
+	}{
+		{ 1, 1, []string{ "StreamDensity" } },
+		{ 3, 1, []string{ "StreamDensity" } },
+		{ 3, 2, []string{ "StreamDensity" } },
+		{ 2, 1, []string{ "Density", "StreamCount" } },
+		{ 2, 2, []string{ "Density", "StreamCount" } },
+	}
+
+	for i := range table {
+		NumCores = table[i].workers
+		skip := table[i].skip
+
+		// Both boxes are aligned with the Lagrangian cubes, so every
+		// tetrahedron is either entirely inside or outside them. The second
+		// box wraps around the edge of the simulation.
+		boxes := make([]HistBox, 2)
+		cons := []io.BoxConfig{
+			{ X: 8, Y: 8, Z: 8, XWidth: 8, YWidth: 8, ZWidth: 8 },
+			{ X: 24, Y: 0, Z: 28, XWidth: 16, YWidth: 8, ZWidth: 8 },
+		}
+		for j := range boxes {
+			var err error
+			boxes[j], err = NewHistBox(&cons[j])
+			if err != nil { t.Fatal(err.Error()) }
+		}
+
+		man, err := NewHistManager(
+			files, boxes, points, table[i].quantities, "",
+		)
+		if err != nil { t.Fatal(err.Error()) }
+		if err = man.Subsample(skip); err != nil { t.Fatal(err.Error()) }
+
+		info := make([]HistInfo, len(table[i].quantities))
+		for k := range info { info[k] = HistInfo{ 0.5, 1.5, 1, "Linear" } }
+		if err = man.Hist(info); err != nil { t.Fatal(err.Error()) }
+
+		for j := range boxes {
+			dx := 2 * float64(skip)
+			cubes := cons[j].XWidth*cons[j].YWidth*cons[j].ZWidth / (dx*dx*dx)
+			expected := int(cubes) * geom.TetraDirCount * points
+
+			counts := man.boxes[j].Counts
+			if len(counts) != 1 || counts[0] != expected {
+				t.Errorf(
+					"%d: box %d with %v has counts %v, expected [%d].",
+					i, j, table[i].quantities, counts, expected,
+				)
+			}
+		}
+	}
+}
+
+func TestHistIndexBatches(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	files := writeLatticeSheets(dir, 16, 2, 32)
+
+	points := 10
+	cons := []io.BoxConfig{
+		{ X: 8, Y: 8, Z: 8, XWidth: 8, YWidth: 8, ZWidth: 8 },
+		{ X: 24, Y: 0, Z: 28, XWidth: 16, YWidth: 8, ZWidth: 8 },
+		{ X: 0, Y: 16, Z: 4, XWidth: 8, YWidth: 16, ZWidth: 8 },
+	}
+	newManager := func() *HistManager {
+		boxes := make([]HistBox, len(cons))
+		for j := range boxes {
+			var err error
+			boxes[j], err = NewHistBox(&cons[j])
+			if err != nil { t.Fatal(err.Error()) }
+		}
+		man, err := NewHistManager(files, boxes, points, []string{ "Density" }, "")
+		if err != nil { t.Fatal(err.Error()) }
+		return man
+	}
+
+	// Measure the size of each index and check that it matches the size of
+	// the index once it's built.
+	man := newManager()
+	man.newIndices()
+	for _, file := range files {
+		if err := man.indexFile(file, true); err != nil { t.Fatal(err.Error()) }
+	}
+	sizes, max := make([]int64, len(cons)), int64(0)
+	for j := range sizes {
+		sizes[j] = man.boxes[j].index.Bytes()
+		if sizes[j] > max { max = sizes[j] }
+	}
+	if err := man.indexFiles(); err != nil { t.Fatal(err.Error()) }
+	for j := range sizes {
+		if b := man.boxes[j].index.Bytes(); b != sizes[j] {
+			t.Errorf("Index %d was measured at %d bytes, but uses %d.",
+				j, sizes[j], b)
+		}
+	}
+
+	man = newManager()
+	man.indexBytes = max
+	batches, err := man.indexBatches()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(batches) < 2 {
+		t.Errorf("Boxes were split into batches %v, expected at least two.",
+			batches)
+	}
+	for _, b := range batches {
+		bytes := int64(0)
+		for j := b[0]; j < b[1]; j++ { bytes += sizes[j] }
+		if bytes > max {
+			t.Errorf("Batch %v uses %d bytes, more than the limit, %d.",
+				b, bytes, max)
+		}
+	}
+
+	info := []HistInfo{ { 0.5, 1.5, 1, "Linear" } }
+	if err = man.Hist(info); err != nil { t.Fatal(err.Error()) }
+	if len(man.boxes) != len(cons) {
+		t.Fatalf("Manager has %d boxes after Hist, expected %d.",
+			len(man.boxes), len(cons))
+	}
+	for j := range man.boxes {
+		cubes := cons[j].XWidth*cons[j].YWidth*cons[j].ZWidth / 8
+		expected := int(cubes) * geom.TetraDirCount * points
+		if counts := man.boxes[j].Counts; counts[0] != expected {
+			t.Errorf("Box %d has counts %v, expected [%d].",
+				j, counts, expected)
+		}
+		if man.boxes[j].index != nil {
+			t.Errorf("Index of box %d wasn't freed.", j)
+		}
+	}
+
+	man = newManager()
+	man.indexBytes = max - 1
+	if err = man.Hist(info); err == nil {
+		t.Errorf("Expected an error when a box's index is over the limit.")
+	}
+}
+
+func TestHistValues(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	// dx = 2 Mpc/h.
+	files := writeLatticeSheets(dir, 8, 1, 16)
+
+	quantities := []string{
+		"StreamCount", "StreamDensity", "Radius", "RadialVelocity",
+		"VelocityMagnitude", "VelocityDivergence",
+	}
+	boxes := make([]HistBox, 1)
+	var err error
+	boxes[0], err = NewHistBox(&io.BoxConfig{
+		X: 4, Y: 4, Z: 4, XWidth: 8, YWidth: 8, ZWidth: 8,
+	})
+	if err != nil { t.Fatal(err.Error()) }
+
+	// Stream counts can't be read from a density grid.
+	man, err := NewHistManager(
+		files, boxes, 20, []string{ "StreamCount" }, "unused.gtet",
+	)
+	if err != nil { t.Fatal(err.Error()) }
+	if !man.needIndex || man.lookup != nil {
+		t.Errorf("StreamCount with a GridFile doesn't use the tetrahedra.")
+	}
+
+	man, err = NewHistManager(files, boxes, 20, quantities, "")
+	if err != nil { t.Fatal(err.Error()) }
+	if err = man.indexFiles(); err != nil { t.Fatal(err.Error()) }
+	if err = man.loadFile(files[0]); err != nil { t.Fatal(err.Error()) }
+
+	// A single-stream sheet in a uniform Hubble flow around the center of
+	// the box: v = H (x - center).
+	H, dx := 0.5, float32(2)
+	box := &man.boxes[0]
+	center := box.Center(man.hd.TotalWidth)
+	gw := int(man.hd.GridWidth)
+	for i := range man.vs {
+		q := [3]int{ i % gw, (i / gw) % gw, i / (gw*gw) }
+		for k := 0; k < 3; k++ {
+			man.vs[i][k] = float32(H) * (float32(q[k])*dx - center[k])
+		}
+	}
+
+	pts := len(man.unitBufs[0])
+	w := &histWorkspace{
+		qs: make([][]float64, len(quantities)), inBox: make([]bool, pts),
+		vecBuf: make([]geom.Vec, pts), velBuf: make([][3]float64, pts),
+		gen: rand.New(rand.Tausworthe, 1),
+	}
+	for k := range w.qs { w.qs[k] = make([]float64, pts) }
+
+	// Expected values of each quantity as a function of Radius, which is
+	// quantity 2.
+	expected := []func(r float64) float64{
+		func(r float64) float64 { return 1 },
+		func(r float64) float64 { return 1 },
+		func(r float64) float64 { return r },
+		func(r float64) float64 { return H * r },
+		func(r float64) float64 { return H * r },
+		func(r float64) float64 { return 3 * H },
+	}
+
+	n := 0
+	forCubes(&man.hd, man.skip, 0, 1, func(idx, _, _, _ int) {
+		if !man.cubeIntersects(idx, box) { return }
+		for dir := 0; dir < geom.TetraDirCount; dir++ {
+			man.getValues(idx, dir, box, w)
+			for i := range w.inBox {
+				if !w.inBox[i] { continue }
+				n++
+
+				r := w.qs[2][i]
+				for k, f := range expected {
+					q, val := w.qs[k][i], f(r)
+					if math.Abs(q - val) > 1e-4 * (1 + math.Abs(val)) {
+						t.Fatalf(
+							"%s of point %v is %g, expected %g.",
+							quantities[k], w.vecBuf[i], q, val,
+						)
+					}
+				}
+			}
+		}
+	})
+	if n == 0 { t.Errorf("No points were drawn inside the box.") }
+}
+
+func TestHistNormalize(t *testing.T) {
+	info := []HistInfo{ { 0, 1, 2, "Linear" }, { 1, 1000, 3, "Log" } }
+	box := &HistBox{ Counts: []int{ 1, 3, 0, 4, 2, 2 } }
+
+	vals, errs, err := box.Normalize(info, "Counts", true)
+	if err != nil { t.Fatal(err.Error()) }
+	expected := []float64{ 1, 4, 1, 8, 3, 12 }
+	for j := range vals {
+		if vals[j] != expected[j] || errs[j] != math.Sqrt(expected[j]) {
+			t.Errorf("Cumulative counts are %v %v, expected %v.",
+				vals, errs, expected)
+			break
+		}
+	}
+
+	// Bins have a volume of 0.5 * 1 dex.
+	vals, _, err = box.Normalize(info, "MassPDF", false)
+	if err != nil { t.Fatal(err.Error()) }
+	integral := 0.0
+	for j := range vals { integral += vals[j] * 0.5 }
+	if math.Abs(integral - 1) > 1e-10 {
+		t.Errorf("MassPDF integrates to %g, expected 1.", integral)
+	}
+
+	vals, _, err = box.Normalize(info, "MassPDF", true)
+	if err != nil { t.Fatal(err.Error()) }
+	if math.Abs(vals[len(vals) - 1] - 1) > 1e-10 {
+		t.Errorf("Cumulative MassPDF ends at %g, expected 1.",
+			vals[len(vals) - 1])
+	}
+
+	if _, _, err = box.Normalize(info, "VolumePDF", false); err == nil {
+		t.Errorf("Expected an error for a VolumePDF without weights.")
+	}
+	if _, _, err = box.Normalize(info, "Bogus", false); err == nil {
+		t.Errorf("Expected an error for an unrecognized normalization.")
+	}
+}
+
+func TestHistBoxShell(t *testing.T) {
+	// A shell centered on (99, 50, 1) which wraps around the x and z edges
+	// of the box.
+	L := 100.0
+	box := &HistBox{
+		Origin: [3]float64{ 94, 45, 96 }, Span: [3]float64{ 10, 10, 10 },
+		Spherical: true, RMin: 2, RMax: 5,
+	}
+
+	table := []struct {
+		v geom.Vec
+		contains bool
+	}{
+		{ geom.Vec{ 99, 50, 1 }, false },
+		{ geom.Vec{ 97, 50, 1 }, true },
+		{ geom.Vec{ 2, 50, 1 }, true },
+		{ geom.Vec{ 3.5, 50, 1 }, true },
+		{ geom.Vec{ 4, 50, 1 }, false },
+		{ geom.Vec{ 99, 50, 5.5 }, true },
+		{ geom.Vec{ 99, 50, 97 }, true },
+		{ geom.Vec{ 99, 50, 96.5 }, true },
+		{ geom.Vec{ 99, 54.9, 1 }, true },
+		{ geom.Vec{ 99, 56, 1 }, false },
+		{ geom.Vec{ 2, 53, 4 }, false },
+		{ geom.Vec{ 1, 52, 99 }, true },
+		{ geom.Vec{ 50, 50, 50 }, false },
+	}
+
+	for i := range table {
+		if box.Contains(table[i].v, L) != table[i].contains {
+			t.Errorf("%d) Contains(%v) = %v, expected %v.", i, table[i].v,
+				!table[i].contains, table[i].contains)
+		}
+	}
+}
+
+func TestHistBoxMask(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+
+	// The mask wraps around the x and z edges of the box.
+	origin, span := [3]int{ 95, 45, 98 }, [3]int{ 6, 4, 4 }
+	g := &io.Grid{ }
+	g.Header.Cosmo = io.NewCosmoInfo(70, 0.27, 0.73, 0, 100)
+	g.Header.Render.ProjectionAxis = -1
+	g.Header.Loc = io.NewLocationInfo(origin, span, 1)
+	vals := make([]float32, span[0]*span[1]*span[2])
+	for i := range vals {
+		switch i % 3 {
+		case 0: vals[i] = 1
+		case 1: vals[i] = 0
+		case 2: vals[i] = -1
+		}
+	}
+	g.Vals = [][]float32{ vals }
+
+	file := path.Join(dir, "mask.gtet")
+	f, err := os.Create(file)
+	if err != nil { t.Fatal(err.Error()) }
+	if err = g.Write(f); err != nil { t.Fatal(err.Error()) }
+	f.Close()
+
+	box := &HistBox{ Span: [3]float64{ 100, 100, 100 } }
+	if err = box.SetMask(file); err != nil { t.Fatal(err.Error()) }
+
+	for z := 0; z < span[2]; z++ {
+		for y := 0; y < span[1]; y++ {
+			for x := 0; x < span[0]; x++ {
+				idx := [3]int{ x, y, z }
+				v := geom.Vec{ }
+				for k := 0; k < 3; k++ {
+					v[k] = float32((origin[k] + idx[k]) % 100) + 0.5
+				}
+				i := x + y*span[0] + z*span[0]*span[1]
+				if box.Contains(v, 100) != (vals[i] > 0) {
+					t.Errorf("Contains(%v) = %v, but the mask is %g.",
+						v, !(vals[i] > 0), vals[i])
+				}
+			}
+		}
+	}
+
+	for _, v := range []geom.Vec{ { 94.5, 46, 99 }, { 50, 50, 50 }, { 1, 46, 2.5 } } {
+		if box.Contains(v, 100) {
+			t.Errorf("Contains(%v) = true, but %v is outside the mask.", v, v)
+		}
+	}
+}
@@ -2,219 +2,27 @@ package io
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"gopkg.in/gcfg.v1"
 	"github.com/phil-mansfield/gotetra/render/density"
 )
 
-
-const (
-	ExampleConvertSnapshotFile = `[ConvertSnapshot]
-
-#######################
-# Required Parameters #
-#######################
-
-# Directory containing the input files.
-Input = path/to/input/dir
-# Directory which output files will be written to.
-Output = path/to/output/dir
-
-# The format of the input files. LGadget-2 is currently the only format
-# supported. I think vanilla Gadget-2 files should also work here, but keep
-# an eye out for any bugs. Support for other file formats will come in the
-# future.
-InputFormat = LGadget-2
-
-# Specifies the geometry of the output files. It's unlikely that you will want
-# to change this.
-Cells = 8 
-
-#######################
-# Optional Parameters #
-#######################
-
-# Gadget2IDSize specifies the size in bits of the IDs used in your Gadget-2
-# files. Default is 64.
-# Gadget2IDSize = 64
-
-# Output files which are useful for profiling and debugging. Generally, there
-# isn't a reason to use these unless something goes wrong.
-# ProfileFile = prof.out
-# LogFile = log.out
-
-# In some cases, you might want to convert several snapshots at once (e.g.
-# sims/output/snapdir001, sims/output/snapdir002, etc.) This can be done with
-# IteratedInput and IteratedOutput, which are printf format strings that
-# describe your output format (e.g. sims/output/snapdir%03d). You must create
-# all the directories which IteratedOutput will use before running, which is
-# easiest to do with a Python loop over os.system("mkdir ...") calls.
-# IteratedInput = path/to/iterated/input_with_single_%d_format
-# IteratedOutput = path/to/iterated/input_with_single_%d_format
-
-# (Inclusive) range for this iteration. If IterationEnd isn't set, folders will
-# be iterated through until an invalid one is found.
-# IterationStart = 0 
-# IterationEnd = 100`
-	ExampleRenderFile = `[Render]
-
-# Render specified 
-
-######################
-# RequiredParameters #
-######################
-
-# Quantity can be set to one of:
-# [ Density ]
-# In the future, 
-# [ Velocity | DensityGradient | VelocityCurl | VelocityDivergence ]
-# will be supported.
-Quantity = Density
-
-# Directory containing the input files.
-Input  = path/to/input/dir
-# Directory where the output .gtet files will be written to.
-Output = path/to/output/dir
-
-# Default way of specifying pixel size. TotalPixels gives the number of pixels
-# across one side of the entire simulation box. This is useful if you are
-# rendering many images with various sizes and want a fixed pixel size. You
-# do not need to specify this if you use ImagePixels instead.
-TotalPixels = 500
-
-# Alternative way of specifying pixel size: the number of pixels required to
-# render the longest axis of eaxh boxing box. This is a more natural way to
-# specify pixl size if you are only rendering a single image at a time.
-# ImagePixels = 100
-
-# Default way of specifying redering resolution. Rendering is performed by
-# populating tetrahedra with points, and this variable to controls the number
-# of points used. You can think of this as "increasing" the number of particles
-# in the simulation by a factor of 6*Particles.
-# Expect to rerun the rendering a couple times to get this number right.
-Particles = 25
-
-#####################
-# OptionalParamters #
-#####################
-
-# SubsampleLength allows you to render the image/volume using a subselection of
-# the particles in the snapshot files. This is useful for resolution tests and
-# some science applications. SubsampleLength must be a power of 2.
-# SubsampleLength = 2
-
-# Rendering output files are named after the bounding box. For example, a
-# bounding box with the header [Box "halo_1"] will be written to halo_1.gtet.
-# You can add leading and ending text to these files names using the following
-# two variables (e.g. pre_halo_1_app.gtet). This is useful if you want to
-# annotate file names with rendering information, like pixel size or particle
-# count.
-# PrependName = pre_
-# AppendName  = _app
-
-# Output files which are useful for profiling and debugging. Generally, there
-# isn't a reason to use these unless something goes wrong.
-# ProfileFile = prof.out
-# LogFile = log.out
-
-# Use these next two options with caution: I need to do much more testing.
-
-# Alternative way of specifying the particle count. gotetra will (attempt to)
-# automatically calculate how many particles are needed so that all projections
-# rendered from the resulting grid will have enough particles-per-tetrahedron
-# to avoid artifacts.
-# AutoParticles = true
-
-# Alternative way of specifying the particle count. Identical to specifying
-# AutoParticles, except that projections with a depth below ProjectionDepth
-# may contain artifacts. 
-# ProjectionDepth = 3`
-	ExampleBoxFile = `[Box "my_z_slice"]
-# This file creates a bounding box which specified a volume or image that will
-# be rendered. It is paired with a Render config file. If ProjectionAxis is set,
-# an image will be rendered. If ProjectionAxis is not set, a 3D volume will
-# be rendered.
-
-# Location of lowermost corner:
-X = 107.9
-Y = 79
-Z = 78.5
-
-# Width of the box in each dimension:
-XWidth = 42.14
-YWidth = 42.14
-ZWidth = 4.21
-
-#######################
-# Optional Parameters #
-#######################
-
-# Projection axis must be one of [ X | Y | Z ].
-# ProjectionAxis = Z`
-	ExampleBallFile = `[Ball "my_halo"]
-# This file creates a bounding box defined by a sphere with a given radius.
-# This is an alternative to using Box to specify rendering regions and is
-# convenient when you're looking at individual haloes.
-
-X = 4.602
-Y = 100.7
-Z = 80.7
-
-Radius = 2.17
-
-#######################
-# Optional Parameters #
-#######################
-
-# Creates an image instead of a volume rendering when set. It must be one of
-# [ X | Y | Z ].
-# ProjectionAxis = Z
-
-# Multiplies Radius by a constant.
-# RadiusMultiplier = 3`
-	ExampleTetraHistFile = `[TetraHist]
-
-#######################
-# Required Parameters #
-#######################
-
-# The property which a distribution is being measured for. Supported properties:
-# Density: The mass-weighted density.
-Quantity = Density
-
-HistMin = 1e-2
-HistMax = 1e4
-HistBins = 200
-
-# Must be "Log" or "Linear"
-HistScale = Log
-
-Particles = 50
-
-Input = path/to/input/dir/
-Output = path/to/outut/dir/
-GridFile = path/to/gtet/grid.gtet
-
-#######################
-# Optional Parameters #
-#######################
-
-# SubsampleLength = 1
-
-# Will result in files named pre_*foo*_app.txt:
-# PrependName = pre_
-# AppendName  = _app
-
-# ProfileFile = prof.out
-# LogFile = log.out`
-)
+// The fields of config structs are documented with struct tags, which are
+// used to generate example config files and config references (see
+// describe.go). doc describes the variable, example gives the value shown in
+// example files, required marks variables which must be set, and allowed
+// lists the accepted values. Variables with doc:"-" aren't documented.
 
 type SharedConfig struct {
 	// Required
-	Input, Output string
+	Input string `doc:"Directory containing the input files." example:"path/to/input/dir" required:"true"`
+	Output string `doc:"Directory which output files will be written to." example:"path/to/output/dir" required:"true"`
 	// Optional
-	LogFile, ProfileFile string
+	LogFile string `doc:"File which log output is written to instead of stderr. Generally, there isn't a reason to use this unless something goes wrong." example:"log.out"`
+	ProfileFile string `doc:"File which a CPU profile is written to." example:"prof.out"`
+	EventFile string `doc:"If set, progress events (files started and finished, boxes completed, bytes read, elapsed time, and memory usage) are written to this file as JSON lines, one object per line, for use by workflow managers." example:"events.jsonl"`
 }
 
 func (con *SharedConfig) ValidInput() bool {
@@ -229,17 +37,22 @@ func (con *SharedConfig) ValidLogFile() bool {
 func (con *SharedConfig) ValidProfileFile() bool {
 	return con.ProfileFile != ""
 }
+func (con *SharedConfig) ValidEventFile() bool {
+	return con.EventFile != ""
+}
 
 type ConvertSnapshotConfig struct {
 	SharedConfig
 	// Required
-	Cells int
-	Gadget2IDSize int
-	InputFormat string
+	Cells int `doc:"Specifies the geometry of the output files: each snapshot is split into Cells^3 sheet files. It's unlikely that you will want to change this." example:"8" required:"true"`
+	Gadget2IDSize int `doc:"The size in bits of the IDs used in your Gadget-2 files." allowed:"32|64"`
+	InputFormat string `doc:"The format of the input files. I think vanilla Gadget-2 files should also work as LGadget-2, but keep an eye out for any bugs." allowed:"LGadget-2" required:"true"`
 
 	// Optional
-	IteratedInput, IteratedOutput string
-	IterationStart, IterationEnd int
+	IteratedInput string `doc:"In some cases, you might want to convert several snapshots at once (e.g. sims/output/snapdir001, sims/output/snapdir002, etc.). IteratedInput and IteratedOutput are printf format strings that describe the input and output directories of each snapshot (e.g. sims/output/snapdir%03d) and replace Input and Output." example:"path/to/input/snapdir%03d"`
+	IteratedOutput string `doc:"See IteratedInput. Output directories are created if they don't exist." example:"path/to/output/snapdir%03d"`
+	IterationStart int `doc:"The first snapshot converted when IteratedInput is set." example:"0"`
+	IterationEnd int `doc:"The last snapshot (inclusive) converted when IteratedInput is set. This must be set if IteratedInput is set." example:"100"`
 }
 
 func DefaultConvertSnapshotWrapper() *ConvertSnapshotWrapper {
@@ -273,23 +86,79 @@ func (con *ConvertSnapshotConfig) ValidIterationEnd() bool {
 	return con.IterationEnd >= 0
 }
 
+// Validate returns every problem with con.
+func (con *ConvertSnapshotConfig) Validate() []error {
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf(
+			"ConvertSnapshot", "", key, format, args...,
+		))
+	}
+
+	if !con.ValidInput() && !con.ValidIteratedInput() {
+		add("Input", "Invalid/non-existent 'Input' value.")
+	}
+	if !con.ValidOutput() && !con.ValidIteratedOutput() {
+		add("Output", "Invalid/non-existent 'Output' value.")
+	}
+	if !con.ValidCells() {
+		add("Cells", "Invalid/non-existent 'Cells' value.")
+	}
+	if con.ValidIteratedInput() != con.ValidIteratedOutput() {
+		add(
+			"IteratedInput",
+			"Only one of IteratedInput and IteratedOutput is set.",
+		)
+	}
+	if con.ValidIteratedInput() && !con.ValidIterationEnd() {
+		add(
+			"IterationEnd",
+			"IterationEnd must be set if IteratedInput is set.",
+		)
+	}
+	if !con.ValidGadget2IDSize() {
+		add("Gadget2IDSize", "Gadget2IDSize must be set to 32 or 64.")
+	}
+	if con.InputFormat != "LGadget-2" {
+		add(
+			"InputFormat", "Only LGadget-2 snapshots can be read at this " +
+				"time, but 'InputFormat' is '%s'.", con.InputFormat,
+		)
+	}
+
+	return errs
+}
+
 type RenderConfig struct {
 	SharedConfig
 	
 	// Required
-	Quantity string
-	TotalPixels, Particles int
+	Quantity string `doc:"The quantity which is rendered." example:"Density" allowed:"Density|DensityGradient|Velocity|VelocityDivergence|VelocityCurl" required:"true"`
+	TotalPixels int `doc:"Default way of specifying pixel size: the number of pixels across one side of the entire simulation box. This is useful if you are rendering many images with various sizes and want a fixed pixel size. You do not need to specify this if you use ImagePixels instead." example:"500" required:"true"`
+	Particles int `doc:"Default way of specifying rendering resolution. Rendering is performed by populating tetrahedra with points, and this variable controls the number of points used. You can think of this as increasing the number of particles in the simulation by a factor of 6*Particles. Expect to rerun the rendering a couple times to get this number right." example:"25" required:"true"`
 
 	// Optional
-	AutoParticles bool
-	ImagePixels, ProjectionDepth int
-	SubsampleLength int
-	AppendName, PrependName string
+	AutoParticles bool `doc:"Alternative way of specifying the particle count. gotetra will (attempt to) automatically calculate how many particles are needed so that all projections rendered from the resulting grid will have enough particles per tetrahedron to avoid artifacts. Use with caution." example:"true"`
+	ImagePixels int `doc:"Alternative way of specifying pixel size: the number of pixels across the longest axis of each bounding box. This is a more natural way to specify pixel size if you are only rendering a single image at a time. Overrides TotalPixels." example:"100"`
+	ProjectionDepth int `doc:"Alternative way of specifying the particle count. Identical to AutoParticles, except that projections with a depth below ProjectionDepth pixels may contain artifacts. Use with caution." example:"3"`
+	SubsampleLength int `doc:"Renders using a subselection of the particles in the snapshot files. This is useful for resolution tests and some science applications. Must be a power of 2." example:"2"`
+	AppendName string `doc:"Text added to the end of output file names. Output files are named after their bounding box, so with PrependName = pre_ and AppendName = _app, the box [Box \"halo_1\"] is written to pre_halo_1_app.gtet. This is useful for annotating file names with rendering information." example:"_app"`
+	PrependName string `doc:"Text added to the start of output file names. See AppendName." example:"pre_"`
+	NpyOutput bool `doc:"If set, every .gtet file will also be written as a NumPy .npy file (e.g. halo_1.npy) along with a JSON file containing the header information (e.g. halo_1.json). These can be read with np.load and json.load without any gotetra-specific code." example:"true"`
+	TileWidth int `doc:"Boxes which are too large to fit in memory can be split into cubic tiles that are TileWidth pixels across. Tiling is turned off if this is 0." example:"1024"`
+	TilesPerPass int `doc:"The number of tiles rendered during each pass through the input files. Tiles which overlap the same input files are grouped into the same pass, so each of those files is only read once for all of them. More tiles per pass means less I/O and more memory." example:"1"`
+	TileOutput string `doc:"If Separate, each tile is written to its own file (e.g. halo_1_tile_0_1_0.gtet) and a manifest describing their layout is written to halo_1_tiles.txt. If Assembled, tiles are written directly into a single output file." allowed:"Separate|Assembled"`
+	MemoryLimitMB int `doc:"The estimated memory usage of the render is checked before any files are read. If set, the render will stop before doing any work if it is estimated to use more than this many megabytes. Running with -DryRun prints the estimate without rendering anything." example:"16000"`
+	CheckpointFile string `doc:"Long renders can be checkpointed by setting this. The partially rendered grids are written to this file (with the index of each pass through the input files appended to the name) every CheckpointInterval input files. If the render is killed, running it again with -Resume will pick up from the last checkpoint. Checkpoints are deleted once the render finishes." example:"path/to/checkpoint"`
+	CheckpointInterval int `doc:"The number of input files rendered between checkpoints." example:"16"`
 }
 
 func DefaultRenderWrapper() *RenderWrapper {
 	rc := RenderConfig{ }
 	rc.SubsampleLength = 1
+	rc.TilesPerPass = 1
+	rc.TileOutput = "Separate"
+	rc.CheckpointInterval = 16
 	return &RenderWrapper{rc}
 }
 
@@ -319,6 +188,96 @@ func (con *RenderConfig) ValidImagePixels() bool {
 func (con *RenderConfig) ValidProjectionDepth() bool {
 	return con.ProjectionDepth > 0
 }
+func (con *RenderConfig) ValidTileWidth() bool {
+	return con.TileWidth >= 0
+}
+func (con *RenderConfig) ValidTilesPerPass() bool {
+	return con.TilesPerPass > 0
+}
+func (con *RenderConfig) ValidTileOutput() bool {
+	return con.TileOutput == "Separate" || con.TileOutput == "Assembled"
+}
+func (con *RenderConfig) ValidMemoryLimitMB() bool {
+	return con.MemoryLimitMB >= 0
+}
+func (con *RenderConfig) ValidCheckpointInterval() bool {
+	return con.CheckpointInterval > 0
+}
+func (con *RenderConfig) IsCheckpointed() bool {
+	return con.CheckpointFile != ""
+}
+func (con *RenderConfig) IsTiled() bool {
+	return con.TileWidth > 0
+}
+
+// Validate returns every problem with con.
+func (con *RenderConfig) Validate() []error {
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf("Render", "", key, format, args...))
+	}
+
+	if !con.ValidInput() {
+		add("Input", "Invalid/non-existent 'Input' value, %s.", con.Input)
+	}
+	if !con.ValidOutput() {
+		add("Output", "Invalid/non-existent 'Output' value, %s.", con.Output)
+	}
+	if !con.ValidQuantity() {
+		add("Quantity", "Invalid 'Quantity' value, '%s'.", con.Quantity)
+	}
+	if !con.ValidSubsampleLength() {
+		add(
+			"SubsampleLength", "Invalid 'SubsampleLength' value, %d.",
+			con.SubsampleLength,
+		)
+	}
+	if !con.ValidTileWidth() {
+		add("TileWidth", "Invalid 'TileWidth' value, %d.", con.TileWidth)
+	}
+	if !con.ValidTilesPerPass() {
+		add(
+			"TilesPerPass", "Invalid 'TilesPerPass' value, %d.",
+			con.TilesPerPass,
+		)
+	}
+	if !con.ValidTileOutput() {
+		add(
+			"TileOutput", "Invalid 'TileOutput' value, '%s'. Must be " +
+				"'Separate' or 'Assembled'.", con.TileOutput,
+		)
+	}
+
+	if !con.ValidMemoryLimitMB() {
+		add(
+			"MemoryLimitMB", "Invalid 'MemoryLimitMB' value, %d.",
+			con.MemoryLimitMB,
+		)
+	}
+
+	if !con.ValidCheckpointInterval() {
+		add(
+			"CheckpointInterval", "Invalid 'CheckpointInterval' value, %d.",
+			con.CheckpointInterval,
+		)
+	}
+
+	if !con.ValidImagePixels() && !con.ValidTotalPixels() {
+		add(
+			"ImagePixels", "You must set either a valid 'ImagePixels' " +
+				"or a valid 'TotalPixels'.",
+		)
+	}
+	if !con.ValidParticles() && !con.ValidProjectionDepth() &&
+		!con.AutoParticles {
+		add(
+			"Particles", "You must set either a valid 'Particles' or a " +
+				"valid 'ProjectionDepth' or must set 'AutoParticles' to true.",
+		)
+	}
+
+	return errs
+}
 
 type ConvertSnapshotWrapper struct {
 	ConvertSnapshot ConvertSnapshotConfig
@@ -330,47 +289,165 @@ type RenderWrapper struct {
 
 type BallConfig struct {
 	// Required
-	X, Y, Z, Radius float64
+	X float64 `doc:"X coordinate of the center of the ball in comoving Mpc/h." example:"4.602" required:"true"`
+	Y float64 `doc:"Y coordinate of the center of the ball in comoving Mpc/h." example:"100.7" required:"true"`
+	Z float64 `doc:"Z coordinate of the center of the ball in comoving Mpc/h." example:"80.7" required:"true"`
+	Radius float64 `doc:"Radius of the ball in comoving Mpc/h." example:"2.17" required:"true"`
 
 	// Optional
-	RadiusMultiplier float64
-	Name string
+	RadiusMultiplier float64 `doc:"Multiplies Radius by a constant. Default is 1." example:"3"`
+	RadiusMin float64 `doc:"Inner radius of a spherical shell in comoving Mpc/h. TetraHist only uses points whose distance from the center is between RadiusMin and Radius. It is also multiplied by RadiusMultiplier." example:"0.5"`
+	ProjectionAxis string `doc:"Creates an image instead of a volume rendering when set." allowed:"X|Y|Z"`
+	MaskFile string `doc:"A .gtet grid which masks the ball. TetraHist only uses points where the grid is positive." example:"path/to/mask.gtet"`
+	BoxRenderConfig
+	Name string `doc:"-"`
 }
 
-func (ball *BallConfig) CheckInit(name string, totalWidth float64) error {
-	if ball.Radius == 0 {
-		return fmt.Errorf(
-			"Need to specify a positive radius for Ball '%s'.", name,
+// BoxRenderConfig contains render settings which individual boxes can use
+// to override the values in RenderConfig. Zero values aren't overridden.
+type BoxRenderConfig struct {
+	Quantity string `doc:"Overrides the Quantity in the Render config file for this box only. Boxes with different settings are still rendered during the same pass through the input files." allowed:"Density|DensityGradient|Velocity|VelocityDivergence|VelocityCurl" example:"Velocity"`
+	Particles int `doc:"Overrides the Particles in the Render config file for this box only." example:"50"`
+	ImagePixels int `doc:"Overrides the ImagePixels in the Render config file for this box only." example:"2000"`
+	SubsampleLength int `doc:"Overrides the SubsampleLength in the Render config file for this box only. It can't be smaller than that SubsampleLength and must evenly divide the segment width of the input files." example:"2"`
+}
+
+func (con *BoxRenderConfig) validate(section, name string) []error {
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf(section, name, key, format, args...))
+	}
+
+	if con.Quantity != "" {
+		if _, ok := density.QuantityFromString(con.Quantity); !ok {
+			add(
+				"Quantity", "Quantity of '%s' is '%s', which is not " +
+					"recognized.", name, con.Quantity,
+			)
+		}
+	}
+
+	if con.Particles < 0 {
+		add(
+			"Particles", "Particles of '%s' must be positive, but is %d.",
+			name, con.Particles,
 		)
 	}
+	if con.ImagePixels < 0 {
+		add(
+			"ImagePixels", "ImagePixels of '%s' must be positive, but is %d.",
+			name, con.ImagePixels,
+		)
+	}
+	if s := con.SubsampleLength; s < 0 || (s > 0 && s & (s - 1) != 0) {
+		add(
+			"SubsampleLength", "SubsampleLength of '%s' must be a power " +
+				"of two, but is %d.", name, con.SubsampleLength,
+		)
+	}
+
+	return errs
+}
 
-	if ball.X >= totalWidth || ball.X < 0 {
-		return fmt.Errorf(
-			"X center of Ball '%s' must be in range [0, %g), but is %g",
-			name, totalWidth, ball.X,
+// validProjectionAxis returns true if axis is empty or names an axis.
+func validProjectionAxis(axis string) bool {
+	switch strings.Trim(strings.ToUpper(axis), " ") {
+	case "", "X", "Y", "Z": return true
+	}
+	return false
+}
+
+// Override returns a copy of con with the values set in box replacing
+// the original values.
+func (con *RenderConfig) Override(box *BoxRenderConfig) *RenderConfig {
+	out := *con
+	if box.Quantity != "" { out.Quantity = box.Quantity }
+	if box.Particles > 0 {
+		out.Particles = box.Particles
+		out.AutoParticles = false
+		out.ProjectionDepth = 0
+	}
+	if box.ImagePixels > 0 { out.ImagePixels = box.ImagePixels }
+	if box.SubsampleLength > 0 { out.SubsampleLength = box.SubsampleLength }
+	return &out
+}
+
+// Validate returns every problem with ball which can be found without knowing
+// the size of the simulation.
+func (ball *BallConfig) Validate() []error {
+	name := ball.Name
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf("Ball", name, key, format, args...))
+	}
+
+	if ball.Radius <= 0 {
+		add("Radius", "Need to specify a positive radius for Ball '%s'.", name)
+	}
+	if ball.X < 0 {
+		add(
+			"X", "X center of Ball '%s' must be positive, but is %g",
+			name, ball.X,
 		)
-	} else if ball.Y >= totalWidth || ball.Y < 0 {
-		return fmt.Errorf(
-			"Y center of Ball '%s' must be in range [0, %g), but is %g",
-			name, totalWidth, ball.Y,
+	}
+	if ball.Y < 0 {
+		add(
+			"Y", "Y center of Ball '%s' must be positive, but is %g",
+			name, ball.Y,
 		)
-	} else if ball.Z >= totalWidth || ball.Z < 0 {
-		return fmt.Errorf(
-			"Z center of Ball '%s' must be in range [0, %g), but is %g",
-			name, totalWidth, ball.Z,
+	}
+	if ball.Z < 0 {
+		add(
+			"Z", "Z center of Ball '%s' must be positive, but is %g",
+			name, ball.Z,
+		)
+	}
+	if ball.RadiusMultiplier < 0 {
+		add(
+			"RadiusMultiplier", "Ball '%s' given a negative radius " +
+				"multiplier, %g.", name, ball.RadiusMultiplier,
+		)
+	}
+	if ball.RadiusMin < 0 || (ball.Radius > 0 && ball.RadiusMin >= ball.Radius) {
+		add(
+			"RadiusMin", "RadiusMin of Ball '%s' must be in the range " +
+				"[0, %g), but is %g.", name, ball.Radius, ball.RadiusMin,
+		)
+	}
+	if !validProjectionAxis(ball.ProjectionAxis) {
+		add(
+			"ProjectionAxis", "ProjectionAxis of Ball '%s' must be one of " +
+				"[X | Y | Z]. '%s' is not recognized.",
+			name, ball.ProjectionAxis,
 		)
 	}
 
+	return append(errs, ball.BoxRenderConfig.validate("Ball", name)...)
+}
+
+func (ball *BallConfig) CheckInit(name string, totalWidth float64) error {
 	ball.Name = name
-	if ball.RadiusMultiplier == 0 {
-		ball.RadiusMultiplier = 1
-	} else if ball.RadiusMultiplier < 0 {
-		return fmt.Errorf(
-			"Ball '%s' given a negative radius multiplier, %g.",
-			name, ball.RadiusMultiplier,
+	if errs := ball.Validate(); len(errs) > 0 { return errs[0] }
+
+	if ball.X >= totalWidth {
+		return configErrorf(
+			"Ball", name, "X", "X center of Ball '%s' must be in range " +
+				"[0, %g), but is %g", name, totalWidth, ball.X,
+		)
+	} else if ball.Y >= totalWidth {
+		return configErrorf(
+			"Ball", name, "Y", "Y center of Ball '%s' must be in range " +
+				"[0, %g), but is %g", name, totalWidth, ball.Y,
+		)
+	} else if ball.Z >= totalWidth {
+		return configErrorf(
+			"Ball", name, "Z", "Z center of Ball '%s' must be in range " +
+				"[0, %g), but is %g", name, totalWidth, ball.Z,
 		)
 	}
 
+	if ball.RadiusMultiplier == 0 { ball.RadiusMultiplier = 1 }
+
 	return nil
 }
 
@@ -399,81 +476,279 @@ func (ball *BallConfig) Box(totalWidth float64) *BoxConfig {
 	}
 
 	box.Name = ball.Name
+	box.ProjectionAxis = ball.ProjectionAxis
+	box.MaskFile = ball.MaskFile
+	box.BoxRenderConfig = ball.BoxRenderConfig
+
+	box.SetShell(ball.RadiusMin * ball.RadiusMultiplier, rad)
 
 	return box
 }
 
 type BoxConfig struct {
 	// Required
-	X, Y, Z float64
-	XWidth, YWidth, ZWidth float64
+	X float64 `doc:"X coordinate of the lowermost corner of the box in comoving Mpc/h." example:"107.9" required:"true"`
+	Y float64 `doc:"Y coordinate of the lowermost corner of the box in comoving Mpc/h." example:"79" required:"true"`
+	Z float64 `doc:"Z coordinate of the lowermost corner of the box in comoving Mpc/h." example:"78.5" required:"true"`
+	XWidth float64 `doc:"Width of the box along the X axis in comoving Mpc/h." example:"42.14" required:"true"`
+	YWidth float64 `doc:"Width of the box along the Y axis in comoving Mpc/h." example:"42.14" required:"true"`
+	ZWidth float64 `doc:"Width of the box along the Z axis in comoving Mpc/h." example:"4.21" required:"true"`
 
 	// Optional
-	ProjectionAxis string
+	ProjectionAxis string `doc:"If set, an image projected along this axis will be rendered. Otherwise, a 3D volume will be rendered." allowed:"X|Y|Z"`
+	MaskFile string `doc:"A .gtet grid which masks the box. TetraHist only uses points where the grid is positive." example:"path/to/mask.gtet"`
+	BoxRenderConfig
 
 	// Optional, "undocumented"
-	Name string
+	Name string `doc:"-"`
+
+	// The bounding boxes of Balls are restricted to a spherical shell around
+	// their centers (see Shell). These fields are unexported so that they
+	// can't be set by [Box] sections of bounds files.
+	inShell bool
+	shellRadii [2]float64
 }
 
-func (box *BoxConfig) CheckInit(name string, totalWidth float64) error {
+// Shell returns the inner and outer radii of the spherical shell around the
+// center of the box which the box is restricted to. ok is false if the box
+// isn't restricted to a shell, which is true of every box that doesn't come
+// from a Ball or a Catalog. Only TetraHist and the modes built on it use
+// shells.
+func (box *BoxConfig) Shell() (rMin, rMax float64, ok bool) {
+	return box.shellRadii[0], box.shellRadii[1], box.inShell
+}
+
+// SetShell restricts the box to the shell between rMin and rMax of its
+// center.
+func (box *BoxConfig) SetShell(rMin, rMax float64) {
+	box.inShell = true
+	box.shellRadii = [2]float64{ rMin, rMax }
+}
+
+// Validate returns every problem with box which can be found without knowing
+// the size of the simulation.
+func (box *BoxConfig) Validate() []error {
+	name := box.Name
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf("Box", name, key, format, args...))
+	}
+
 	if box.XWidth <= 0 {
-		return fmt.Errorf(
-			"Need to specify a positive XWidth for Box '%s'", name,
+		add("XWidth", "Need to specify a positive XWidth for Box '%s'", name)
+	}
+	if box.YWidth <= 0 {
+		add("YWidth", "Need to specify a positive YWidth for Box '%s'", name)
+	}
+	if box.ZWidth <= 0 {
+		add("ZWidth", "Need to specify a positive ZWidth for Box '%s'", name)
+	}
+	if box.X < 0 {
+		add(
+			"X", "X origin of Box '%s' must be positive, but is %g",
+			name, box.X,
 		)
-	} else if box.YWidth <= 0 {
-		return fmt.Errorf(
-			"Need to specify a positive YWidth for Box '%s'", name,
+	}
+	if box.Y < 0 {
+		add(
+			"Y", "Y origin of Box '%s' must be positive, but is %g",
+			name, box.Y,
 		)
-	} else if box.ZWidth <= 0 {
-		return fmt.Errorf(
-			"Need to specify a positive ZWidth for Box '%s'", name,
+	}
+	if box.Z < 0 {
+		add(
+			"Z", "Z origin of Box '%s' must be positive, but is %g",
+			name, box.Z,
+		)
+	}
+	if !validProjectionAxis(box.ProjectionAxis) {
+		add(
+			"ProjectionAxis", "ProjectionAxis of Box '%s' must be one of " +
+				"[X | Y | Z]. '%s' is not recognized.",
+			name, box.ProjectionAxis,
 		)
 	}
 
-	if box.X >= totalWidth || box.X < 0 {
-		return fmt.Errorf(
-			"X origin of Box '%s' must be in range [0, %g), but is %g",
-			name, totalWidth, box.X,
+	return append(errs, box.BoxRenderConfig.validate("Box", name)...)
+}
+
+func (box *BoxConfig) CheckInit(name string, totalWidth float64) error {
+	box.Name = name
+	if errs := box.Validate(); len(errs) > 0 { return errs[0] }
+
+	if box.X >= totalWidth {
+		return configErrorf(
+			"Box", name, "X", "X origin of Box '%s' must be in range " +
+				"[0, %g), but is %g", name, totalWidth, box.X,
 		)
-	} else if box.Y >= totalWidth || box.Y < 0 {
-		return fmt.Errorf(
-			"Y origin of Box '%s' must be in range [0, %g), but is %g",
-			name, totalWidth, box.Y,
+	} else if box.Y >= totalWidth {
+		return configErrorf(
+			"Box", name, "Y", "Y origin of Box '%s' must be in range " +
+				"[0, %g), but is %g", name, totalWidth, box.Y,
 		)
-	} else if box.Z >= totalWidth || box.Z < 0 {
-		return fmt.Errorf(
-			"Z origin of Box '%s' must be in range [0, %g), but is %g",
-			name, totalWidth, box.Z,
+	} else if box.Z >= totalWidth {
+		return configErrorf(
+			"Box", name, "Z", "Z origin of Box '%s' must be in range " +
+				"[0, %g), but is %g", name, totalWidth, box.Z,
 		)
 	}
 
-	tmp := box.ProjectionAxis
 	box.ProjectionAxis = strings.Trim(strings.ToUpper(box.ProjectionAxis), " ")
-	if box.ProjectionAxis != "" &&
-		box.ProjectionAxis != "X" &&
-		box.ProjectionAxis != "Y" &&
-		box.ProjectionAxis != "Z" {
 
-		return fmt.Errorf(
-			"ProjectionAxis of Box '%s' must be one of [X | Y | Z]. '%s' is " + 
-				"not recognized.", name, tmp,
+	return nil
+}
+
+func (box *BoxConfig) IsProjection() bool { return box.ProjectionAxis != "" }
+
+type CatalogConfig struct {
+	// Required
+	File string `doc:"Rockstar catalog containing the halos." example:"path/to/rockstar/hlist.list" required:"true"`
+
+	// Optional
+	Binary bool `doc:"Set if File has been converted to gotetra's binary catalog format." example:"true"`
+	MassMin float64 `doc:"Minimum halo mass in Msun/h. Masses use the definition given by RadiusType." example:"8e11"`
+	MassMax float64 `doc:"Maximum halo mass in Msun/h." example:"1e12"`
+	ID []int `doc:"Only render halos with the given IDs. May be given multiple times." example:"169607412|169607413"`
+	HostsOnly bool `doc:"Skip subhalos." example:"true"`
+	MaxCount int `doc:"Only render the MaxCount most massive halos which pass all other filters." example:"10"`
+	RadiusType string `doc:"Radius definition. Vir is used if this isn't set." allowed:"Vir|200m|200c|500c|2500c"`
+	RadiusMultiplier float64 `doc:"Multiplies each halo's radius by a constant. Default is 1." example:"3"`
+	ProjectionAxis string `doc:"Creates images instead of volume renderings when set." allowed:"X|Y|Z"`
+
+	// Optional, "undocumented"
+	Name string `doc:"-"`
+}
+
+// CatalogHalos contains the properties of every halo in a catalog. Positions
+// and radii are in comoving Mpc/h and masses are in Msun/h. PIDs are -1 for
+// host halos.
+type CatalogHalos struct {
+	IDs, PIDs []int
+	X, Y, Z, M, R []float64
+}
+
+// HaloCatalog reads the halo catalogs referred to by Catalog sections of
+// bounds files. It's implemented by halo.RockstarCatalog (the halo package
+// depends on io, so io can't call it directly).
+type HaloCatalog interface {
+	Halos(con *CatalogConfig, cosmo *CosmologyHeader) (*CatalogHalos, error)
+}
+
+// Validate returns every problem with cat.
+func (cat *CatalogConfig) Validate() []error {
+	name := cat.Name
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf(
+			"Catalog", name, key, format, args...,
+		))
+	}
+
+	if cat.File == "" {
+		add("File", "Need to specify a File for Catalog '%s'.", name)
+	}
+	if cat.MassMin < 0 || (cat.MassMax != 0 && cat.MassMax < cat.MassMin) {
+		add(
+			"MassMin", "Catalog '%s' has an invalid mass range, (%g, %g).",
+			name, cat.MassMin, cat.MassMax,
+		)
+	}
+	if cat.MaxCount < 0 {
+		add(
+			"MaxCount", "Catalog '%s' given a negative MaxCount, %d.",
+			name, cat.MaxCount,
+		)
+	}
+	if cat.RadiusMultiplier < 0 {
+		add(
+			"RadiusMultiplier", "Catalog '%s' given a negative radius " +
+				"multiplier, %g.", name, cat.RadiusMultiplier,
+		)
+	}
+	if !validProjectionAxis(cat.ProjectionAxis) {
+		add(
+			"ProjectionAxis", "ProjectionAxis of Catalog '%s' must be one " +
+				"of [X | Y | Z]. '%s' is not recognized.",
+			name, cat.ProjectionAxis,
 		)
 	}
 
-	box.Name = name
+	return errs
+}
+
+func (cat *CatalogConfig) CheckInit(name string) error {
+	cat.Name = name
+	if errs := cat.Validate(); len(errs) > 0 { return errs[0] }
+
+	if cat.RadiusType == "" { cat.RadiusType = "Vir" }
+	if cat.RadiusMultiplier == 0 { cat.RadiusMultiplier = 1 }
 
 	return nil
 }
 
-func (box *BoxConfig) IsProjection() bool { return box.ProjectionAxis != "" }
+// Boxes reads the catalog and returns a box for every halo which passes the
+// catalog's filters, ordered from most to least massive.
+func (cat *CatalogConfig) Boxes(
+	halos HaloCatalog, hd *SheetHeader,
+) ([]BoxConfig, error) {
+	hs, err := halos.Halos(cat, &hd.Cosmo)
+	if err != nil { return nil, err }
+
+	ids := map[int]bool{ }
+	for _, id := range cat.ID { ids[id] = true }
+
+	idxs := []int{ }
+	for i := range hs.IDs {
+		if len(ids) > 0 && !ids[hs.IDs[i]] { continue }
+		if cat.HostsOnly && hs.PIDs[i] != -1 { continue }
+		if hs.M[i] < cat.MassMin { continue }
+		if cat.MassMax > 0 && hs.M[i] > cat.MassMax { continue }
+		idxs = append(idxs, i)
+	}
+
+	sort.Slice(idxs, func(i, j int) bool {
+		return hs.M[idxs[i]] > hs.M[idxs[j]]
+	})
+	if cat.MaxCount > 0 && len(idxs) > cat.MaxCount {
+		idxs = idxs[:cat.MaxCount]
+	}
+
+	boxes := []BoxConfig{ }
+	for _, i := range idxs {
+		name := fmt.Sprintf("%s_%d", cat.Name, hs.IDs[i])
+		ball := &BallConfig{
+			X: hs.X[i], Y: hs.Y[i], Z: hs.Z[i], Radius: hs.R[i],
+			RadiusMultiplier: cat.RadiusMultiplier,
+		}
+		if err := ball.CheckInit(name, hd.TotalWidth); err != nil {
+			return nil, err
+		}
+
+		box := ball.Box(hd.TotalWidth)
+		box.ProjectionAxis = cat.ProjectionAxis
+		if err := box.CheckInit(name, hd.TotalWidth); err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, *box)
+	}
+
+	return boxes, nil
+}
 
 type BoundsConfig struct {
 	Ball map[string]*BallConfig
 	Box  map[string]*BoxConfig
+	Catalog map[string]*CatalogConfig
 }
 
-func ReadBoundsConfig(fname string, totalWidth float64) ([]BoxConfig, error) {
+// ReadBoundsConfig reads the boxes in a bounds file. hd is the header of
+// one of the sheets being rendered and halos is used to read the catalogs
+// in any Catalog sections. halos may be nil if there are no such sections.
+func ReadBoundsConfig(
+	fname string, hd *SheetHeader, halos HaloCatalog,
+) ([]BoxConfig, error) {
 	bc := BoundsConfig{}
+	totalWidth := hd.TotalWidth
 
 	if err := gcfg.ReadFileInto(&bc, fname); err != nil {
 		return nil, err
@@ -482,35 +757,66 @@ func ReadBoundsConfig(fname string, totalWidth float64) ([]BoxConfig, error) {
 	boxes := []BoxConfig{}
 	for name, ball := range bc.Ball {
 		if err := ball.CheckInit(name, totalWidth); err != nil {
+			return nil, locateError(fname, err)
+		}
+		box := ball.Box(totalWidth)
+		if err := box.CheckInit(name, totalWidth); err != nil {
 			return nil, err
 		}
-		boxes = append(boxes, *ball.Box(totalWidth))
+		boxes = append(boxes, *box)
 	}
 	for name, box := range bc.Box {
 		if err := box.CheckInit(name, totalWidth); err != nil {
-			return nil, err
+			return nil, locateError(fname, err)
 		}
 		boxes = append(boxes, *box)
 	}
+	for name, cat := range bc.Catalog {
+		if err := cat.CheckInit(name); err != nil {
+			return nil, locateError(fname, err)
+		}
+		if halos == nil {
+			return nil, fmt.Errorf(
+				"Catalog '%s' cannot be read without a halo catalog reader.",
+				name,
+			)
+		}
+
+		catBoxes, err := cat.Boxes(halos, hd)
+		if err != nil { return nil, err }
+		boxes = append(boxes, catBoxes...)
+	}
 
 	return boxes, nil
 }
 
+func locateError(fname string, err error) error {
+	return LocateErrors(fname, []error{ err })[0]
+}
+
 type TetraHistConfig struct {
 	SharedConfig
 
-	Quantity string
+	Quantity []string `doc:"The property which a mass-weighted distribution is measured for. Giving several Quantity values creates a joint histogram with one axis per Quantity, and HistMin, HistMax, HistBins, and HistScale must be given once for each axis, in the same order. Density is the total density of every stream and StreamDensity is the density of the single stream containing each point, both in units of the mean density. StreamCount is always counted from the tetrahedra which contain each point, even if GridFile is set, since a density grid can't separate streams. RadialVelocity and Radius are measured relative to the center of each box. VelocityMagnitude and RadialVelocity are in the units of the input velocities, and VelocityDivergence is in those units per Mpc/h." example:"Density|Radius" allowed:"Density|StreamCount|StreamDensity|RadialVelocity|VelocityMagnitude|VelocityDivergence|Radius" required:"true"`
 
-	HistMin, HistMax float64
-	HistBins int
-	HistScale string
+	HistMin []float64 `doc:"Lower edge of each histogram axis." example:"1e-2|0.01" required:"true"`
+	HistMax []float64 `doc:"Upper edge of each histogram axis." example:"1e4|2" required:"true"`
+	HistBins []int `doc:"Number of bins along each histogram axis." example:"200|50" required:"true"`
+	HistScale []string `doc:"Spacing of the bins along each histogram axis." example:"Log|Log" allowed:"Log|Linear" required:"true"`
 
-	Particles int
+	Particles int `doc:"Number of points used per tetrahedron." example:"50" required:"true"`
 	
-	SubsampleLength int
-
-	GridFile string
-	AppendName, PrependName string
+	SubsampleLength int `doc:"Uses a subselection of the particles in the input files. Must be a power of 2." example:"2"`
+
+	GridFile string `doc:"Rendered density grid which Density is read from. If it isn't set, it's computed directly from the tetrahedra by summing over every stream at each point. This doesn't depend on the resolution of a previous render, but every tetrahedron near each box has to be stored in memory, which takes an extra full pass through the input files. See IndexMemoryMB." example:"path/to/gtet/grid.gtet"`
+	GridInterpolation string `doc:"How densities are looked up on GridFile. NGP uses the cell containing each point. CIC and TriLinear are the same: they interpolate between the eight nearest cell centers, wrapping around the simulation box along axes which GridFile spans completely. Default is NGP." allowed:"NGP|CIC|TriLinear"`
+	AppendName string `doc:"Text added to the end of output file names, e.g. halo_1_app.txt." example:"_app"`
+	PrependName string `doc:"Text added to the start of output file names, e.g. pre_halo_1.txt." example:"pre_"`
+	BinaryOutput bool `doc:"If set, every histogram will also be written as a binary .ghist file (e.g. halo_1.ghist), which can be read with io.ReadHistFile or gotetra.read_hist. .ghist files always contain raw counts, but record Normalization, Cumulative, and PoissonErrors, and also contain the volume weights of each bin when Normalization is VolumePDF." example:"true"`
+	Normalization string `doc:"How the bins of each histogram are normalized. Counts writes raw counts. MassPDF writes the mass-weighted probability density, normalized so that its integral over the range of the histogram is 1. VolumePDF does the same for the volume-weighted probability density, which weights each point by the inverse of the total density at its position. Densities are taken per unit log10 of the quantity along Log axes. VolumePDF reads densities from GridFile if it's set and computes them from the tetrahedra otherwise." allowed:"Counts|MassPDF|VolumePDF"`
+	IndexMemoryMB int `doc:"Used when densities are computed from the tetrahedra instead of GridFile, and whenever StreamCount is measured. The tetrahedra near each box are stored in an index, which can be large for big or dense boxes. Boxes are indexed and analyzed in batches whose indices use at most this many megabytes, and the run stops before indexing if a single box needs more. Measuring the indices takes one more full pass through the input files, and each batch after the first takes two more. If 0, every box is indexed at once without measuring. Default is 4096." example:"4096"`
+	Cumulative bool `doc:"If set, cumulative distributions are written instead, where each bin contains the total of every bin at or below it along every axis." example:"true"`
+	PoissonErrors bool `doc:"If set, a column containing the Poisson error of each bin is added to the output." example:"true"`
 }
 
 type TetraHistWrapper struct {
@@ -518,7 +824,9 @@ type TetraHistWrapper struct {
 }
 
 func DefaultTetraHistWrapper() *TetraHistWrapper {
-	cfg := TetraHistConfig{ SubsampleLength: 1 }
+	cfg := TetraHistConfig{
+		SubsampleLength: 1, Normalization: "Counts", IndexMemoryMB: 4096,
+	}
 	return &TetraHistWrapper{ cfg }
 }
 
@@ -534,32 +842,52 @@ func (con *TetraHistConfig) ValidGridFile() bool {
 	return con.GridFile != ""
 }
 
-func (con *TetraHistConfig) ValidQuantity() bool {
-	switch con.Quantity {
-	case "Density":
+func (con *TetraHistConfig) ValidGridInterpolation() bool {
+	switch con.GridInterpolation {
+	case "", "NGP", "CIC", "TriLinear":
 		return true
 	}
 	return false
 }
 
-func (con *TetraHistConfig) ValidHistMin() bool {
-	return (con.HistScale == "Linear" ||
-		(con.HistScale == "Log" && con.HistMin > 0)) && 
-		con.HistMin < con.HistMax
+func (con *TetraHistConfig) ValidNormalization() bool {
+	return HistNormalizationIndex(con.Normalization) != -1
 }
 
-func (con *TetraHistConfig) ValidHistMax() bool {
-	return (con.HistScale == "Linear" ||
-		(con.HistScale == "Log" && con.HistMax > 0)) &&
-		con.HistMin < con.HistMax
+func (con *TetraHistConfig) ValidQuantity() bool {
+	if len(con.Quantity) == 0 { return false }
+	for _, q := range con.Quantity {
+		if HistQuantityIndex(q) == -1 { return false }
+	}
+	return true
 }
 
-func (con *TetraHistConfig) ValidHistBins() bool {
-	return con.HistBins > 0
+// ValidAxes returns true if each histogram axis has a HistMin, HistMax,
+// HistBins, and HistScale.
+func (con *TetraHistConfig) ValidAxes() bool {
+	n := len(con.Quantity)
+	return len(con.HistMin) == n && len(con.HistMax) == n &&
+		len(con.HistBins) == n && len(con.HistScale) == n
 }
 
-func (con *TetraHistConfig) ValidHistScale() bool {
-	return con.HistScale == "Linear" || con.HistScale == "Log"
+func (con *TetraHistConfig) ValidHistMin(i int) bool {
+	return (con.HistScale[i] == "Linear" ||
+		(con.HistScale[i] == "Log" && con.HistMin[i] > 0)) && 
+		con.HistMin[i] < con.HistMax[i]
+}
+
+func (con *TetraHistConfig) ValidHistMax(i int) bool {
+	return (con.HistScale[i] == "Linear" ||
+		(con.HistScale[i] == "Log" && con.HistMax[i] > 0)) &&
+		con.HistMin[i] < con.HistMax[i]
+}
+
+func (con *TetraHistConfig) ValidHistBins(i int) bool {
+	return con.HistBins[i] > 0
+}
+
+func (con *TetraHistConfig) ValidHistScale(i int) bool {
+	return con.HistScale[i] == "Linear" || con.HistScale[i] == "Log"
 }
 
 func (con *TetraHistConfig) ValidSubsampleLength() bool {
@@ -572,3 +900,399 @@ func (con *TetraHistConfig) ValidSubsampleLength() bool {
 		s /= 2
 	}
 }
+
+// Validate returns every problem with con.
+func (con *TetraHistConfig) Validate() []error {
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf("TetraHist", "", key, format, args...))
+	}
+
+	if !con.ValidInput() {
+		add("Input", "Invalid/non-existent 'Input' value, %s.", con.Input)
+	}
+	if !con.ValidOutput() {
+		add("Output", "Invalid/non-existent 'Output' value, %s.", con.Output)
+	}
+	if !con.ValidQuantity() {
+		add("Quantity", "Invalid 'Quantity' value, %v.", con.Quantity)
+	}
+	if !con.ValidGridInterpolation() {
+		add(
+			"GridInterpolation", "Invalid 'GridInterpolation' value, '%s'.",
+			con.GridInterpolation,
+		)
+	}
+	if !con.ValidNormalization() {
+		add(
+			"Normalization", "Invalid 'Normalization' value, '%s'.",
+			con.Normalization,
+		)
+	}
+	if con.IndexMemoryMB < 0 {
+		add(
+			"IndexMemoryMB", "Invalid 'IndexMemoryMB' value, %d.",
+			con.IndexMemoryMB,
+		)
+	}
+	if !con.ValidSubsampleLength() {
+		add(
+			"SubsampleLength", "Invalid 'SubsampleLength' value, %d.",
+			con.SubsampleLength,
+		)
+	}
+
+	if !con.ValidAxes() {
+		add(
+			"HistMin", "There are %d 'Quantity' values, so 'HistMin', " +
+				"'HistMax', 'HistBins', and 'HistScale' must each be given " +
+				"%d times, but they're given (%d, %d, %d, %d) times.",
+			len(con.Quantity), len(con.Quantity), len(con.HistMin),
+			len(con.HistMax), len(con.HistBins), len(con.HistScale),
+		)
+		return errs
+	}
+
+	for i := range con.Quantity {
+		if !con.ValidHistScale(i) {
+			add("HistScale", "Invalid 'HistScale' value, %s.", con.HistScale[i])
+		} else if !con.ValidHistMin(i) || !con.ValidHistMax(i) {
+			add(
+				"HistMin", "Invalid ('HistMin', 'HistMax'), (%g, %g).",
+				con.HistMin[i], con.HistMax[i],
+			)
+		}
+		if !con.ValidHistBins(i) {
+			add("HistBins", "Invalid 'HistBins' value, %d.", con.HistBins[i])
+		}
+	}
+
+	return errs
+}
+
+type LightConeConfig struct {
+	// Required
+	Input []string `doc:"Each Input is a directory of converted sheet files from a single snapshot. The redshift of each snapshot is read from its sheet headers. List as many snapshots as you need to cover the light cone." example:"path/to/snapshot/dir_z0.0/|path/to/snapshot/dir_z0.5/|path/to/snapshot/dir_z1.0/" required:"true"`
+	Output string `doc:"Directory which the light cone is written to." example:"path/to/output/dir/" required:"true"`
+	ObserverX float64 `doc:"X coordinate of the observer in comoving Mpc/h." example:"0" required:"true"`
+	ObserverY float64 `doc:"Y coordinate of the observer in comoving Mpc/h." example:"0" required:"true"`
+	ObserverZ float64 `doc:"Z coordinate of the observer in comoving Mpc/h." example:"0" required:"true"`
+	LineOfSight string `doc:"The axis which the map is centered on." example:"Z" allowed:"X|Y|Z" required:"true"`
+	OpeningAngle float64 `doc:"Width of the (square) map in degrees." example:"10" required:"true"`
+	ImagePixels int `doc:"Number of pixels across the map." example:"1000" required:"true"`
+	Particles int `doc:"Number of points used per tetrahedron." example:"20" required:"true"`
+	MaxRedshift float64 `doc:"Maximum redshift of the light cone. Each snapshot is rendered out to the comoving distance halfway between it and its neighbors." example:"1.25" required:"true"`
+
+	// Optional
+	MinRedshift float64 `doc:"Minimum redshift of the light cone." example:"0.1"`
+	SubsampleLength int `doc:"Uses a subselection of the particles in the input files. Must be a power of 2." example:"2"`
+	AppendName string `doc:"Text added to the end of the output file name, e.g. light_cone_app.gtet." example:"_app"`
+	PrependName string `doc:"Text added to the start of the output file name, e.g. pre_light_cone.gtet." example:"pre_"`
+	LogFile string `doc:"File which log output is written to instead of stderr." example:"log.out"`
+	ProfileFile string `doc:"File which a CPU profile is written to." example:"prof.out"`
+}
+
+type LightConeWrapper struct {
+	LightCone LightConeConfig
+}
+
+func DefaultLightConeWrapper() *LightConeWrapper {
+	cfg := LightConeConfig{ SubsampleLength: 1 }
+	return &LightConeWrapper{ cfg }
+}
+
+func (con *LightConeConfig) ValidInput() bool {
+	if len(con.Input) == 0 { return false }
+	for _, in := range con.Input {
+		if in == "" { return false }
+	}
+	return true
+}
+func (con *LightConeConfig) ValidOutput() bool {
+	return con.Output != ""
+}
+func (con *LightConeConfig) ValidLineOfSight() bool {
+	return con.LineOfSight == "X" || con.LineOfSight == "Y" ||
+		con.LineOfSight == "Z"
+}
+func (con *LightConeConfig) ValidOpeningAngle() bool {
+	return con.OpeningAngle > 0 && con.OpeningAngle < 180
+}
+func (con *LightConeConfig) ValidImagePixels() bool {
+	return con.ImagePixels > 0
+}
+func (con *LightConeConfig) ValidParticles() bool {
+	return con.Particles > 0
+}
+func (con *LightConeConfig) ValidRedshifts() bool {
+	return con.MinRedshift >= 0 && con.MaxRedshift > con.MinRedshift
+}
+func (con *LightConeConfig) ValidSubsampleLength() bool {
+	s := con.SubsampleLength
+	if s <= 0 { return false }
+
+	for {
+		if s == 1 { return true }
+		if s % 2 == 1 { return false }
+		s /= 2
+	}
+}
+func (con *LightConeConfig) ValidLogFile() bool {
+	return con.LogFile != ""
+}
+func (con *LightConeConfig) ValidProfileFile() bool {
+	return con.ProfileFile != ""
+}
+// Validate returns every problem with con.
+func (con *LightConeConfig) Validate() []error {
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf("LightCone", "", key, format, args...))
+	}
+
+	if !con.ValidInput() {
+		add("Input", "Invalid/non-existent 'Input' value.")
+	}
+	if !con.ValidOutput() {
+		add("Output", "Invalid/non-existent 'Output' value, %s.", con.Output)
+	}
+	if !con.ValidLineOfSight() {
+		add(
+			"LineOfSight", "Invalid 'LineOfSight' value, '%s'.",
+			con.LineOfSight,
+		)
+	}
+	if !con.ValidOpeningAngle() {
+		add(
+			"OpeningAngle", "Invalid 'OpeningAngle' value, %g.",
+			con.OpeningAngle,
+		)
+	}
+	if !con.ValidImagePixels() {
+		add(
+			"ImagePixels", "Invalid 'ImagePixels' value, %d.",
+			con.ImagePixels,
+		)
+	}
+	if !con.ValidParticles() {
+		add("Particles", "Invalid 'Particles' value, %d.", con.Particles)
+	}
+	if !con.ValidRedshifts() {
+		add(
+			"MaxRedshift", "Invalid ('MinRedshift', 'MaxRedshift'), (%g, %g).",
+			con.MinRedshift, con.MaxRedshift,
+		)
+	}
+	if !con.ValidSubsampleLength() {
+		add(
+			"SubsampleLength", "Invalid 'SubsampleLength' value, %d.",
+			con.SubsampleLength,
+		)
+	}
+
+	return errs
+}
+
+func (con *LightConeConfig) Axis() int {
+	switch con.LineOfSight {
+	case "X": return 0
+	case "Y": return 1
+	case "Z": return 2
+	}
+	return -1
+}
+
+type ProfileConfig struct {
+	SharedConfig
+
+	Particles int `doc:"Number of points used per tetrahedron." example:"50" required:"true"`
+	Bins int `doc:"Number of log-spaced radial bins in each profile. The outermost bin ends at the radius of each Ball (including its RadiusMultiplier) or Catalog halo." example:"40" required:"true"`
+
+	MinRadiusFraction float64 `doc:"Inner edge of the innermost radial bin as a fraction of the outer edge. Balls which set RadiusMin use that instead." example:"0.01"`
+	SubsampleLength int `doc:"Uses a subselection of the particles in the input files. Must be a power of 2." example:"2"`
+	Velocity bool `doc:"If set, the mass-weighted mean and dispersion of the radial velocity in each bin are also written, in the units of the input velocities." example:"true"`
+	ExclusionFile string `doc:"Text file listing spheres which are left out of every profile, e.g. subhalos. Each line gives the X, Y, and Z coordinates and radius of a sphere in comoving Mpc/h. Both the mass and the volume inside the spheres are removed, except for spheres which contain the center of the profile." example:"path/to/subhalos.txt"`
+	AppendName string `doc:"Text added to the end of output file names, e.g. halo_1_app.txt." example:"_app"`
+	PrependName string `doc:"Text added to the start of output file names, e.g. pre_halo_1.txt." example:"pre_"`
+}
+
+type ProfileWrapper struct {
+	Profile ProfileConfig
+}
+
+func DefaultProfileWrapper() *ProfileWrapper {
+	cfg := ProfileConfig{ SubsampleLength: 1, MinRadiusFraction: 0.01 }
+	return &ProfileWrapper{ cfg }
+}
+
+func (con *ProfileConfig) ValidParticles() bool {
+	return con.Particles > 0
+}
+
+func (con *ProfileConfig) ValidBins() bool {
+	return con.Bins > 0
+}
+
+func (con *ProfileConfig) ValidMinRadiusFraction() bool {
+	return con.MinRadiusFraction > 0 && con.MinRadiusFraction < 1
+}
+
+func (con *ProfileConfig) ValidSubsampleLength() bool {
+	s := con.SubsampleLength
+	if s <= 0 { return false }
+
+	for {
+		if s == 1 { return true }
+		if s % 2 == 1 { return false }
+		s /= 2
+	}
+}
+
+// Validate returns every problem with con.
+func (con *ProfileConfig) Validate() []error {
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf("Profile", "", key, format, args...))
+	}
+
+	if !con.ValidInput() {
+		add("Input", "Invalid/non-existent 'Input' value, %s.", con.Input)
+	}
+	if !con.ValidOutput() {
+		add("Output", "Invalid/non-existent 'Output' value, %s.", con.Output)
+	}
+	if !con.ValidParticles() {
+		add("Particles", "Invalid 'Particles' value, %d.", con.Particles)
+	}
+	if !con.ValidBins() {
+		add("Bins", "Invalid 'Bins' value, %d.", con.Bins)
+	}
+	if !con.ValidMinRadiusFraction() {
+		add(
+			"MinRadiusFraction", "Invalid 'MinRadiusFraction' value, %g.",
+			con.MinRadiusFraction,
+		)
+	}
+	if !con.ValidSubsampleLength() {
+		add(
+			"SubsampleLength", "Invalid 'SubsampleLength' value, %d.",
+			con.SubsampleLength,
+		)
+	}
+
+	return errs
+}
+
+type SplashbackConfig struct {
+	SharedConfig
+
+	Lines int `doc:"Number of randomly oriented lines of sight sampled around each halo." example:"256" required:"true"`
+	Samples int `doc:"Number of log-spaced points along each line of sight. Must be at least SavGolWindow." example:"100" required:"true"`
+
+	MinRadiusFraction float64 `doc:"Inner end of each line of sight as a fraction of its outer end. The outer end is at the radius of each Ball (including its RadiusMultiplier) or Catalog halo, so the radius should be several times larger than the expected splashback radius. Balls which set RadiusMin use that instead." example:"0.2"`
+	SubsampleLength int `doc:"Uses a subselection of the particles in the input files. Must be a power of 2." example:"2"`
+	SavGolOrder int `doc:"Order of the polynomial used by the Savitzky-Golay filter which smooths each line of sight. The filter works best if this is at least 4." example:"4"`
+	SavGolWindow int `doc:"Width of the Savitzky-Golay filter in points. Must be odd and larger than SavGolOrder. Points within half a window of either end of a line of sight are never chosen as the splashback radius." example:"21"`
+	IndexMemoryMB int `doc:"Densities are found from an index of the tetrahedra near each halo, which can be large for big halos or big catalogs. Halos are indexed and processed in batches whose indices use at most this many megabytes, and the run stops before indexing if a single halo needs more. Measuring the indices takes one more full pass through the input files. If 0, every halo is indexed at once without measuring. Default is 4096." example:"4096"`
+	AppendName string `doc:"Text added to the end of output file names, e.g. halo_1_app_shell.txt." example:"_app"`
+	PrependName string `doc:"Text added to the start of output file names, e.g. pre_halo_1_shell.txt." example:"pre_"`
+}
+
+type SplashbackWrapper struct {
+	Splashback SplashbackConfig
+}
+
+func DefaultSplashbackWrapper() *SplashbackWrapper {
+	cfg := SplashbackConfig{
+		SubsampleLength: 1, MinRadiusFraction: 0.2,
+		SavGolOrder: 4, SavGolWindow: 21, IndexMemoryMB: 4096,
+	}
+	return &SplashbackWrapper{ cfg }
+}
+
+func (con *SplashbackConfig) ValidLines() bool {
+	return con.Lines > 0
+}
+
+func (con *SplashbackConfig) ValidSamples() bool {
+	return con.Samples > 0 && con.Samples >= con.SavGolWindow
+}
+
+func (con *SplashbackConfig) ValidMinRadiusFraction() bool {
+	return con.MinRadiusFraction > 0 && con.MinRadiusFraction < 1
+}
+
+func (con *SplashbackConfig) ValidSubsampleLength() bool {
+	s := con.SubsampleLength
+	if s <= 0 { return false }
+
+	for {
+		if s == 1 { return true }
+		if s % 2 == 1 { return false }
+		s /= 2
+	}
+}
+
+func (con *SplashbackConfig) ValidSavGolOrder() bool {
+	return con.SavGolOrder >= 1
+}
+
+func (con *SplashbackConfig) ValidSavGolWindow() bool {
+	return con.SavGolWindow % 2 == 1 && con.SavGolWindow > con.SavGolOrder
+}
+
+// Validate returns every problem with con.
+func (con *SplashbackConfig) Validate() []error {
+	errs := []error{ }
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, configErrorf("Splashback", "", key, format, args...))
+	}
+
+	if !con.ValidInput() {
+		add("Input", "Invalid/non-existent 'Input' value, %s.", con.Input)
+	}
+	if !con.ValidOutput() {
+		add("Output", "Invalid/non-existent 'Output' value, %s.", con.Output)
+	}
+	if !con.ValidLines() {
+		add("Lines", "Invalid 'Lines' value, %d.", con.Lines)
+	}
+	if !con.ValidSamples() {
+		add(
+			"Samples", "'Samples' is %d, but it must be positive and at " +
+				"least 'SavGolWindow', %d.", con.Samples, con.SavGolWindow,
+		)
+	}
+	if !con.ValidMinRadiusFraction() {
+		add(
+			"MinRadiusFraction", "Invalid 'MinRadiusFraction' value, %g.",
+			con.MinRadiusFraction,
+		)
+	}
+	if !con.ValidSubsampleLength() {
+		add(
+			"SubsampleLength", "Invalid 'SubsampleLength' value, %d.",
+			con.SubsampleLength,
+		)
+	}
+	if !con.ValidSavGolOrder() {
+		add(
+			"SavGolOrder", "Invalid 'SavGolOrder' value, %d.", con.SavGolOrder,
+		)
+	}
+	if !con.ValidSavGolWindow() {
+		add(
+			"SavGolWindow", "'SavGolWindow' is %d, but it must be odd and " +
+				"larger than 'SavGolOrder', %d.",
+			con.SavGolWindow, con.SavGolOrder,
+		)
+	}
+	if con.IndexMemoryMB < 0 {
+		add(
+			"IndexMemoryMB", "Invalid 'IndexMemoryMB' value, %d.",
+			con.IndexMemoryMB,
+		)
+	}
+
+	return errs
+}
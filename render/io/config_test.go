@@ -0,0 +1,95 @@
+package io
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// fakeCatalog is a HaloCatalog which returns a fixed set of halos.
+type fakeCatalog struct {
+	halos *CatalogHalos
+	err error
+}
+
+func (cat *fakeCatalog) Halos(
+	con *CatalogConfig, cosmo *CosmologyHeader,
+) (*CatalogHalos, error) {
+	return cat.halos, cat.err
+}
+
+func TestCatalogBoxes(t *testing.T) {
+	halos := &fakeCatalog{ halos: &CatalogHalos{
+		IDs: []int{ 1, 2, 3, 4, 5 },
+		PIDs: []int{ -1, 1, -1, -1, 3 },
+		X: []float64{ 10, 20, 30, 40, 50 },
+		Y: []float64{ 10, 20, 30, 40, 50 },
+		Z: []float64{ 10, 20, 30, 40, 50 },
+		M: []float64{ 1e12, 5e12, 1e13, 1e11, 2e12 },
+		R: []float64{ 1, 1, 1, 1, 1 },
+	} }
+	hd := &SheetHeader{ TotalWidth: 100 }
+
+	table := []struct {
+		cat CatalogConfig
+		ids []int
+	}{
+		{ CatalogConfig{ }, []int{ 3, 2, 5, 1, 4 } },
+		{ CatalogConfig{ MassMin: 1e12 }, []int{ 3, 2, 5, 1 } },
+		{ CatalogConfig{ MassMax: 2e12 }, []int{ 5, 1, 4 } },
+		{ CatalogConfig{ MassMin: 1e12, MassMax: 5e12 }, []int{ 2, 5, 1 } },
+		{ CatalogConfig{ MassMin: 1e14 }, []int{ } },
+		{ CatalogConfig{ HostsOnly: true }, []int{ 3, 1, 4 } },
+		{ CatalogConfig{ MaxCount: 2 }, []int{ 3, 2 } },
+		{ CatalogConfig{ MassMax: 5e12, MaxCount: 2 }, []int{ 2, 5 } },
+		{ CatalogConfig{ ID: []int{ 4, 2, 7 } }, []int{ 2, 4 } },
+		{
+			CatalogConfig{ ID: []int{ 1, 2, 5 }, HostsOnly: true,
+				MassMin: 1.5e12 },
+			[]int{ },
+		},
+	}
+
+	for i := range table {
+		cat := table[i].cat
+		cat.File = "halos.list"
+		if err := cat.CheckInit("cat"); err != nil { t.Fatal(err.Error()) }
+
+		boxes, err := cat.Boxes(halos, hd)
+		if err != nil { t.Fatal(err.Error()) }
+
+		names := []string{ }
+		for j := range boxes { names = append(names, boxes[j].Name) }
+		expected := []string{ }
+		for _, id := range table[i].ids {
+			expected = append(expected, fmt.Sprintf("cat_%d", id))
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%d) Got boxes %v, expected %v.", i, names, expected)
+		}
+	}
+
+	cat := CatalogConfig{ File: "halos.list" }
+	if err := cat.CheckInit("cat"); err != nil { t.Fatal(err.Error()) }
+	bad := &fakeCatalog{ err: fmt.Errorf("Catalog is unreadable.") }
+	if _, err := cat.Boxes(bad, hd); err == nil {
+		t.Errorf("Expected an error from an unreadable catalog.")
+	}
+}
+
+func TestBoxShell(t *testing.T) {
+	ball := &BallConfig{
+		X: 50, Y: 50, Z: 50, Radius: 4, RadiusMin: 1, RadiusMultiplier: 2,
+	}
+	box := ball.Box(100)
+	rMin, rMax, ok := box.Shell()
+	if !ok || rMin != 2 || rMax != 8 {
+		t.Errorf("Ball's box has shell (%g, %g, %v), expected (2, 8, true).",
+			rMin, rMax, ok)
+	}
+
+	box = &BoxConfig{ X: 1, Y: 1, Z: 1, XWidth: 1, YWidth: 1, ZWidth: 1 }
+	if _, _, ok := box.Shell(); ok {
+		t.Errorf("Box has a shell.")
+	}
+}
@@ -0,0 +1,308 @@
+package io
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// commentWidth is the width that comments in example config files are
+// wrapped to.
+const commentWidth = 79
+
+// ConfigField describes a single variable in a config file. It's generated
+// from the struct tags of the config struct (see SharedConfig).
+type ConfigField struct {
+	Name, Type, Doc string
+	// Default is the value used if the variable isn't set and Example is the
+	// value shown in example config files.
+	Default, Example string
+	Allowed []string
+	// Multiple is true if the variable may be given multiple times.
+	Required, Multiple bool
+}
+
+// configSection is a section which can appear in a config file.
+type configSection struct {
+	// name is the section header and subsection is the example subsection
+	// name used for bounds file sections.
+	name, subsection string
+	doc string
+	// defaults returns a pointer to a config struct containing default
+	// values.
+	defaults func() interface{}
+}
+
+var configSections = []configSection{
+	{
+		"ConvertSnapshot", "",
+		"Converts particle snapshots into gotetra sheet files. To convert " +
+			"snapshots, you must run gotetra on a machine with enough " +
+			"memory to store the entire simulation.",
+		func() interface{} {
+			return &DefaultConvertSnapshotWrapper().ConvertSnapshot
+		},
+	},
+	{
+		"Render", "",
+		"Renders the boxes given in bounds files. It is paired with at " +
+			"least one bounds file containing Box, Ball, or Catalog " +
+			"sections.",
+		func() interface{} { return &DefaultRenderWrapper().Render },
+	},
+	{
+		"TetraHist", "",
+		"Computes histograms of the mass-weighted properties of " +
+			"tetrahedra within the boxes given in bounds files.",
+		func() interface{} { return &DefaultTetraHistWrapper().TetraHist },
+	},
+	{
+		"Profile", "",
+		"Computes spherically averaged density and velocity profiles " +
+			"directly from tetrahedra around the centers of the Ball and " +
+			"Catalog sections in bounds files. Each profile is written to " +
+			"its own file.",
+		func() interface{} { return &DefaultProfileWrapper().Profile },
+	},
+	{
+		"Splashback", "",
+		"Finds the splashback radius of each Ball and Catalog halo in " +
+			"bounds files by measuring the steepest logarithmic slope of " +
+			"the density along many lines of sight. Densities are computed " +
+			"directly from tetrahedra. The radius of each halo and the " +
+			"3D points where each line of sight crosses the splashback " +
+			"shell are written to output files.",
+		func() interface{} { return &DefaultSplashbackWrapper().Splashback },
+	},
+	{
+		"LightCone", "",
+		"Renders an angular map of a light cone from multiple snapshots.",
+		func() interface{} { return &DefaultLightConeWrapper().LightCone },
+	},
+	{
+		"Box", "my_z_slice",
+		"This section creates a bounding box which specifies a volume or " +
+			"image that will be rendered. It is paired with a Render config " +
+			"file. If ProjectionAxis is set, an image will be rendered. If " +
+			"ProjectionAxis is not set, a 3D volume will be rendered.",
+		func() interface{} { return &BoxConfig{ } },
+	},
+	{
+		"Ball", "my_halo",
+		"This section creates a bounding box defined by a sphere with a " +
+			"given radius. This is an alternative to using Box to specify " +
+			"rendering regions and is convenient when you're looking at " +
+			"individual haloes.",
+		func() interface{} { return &BallConfig{ } },
+	},
+	{
+		"Catalog", "my_halos",
+		"This section creates one bounding box for every halo in a " +
+			"Rockstar catalog which passes the given filters. Each box is " +
+			"named after the section and the halo's ID (e.g. " +
+			"my_halos_169607412) and is sized like a Ball with the halo's " +
+			"radius.",
+		func() interface{} { return &CatalogConfig{ } },
+	},
+}
+
+// ConfigSections returns the names of every section which can appear in a
+// config file.
+func ConfigSections() []string {
+	names := make([]string, len(configSections))
+	for i := range configSections { names[i] = configSections[i].name }
+	return names
+}
+
+func findSection(name string) (*configSection, error) {
+	for i := range configSections {
+		if strings.ToLower(configSections[i].name) == strings.ToLower(name) {
+			return &configSections[i], nil
+		}
+	}
+	return nil, fmt.Errorf(
+		"Unrecognized config section '%s'. Only recognized sections are " +
+			"%s.", name, strings.Join(ConfigSections(), ", "),
+	)
+}
+
+// ConfigFields returns the documented variables of a config section.
+func ConfigFields(section string) ([]ConfigField, error) {
+	sec, err := findSection(section)
+	if err != nil { return nil, err }
+	defaults := reflect.ValueOf(sec.defaults()).Elem()
+	return structFields(defaults), nil
+}
+
+// structFields returns the documented fields of v, including the fields of
+// embedded structs.
+func structFields(v reflect.Value) []ConfigField {
+	fields := []ConfigField{ }
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, structFields(v.Field(i))...)
+			continue
+		} else if sf.PkgPath != "" || sf.Tag.Get("doc") == "-" {
+			continue
+		}
+
+		field := ConfigField{
+			Name: sf.Name, Type: typeName(sf.Type),
+			Doc: sf.Tag.Get("doc"), Example: sf.Tag.Get("example"),
+			Required: sf.Tag.Get("required") == "true",
+			Multiple: sf.Type.Kind() == reflect.Slice,
+		}
+		if allowed := sf.Tag.Get("allowed"); allowed != "" {
+			field.Allowed = strings.Split(allowed, "|")
+		}
+		if val := v.Field(i); !isZero(val) {
+			field.Default = fmt.Sprint(val.Interface())
+		}
+
+		if field.Example == "" { field.Example = field.Default }
+		if field.Example == "" && len(field.Allowed) > 0 {
+			field.Example = field.Allowed[0]
+		}
+
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func isZero(v reflect.Value) bool {
+	if v.Kind() == reflect.Slice { return v.Len() == 0 }
+	return v.Interface() == reflect.Zero(v.Type()).Interface()
+}
+
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Slice:
+		return "list of " + typeName(t.Elem())
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Int, reflect.Int64:
+		return "integer"
+	case reflect.Bool:
+		return "true/false"
+	}
+	return t.Kind().String()
+}
+
+// ExampleConfig returns an example config file containing a single section.
+// Required variables are set to example values and optional variables are
+// commented out.
+func ExampleConfig(section string) (string, error) {
+	sec, err := findSection(section)
+	if err != nil { return "", err }
+	fields, _ := ConfigFields(section)
+
+	lines := []string{ }
+	if sec.subsection == "" {
+		lines = append(lines, fmt.Sprintf("[%s]", sec.name))
+	} else {
+		lines = append(lines, fmt.Sprintf("[%s \"%s\"]", sec.name, sec.subsection))
+	}
+	lines = append(lines, comment(sec.doc)...)
+
+	for _, required := range []bool{ true, false } {
+		header := "# Required Parameters #"
+		if !required { header = "# Optional Parameters #" }
+		bar := strings.Repeat("#", len(header))
+		lines = append(lines, "", bar, header, bar)
+
+		for _, field := range fields {
+			if field.Required != required { continue }
+			lines = append(lines, "")
+			lines = append(lines, comment(fieldNotes(&field))...)
+
+			vals := []string{ field.Example }
+			if field.Multiple { vals = strings.Split(field.Example, "|") }
+			for _, val := range vals {
+				line := fmt.Sprintf("%s = %s", field.Name, val)
+				if !required { line = "# " + line }
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// DescribeConfig returns a reference listing the type, default value, and
+// allowed values of every variable in a config section.
+func DescribeConfig(section string) (string, error) {
+	sec, err := findSection(section)
+	if err != nil { return "", err }
+	fields, _ := ConfigFields(section)
+
+	lines := []string{ fmt.Sprintf("[%s]", sec.name) }
+	lines = append(lines, wrap(sec.doc, commentWidth)...)
+	for _, field := range fields {
+		lines = append(lines, "", field.Name)
+		lines = append(lines, fmt.Sprintf("    Type:     %s", field.Type))
+		if field.Required {
+			lines = append(lines, "    Required: yes")
+		} else {
+			lines = append(lines, "    Required: no")
+			if field.Default != "" {
+				lines = append(lines, fmt.Sprintf(
+					"    Default:  %s", field.Default,
+				))
+			}
+		}
+		if len(field.Allowed) > 0 {
+			lines = append(lines, fmt.Sprintf(
+				"    Allowed:  %s", strings.Join(field.Allowed, " | "),
+			))
+		}
+		for _, line := range wrap(field.Doc, commentWidth - 4) {
+			lines = append(lines, "    " + line)
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// fieldNotes returns the documentation of a field along with its allowed
+// values and default.
+func fieldNotes(field *ConfigField) string {
+	notes := field.Doc
+	if len(field.Allowed) > 0 {
+		notes += fmt.Sprintf(
+			" Must be one of [ %s ].", strings.Join(field.Allowed, " | "),
+		)
+	}
+	if !field.Required && field.Default != "" {
+		notes += fmt.Sprintf(" Default is %s.", field.Default)
+	}
+	return notes
+}
+
+// comment wraps text into config file comments.
+func comment(text string) []string {
+	lines := wrap(text, commentWidth - 2)
+	for i := range lines { lines[i] = "# " + lines[i] }
+	return lines
+}
+
+// wrap splits text into lines which are at most width characters long,
+// unless a single word is longer than that.
+func wrap(text string, width int) []string {
+	lines := []string{ }
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line) + 1 + len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line == "" {
+			line = word
+		} else {
+			line += " " + word
+		}
+	}
+	if line != "" { lines = append(lines, line) }
+	return lines
+}
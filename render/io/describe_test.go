@@ -0,0 +1,114 @@
+package io
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/gcfg.v1"
+)
+
+// TestFieldsDocumented checks that every variable which can be set in a
+// config file has documentation.
+func TestFieldsDocumented(t *testing.T) {
+	for _, sec := range configSections {
+		fields, err := ConfigFields(sec.name)
+		if err != nil { t.Fatal(err.Error()) }
+		names := map[string]bool{ }
+		for _, field := range fields {
+			names[field.Name] = true
+			if field.Doc == "" {
+				t.Errorf("%s.%s has no documentation.", sec.name, field.Name)
+			}
+			if field.Example == "" {
+				t.Errorf("%s.%s has no example value.", sec.name, field.Name)
+			}
+		}
+
+		// Fields which are missing from ConfigFields must be marked
+		// doc:"-" explicitly.
+		checkTagged(t, sec.name, reflect.TypeOf(sec.defaults()).Elem(), names)
+	}
+}
+
+func checkTagged(t *testing.T, sec string, typ reflect.Type, names map[string]bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		if sf.Anonymous {
+			checkTagged(t, sec, sf.Type, names)
+		} else if sf.PkgPath != "" {
+			// Unexported fields can't be set in config files.
+			continue
+		} else if !names[sf.Name] && sf.Tag.Get("doc") != "-" {
+			t.Errorf("%s.%s is missing from ConfigFields.", sec, sf.Name)
+		}
+	}
+}
+
+// TestExampleConfigs checks that every example config contains every
+// variable, can be read, and passes validation.
+func TestExampleConfigs(t *testing.T) {
+	for _, sec := range configSections {
+		text, err := ExampleConfig(sec.name)
+		if err != nil { t.Fatal(err.Error()) }
+		fields, _ := ConfigFields(sec.name)
+		for _, field := range fields {
+			if !strings.Contains(text, field.Name + " = ") {
+				t.Errorf(
+					"Example %s config doesn't contain %s.",
+					sec.name, field.Name,
+				)
+			}
+		}
+
+		var errs []error
+		switch sec.name {
+		case "ConvertSnapshot":
+			wrap := DefaultConvertSnapshotWrapper()
+			err = gcfg.ReadStringInto(wrap, text)
+			errs = wrap.ConvertSnapshot.Validate()
+		case "Render":
+			wrap := DefaultRenderWrapper()
+			err = gcfg.ReadStringInto(wrap, text)
+			errs = wrap.Render.Validate()
+		case "TetraHist":
+			wrap := DefaultTetraHistWrapper()
+			err = gcfg.ReadStringInto(wrap, text)
+			errs = wrap.TetraHist.Validate()
+		case "Profile":
+			wrap := DefaultProfileWrapper()
+			err = gcfg.ReadStringInto(wrap, text)
+			errs = wrap.Profile.Validate()
+		case "Splashback":
+			wrap := DefaultSplashbackWrapper()
+			err = gcfg.ReadStringInto(wrap, text)
+			errs = wrap.Splashback.Validate()
+		case "LightCone":
+			wrap := DefaultLightConeWrapper()
+			err = gcfg.ReadStringInto(wrap, text)
+			errs = wrap.LightCone.Validate()
+		default:
+			bc := BoundsConfig{ }
+			err = gcfg.ReadStringInto(&bc, text)
+			for name, ball := range bc.Ball {
+				ball.Name = name
+				errs = append(errs, ball.Validate()...)
+			}
+			for name, box := range bc.Box {
+				box.Name = name
+				errs = append(errs, box.Validate()...)
+			}
+			for name, cat := range bc.Catalog {
+				cat.Name = name
+				errs = append(errs, cat.Validate()...)
+			}
+		}
+
+		if err != nil {
+			t.Errorf("Could not read example %s config: %s", sec.name, err)
+		}
+		for _, err := range errs {
+			t.Errorf("Example %s config is invalid: %s", sec.name, err)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"unsafe"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+)
+
+// Grid is an in-memory representation of a .gtet file. Vals contains one
+// slice for scalar grids and three slices (x, y, z components) for vector
+// grids.
+type Grid struct {
+	Header GridHeader
+	Vals [][]float32
+}
+
+// GridStats contains summary statistics of a Grid.
+type GridStats struct {
+	Min, Max, Mean float64
+	// Mass is only meaningful for density grids. It is NaN for angular
+	// grids, since their pixels don't have a comoving volume.
+	Mass float64
+	NaNs int
+}
+
+// Dims returns the dimensions of the array stored in the .gtet file. The
+// projection axis of 2D grids has a width of one.
+func (hd *GridHeader) Dims() [3]int {
+	dims := [3]int{}
+	for k := 0; k < 3; k++ { dims[k] = int(hd.Loc.PixelSpan[k]) }
+	if axis := hd.Render.ProjectionAxis; axis >= 0 && axis < 3 {
+		dims[axis] = 1
+	}
+	return dims
+}
+
+// IsAngular returns true if the grid's pixels are spaced in angle rather than
+// in comoving distance, like light cone maps. The non-projected dimensions of
+// Loc are in degrees for these grids, the projected dimension is in Mpc/h,
+// and TotalPixels is the width of the map in pixels.
+func (hd *GridHeader) IsAngular() bool {
+	return hd.Type.IsAngular == 1
+}
+
+// Len returns the number of elements in each component of the grid.
+func (hd *GridHeader) Len() int {
+	dims := hd.Dims()
+	return dims[0] * dims[1] * dims[2]
+}
+
+// ReadGridFile reads the header and the values of a .gtet file. Unlike
+// ReadGrid, it can read vector grids and projected grids.
+func ReadGridFile(fname string) (*Grid, error) {
+	f, err := os.Open(fname)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	g := &Grid{}
+	err = readGridHeader(f, fname, &g.Header)
+	if err != nil { return nil, err }
+
+	comps := 1
+	if g.Header.Type.IsVectorGrid == 1 { comps = 3 }
+	g.Vals = make([][]float32, comps)
+	for i := range g.Vals {
+		g.Vals[i] = make([]float32, g.Header.Len())
+		err = binary.Read(f, end, g.Vals[i])
+		if err != nil { return nil, err }
+	}
+
+	return g, nil
+}
+
+// Write writes the grid to wr in the .gtet format.
+func (g *Grid) Write(wr io.Writer) error {
+	hd := g.Header
+	hd.EndiannessVersion = EndiannessVersionFlag(end)
+	hd.Type.HeaderSize = int64(unsafe.Sizeof(hd))
+	if len(g.Vals) == 3 {
+		hd.Type.IsVectorGrid = 1
+	} else {
+		hd.Type.IsVectorGrid = 0
+	}
+
+	if err := binary.Write(wr, end, &hd); err != nil { return err }
+	for _, vals := range g.Vals {
+		if err := binary.Write(wr, end, vals); err != nil { return err }
+	}
+	return nil
+}
+
+// Stats computes summary statistics of the grid. NaN values are counted,
+// but otherwise ignored. Vector grids are summarized by their magnitudes.
+func (g *Grid) Stats() *GridStats {
+	st := &GridStats{ Min: math.Inf(+1), Max: math.Inf(-1) }
+	n, sum := 0, 0.0
+	for i := 0; i < g.Header.Len(); i++ {
+		var x float64
+		if len(g.Vals) == 3 {
+			for k := 0; k < 3; k++ {
+				v := float64(g.Vals[k][i])
+				x += v*v
+			}
+			x = math.Sqrt(x)
+		} else {
+			x = float64(g.Vals[0][i])
+		}
+
+		if math.IsNaN(x) {
+			st.NaNs++
+			continue
+		}
+
+		if x < st.Min { st.Min = x }
+		if x > st.Max { st.Max = x }
+		sum += x
+		n++
+	}
+
+	if n > 0 { st.Mean = sum / float64(n) }
+
+	// Density grids are in units of the mean density and projections are
+	// averaged over the projection depth.
+	if g.Header.IsAngular() {
+		st.Mass = math.NaN()
+	} else if g.Header.Type.GridType == int64(density.Density) {
+		a := g.Header.Cosmo.ScaleFactor
+		rhoM := g.Header.Cosmo.RhoMean * a * a * a
+		pw := g.Header.Loc.PixelWidth
+		st.Mass = sum * rhoM * pw * pw * pw
+		if axis := g.Header.Render.ProjectionAxis; axis >= 0 && axis < 3 {
+			st.Mass *= float64(g.Header.Loc.PixelSpan[axis])
+		}
+	}
+
+	return st
+}
+
+// Crop returns the subsection of the grid which starts at the pixel origin
+// and has the given pixel span. Both are relative to the lower corner of the
+// grid. Projection axes are left untouched.
+func (g *Grid) Crop(origin, span [3]int) (*Grid, error) {
+	dims := g.Header.Dims()
+	axis := int(g.Header.Render.ProjectionAxis)
+	for k := 0; k < 3; k++ {
+		if k == axis {
+			origin[k], span[k] = 0, 1
+			continue
+		}
+		if origin[k] < 0 || span[k] <= 0 || origin[k] + span[k] > dims[k] {
+			return nil, fmt.Errorf(
+				"Crop range [%d, %d) in dimension %d is not inside [0, %d).",
+				origin[k], origin[k] + span[k], k, dims[k],
+			)
+		}
+	}
+
+	out := &Grid{ Header: g.Header, Vals: make([][]float32, len(g.Vals)) }
+	for k := 0; k < 3; k++ {
+		if k == axis { continue }
+		out.Header.Loc.PixelSpan[k] = int64(span[k])
+		out.Header.Loc.PixelOrigin[k] += int64(origin[k])
+	}
+	out.Header.updatePhysical(&g.Header.Loc)
+
+	for c := range g.Vals {
+		out.Vals[c] = make([]float32, span[0] * span[1] * span[2])
+		i := 0
+		for z := origin[2]; z < origin[2] + span[2]; z++ {
+			for y := origin[1]; y < origin[1] + span[1]; y++ {
+				for x := origin[0]; x < origin[0] + span[0]; x++ {
+					out.Vals[c][i] = g.Vals[c][x + y*dims[0] + z*dims[0]*dims[1]]
+					i++
+				}
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// Downsample block-averages the grid by factor in every non-projected
+// dimension. Blocks are aligned with the coarser global pixel grid, so grids
+// whose origin or span aren't divisible by factor are padded with zeros. For
+// density grids, this means that the total mass is conserved exactly. Other
+// quantities are averaged over the non-padded pixels in each block.
+func (g *Grid) Downsample(factor int) (*Grid, error) {
+	if factor < 1 {
+		return nil, fmt.Errorf("Downsampling factor must be positive.")
+	}
+
+	dims := g.Header.Dims()
+	axis := int(g.Header.Render.ProjectionAxis)
+	outDims, pad := [3]int{}, [3]int{}
+	for k := 0; k < 3; k++ {
+		if k == axis {
+			outDims[k] = 1
+			continue
+		}
+		pad[k] = int(g.Header.Loc.PixelOrigin[k] % int64(factor))
+		outDims[k] = (pad[k] + dims[k] + factor - 1) / factor
+	}
+
+	out := &Grid{ Header: g.Header, Vals: make([][]float32, len(g.Vals)) }
+	loc := &out.Header.Loc
+	loc.PixelWidth *= float64(factor)
+	for k := 0; k < 3; k++ {
+		if k == axis {
+			// The projection depth is stored in pixels.
+			loc.PixelSpan[k] = int64(math.Ceil(
+				float64(loc.PixelSpan[k]) / float64(factor),
+			))
+		} else {
+			loc.PixelSpan[k] = int64(outDims[k])
+		}
+		loc.PixelOrigin[k] /= int64(factor)
+	}
+	out.Header.updatePhysical(&g.Header.Loc)
+	if axis >= 0 && axis < 3 {
+		// The physical extent of the projection is unchanged.
+		loc.Origin[axis] = g.Header.Loc.Origin[axis]
+		loc.Span[axis] = g.Header.Loc.Span[axis]
+	}
+
+	rd := &out.Header.Render
+	if g.Header.IsAngular() {
+		// TotalPixels is the width of the full map, which needn't be a
+		// multiple of factor.
+		rd.TotalPixels = (rd.TotalPixels + int64(factor) - 1) / int64(factor)
+	} else {
+		rd.TotalPixels /= int64(factor)
+	}
+	rd.MinProjectionDepth = int64(math.Ceil(
+		float64(rd.MinProjectionDepth) / float64(factor),
+	))
+
+	// Mass is the sum of the pixels times the pixel volume, times the
+	// projection depth in pixels for projected grids. Angular grids don't
+	// have a mass (see GridStats), so their densities are averaged instead.
+	isDensity := g.Header.Type.GridType == int64(density.Density) &&
+		!g.Header.IsAngular()
+	massNorm := 1.0
+	for k := 0; k < 3; k++ {
+		if k == axis {
+			massNorm *= float64(g.Header.Loc.PixelSpan[k]) /
+				float64(factor * int(loc.PixelSpan[k]))
+		} else {
+			massNorm /= float64(factor)
+		}
+	}
+
+	outLen := outDims[0] * outDims[1] * outDims[2]
+	counts := make([]int, outLen)
+	for c := range g.Vals {
+		sums := make([]float64, outLen)
+		for z := 0; z < dims[2]; z++ {
+			oz := 0
+			if axis != 2 { oz = (z + pad[2]) / factor }
+			for y := 0; y < dims[1]; y++ {
+				oy := 0
+				if axis != 1 { oy = (y + pad[1]) / factor }
+				for x := 0; x < dims[0]; x++ {
+					ox := 0
+					if axis != 0 { ox = (x + pad[0]) / factor }
+					oIdx := ox + oy*outDims[0] + oz*outDims[0]*outDims[1]
+					sums[oIdx] += float64(
+						g.Vals[c][x + y*dims[0] + z*dims[0]*dims[1]],
+					)
+					if c == 0 { counts[oIdx]++ }
+				}
+			}
+		}
+
+		out.Vals[c] = make([]float32, outLen)
+		for i := range sums {
+			if isDensity {
+				out.Vals[c][i] = float32(sums[i] * massNorm)
+			} else {
+				out.Vals[c][i] = float32(sums[i] / float64(counts[i]))
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// Pyramid returns a sequence of grids where the pixels of level i are 2^i
+// times wider than the pixels of g. Level 0 is g itself. If levels is not
+// positive, levels are added until the grid is a single pixel wide in every
+// non-projected dimension. Each level conserves the mass of the previous
+// level (see Downsample).
+func (g *Grid) Pyramid(levels int) ([]*Grid, error) {
+	pyr := []*Grid{ g }
+	for i := 1; levels <= 0 || i < levels; i++ {
+		prev := pyr[len(pyr) - 1]
+		if levels <= 0 && prev.Header.Len() == 1 { break }
+
+		next, err := prev.Downsample(2)
+		if err != nil { return nil, err }
+		pyr = append(pyr, next)
+	}
+	return pyr, nil
+}
+
+// Stitch combines adjacent tiles into a single grid. All tiles must have
+// the same quantity, projection axis, projection range, and PixelWidth, and
+// no two tiles may overlap. Pixels which are not covered by any tile are set
+// to zero.
+func Stitch(tiles []*Grid) (*Grid, error) {
+	if len(tiles) == 0 {
+		return nil, fmt.Errorf("No tiles given to Stitch.")
+	}
+
+	hd0 := &tiles[0].Header
+	axis := int(hd0.Render.ProjectionAxis)
+	totalPixels := int64(round(hd0.Cosmo.BoxWidth / hd0.Loc.PixelWidth))
+
+	for _, t := range tiles[1:] {
+		hd := &t.Header
+		if hd.Type.GridType != hd0.Type.GridType ||
+			len(t.Vals) != len(tiles[0].Vals) {
+			return nil, fmt.Errorf("Tiles contain different quantities.")
+		} else if hd.IsAngular() != hd0.IsAngular() {
+			return nil, fmt.Errorf(
+				"Tiles mix angular and comoving pixel coordinates.",
+			)
+		} else if hd.Render.ProjectionAxis != hd0.Render.ProjectionAxis {
+			return nil, fmt.Errorf("Tiles have different projection axes.")
+		} else if axis >= 0 && axis < 3 &&
+			(hd.Loc.PixelSpan[axis] != hd0.Loc.PixelSpan[axis] ||
+			hd.Loc.PixelOrigin[axis] != hd0.Loc.PixelOrigin[axis]) {
+			return nil, fmt.Errorf(
+				"Tiles are projected over different ranges along axis %d: " +
+					"[%d, %d) and [%d, %d).", axis,
+				hd0.Loc.PixelOrigin[axis],
+				hd0.Loc.PixelOrigin[axis] + hd0.Loc.PixelSpan[axis],
+				hd.Loc.PixelOrigin[axis],
+				hd.Loc.PixelOrigin[axis] + hd.Loc.PixelSpan[axis],
+			)
+		} else if math.Abs(hd.Loc.PixelWidth - hd0.Loc.PixelWidth) >
+			1e-6 * hd0.Loc.PixelWidth {
+			return nil, fmt.Errorf(
+				"Tiles have different PixelWidths, %g and %g.",
+				hd0.Loc.PixelWidth, hd.Loc.PixelWidth,
+			)
+		}
+	}
+
+	// Tile offsets are measured relative to the first tile in a periodic
+	// box, so tiles can wrap around the edge of the simulation. Angular
+	// grids aren't periodic.
+	if hd0.IsAngular() { totalPixels = 0 }
+	offsets := make([][3]int64, len(tiles))
+	low, high := [3]int64{}, [3]int64{}
+	for i, t := range tiles {
+		for k := 0; k < 3; k++ {
+			if k == axis { continue }
+			d := t.Header.Loc.PixelOrigin[k] - hd0.Loc.PixelOrigin[k]
+			if totalPixels == 0 {
+				// Angular grids use the offset as is.
+			} else if d > totalPixels / 2 {
+				d -= totalPixels
+			} else if d < -totalPixels / 2 {
+				d += totalPixels
+			}
+			offsets[i][k] = d
+			if d < low[k] { low[k] = d }
+			if e := d + t.Header.Loc.PixelSpan[k]; e > high[k] { high[k] = e }
+		}
+	}
+
+	out := &Grid{ Header: *hd0, Vals: make([][]float32, len(tiles[0].Vals)) }
+	for k := 0; k < 3; k++ {
+		if k == axis { continue }
+		out.Header.Loc.PixelSpan[k] = high[k] - low[k]
+		origin := hd0.Loc.PixelOrigin[k] + low[k]
+		if origin < 0 { origin += totalPixels }
+		out.Header.Loc.PixelOrigin[k] = origin
+	}
+	out.Header.updatePhysical(&hd0.Loc)
+
+	outDims := out.Header.Dims()
+	for c := range out.Vals {
+		out.Vals[c] = make([]float32, out.Header.Len())
+	}
+
+	covered := make([]bool, out.Header.Len())
+	for i, t := range tiles {
+		dims := t.Header.Dims()
+		for k := 0; k < 3; k++ { offsets[i][k] -= low[k] }
+		ox, oy, oz := int(offsets[i][0]), int(offsets[i][1]), int(offsets[i][2])
+
+		j := 0
+		for z := 0; z < dims[2]; z++ {
+			for y := 0; y < dims[1]; y++ {
+				for x := 0; x < dims[0]; x++ {
+					idx := (x + ox) + (y + oy)*outDims[0] +
+						(z + oz)*outDims[0]*outDims[1]
+					if covered[idx] {
+						return nil, fmt.Errorf(
+							"Tile %d overlaps an earlier tile at pixel " +
+								"(%d, %d, %d) of the stitched grid.",
+							i, x + ox, y + oy, z + oz,
+						)
+					}
+					covered[idx] = true
+					for c := range t.Vals { out.Vals[c][idx] = t.Vals[c][j] }
+					j++
+				}
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// updatePhysical recomputes Origin and Span of hd from its pixel coordinates
+// after they've been changed from prev. Comoving grids have their pixel
+// origin wrapped into the simulation box. Angular grids aren't periodic and
+// their pixel zero isn't at an angle of zero, so their Origin is shifted from
+// prev's by the change in the pixel origin instead, and the projected
+// dimension, which is in Mpc/h, is left as is.
+func (hd *GridHeader) updatePhysical(prev *LocationInfo) {
+	loc := &hd.Loc
+	if hd.IsAngular() {
+		axis := int(hd.Render.ProjectionAxis)
+		for k := 0; k < 3; k++ {
+			if k == axis { continue }
+			corner := prev.Origin[k] -
+				float64(prev.PixelOrigin[k]) * prev.PixelWidth
+			loc.Origin[k] = corner + float64(loc.PixelOrigin[k]) * loc.PixelWidth
+			loc.Span[k] = float64(loc.PixelSpan[k]) * loc.PixelWidth
+		}
+		return
+	}
+
+	totalPixels := int64(round(hd.Cosmo.BoxWidth / loc.PixelWidth))
+	for k := 0; k < 3; k++ {
+		if loc.PixelOrigin[k] >= totalPixels {
+			loc.PixelOrigin[k] -= totalPixels
+		}
+		loc.Origin[k] = float64(loc.PixelOrigin[k]) * loc.PixelWidth
+		loc.Span[k] = float64(loc.PixelSpan[k]) * loc.PixelWidth
+	}
+}
+
+// round rounds x to the nearest integer.
+func round(x float64) int {
+	return int(math.Floor(x + 0.5))
+}
+
+// TiledGridWriter writes a .gtet file one tile at a time so that the full
+// grid never needs to be held in memory. Pixels which are never written to
+// are zero.
+type TiledGridWriter struct {
+	f *os.File
+	hd GridHeader
+	comps int
+}
+
+// NewTiledGridWriter creates the file fname and writes a header for a grid
+// of the given quantity which covers the location loc.
+func NewTiledGridWriter(
+	fname string, q density.Quantity,
+	cosmo CosmoInfo, render RenderInfo, loc LocationInfo,
+) (*TiledGridWriter, error) {
+	w := &TiledGridWriter{ comps: 1 }
+	if isVectorQuantity(q) { w.comps = 3 }
+
+	w.hd.EndiannessVersion = EndiannessVersionFlag(end)
+	w.hd.Type.HeaderSize = int64(unsafe.Sizeof(w.hd))
+	w.hd.Type.GridType = int64(q)
+	if w.comps == 3 { w.hd.Type.IsVectorGrid = 1 }
+	w.hd.Cosmo = cosmo
+	w.hd.Render = render
+	w.hd.Loc = loc
+
+	var err error
+	w.f, err = os.Create(fname)
+	if err != nil { return nil, err }
+
+	// Truncate will zero-fill the file without writing anything to disk.
+	size := int64(unsafe.Sizeof(w.hd)) + int64(4 * w.comps * w.hd.Len())
+	err = binary.Write(w.f, end, &w.hd)
+	if err == nil { err = w.f.Truncate(size) }
+	if err != nil {
+		w.f.Close()
+		os.Remove(fname)
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// OpenTiledGridWriter opens a grid file created by NewTiledGridWriter so that
+// more tiles can be written to it without erasing the existing ones.
+func OpenTiledGridWriter(fname string) (*TiledGridWriter, error) {
+	w := &TiledGridWriter{ comps: 1 }
+
+	var err error
+	w.f, err = os.OpenFile(fname, os.O_RDWR, 0)
+	if err != nil { return nil, err }
+	if err = readGridHeader(w.f, fname, &w.hd); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	if w.hd.Type.IsVectorGrid == 1 { w.comps = 3 }
+
+	return w, nil
+}
+
+// WriteTile writes the contents of buf, which covers the location tileLoc,
+// to its place in the full grid.
+func (w *TiledGridWriter) WriteTile(
+	buf density.Buffer, tileLoc LocationInfo,
+) error {
+	var comps [][]float32
+	if xs, ok := buf.FinalizedScalarBuffer(); ok {
+		comps = [][]float32{ xs }
+	} else if xs, ys, zs, ok := buf.FinalizedVectorBuffer(); ok {
+		comps = [][]float32{ xs, ys, zs }
+	}
+	if len(comps) != w.comps {
+		return fmt.Errorf("Tile quantity does not match the grid quantity.")
+	}
+
+	tileHd := w.hd
+	tileHd.Loc = tileLoc
+	dims, tileDims := w.hd.Dims(), tileHd.Dims()
+	totalPixels := int64(round(w.hd.Cosmo.BoxWidth / w.hd.Loc.PixelWidth))
+
+	offset := [3]int{}
+	for k := 0; k < 3; k++ {
+		if dims[k] == 1 { continue }
+		d := tileLoc.PixelOrigin[k] - w.hd.Loc.PixelOrigin[k]
+		if d < 0 { d += totalPixels }
+		offset[k] = int(d)
+		if offset[k] + tileDims[k] > dims[k] {
+			return fmt.Errorf(
+				"Tile extends past the edge of the grid in dimension %d.", k,
+			)
+		}
+	}
+
+	hdSize := int64(unsafe.Sizeof(w.hd))
+	row := make([]byte, 4 * tileDims[0])
+	for c, vals := range comps {
+		compStart := hdSize + int64(4 * c * w.hd.Len())
+		for z := 0; z < tileDims[2]; z++ {
+			for y := 0; y < tileDims[1]; y++ {
+				start := (y*tileDims[0] + z*tileDims[0]*tileDims[1])
+				for x := 0; x < tileDims[0]; x++ {
+					end.PutUint32(row[4*x:], math.Float32bits(vals[start + x]))
+				}
+
+				idx := offset[0] + (y + offset[1])*dims[0] +
+					(z + offset[2])*dims[0]*dims[1]
+				_, err := w.f.WriteAt(row, compStart + int64(4 * idx))
+				if err != nil { return err }
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close closes the underlying file.
+func (w *TiledGridWriter) Close() error {
+	return w.f.Close()
+}
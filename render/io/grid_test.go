@@ -0,0 +1,344 @@
+package io
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+)
+
+// testGrid creates a density grid in a box with totalPixels pixels of width
+// 0.5 Mpc/h on a side. Every pixel has a different value. axis is the
+// projection axis, or -1 for 3D grids.
+func testGrid(origin, span [3]int, axis, totalPixels int) *Grid {
+	g := &Grid{ }
+	hd := &g.Header
+	hd.Type.GridType = int64(density.Density)
+	hd.Cosmo = NewCosmoInfo(70, 0.27, 0.73, 0, float64(totalPixels) * 0.5)
+	hd.Render.ProjectionAxis = int64(axis)
+	hd.Render.TotalPixels = int64(totalPixels)
+	hd.Loc = NewLocationInfo(origin, span, 0.5)
+
+	g.Vals = [][]float32{ make([]float32, hd.Len()) }
+	for i := range g.Vals[0] { g.Vals[0][i] = float32(i % 17 + 1) }
+	return g
+}
+
+// gridsEqual returns true if two grids have the same location and values.
+func gridsEqual(a, b *Grid) bool {
+	if a.Header.Loc.PixelOrigin != b.Header.Loc.PixelOrigin ||
+		a.Header.Loc.PixelSpan != b.Header.Loc.PixelSpan ||
+		len(a.Vals) != len(b.Vals) {
+		return false
+	}
+	for c := range a.Vals {
+		if len(a.Vals[c]) != len(b.Vals[c]) { return false }
+		for i := range a.Vals[c] {
+			if a.Vals[c][i] != b.Vals[c][i] { return false }
+		}
+	}
+	return true
+}
+
+func TestCropStitch(t *testing.T) {
+	table := []struct {
+		origin, span [3]int
+		axis int
+	}{
+		{ [3]int{ 2, 3, 1 }, [3]int{ 8, 6, 4 }, -1 },
+		// Wraps around the edge of the box.
+		{ [3]int{ 12, 0, 14 }, [3]int{ 8, 6, 4 }, -1 },
+		{ [3]int{ 2, 3, 1 }, [3]int{ 8, 6, 5 }, 2 },
+		{ [3]int{ 2, 13, 1 }, [3]int{ 8, 6, 5 }, 0 },
+	}
+
+	for i := range table {
+		g := testGrid(table[i].origin, table[i].span, table[i].axis, 16)
+		dims := g.Header.Dims()
+
+		// Split the grid into 2 x 2 x 2 tiles (or 2 x 2 for projections)
+		// and stitch them back together in reverse order.
+		tiles := []*Grid{ }
+		for cz := 0; cz < 2; cz++ {
+			for cy := 0; cy < 2; cy++ {
+				for cx := 0; cx < 2; cx++ {
+					c := [3]int{ cx, cy, cz }
+					origin, span := [3]int{ }, [3]int{ }
+					skip := false
+					for k := 0; k < 3; k++ {
+						if dims[k] == 1 {
+							if c[k] == 1 { skip = true }
+							span[k] = 1
+							continue
+						}
+						origin[k] = c[k] * (dims[k] / 2)
+						span[k] = dims[k] / 2
+						if c[k] == 1 { span[k] = dims[k] - origin[k] }
+					}
+					if skip { continue }
+
+					tile, err := g.Crop(origin, span)
+					if err != nil { t.Fatal(err.Error()) }
+					tiles = append([]*Grid{ tile }, tiles...)
+				}
+			}
+		}
+
+		out, err := Stitch(tiles)
+		if err != nil { t.Fatalf("%d: %s", i, err.Error()) }
+		if !gridsEqual(g, out) {
+			t.Errorf("%d: stitched grid at %v %v doesn't match the " +
+				"original grid at %v %v.", i, out.Header.Loc.PixelOrigin,
+				out.Header.Loc.PixelSpan, g.Header.Loc.PixelOrigin,
+				g.Header.Loc.PixelSpan)
+		}
+	}
+}
+
+func TestCropErrors(t *testing.T) {
+	g := testGrid([3]int{ 0, 0, 0 }, [3]int{ 4, 4, 4 }, -1, 16)
+	table := [][2][3]int{
+		{ { -1, 0, 0 }, { 2, 2, 2 } },
+		{ { 0, 0, 0 }, { 5, 2, 2 } },
+		{ { 3, 0, 0 }, { 2, 2, 2 } },
+		{ { 0, 0, 0 }, { 2, 0, 2 } },
+	}
+	for i := range table {
+		if _, err := g.Crop(table[i][0], table[i][1]); err == nil {
+			t.Errorf("Expected an error for Crop(%v, %v).",
+				table[i][0], table[i][1])
+		}
+	}
+}
+
+func TestStitchErrors(t *testing.T) {
+	base := testGrid([3]int{ 0, 0, 0 }, [3]int{ 4, 4, 4 }, -1, 16)
+	proj := testGrid([3]int{ 0, 0, 0 }, [3]int{ 4, 4, 4 }, 2, 16)
+
+	overlap := testGrid([3]int{ 2, 0, 0 }, [3]int{ 4, 4, 4 }, -1, 16)
+	width := testGrid([3]int{ 4, 0, 0 }, [3]int{ 4, 4, 4 }, -1, 16)
+	width.Header.Loc.PixelWidth *= 2
+	quantity := testGrid([3]int{ 4, 0, 0 }, [3]int{ 4, 4, 4 }, -1, 16)
+	quantity.Header.Type.GridType = int64(density.Velocity)
+	axis := testGrid([3]int{ 4, 0, 0 }, [3]int{ 4, 4, 4 }, 1, 16)
+	depth := testGrid([3]int{ 4, 0, 0 }, [3]int{ 4, 4, 8 }, 2, 16)
+	slab := testGrid([3]int{ 4, 0, 4 }, [3]int{ 4, 4, 4 }, 2, 16)
+
+	table := []struct {
+		name string
+		tiles []*Grid
+	}{
+		{ "overlapping", []*Grid{ base, overlap } },
+		{ "duplicate", []*Grid{ base, base } },
+		{ "PixelWidth", []*Grid{ base, width } },
+		{ "quantity", []*Grid{ base, quantity } },
+		{ "projection axis", []*Grid{ proj, axis } },
+		{ "projection depth", []*Grid{ proj, depth } },
+		{ "projection origin", []*Grid{ proj, slab } },
+		{ "empty", []*Grid{ } },
+	}
+	for i := range table {
+		if _, err := Stitch(table[i].tiles); err == nil {
+			t.Errorf("Expected an error for %s tiles.", table[i].name)
+		}
+	}
+
+	// Adjacent tiles are fine.
+	adjacent := testGrid([3]int{ 4, 0, 0 }, [3]int{ 4, 4, 4 }, -1, 16)
+	out, err := Stitch([]*Grid{ base, adjacent })
+	if err != nil { t.Fatal(err.Error()) }
+	if out.Header.Loc.PixelSpan != (IntVector{ 8, 4, 4 }) {
+		t.Errorf("Stitched grid has span %v, expected [8 4 4].",
+			out.Header.Loc.PixelSpan)
+	}
+}
+
+func TestDownsampleMass(t *testing.T) {
+	table := []struct {
+		origin, span [3]int
+		axis int
+	}{
+		{ [3]int{ 0, 0, 0 }, [3]int{ 8, 8, 8 }, -1 },
+		// Unaligned origins and odd spans are padded.
+		{ [3]int{ 3, 5, 1 }, [3]int{ 7, 6, 5 }, -1 },
+		{ [3]int{ 0, 0, 0 }, [3]int{ 8, 8, 4 }, 2 },
+		{ [3]int{ 3, 2, 1 }, [3]int{ 7, 5, 5 }, 2 },
+		{ [3]int{ 1, 3, 6 }, [3]int{ 3, 9, 7 }, 0 },
+		// Wraps around the edge of the box.
+		{ [3]int{ 13, 11, 9 }, [3]int{ 6, 7, 5 }, 1 },
+	}
+
+	for i := range table {
+		g := testGrid(table[i].origin, table[i].span, table[i].axis, 16)
+		mass := g.Stats().Mass
+		if mass <= 0 { t.Fatalf("%d) Grid has mass %g.", i, mass) }
+
+		for _, factor := range []int{ 2, 3, 4 } {
+			ds, err := g.Downsample(factor)
+			if err != nil { t.Fatal(err.Error()) }
+			if m := ds.Stats().Mass; math.Abs(m / mass - 1) > 1e-5 {
+				t.Errorf("%d) Downsample(%d) has mass %g, expected %g.",
+					i, factor, m, mass)
+			}
+		}
+
+		pyr, err := g.Pyramid(0)
+		if err != nil { t.Fatal(err.Error()) }
+		if n := pyr[len(pyr) - 1].Header.Len(); n != 1 {
+			t.Errorf("%d) Last Pyramid level has %d pixels.", i, n)
+		}
+		for lvl := range pyr {
+			if m := pyr[lvl].Stats().Mass; math.Abs(m / mass - 1) > 1e-5 {
+				t.Errorf("%d) Pyramid level %d has mass %g, expected %g.",
+					i, lvl, m, mass)
+			}
+		}
+	}
+}
+
+func TestAngularStats(t *testing.T) {
+	g := testGrid([3]int{ 0, 0, 0 }, [3]int{ 4, 4, 4 }, 2, 16)
+	if g.Header.IsAngular() || math.IsNaN(g.Stats().Mass) {
+		t.Errorf("Box grid treated as an angular grid.")
+	}
+	g.Header.Type.IsAngular = 1
+	if !g.Header.IsAngular() || !math.IsNaN(g.Stats().Mass) {
+		t.Errorf("Angular grid has mass %g, expected NaN.", g.Stats().Mass)
+	}
+}
+
+// angularGrid creates a light cone map with pixels pixels on a side which
+// covers an opening angle of 10 degrees between 100 and 300 Mpc/h.
+func angularGrid(pixels int) *Grid {
+	g := testGrid([3]int{ 0, 0, 0 }, [3]int{ pixels, pixels, 1 }, 2, pixels)
+	hd := &g.Header
+	hd.Type.IsAngular = 1
+	hd.Cosmo.BoxWidth = 62.5
+	hd.Loc.PixelWidth = 10 / float64(pixels)
+	for k := 0; k < 2; k++ {
+		hd.Loc.Origin[k], hd.Loc.Span[k] = -5, 10
+	}
+	hd.Loc.Origin[2], hd.Loc.Span[2] = 100, 200
+	return g
+}
+
+func TestAngularCropDownsample(t *testing.T) {
+	g := angularGrid(10)
+
+	crop, err := g.Crop([3]int{ 2, 6, 0 }, [3]int{ 5, 4, 1 })
+	if err != nil { t.Fatal(err.Error()) }
+	loc := &crop.Header.Loc
+	if math.Abs(loc.Origin[0] + 3) > 1e-6 ||
+		math.Abs(loc.Origin[1] - 1) > 1e-6 ||
+		math.Abs(loc.Span[0] - 5) > 1e-6 || math.Abs(loc.Span[1] - 4) > 1e-6 {
+		t.Errorf("Cropped grid has origin %v and span %v, expected " +
+			"[-3 1 100] and [5 4 200].", loc.Origin, loc.Span)
+	}
+	if loc.Origin[2] != 100 || loc.Span[2] != 200 || loc.PixelSpan[2] != 1 {
+		t.Errorf("Cropped grid has line of sight [%g, %g) with %d pixels, " +
+			"expected [100, 300) with 1.", loc.Origin[2],
+			loc.Origin[2] + loc.Span[2], loc.PixelSpan[2])
+	}
+
+	for _, grid := range []*Grid{ g, crop } {
+		ds, err := grid.Downsample(3)
+		if err != nil { t.Fatal(err.Error()) }
+		loc, prev := &ds.Header.Loc, &grid.Header.Loc
+		if math.Abs(loc.PixelWidth - 3) > 1e-6 {
+			t.Errorf("Downsampled PixelWidth is %g, expected 3.",
+				loc.PixelWidth)
+		}
+		for k := 0; k < 2; k++ {
+			// Downsampled pixels are aligned with the corner of the map.
+			pad := float64(prev.PixelOrigin[k] % 3) * prev.PixelWidth
+			if math.Abs(loc.Origin[k] - (prev.Origin[k] - pad)) > 1e-6 {
+				t.Errorf("Downsampled origin in dimension %d is %g, " +
+					"expected %g.", k, loc.Origin[k], prev.Origin[k] - pad)
+			}
+		}
+		if loc.Origin[2] != 100 || loc.Span[2] != 200 ||
+			loc.PixelSpan[2] != 1 {
+			t.Errorf("Downsampled grid has line of sight [%g, %g) with %d " +
+				"pixels.", loc.Origin[2], loc.Origin[2] + loc.Span[2],
+				loc.PixelSpan[2])
+		}
+		if ds.Header.Render.TotalPixels != 4 {
+			t.Errorf("Downsampled map is %d pixels wide, expected 4.",
+				ds.Header.Render.TotalPixels)
+		}
+
+		// Densities are averaged rather than summed.
+		st, dsSt := grid.Stats(), ds.Stats()
+		if dsSt.Max > st.Max || dsSt.Min < st.Min {
+			t.Errorf("Downsampled range [%g, %g] is outside of [%g, %g].",
+				dsSt.Min, dsSt.Max, st.Min, st.Max)
+		}
+	}
+
+	// Pieces of an angular map stitch back together without wrapping.
+	left, err := g.Crop([3]int{ 0, 0, 0 }, [3]int{ 1, 10, 1 })
+	if err != nil { t.Fatal(err.Error()) }
+	right, err := g.Crop([3]int{ 1, 0, 0 }, [3]int{ 9, 10, 1 })
+	if err != nil { t.Fatal(err.Error()) }
+	out, err := Stitch([]*Grid{ right, left })
+	if err != nil { t.Fatal(err.Error()) }
+	if !gridsEqual(out, g) {
+		t.Errorf("Stitched angular grid differs from the original.")
+	} else if math.Abs(out.Header.Loc.Origin[0] + 5) > 1e-6 {
+		t.Errorf("Stitched angular grid has origin %g, expected -5.",
+			out.Header.Loc.Origin[0])
+	}
+
+	box := testGrid([3]int{ 0, 0, 0 }, [3]int{ 1, 10, 1 }, 2, 10)
+	if _, err = Stitch([]*Grid{ right, box }); err == nil {
+		t.Errorf("Stitching an angular grid to a box grid did not fail.")
+	}
+}
+
+func TestReadGridFileVersion(t *testing.T) {
+	g := testGrid([3]int{ 0, 0, 0 }, [3]int{ 4, 4, 4 }, 2, 16)
+	g.Header.Type.IsAngular = 1
+
+	dir, err := ioutil.TempDir("", "gotetra")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "grid.gtet")
+
+	buf := &bytes.Buffer{ }
+	if err = g.Write(buf); err != nil { t.Fatal(err.Error()) }
+	data := buf.Bytes()
+	if err = ioutil.WriteFile(fname, data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err := ReadGridFile(fname)
+	if err != nil { t.Fatal(err.Error()) }
+	if !out.Header.IsAngular() || !gridsEqual(out, g) {
+		t.Errorf("Angular grid wasn't read back correctly.")
+	}
+	if _, err = ReadGridHeader(fname); err != nil { t.Fatal(err.Error()) }
+
+	// Files written by other versions have a different header layout.
+	flag := append([]byte{ }, data...)
+	flag[0] ^= 1
+	size := append([]byte{ }, data...)
+	size[8]++
+	for name, bad := range map[string][]byte{
+		"version flag": flag, "header size": size,
+	} {
+		if err = ioutil.WriteFile(fname, bad, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err = ReadGridFile(fname); err == nil {
+			t.Errorf("Expected an error from ReadGridFile with a bad %s.",
+				name)
+		}
+		if _, err = ReadGridHeader(fname); err == nil {
+			t.Errorf("Expected an error from ReadGridHeader with a bad %s.",
+				name)
+		}
+	}
+}
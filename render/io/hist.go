@@ -0,0 +1,167 @@
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// HistQuantities lists the quantities which TetraHist can compute histograms
+// of. The index of a quantity in this list is the value stored in
+// HistAxisHeader.Quantity.
+var HistQuantities = []string{
+	"Density", "StreamCount", "RadialVelocity",
+	"VelocityMagnitude", "VelocityDivergence", "Radius", "StreamDensity",
+}
+
+// HistQuantityIndex returns the index of a quantity in HistQuantities or -1
+// if it isn't a histogram quantity.
+func HistQuantityIndex(quantity string) int {
+	for i, q := range HistQuantities {
+		if q == quantity { return i }
+	}
+	return -1
+}
+
+// HistNormalizations lists the ways which a histogram can be normalized. The
+// index of a normalization in this list is the value stored in
+// HistHeader.Normalization.
+var HistNormalizations = []string{ "Counts", "MassPDF", "VolumePDF" }
+
+// HistNormalizationIndex returns the index of a normalization in
+// HistNormalizations or -1 if it isn't a histogram normalization.
+func HistNormalizationIndex(norm string) int {
+	for i, n := range HistNormalizations {
+		if n == norm { return i }
+	}
+	return -1
+}
+
+// HistHeader is the header of a binary .ghist histogram file. It is followed
+// by Dims HistAxisHeaders and then the bin counts as int64s, with the first
+// axis varying fastest. If HasWeights is set, the counts are followed by the
+// summed volume weights of each bin and then the sums of their squares, both
+// as float64s.
+type HistHeader struct {
+	EndiannessVersion uint64
+	HeaderSize int64
+	Dims int64
+	Cosmo CosmoInfo
+	Particles, SubsampleLength int64
+	// Origin and Span give the bounding box of the histogrammed region.
+	Origin, Span Vector
+
+	// Normalization, Cumulative, and PoissonErrors record how the text
+	// output was normalized. The bins of the file are always raw counts.
+	Normalization int64
+	Cumulative, PoissonErrors int64
+	HasWeights int64
+}
+
+// HistAxisHeader describes the binning of one axis of a histogram.
+type HistAxisHeader struct {
+	Quantity int64
+	Min, Max float64
+	Bins int64
+	IsLog int64
+}
+
+// Hist is an in-memory representation of a .ghist file.
+type Hist struct {
+	Header HistHeader
+	Axes []HistAxisHeader
+	Counts []int64
+	// Weights and Weights2 are nil unless Header.HasWeights is set.
+	Weights, Weights2 []float64
+}
+
+// Len returns the number of bins in the histogram.
+func (h *Hist) Len() int {
+	n := 1
+	for i := range h.Axes { n *= int(h.Axes[i].Bins) }
+	return n
+}
+
+// ReadHistFile reads a .ghist file. The file's byte order is found from its
+// EndiannessVersion flag and its HeaderSize must match this version's header.
+func ReadHistFile(fname string) (*Hist, error) {
+	f, err := os.Open(fname)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	flag := [8]byte{ }
+	if _, err = io.ReadFull(f, flag[:]); err != nil { return nil, err }
+	order, err := FlagByteOrder(flag)
+	if err != nil { return nil, fmt.Errorf("%s: %s", fname, err.Error()) }
+	if _, err = f.Seek(0, 0); err != nil { return nil, err }
+
+	h := &Hist{ }
+	err = binary.Read(f, order, &h.Header)
+	if err != nil { return nil, err }
+	if size := int64(unsafe.Sizeof(h.Header)); h.Header.HeaderSize != size {
+		return nil, fmt.Errorf(
+			"%s has a %d byte header, but version %d headers are %d bytes.",
+			fname, h.Header.HeaderSize, Version, size,
+		)
+	} else if h.Header.Dims <= 0 {
+		return nil, fmt.Errorf(
+			"%s has %d histogram axes.", fname, h.Header.Dims,
+		)
+	} else if n := h.Header.Normalization;
+		n < 0 || n >= int64(len(HistNormalizations)) {
+		return nil, fmt.Errorf(
+			"%s has an unknown normalization, %d.", fname, n,
+		)
+	}
+
+	h.Axes = make([]HistAxisHeader, h.Header.Dims)
+	err = binary.Read(f, order, h.Axes)
+	if err != nil { return nil, err }
+
+	h.Counts = make([]int64, h.Len())
+	err = binary.Read(f, order, h.Counts)
+	if err != nil { return nil, err }
+
+	if h.Header.HasWeights != 0 {
+		h.Weights = make([]float64, h.Len())
+		h.Weights2 = make([]float64, h.Len())
+		err = binary.Read(f, order, h.Weights)
+		if err != nil { return nil, err }
+		err = binary.Read(f, order, h.Weights2)
+		if err != nil { return nil, err }
+	}
+
+	return h, nil
+}
+
+// Write writes the histogram to wr in the .ghist format.
+func (h *Hist) Write(wr io.Writer) error {
+	if len(h.Counts) != h.Len() {
+		return fmt.Errorf(
+			"Histogram has %d counts, but its axes have %d bins.",
+			len(h.Counts), h.Len(),
+		)
+	} else if h.Weights != nil &&
+		(len(h.Weights) != h.Len() || len(h.Weights2) != h.Len()) {
+		return fmt.Errorf(
+			"Histogram has %d and %d weights, but its axes have %d bins.",
+			len(h.Weights), len(h.Weights2), h.Len(),
+		)
+	}
+
+	hd := h.Header
+	hd.EndiannessVersion = EndiannessVersionFlag(end)
+	hd.HeaderSize = int64(unsafe.Sizeof(hd))
+	hd.Dims = int64(len(h.Axes))
+	hd.HasWeights = 0
+	if h.Weights != nil { hd.HasWeights = 1 }
+
+	if err := binary.Write(wr, end, &hd); err != nil { return err }
+	if err := binary.Write(wr, end, h.Axes); err != nil { return err }
+	if err := binary.Write(wr, end, h.Counts); err != nil { return err }
+	if h.Weights == nil { return nil }
+	if err := binary.Write(wr, end, h.Weights); err != nil { return err }
+	return binary.Write(wr, end, h.Weights2)
+}
@@ -0,0 +1,143 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestHistReadWrite(t *testing.T) {
+	h := &Hist{ }
+	h.Header.Particles, h.Header.SubsampleLength = 50, 2
+	h.Header.Origin, h.Header.Span = Vector{ 1, 2, 3 }, Vector{ 4, 5, 6 }
+	h.Axes = []HistAxisHeader{
+		{ int64(HistQuantityIndex("Density")), 1e-2, 1e4, 3, 1 },
+		{ int64(HistQuantityIndex("Radius")), 0, 2, 2, 0 },
+	}
+	h.Counts = []int64{ 1, 2, 3, 4, 5, 6 }
+	h.Header.Normalization = int64(HistNormalizationIndex("VolumePDF"))
+	h.Header.Cumulative, h.Header.PoissonErrors = 1, 1
+	h.Weights = []float64{ 0.5, 1, 1.5, 2, 2.5, 3 }
+	h.Weights2 = []float64{ 0.25, 0.5, 0.75, 1, 1.25, 1.5 }
+
+	dir, err := ioutil.TempDir("", "gotetra")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "hist.ghist")
+
+	f, err := os.Create(fname)
+	if err != nil { t.Fatal(err.Error()) }
+	if err = h.Write(f); err != nil { t.Fatal(err.Error()) }
+	f.Close()
+
+	out, err := ReadHistFile(fname)
+	if err != nil { t.Fatal(err.Error()) }
+	if out.Header.Dims != 2 {
+		t.Errorf("Read %d axes, expected 2.", out.Header.Dims)
+	}
+	if out.Header.Origin != h.Header.Origin || out.Header.Span != h.Header.Span {
+		t.Errorf("Read box %v %v, expected %v %v.", out.Header.Origin,
+			out.Header.Span, h.Header.Origin, h.Header.Span)
+	}
+	if !reflect.DeepEqual(out.Axes, h.Axes) {
+		t.Errorf("Read axes %v, expected %v.", out.Axes, h.Axes)
+	}
+	if !reflect.DeepEqual(out.Counts, h.Counts) {
+		t.Errorf("Read counts %v, expected %v.", out.Counts, h.Counts)
+	}
+	if out.Header.Normalization != h.Header.Normalization ||
+		out.Header.Cumulative != 1 || out.Header.PoissonErrors != 1 ||
+		out.Header.HasWeights != 1 {
+		t.Errorf("Read normalization settings %d %d %d %d, expected " +
+			"%d 1 1 1.", out.Header.Normalization, out.Header.Cumulative,
+			out.Header.PoissonErrors, out.Header.HasWeights,
+			h.Header.Normalization)
+	}
+	if !reflect.DeepEqual(out.Weights, h.Weights) ||
+		!reflect.DeepEqual(out.Weights2, h.Weights2) {
+		t.Errorf("Read weights %v %v, expected %v %v.", out.Weights,
+			out.Weights2, h.Weights, h.Weights2)
+	}
+
+	// Histograms without weights don't store them.
+	h.Weights, h.Weights2 = nil, nil
+	buf := &bytes.Buffer{ }
+	if err = h.Write(buf); err != nil { t.Fatal(err.Error()) }
+	size := int(unsafe.Sizeof(h.Header)) + 2*int(unsafe.Sizeof(h.Axes[0])) +
+		8*len(h.Counts)
+	if buf.Len() != size {
+		t.Errorf("Unweighted histogram is %d bytes, expected %d.",
+			buf.Len(), size)
+	}
+
+	h.Weights, h.Weights2 = make([]float64, 6), make([]float64, 5)
+	if err := h.Write(&bytes.Buffer{ }); err == nil {
+		t.Errorf("Expected an error when writing mismatched weights.")
+	}
+	h.Weights, h.Weights2 = nil, nil
+
+	h.Counts = h.Counts[:5]
+	if err := h.Write(&bytes.Buffer{ }); err == nil {
+		t.Errorf("Expected an error when writing mismatched counts.")
+	}
+}
+
+func TestReadHistFileHeader(t *testing.T) {
+	h := &Hist{ }
+	h.Header.Particles = 50
+	h.Axes = []HistAxisHeader{
+		{ int64(HistQuantityIndex("Density")), 1e-2, 1e4, 3, 1 },
+	}
+	h.Counts = []int64{ 1, 2, 3 }
+
+	dir, err := ioutil.TempDir("", "gotetra")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "hist.ghist")
+
+	buf := &bytes.Buffer{ }
+	if err = h.Write(buf); err != nil { t.Fatal(err.Error()) }
+	data := buf.Bytes()
+
+	// Big endian files written on other machines can still be read.
+	hd := h.Header
+	hd.EndiannessVersion = EndiannessVersionFlag(binary.BigEndian)
+	hd.HeaderSize = int64(unsafe.Sizeof(hd))
+	hd.Dims = 1
+	big := &bytes.Buffer{ }
+	binary.Write(big, binary.BigEndian, &hd)
+	binary.Write(big, binary.BigEndian, h.Axes)
+	binary.Write(big, binary.BigEndian, h.Counts)
+
+	if err = ioutil.WriteFile(fname, big.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err := ReadHistFile(fname)
+	if err != nil { t.Fatal(err.Error()) }
+	if !reflect.DeepEqual(out.Counts, h.Counts) ||
+		!reflect.DeepEqual(out.Axes, h.Axes) {
+		t.Errorf("Read big endian histogram %v %v, expected %v %v.",
+			out.Axes, out.Counts, h.Axes, h.Counts)
+	}
+
+	flag := append([]byte{ }, data...)
+	flag[3] ^= 0xff
+	size := append([]byte{ }, data...)
+	size[8]++
+	for name, bad := range map[string][]byte{
+		"flag": flag, "header size": size, "length": data[:4],
+	} {
+		if err = ioutil.WriteFile(fname, bad, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err = ReadHistFile(fname); err == nil {
+			t.Errorf("Expected an error when reading a file with a bad %s.",
+				name)
+		}
+	}
+}
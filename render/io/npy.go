@@ -0,0 +1,158 @@
+package io
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+)
+
+const (
+	npyMagic = "\x93NUMPY"
+	// NumPy recommends aligning the start of the array data to 64 bytes.
+	npyAlignment = 64
+)
+
+// NpySidecar is the JSON-encoded meta-information written next to a .npy
+// file. It contains everything in a GridHeader which can't be expressed
+// through the .npy format itself.
+type NpySidecar struct {
+	Quantity string
+	IsVectorGrid bool
+	Shape []int
+
+	Cosmo CosmoInfo
+	Render RenderInfo
+	Loc LocationInfo
+}
+
+// NpyShape returns the C-ordered shape of the array which represents a grid
+// with the given location and projection axis. Projected grids are 2D and
+// volumes are 3D. Vector grids have a leading dimension of length 3.
+func NpyShape(loc LocationInfo, axis int64, isVector bool) []int {
+	sp := loc.PixelSpan
+	var shape []int
+	switch axis {
+	case 0:
+		shape = []int{ int(sp[2]), int(sp[1]) }
+	case 1:
+		shape = []int{ int(sp[2]), int(sp[0]) }
+	case 2:
+		shape = []int{ int(sp[1]), int(sp[0]) }
+	default:
+		shape = []int{ int(sp[2]), int(sp[1]), int(sp[0]) }
+	}
+
+	if isVector { shape = append([]int{ 3 }, shape...) }
+	return shape
+}
+
+// npyHeader returns the full .npy preamble for a little endian float32 array
+// of the given shape: magic string, version, header length, and the padded
+// header dictionary.
+func npyHeader(shape []int) []byte {
+	dims := make([]string, len(shape))
+	for i := range shape { dims[i] = fmt.Sprintf("%d", shape[i]) }
+	shapeStr := strings.Join(dims, ", ")
+	if len(shape) == 1 { shapeStr += "," }
+
+	dict := fmt.Sprintf(
+		"{'descr': '<f4', 'fortran_order': False, 'shape': (%s), }",
+		shapeStr,
+	)
+
+	// magic (6) + version (2) + header length (2) + dict + '\n'
+	preLen := len(npyMagic) + 2 + 2
+	total := preLen + len(dict) + 1
+	if rem := total % npyAlignment; rem != 0 {
+		dict += strings.Repeat(" ", npyAlignment - rem)
+	}
+	dict += "\n"
+
+	out := make([]byte, 0, preLen + len(dict))
+	out = append(out, npyMagic...)
+	out = append(out, 1, 0)
+	hdLen := make([]byte, 2)
+	binary.LittleEndian.PutUint16(hdLen, uint16(len(dict)))
+	out = append(out, hdLen...)
+	out = append(out, dict...)
+	return out
+}
+
+// WriteNpy writes the contents of buf to wr as a NumPy .npy file with a
+// float32 dtype and a C-ordered shape given by NpyShape. The resulting file
+// can be read with np.load and indexes the same way as the arrays returned
+// by gotetra.py's read_grid.
+func WriteNpy(
+	buf density.Buffer, render RenderInfo, loc LocationInfo, wr io.Writer,
+) error {
+	if xs, ok := buf.FinalizedScalarBuffer(); ok {
+		shape := NpyShape(loc, render.ProjectionAxis, false)
+		if err := checkNpyLen(shape, len(xs)); err != nil { return err }
+
+		if _, err := wr.Write(npyHeader(shape)); err != nil { return err }
+		return binary.Write(wr, binary.LittleEndian, xs)
+	} else if xs, ys, zs, ok := buf.FinalizedVectorBuffer(); ok {
+		shape := NpyShape(loc, render.ProjectionAxis, true)
+		if err := checkNpyLen(shape, 3 * len(xs)); err != nil { return err }
+
+		if _, err := wr.Write(npyHeader(shape)); err != nil { return err }
+		for _, comp := range [][]float32{ xs, ys, zs } {
+			err := binary.Write(wr, binary.LittleEndian, comp)
+			if err != nil { return err }
+		}
+		return nil
+	}
+	return fmt.Errorf("Buffer is neither scalar nor vector.")
+}
+
+// checkNpyLen returns an error if a shape does not describe n elements.
+func checkNpyLen(shape []int, n int) error {
+	prod := 1
+	for _, x := range shape { prod *= x }
+	if prod != n {
+		return fmt.Errorf(
+			"Grid shape %v requires %d elements, but buffer has %d.",
+			shape, prod, n,
+		)
+	}
+	return nil
+}
+
+// isVectorQuantity returns true if the finalized grid of the given quantity
+// is a vector field.
+func isVectorQuantity(q density.Quantity) bool {
+	switch q {
+	case density.Density, density.VelocityDivergence:
+		return false
+	}
+	return true
+}
+
+// WriteNpySidecar writes the JSON file which accompanies a .npy file written
+// by WriteNpy.
+func WriteNpySidecar(
+	buf density.Buffer,
+	cosmo CosmoInfo, render RenderInfo, loc LocationInfo,
+	wr io.Writer,
+) error {
+	isVector := isVectorQuantity(buf.Quantity())
+
+	sc := &NpySidecar{
+		Quantity: buf.Quantity().String(),
+		IsVectorGrid: isVector,
+		Shape: NpyShape(loc, render.ProjectionAxis, isVector),
+		Cosmo: cosmo,
+		Render: render,
+		Loc: loc,
+	}
+
+	b, err := json.MarshalIndent(sc, "", "    ")
+	if err != nil { return err }
+	if _, err = wr.Write(b); err != nil { return err }
+	_, err = wr.Write([]byte("\n"))
+	return err
+}
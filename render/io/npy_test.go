@@ -0,0 +1,121 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+)
+
+// readNpy splits a .npy file into its header dictionary and its float32
+// values. It fails the test if the preamble isn't valid.
+func readNpy(t *testing.T, b []byte) (string, []float32) {
+	if len(b) < 10 || string(b[:6]) != npyMagic {
+		t.Fatalf("File doesn't start with the .npy magic string.")
+	}
+	if b[6] != 1 || b[7] != 0 {
+		t.Errorf("File has version %d.%d, expected 1.0.", b[6], b[7])
+	}
+
+	hdLen := int(binary.LittleEndian.Uint16(b[8:10]))
+	if (10 + hdLen) % npyAlignment != 0 {
+		t.Errorf("Data starts at byte %d, which isn't a multiple of %d.",
+			10 + hdLen, npyAlignment)
+	}
+	dict := string(b[10:10 + hdLen])
+	if !strings.HasSuffix(dict, "\n") {
+		t.Errorf("Header '%s' doesn't end in a newline.", dict)
+	}
+
+	data := b[10 + hdLen:]
+	if len(data) % 4 != 0 {
+		t.Fatalf("Data has %d bytes, which isn't a multiple of 4.", len(data))
+	}
+	vals := make([]float32, len(data) / 4)
+	for i := range vals {
+		vals[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return dict, vals
+}
+
+func TestWriteNpy(t *testing.T) {
+	// A volume with a different width along each axis.
+	loc := NewLocationInfo([3]int{ 1, 2, 3 }, [3]int{ 5, 4, 3 }, 0.5)
+	n := 5 * 4 * 3
+
+	rhos := make([]float64, n)
+	for i := range rhos { rhos[i] = float64(i) + 0.25 }
+	scalar := density.WrapperDensityBuffer(rhos)
+
+	vector := density.NewBuffer(density.Velocity, n, n, nil)
+	vecs, _ := vector.VectorBuffer()
+	num, _ := vector.CountBuffer()
+	for i := range vecs {
+		for k := 0; k < 3; k++ { vecs[i][k] = float64(100*k + i) }
+		num[i] = 1
+	}
+
+	// The projected grid is 5 x 3 pixels, stored as 3 rows of 5.
+	projLoc := NewLocationInfo([3]int{ 1, 2, 3 }, [3]int{ 5, 1, 3 }, 0.5)
+	projected := density.WrapperDensityBuffer(rhos[:15])
+
+	table := []struct {
+		buf density.Buffer
+		loc LocationInfo
+		axis int64
+		shape string
+		vals []float32
+	}{
+		{ scalar, loc, -1, "(3, 4, 5)", nil },
+		{ vector, loc, -1, "(3, 3, 4, 5)", nil },
+		{ projected, projLoc, 1, "(3, 5)", nil },
+	}
+	for i := range table {
+		if xs, ok := table[i].buf.FinalizedScalarBuffer(); ok {
+			table[i].vals = xs
+		} else {
+			// Vector components are stored one after another.
+			xs, ys, zs, _ := table[i].buf.FinalizedVectorBuffer()
+			table[i].vals = append(append(xs, ys...), zs...)
+		}
+	}
+
+	for i := range table {
+		wr := &bytes.Buffer{ }
+		render := RenderInfo{ ProjectionAxis: table[i].axis }
+		err := WriteNpy(table[i].buf, render, table[i].loc, wr)
+		if err != nil { t.Fatal(err.Error()) }
+
+		dict, vals := readNpy(t, wr.Bytes())
+		for _, s := range []string{
+			"'descr': '<f4'", "'fortran_order': False",
+			"'shape': " + table[i].shape,
+		} {
+			if !strings.Contains(dict, s) {
+				t.Errorf("%d) Header '%s' doesn't contain %s.", i, dict, s)
+			}
+		}
+
+		if len(vals) != len(table[i].vals) {
+			t.Errorf("%d) File has %d values, expected %d.",
+				i, len(vals), len(table[i].vals))
+			continue
+		}
+		for j := range vals {
+			if vals[j] != table[i].vals[j] {
+				t.Errorf("%d) Value %d is %g, expected %g.",
+					i, j, vals[j], table[i].vals[j])
+				break
+			}
+		}
+	}
+
+	// Shapes which don't match the buffer are rejected.
+	render := RenderInfo{ ProjectionAxis: -1 }
+	if err := WriteNpy(projected, render, loc, &bytes.Buffer{ }); err == nil {
+		t.Errorf("Writing a buffer with the wrong length didn't fail.")
+	}
+}
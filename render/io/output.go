@@ -17,7 +17,7 @@ var (
 	end = binary.LittleEndian
 )
 const (
-	Version = uint64(2)
+	Version = uint64(3)
 )
 
 type GridHeader struct {
@@ -33,6 +33,9 @@ type TypeInfo struct {
 	HeaderSize int64
     GridType int64
     IsVectorGrid int64
+	// IsAngular is 1 for grids whose pixels are spaced in angle, like light
+	// cone maps, and 0 otherwise. See GridHeader.IsAngular.
+	IsAngular int64
 }
 
 type CosmoInfo struct {
@@ -58,20 +61,20 @@ type LocationInfo struct {
 
 func ReadGridHeader(fname string) (*GridHeader, error) {
     f, err := os.Open(fname)
-    defer f.Close()
     if err != nil { return nil, err }
+    defer f.Close()
     hd := &GridHeader{}
-    err = binary.Read(f, end, hd)
+    err = readGridHeader(f, fname, hd)
     if err != nil { return nil, err }
     return hd, nil
 }
 
 func ReadGrid(fname string) ([]float64, error) {
     f, err := os.Open(fname)
-    defer f.Close()
     if err != nil { return nil, err }
+    defer f.Close()
     hd := &GridHeader{}
-    err = binary.Read(f, end, hd)
+    err = readGridHeader(f, fname, hd)
     if err != nil { return nil, err }
 
     if hd.Type.IsVectorGrid == 1 {
@@ -88,6 +91,26 @@ func ReadGrid(fname string) ([]float64, error) {
     return vals, nil
 }
 
+// readGridHeader reads the header of the grid file fname from rd. It returns
+// an error if the file wasn't written by this version of gotetra, since the
+// layout of the header differs between versions.
+func readGridHeader(rd io.Reader, fname string, hd *GridHeader) error {
+	if err := binary.Read(rd, end, hd); err != nil { return err }
+	if hd.EndiannessVersion != EndiannessVersionFlag(end) {
+		return fmt.Errorf(
+			"%s has the endianness/version flag %x, but this version of " +
+				"gotetra only reads little endian version %d files.",
+			fname, hd.EndiannessVersion, Version,
+		)
+	} else if size := int64(unsafe.Sizeof(*hd)); hd.Type.HeaderSize != size {
+		return fmt.Errorf(
+			"%s has a %d byte header, but version %d headers are %d bytes.",
+			fname, hd.Type.HeaderSize, Version, size,
+		)
+	}
+	return nil
+}
+
 type Vector [3]float64
 type IntVector [3]int64
 
@@ -152,12 +175,13 @@ func WriteBuffer(
 	hd.Render = render
 	hd.Loc = loc
 
-	binary.Write(wr, end, &hd)
 	if xs, ok := buf.FinalizedScalarBuffer(); ok {
 		hd.Type.IsVectorGrid = 0
+		binary.Write(wr, end, &hd)
 		binary.Write(wr, end, xs)
 	} else if xs, ys, zs, ok := buf.FinalizedVectorBuffer(); ok {
 		hd.Type.IsVectorGrid = 1
+		binary.Write(wr, end, &hd)
 		binary.Write(wr, end, xs)
 		binary.Write(wr, end, ys)
 		binary.Write(wr, end, zs)
@@ -175,6 +199,22 @@ func EndiannessVersionFlag(end binary.ByteOrder) uint64 {
 	return flag
 }
 
+// FlagByteOrder returns the byte order of a file which starts with the
+// EndiannessVersion flag stored in the bytes b. It returns an error if the
+// flag was written by a different version of gotetra.
+func FlagByteOrder(b [8]byte) (binary.ByteOrder, error) {
+	orders := []binary.ByteOrder{ binary.LittleEndian, binary.BigEndian }
+	for _, order := range orders {
+		if order.Uint64(b[:]) == EndiannessVersionFlag(order) {
+			return order, nil
+		}
+	}
+	return nil, fmt.Errorf(
+		"Unrecognized endianness/version flag, %x. Version %d is required.",
+		b, Version,
+	)
+}
+
 func reverse(x uint64) uint64 {
 	out := uint64(0)
 	for i := uint(0); i < 64; i++ {
@@ -0,0 +1,186 @@
+package io
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/gcfg.v1"
+)
+
+// ConfigError is a problem with a single variable in a config file. File and
+// Line are filled in by LocateErrors and are empty until then.
+type ConfigError struct {
+	Section, Name, Key string
+	Msg string
+
+	File string
+	Line int
+}
+
+func (err *ConfigError) Error() string {
+	if err.File == "" { return err.Msg }
+	if err.Line == 0 { return fmt.Sprintf("%s: %s", err.File, err.Msg) }
+	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Msg)
+}
+
+// configErrorf creates a ConfigError for the variable key in the section
+// [section "name"]. name is empty for sections without subsections.
+func configErrorf(
+	section, name, key, format string, args ...interface{},
+) *ConfigError {
+	return &ConfigError{
+		Section: section, Name: name, Key: key,
+		Msg: fmt.Sprintf(format, args...),
+	}
+}
+
+// LocateErrors sets the file and line number of every ConfigError in errs
+// which hasn't been located yet and sorts errs by line number. Errors for
+// variables which aren't in the file point to the start of their section.
+func LocateErrors(fname string, errs []error) []error {
+	lines, err := configLines(fname)
+	if err != nil { return errs }
+
+	for _, err := range errs {
+		cerr, ok := err.(*ConfigError)
+		if !ok || cerr.File != "" { continue }
+
+		cerr.File = fname
+		section := strings.ToLower(cerr.Section)
+		if line, ok := lines[lineKey(section, cerr.Name, cerr.Key)]; ok {
+			cerr.Line = line
+		} else {
+			cerr.Line = lines[lineKey(section, cerr.Name, "")]
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errorLine(errs[i]) < errorLine(errs[j])
+	})
+	return errs
+}
+
+func errorLine(err error) int {
+	if cerr, ok := err.(*ConfigError); ok { return cerr.Line }
+	return 0
+}
+
+func lineKey(section, name, key string) string {
+	return fmt.Sprintf("%s\x00%s\x00%s", section, name, strings.ToLower(key))
+}
+
+// configLines returns the line numbers of every section header and variable
+// in a gcfg file. Section headers are stored with an empty key.
+func configLines(fname string) (map[string]int, error) {
+	f, err := os.Open(fname)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	lines := map[string]int{ }
+	section, name := "", ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' { continue }
+
+		if line[0] == '[' {
+			header := strings.Trim(line, "[] \t")
+			section, name = header, ""
+			if i := strings.Index(header, " "); i >= 0 {
+				section = header[:i]
+				name = strings.Trim(strings.TrimSpace(header[i:]), "\"")
+			}
+			section = strings.ToLower(section)
+			lines[lineKey(section, name, "")] = n
+			continue
+		}
+
+		key := line
+		if i := strings.Index(line, "="); i >= 0 { key = line[:i] }
+		k := lineKey(section, name, strings.TrimSpace(key))
+		if _, ok := lines[k]; !ok { lines[k] = n }
+	}
+
+	return lines, scanner.Err()
+}
+
+// ConfigSection returns the name of the first section in a config file.
+// This is used to figure out what type of config file it is.
+func ConfigSection(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil { return "", err }
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] != '[' { continue }
+		header := strings.Trim(line, "[] \t")
+		if i := strings.Index(header, " "); i >= 0 { header = header[:i] }
+		return header, nil
+	}
+	if err := scanner.Err(); err != nil { return "", err }
+
+	return "", fmt.Errorf("'%s' doesn't contain any sections.", fname)
+}
+
+// ValidateBoundsFile returns every problem with the Box, Ball, and Catalog
+// sections of a bounds file which can be found without reading the
+// simulation. Problems which depend on the simulation (e.g. boxes outside
+// the simulation volume) are found by ReadBoundsConfig.
+func ValidateBoundsFile(fname string) []error {
+	bc := BoundsConfig{}
+	if err := gcfg.ReadFileInto(&bc, fname); err != nil {
+		return []error{ err }
+	}
+
+	errs := []error{ }
+	for name, ball := range bc.Ball {
+		ball.Name = name
+		errs = append(errs, ball.Validate()...)
+	}
+	for name, box := range bc.Box {
+		box.Name = name
+		errs = append(errs, box.Validate()...)
+	}
+	for name, cat := range bc.Catalog {
+		cat.Name = name
+		errs = append(errs, cat.Validate()...)
+	}
+
+	return LocateErrors(fname, errs)
+}
+
+// ValidateBoxOverrides returns every problem with the render settings which
+// boxes override that can only be found once con and the sheets described by
+// hd are known. A box's SubsampleLength must evenly divide the sheet segment
+// width and can't be smaller than the SubsampleLength of con.
+func ValidateBoxOverrides(
+	con *RenderConfig, boxes []BoxConfig, hd *SheetHeader,
+) []error {
+	errs := []error{ }
+	for i := range boxes {
+		s := boxes[i].SubsampleLength
+		if s == 0 { continue }
+
+		if s < con.SubsampleLength {
+			errs = append(errs, configErrorf(
+				"Box", boxes[i].Name, "SubsampleLength",
+				"SubsampleLength of '%s' is %d, but it can't be smaller " +
+					"than the SubsampleLength of the Render config file, %d.",
+				boxes[i].Name, s, con.SubsampleLength,
+			))
+		} else if hd.SegmentWidth % int64(s) != 0 {
+			errs = append(errs, configErrorf(
+				"Box", boxes[i].Name, "SubsampleLength",
+				"SubsampleLength of '%s' is %d, but it must evenly divide " +
+					"the sheet segment width, %d.",
+				boxes[i].Name, s, hd.SegmentWidth,
+			))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,100 @@
+package io
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestValidateBoundsFileLines(t *testing.T) {
+	text := `# Bounds with a few mistakes.
+[Ball "a"]
+X = 10
+Y = 10
+Z = 10
+
+[Box "b"]
+X = -1
+Y = 5
+Z = 5
+XWidth = 2
+; Comments don't shift line numbers.
+YWidth = 2
+ZWidth = 2
+ProjectionAxis = W
+
+[Catalog "c"]
+File = halos.list
+MassMin = 5e12
+MassMax = 1e12
+`
+	dir, err := ioutil.TempDir("", "gotetra")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "bounds.cfg")
+	err = ioutil.WriteFile(fname, []byte(text), 0644)
+	if err != nil { t.Fatal(err.Error()) }
+
+	errs := ValidateBoundsFile(fname)
+	lines := []string{ }
+	for _, err := range errs {
+		cerr, ok := err.(*ConfigError)
+		if !ok { t.Fatalf("Unexpected error: %s", err.Error()) }
+		if cerr.File != fname {
+			t.Errorf("Error '%s' is in file '%s'.", cerr.Msg, cerr.File)
+		}
+		lines = append(lines, fmt.Sprintf("%d %s", cerr.Line, cerr.Key))
+	}
+
+	// The missing Radius points to its section.
+	expected := []string{
+		"2 Radius", "8 X", "15 ProjectionAxis", "19 MassMin",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Errors are at %v, expected %v.", lines, expected)
+	}
+}
+
+func TestLocateErrorsUnknownFile(t *testing.T) {
+	cerr := configErrorf("Box", "b", "X", "Bad X.")
+	errs := LocateErrors("does/not/exist.cfg", []error{ cerr })
+	if len(errs) != 1 || cerr.File != "" || cerr.Line != 0 {
+		t.Errorf("Errors in a missing file were located at %s:%d.",
+			cerr.File, cerr.Line)
+	}
+	if cerr.Error() != "Bad X." {
+		t.Errorf("Unlocated error is '%s', expected 'Bad X.'", cerr.Error())
+	}
+}
+
+func TestValidateBoxOverrides(t *testing.T) {
+	con := &RenderConfig{ SubsampleLength: 2 }
+	hd := &SheetHeader{ SegmentWidth: 8 }
+
+	table := []struct {
+		skip int
+		valid bool
+	}{
+		{ 0, true }, { 2, true }, { 8, true },
+		{ 1, false }, { 16, false },
+	}
+	for i := range table {
+		boxes := []BoxConfig{ { Name: "b" } }
+		boxes[0].SubsampleLength = table[i].skip
+		errs := ValidateBoxOverrides(con, boxes, hd)
+		if (len(errs) == 0) != table[i].valid {
+			t.Errorf("%d) SubsampleLength = %d gave errors %v.",
+				i, table[i].skip, errs)
+		}
+		for _, err := range errs {
+			cerr, ok := err.(*ConfigError)
+			if !ok || cerr.Name != "b" || cerr.Key != "SubsampleLength" {
+				t.Errorf("%d) Error '%s' doesn't point to the box.",
+					i, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package render
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"sort"
+
+	"github.com/phil-mansfield/gotetra/cosmo"
+	"github.com/phil-mansfield/gotetra/math/rand"
+	"github.com/phil-mansfield/gotetra/render/geom"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// LightConeShell is a single snapshot along with the range of comoving
+// distances (in Mpc/h) which are rendered from it.
+type LightConeShell struct {
+	Files []string
+	Z float64
+	RMin, RMax float64
+}
+
+// LightConeShells assigns a comoving-distance shell to each snapshot. zs
+// are the redshifts of each snapshot and files are their sheet files. Shell
+// boundaries are placed halfway (in comoving distance) between adjacent
+// snapshots and the full set of shells spans [zMin, zMax]. Snapshots whose
+// shells are empty are dropped.
+func LightConeShells(
+	files [][]string, zs []float64, omegaM, omegaL, zMin, zMax float64,
+) []LightConeShell {
+	shells := make([]LightConeShell, len(zs))
+	for i := range shells {
+		shells[i].Files, shells[i].Z = files[i], zs[i]
+	}
+	sort.Sort(shellsByZ(shells))
+
+	dMin := cosmo.ComovingDistance(omegaM, omegaL, zMin)
+	dMax := cosmo.ComovingDistance(omegaM, omegaL, zMax)
+	ds := make([]float64, len(shells))
+	for i := range shells {
+		ds[i] = cosmo.ComovingDistance(omegaM, omegaL, shells[i].Z)
+	}
+
+	out := []LightConeShell{ }
+	for i := range shells {
+		rMin, rMax := dMin, dMax
+		if i > 0 { rMin = math.Max(rMin, (ds[i-1] + ds[i]) / 2) }
+		if i < len(shells) - 1 { rMax = math.Min(rMax, (ds[i] + ds[i+1]) / 2) }
+		if rMax <= rMin { continue }
+
+		shells[i].RMin, shells[i].RMax = rMin, rMax
+		out = append(out, shells[i])
+	}
+	return out
+}
+
+type shellsByZ []LightConeShell
+func (s shellsByZ) Len() int { return len(s) }
+func (s shellsByZ) Less(i, j int) bool { return s[i].Z < s[j].Z }
+func (s shellsByZ) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// LightConeManager renders the surface density of a light cone into a map
+// of angular pixels. The map covers a square patch of sky centered on one of
+// the box axes and pixels are uniformly spaced in angle along both sides of
+// the patch.
+type LightConeManager struct {
+	xs []geom.Vec
+	hd io.SheetHeader
+	shells []LightConeShell
+
+	observer [3]float64
+	axis, iDim, jDim int
+	halfAngle float64
+	pixels int
+
+	unitBufs [][]geom.Vec
+	skip int
+	workers int
+
+	// workspaces
+	maps [][]float64
+	vecBufs [][]geom.Vec
+	gens []*rand.Generator
+}
+
+// NewLightConeManager creates a LightConeManager which renders the given
+// shells as seen by an observer at the given position looking down axis.
+// openingAngle is the width of the map in degrees and the map is pixels
+// across. points is the number of Monte Carlo samples used per tetrahedron.
+func NewLightConeManager(
+	shells []LightConeShell, observer [3]float64, axis int,
+	openingAngle float64, pixels, points int,
+) (*LightConeManager, error) {
+	if len(shells) == 0 {
+		return nil, fmt.Errorf("No light cone shells to render.")
+	} else if axis < 0 || axis >= 3 {
+		return nil, fmt.Errorf("Invalid line of sight axis, %d.", axis)
+	}
+
+	man := &LightConeManager{
+		shells: shells,
+		observer: observer,
+		axis: axis,
+		halfAngle: openingAngle / 2 * math.Pi / 180,
+		pixels: pixels,
+		skip: 1,
+	}
+
+	man.iDim, man.jDim = 0, 1
+	if axis == 0 { man.iDim, man.jDim = 1, 2 }
+	if axis == 1 { man.iDim, man.jDim = 0, 2 }
+
+	err := io.ReadSheetHeaderAt(shells[0].Files[0], &man.hd)
+	if err != nil { return nil, err }
+	man.xs = make([]geom.Vec, man.hd.GridCount)
+
+	man.unitBufs = unitBufs(UnitBufCount, points)
+
+	man.workers = NumCores
+	runtime.GOMAXPROCS(man.workers)
+	man.maps = make([][]float64, man.workers)
+	man.vecBufs = make([][]geom.Vec, man.workers)
+	man.gens = make([]*rand.Generator, man.workers)
+	for i := 0; i < man.workers; i++ {
+		man.maps[i] = make([]float64, pixels * pixels)
+		man.vecBufs[i] = make([]geom.Vec, points)
+		man.gens[i] = rand.NewTimeSeed(rand.Xorshift)
+	}
+
+	return man, nil
+}
+
+// Subsample makes the LightConeManager only use every skip-th particle along
+// each axis. skip must be a power of two which evenly divides the segment
+// width of the sheets.
+func (man *LightConeManager) Subsample(skip int) error {
+	if err := checkSubsample(&man.hd, skip); err != nil { return err }
+	man.skip = skip
+	return nil
+}
+
+// Render renders every shell into the map.
+func (man *LightConeManager) Render() error {
+	for si := range man.shells {
+		shell := &man.shells[si]
+		log.Printf(
+			"Rendering shell %d/%d: z = %.3f, %.1f < r < %.1f Mpc/h",
+			si + 1, len(man.shells), shell.Z, shell.RMin, shell.RMax,
+		)
+
+		for _, file := range shell.Files {
+			err := man.renderFile(file, shell)
+			if err != nil { return err }
+		}
+	}
+	return nil
+}
+
+// renderFile adds the tetrahedra in a single sheet segment to the map.
+func (man *LightConeManager) renderFile(
+	file string, shell *LightConeShell,
+) error {
+	err := io.ReadSheetHeaderAt(file, &man.hd)
+	if err != nil { return err }
+
+	reps := man.replicas(&man.hd, shell)
+	if len(reps) == 0 { return nil }
+
+	if _, err = loadSheet(file, &man.hd, man.xs, nil); err != nil {
+		return err
+	}
+
+	runWorkers(man.workers, func(id int) {
+		man.workerRender(id, shell, reps)
+	}, nil)
+	return nil
+}
+
+// replicas returns the offsets of every periodic image of the currently
+// loaded segment which could intersect both the shell and the cone.
+func (man *LightConeManager) replicas(
+	hd *io.SheetHeader, shell *LightConeShell,
+) [][3]float64 {
+	L := hd.TotalWidth
+	origin, width := [3]float64{ }, [3]float64{ }
+	low, high := [3]int{ }, [3]int{ }
+	for k := 0; k < 3; k++ {
+		origin[k], width[k] = float64(hd.Origin[k]), float64(hd.Width[k])
+		low[k] = int(math.Floor(
+			(man.observer[k] - shell.RMax - origin[k] - width[k]) / L,
+		))
+		high[k] = int(math.Ceil((man.observer[k] + shell.RMax - origin[k]) / L))
+	}
+
+	// The circumscribing circular cone.
+	coneAngle := math.Atan(math.Sqrt2 * math.Tan(man.halfAngle))
+	halfDiag := math.Sqrt(
+		width[0]*width[0] + width[1]*width[1] + width[2]*width[2],
+	) / 2
+
+	reps := [][3]float64{ }
+	for nz := low[2]; nz <= high[2]; nz++ {
+		for ny := low[1]; ny <= high[1]; ny++ {
+			for nx := low[0]; nx <= high[0]; nx++ {
+				off := [3]float64{
+					float64(nx) * L, float64(ny) * L, float64(nz) * L,
+				}
+
+				// Radial check.
+				near2, far2, center := 0.0, 0.0, [3]float64{ }
+				for k := 0; k < 3; k++ {
+					lo := origin[k] + off[k] - man.observer[k]
+					hi := lo + width[k]
+					if lo > 0 {
+						near2 += lo*lo
+					} else if hi < 0 {
+						near2 += hi*hi
+					}
+					far2 += math.Max(lo*lo, hi*hi)
+					center[k] = (lo + hi) / 2
+				}
+				if near2 > shell.RMax*shell.RMax ||
+					far2 < shell.RMin*shell.RMin {
+					continue
+				}
+
+				// Angular check.
+				dist := math.Sqrt(
+					center[0]*center[0] + center[1]*center[1] +
+						center[2]*center[2],
+				)
+				if dist > halfDiag {
+					angle := math.Acos(center[man.axis] / dist)
+					if angle > coneAngle + math.Asin(halfDiag / dist) {
+						continue
+					}
+				}
+
+				reps = append(reps, off)
+			}
+		}
+	}
+
+	return reps
+}
+
+// workerRender is a worker function which adds a subset of the tetrahedra
+// in the currently loaded segment to the worker's map.
+func (man *LightConeManager) workerRender(
+	id int, shell *LightConeShell, reps [][3]float64,
+) {
+	L := float32(man.hd.TotalWidth)
+	m, vecBuf, gen := man.maps[id], man.vecBufs[id], man.gens[id]
+	weight := lagrangianWeight(&man.hd, man.skip, len(vecBuf))
+	tet, idxBuf := geom.Tetra{ }, geom.TetraIdxs{ }
+	origin := man.hd.Origin
+
+	forCubes(&man.hd, man.skip, id, man.workers, func(idx, _, _, _ int) {
+		for dir := 0; dir < geom.TetraDirCount; dir++ {
+			idxBuf.Init(int64(idx), man.hd.GridWidth, int64(man.skip), dir)
+			tet.Init(
+				&man.xs[idxBuf[0]], &man.xs[idxBuf[1]],
+				&man.xs[idxBuf[2]], &man.xs[idxBuf[3]],
+			)
+			periodizeTetra(&tet, L)
+
+			bufIdx := gen.UniformInt(0, len(man.unitBufs))
+			tet.DistributeTetra(man.unitBufs[bufIdx], vecBuf)
+
+			// Put points in the same periodic image as the segment.
+			for i := range vecBuf {
+				for k := 0; k < 3; k++ {
+					if vecBuf[i][k] < origin[k] {
+						vecBuf[i][k] += L
+					} else if vecBuf[i][k] >= origin[k] + L {
+						vecBuf[i][k] -= L
+					}
+				}
+			}
+
+			man.addPoints(vecBuf, reps, shell, weight, m)
+		}
+	})
+}
+
+// addPoints adds each point in each periodic replica to the map if it lies
+// within the shell and the cone.
+func (man *LightConeManager) addPoints(
+	pts []geom.Vec, reps [][3]float64, shell *LightConeShell,
+	weight float64, m []float64,
+) {
+	rMin2, rMax2 := shell.RMin*shell.RMin, shell.RMax*shell.RMax
+	dTheta := 2 * man.halfAngle / float64(man.pixels)
+
+	for _, off := range reps {
+		for _, pt := range pts {
+			d := [3]float64{ }
+			r2 := 0.0
+			for k := 0; k < 3; k++ {
+				d[k] = float64(pt[k]) + off[k] - man.observer[k]
+				r2 += d[k]*d[k]
+			}
+
+			dk := d[man.axis]
+			if dk <= 0 || r2 < rMin2 || r2 >= rMax2 { continue }
+
+			ti := math.Atan(d[man.iDim] / dk) + man.halfAngle
+			tj := math.Atan(d[man.jDim] / dk) + man.halfAngle
+			if ti < 0 || tj < 0 { continue }
+			i, j := int(ti / dTheta), int(tj / dTheta)
+			if i >= man.pixels || j >= man.pixels { continue }
+
+			m[i + j*man.pixels] += weight
+		}
+	}
+}
+
+// Map returns the rendered map in units of the mean density: the mass in
+// each pixel divided by the mass that pixel would contain in a uniform
+// universe between rMin and rMax.
+func (man *LightConeManager) Map(rMin, rMax float64) []float32 {
+	shellVol := (rMax*rMax*rMax - rMin*rMin*rMin) / 3
+
+	dTheta := 2 * man.halfAngle / float64(man.pixels)
+	out := make([]float32, man.pixels * man.pixels)
+	for j := 0; j < man.pixels; j++ {
+		for i := 0; i < man.pixels; i++ {
+			idx := i + j*man.pixels
+			sum := 0.0
+			for w := range man.maps { sum += man.maps[w][idx] }
+
+			t0 := -man.halfAngle + float64(i) * dTheta
+			u0 := -man.halfAngle + float64(j) * dTheta
+			omega := pixelSolidAngle(t0, t0 + dTheta, u0, u0 + dTheta)
+			out[idx] = float32(sum / (omega * shellVol))
+		}
+	}
+	return out
+}
+
+// pixelSolidAngle returns the solid angle of a pixel which spans [t0, t1)
+// and [u0, u1), where t and u are the angles between the line of sight and
+// the projections of a direction onto the two planes containing the line of
+// sight and one of the map axes.
+func pixelSolidAngle(t0, t1, u0, u1 float64) float64 {
+	x0, x1 := math.Tan(t0), math.Tan(t1)
+	y0, y1 := math.Tan(u0), math.Tan(u1)
+	f := func(x, y float64) float64 {
+		return math.Atan(x*y / math.Sqrt(1 + x*x + y*y))
+	}
+	return f(x1, y1) - f(x0, y1) - f(x1, y0) + f(x0, y0)
+}
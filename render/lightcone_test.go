@@ -0,0 +1,171 @@
+package render
+
+import (
+	"math"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/cosmo"
+	"github.com/phil-mansfield/gotetra/math/rand"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+func TestPixelSolidAngle(t *testing.T) {
+	for _, deg := range []float64{ 1, 10, 60, 120 } {
+		half := deg / 2 * math.Pi / 180
+		pixels := 50
+		dTheta := 2 * half / float64(pixels)
+
+		sum := 0.0
+		for j := 0; j < pixels; j++ {
+			for i := 0; i < pixels; i++ {
+				t0 := -half + float64(i) * dTheta
+				u0 := -half + float64(j) * dTheta
+				sum += pixelSolidAngle(t0, t0 + dTheta, u0, u0 + dTheta)
+			}
+		}
+
+		// The solid angle of a right rectangular pyramid.
+		omega := 4 * math.Asin(math.Sin(half) * math.Sin(half))
+		if math.Abs(sum / omega - 1) > 1e-10 {
+			t.Errorf("Pixels in a %g degree map have a total solid angle " +
+				"of %g, expected %g.", deg, sum, omega)
+		}
+	}
+}
+
+func TestLightConeShells(t *testing.T) {
+	omegaM, omegaL := 0.27, 0.73
+	zs := []float64{ 1.0, 0.0, 3.0, 0.5, 2.0 }
+	files := [][]string{ { "z1.0" }, { "z0.0" }, { "z3.0" }, { "z0.5" }, { "z2.0" } }
+	zMin, zMax := 0.1, 1.5
+
+	shells := LightConeShells(files, zs, omegaM, omegaL, zMin, zMax)
+	// z = 3 is entirely outside the range.
+	if len(shells) != 4 { t.Fatalf("Expected 4 shells, got %d.", len(shells)) }
+
+	dMin := cosmo.ComovingDistance(omegaM, omegaL, zMin)
+	dMax := cosmo.ComovingDistance(omegaM, omegaL, zMax)
+	if shells[0].RMin != dMin || shells[len(shells) - 1].RMax != dMax {
+		t.Errorf("Shells span [%g, %g), expected [%g, %g).", shells[0].RMin,
+			shells[len(shells) - 1].RMax, dMin, dMax)
+	}
+
+	for i := range shells {
+		s := &shells[i]
+		if len(s.Files) != 1 || s.Files[0] != fmtZ(s.Z) {
+			t.Errorf("Shell %d at z = %g has files %v.", i, s.Z, s.Files)
+		}
+		if s.RMin >= s.RMax {
+			t.Errorf("Shell %d has edges %g >= %g.", i, s.RMin, s.RMax)
+		}
+		if i == 0 { continue }
+		if s.Z <= shells[i - 1].Z {
+			t.Errorf("Shell %d has z = %g after z = %g.",
+				i, s.Z, shells[i - 1].Z)
+		}
+		if s.RMin != shells[i - 1].RMax {
+			t.Errorf("Shell %d starts at %g, but shell %d ends at %g.",
+				i, s.RMin, i - 1, shells[i - 1].RMax)
+		}
+	}
+}
+
+func fmtZ(z float64) string {
+	return map[float64]string{
+		0: "z0.0", 0.5: "z0.5", 1: "z1.0", 2: "z2.0", 3: "z3.0",
+	}[z]
+}
+
+func TestLightConeReplicas(t *testing.T) {
+	L := 100.0
+	hd := &io.SheetHeader{ TotalWidth: L }
+	hd.Origin, hd.Width = [3]float32{ 50, 0, 25 }, [3]float32{ 25, 25, 25 }
+
+	table := []struct {
+		observer [3]float64
+		axis int
+		angle, rMin, rMax float64
+	}{
+		{ [3]float64{ 60, 10, 10 }, 2, 40, 0, 40 },
+		{ [3]float64{ 60, 10, 10 }, 2, 20, 120, 180 },
+		{ [3]float64{ 30, 60, 10 }, 0, 30, 200, 250 },
+		{ [3]float64{ 30, 60, 10 }, 1, 90, 50, 150 },
+	}
+
+	gen := rand.New(rand.Tausworthe, 1)
+	for i := range table {
+		man := &LightConeManager{
+			observer: table[i].observer,
+			axis: table[i].axis,
+			halfAngle: table[i].angle / 2 * math.Pi / 180,
+		}
+		man.iDim, man.jDim = 0, 1
+		if man.axis == 0 { man.iDim, man.jDim = 1, 2 }
+		if man.axis == 1 { man.iDim, man.jDim = 0, 2 }
+		shell := &LightConeShell{ RMin: table[i].rMin, RMax: table[i].rMax }
+
+		reps := man.replicas(hd, shell)
+		found := map[[3]float64]bool{ }
+		for _, off := range reps { found[off] = true }
+
+		// Every replica containing a point in the shell and cone must be
+		// returned.
+		n := int(math.Ceil(shell.RMax / L)) + 1
+		hits := 0
+		for p := 0; p < 2000; p++ {
+			pt := [3]float64{ }
+			for k := 0; k < 3; k++ {
+				pt[k] = float64(hd.Origin[k]) +
+					gen.Uniform(0, float64(hd.Width[k]))
+			}
+
+			for nz := -n; nz <= n; nz++ {
+				for ny := -n; ny <= n; ny++ {
+					for nx := -n; nx <= n; nx++ {
+						off := [3]float64{
+							float64(nx) * L, float64(ny) * L, float64(nz) * L,
+						}
+						if !man.inCone(pt, off, shell) { continue }
+						hits++
+						if !found[off] {
+							t.Fatalf("%d) Replica %v contains %v, but isn't " +
+								"in %v.", i, off, pt, reps)
+						}
+					}
+				}
+			}
+		}
+		if hits == 0 { t.Errorf("%d) No points were in the cone.", i) }
+	}
+}
+
+// inCone returns true if the point pt in the periodic replica off is in the
+// shell and the cone of man.
+func (man *LightConeManager) inCone(
+	pt, off [3]float64, shell *LightConeShell,
+) bool {
+	d, r2 := [3]float64{ }, 0.0
+	for k := 0; k < 3; k++ {
+		d[k] = pt[k] + off[k] - man.observer[k]
+		r2 += d[k]*d[k]
+	}
+	dk := d[man.axis]
+	if dk <= 0 || r2 < shell.RMin*shell.RMin || r2 >= shell.RMax*shell.RMax {
+		return false
+	}
+	return math.Abs(math.Atan(d[man.iDim] / dk)) < man.halfAngle &&
+		math.Abs(math.Atan(d[man.jDim] / dk)) < man.halfAngle
+}
+
+func TestLightConeSubsample(t *testing.T) {
+	man := &LightConeManager{ skip: 1 }
+	man.hd.SegmentWidth = 8
+	for _, skip := range []int{ 0, 3, 16 } {
+		if err := man.Subsample(skip); err == nil {
+			t.Errorf("Expected an error for Subsample(%d).", skip)
+		}
+	}
+	if err := man.Subsample(4); err != nil || man.skip != 4 {
+		t.Errorf("Subsample(4) gave skip %d and error %v.", man.skip, err)
+	}
+}
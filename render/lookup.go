@@ -0,0 +1,122 @@
+package render
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/phil-mansfield/gotetra/math/interpolate"
+	"github.com/phil-mansfield/gotetra/render/geom"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// GridInterpolations lists the methods which can be used to look up values
+// on a grid. CIC and TriLinear are the same interpolation: the values of the
+// eight cells surrounding a point are weighted by their overlap with a cloud
+// the size of one cell.
+var GridInterpolations = []string{ "NGP", "CIC", "TriLinear" }
+
+// gridLookup finds the values of a scalar grid at arbitrary points within a
+// periodic box.
+type gridLookup struct {
+	hd *io.GridHeader
+	grid []float64
+	// tri interpolates over the centers of the cells of grid, padded by one
+	// cell on each side. It is nil for nearest grid point lookups.
+	tri *interpolate.TriLinear
+}
+
+// newGridLookup creates a gridLookup which uses the given interpolation
+// method.
+func newGridLookup(
+	hd *io.GridHeader, grid []float64, method string,
+) (*gridLookup, error) {
+	g := &gridLookup{ hd: hd, grid: grid }
+
+	switch strings.ToLower(method) {
+	case "ngp":
+		return g, nil
+	case "cic", "trilinear":
+	default:
+		return nil, fmt.Errorf(
+			"Unrecognized grid interpolation '%s'. Only recognized methods " +
+				"are %s.", method, strings.Join(GridInterpolations, ", "),
+		)
+	}
+
+	n, pw := [3]int{ }, hd.Loc.PixelWidth
+	for k := 0; k < 3; k++ { n[k] = int(hd.Loc.PixelSpan[k]) + 2 }
+	g.tri = interpolate.NewUniformTriLinear(
+		hd.Loc.Origin[0] - pw/2, pw, n[0],
+		hd.Loc.Origin[1] - pw/2, pw, n[1],
+		hd.Loc.Origin[2] - pw/2, pw, n[2],
+		g.padded(), binary.LittleEndian,
+	)
+	return g, nil
+}
+
+// padded returns a copy of the grid with one extra cell on each side. The
+// extra cells are copied from the other side of the grid along axes which
+// span the entire simulation box and from the nearest edge otherwise.
+func (g *gridLookup) padded() []float64 {
+	span := [3]int{ }
+	periodic := [3]bool{ }
+	for k := 0; k < 3; k++ {
+		span[k] = int(g.hd.Loc.PixelSpan[k])
+		width := float64(span[k]) * g.hd.Loc.PixelWidth
+		periodic[k] = width >= g.hd.Cosmo.BoxWidth - g.hd.Loc.PixelWidth/2
+	}
+
+	// source returns the index of the unpadded cell which the padded cell i
+	// is copied from along axis k.
+	source := func(i, k int) int {
+		i--
+		if i < 0 {
+			if periodic[k] { return span[k] - 1 }
+			return 0
+		} else if i >= span[k] {
+			if periodic[k] { return 0 }
+			return span[k] - 1
+		}
+		return i
+	}
+
+	nx, ny, nz := span[0] + 2, span[1] + 2, span[2] + 2
+	out := make([]float64, nx*ny*nz)
+	for z := 0; z < nz; z++ {
+		sz := source(z, 2)
+		for y := 0; y < ny; y++ {
+			sy := source(y, 1)
+			for x := 0; x < nx; x++ {
+				sx := source(x, 0)
+				out[x + y*nx + z*nx*ny] =
+					g.grid[sx + sy*span[0] + sz*span[0]*span[1]]
+			}
+		}
+	}
+	return out
+}
+
+// Value returns the value of the grid at vec. ok is false if vec is outside
+// the grid.
+func (g *gridLookup) Value(vec geom.Vec) (val float64, ok bool) {
+	if g.tri == nil {
+		idx := gridIndex(g.hd, vec)
+		if idx < 0 { return 0, false }
+		return g.grid[idx], true
+	}
+
+	// Move vec into the same periodic image as the grid.
+	pos := [3]float64{ }
+	L := g.hd.Cosmo.BoxWidth
+	for k := 0; k < 3; k++ {
+		delta := float64(vec[k]) - g.hd.Loc.Origin[k]
+		if delta < 0 { delta += L }
+		if delta >= g.hd.Loc.Span[k] { delta -= L }
+
+		if delta < 0 || delta >= g.hd.Loc.Span[k] { return 0, false }
+		pos[k] = g.hd.Loc.Origin[k] + delta
+	}
+
+	return g.tri.Eval(pos[0], pos[1], pos[2]), true
+}
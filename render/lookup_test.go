@@ -0,0 +1,89 @@
+package render
+
+import (
+	"math"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/render/geom"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// lookupGrid creates a grid with one-unit pixels in a box of width 8 whose
+// values are x + 10*y + 100*z, where (x, y, z) is the index of each cell.
+func lookupGrid(origin, span [3]int) (*io.GridHeader, []float64) {
+	hd := &io.GridHeader{ }
+	hd.Cosmo = io.NewCosmoInfo(70, 0.27, 0.73, 0, 8)
+	hd.Render.ProjectionAxis = -1
+	hd.Loc = io.NewLocationInfo(origin, span, 1)
+
+	grid := make([]float64, span[0]*span[1]*span[2])
+	for z := 0; z < span[2]; z++ {
+		for y := 0; y < span[1]; y++ {
+			for x := 0; x < span[0]; x++ {
+				grid[x + y*span[0] + z*span[0]*span[1]] =
+					float64(x + 10*y + 100*z)
+			}
+		}
+	}
+	return hd, grid
+}
+
+func TestGridLookupWrap(t *testing.T) {
+	hd, grid := lookupGrid([3]int{ 0, 0, 0 }, [3]int{ 8, 8, 8 })
+	g, err := newGridLookup(hd, grid, "CIC")
+	if err != nil { t.Fatal(err.Error()) }
+
+	// Points near each edge are interpolated with the cells on the other
+	// side of the box.
+	table := []struct {
+		v geom.Vec
+		val float64
+	}{
+		{ geom.Vec{ 3.5, 2.5, 1.5 }, 3 + 20 + 100 },
+		{ geom.Vec{ 0.1, 2.5, 1.5 }, 0.4*7 + 0.6*0 + 20 + 100 },
+		{ geom.Vec{ 7.9, 2.5, 1.5 }, 0.6*7 + 0.4*0 + 20 + 100 },
+		{ geom.Vec{ 3.5, 0.25, 1.5 }, 3 + 0.25*70 + 0.75*0 + 100 },
+		{ geom.Vec{ 3.5, 7.75, 1.5 }, 3 + 0.75*70 + 0.25*0 + 100 },
+		{ geom.Vec{ 3.5, 2.5, 0.3 }, 3 + 20 + 0.2*700 + 0.8*0 },
+		{ geom.Vec{ 3.5, 2.5, 7.7 }, 3 + 20 + 0.8*700 + 0.2*0 },
+	}
+
+	for i := range table {
+		val, ok := g.Value(table[i].v)
+		if !ok || math.Abs(val - table[i].val) > 1e-3 {
+			t.Errorf("%d) Value(%v) = %g, %v, expected %g, true.",
+				i, table[i].v, val, ok, table[i].val)
+		}
+	}
+}
+
+func TestGridLookupClamp(t *testing.T) {
+	hd, grid := lookupGrid([3]int{ 2, 3, 1 }, [3]int{ 4, 3, 5 })
+	g, err := newGridLookup(hd, grid, "CIC")
+	if err != nil { t.Fatal(err.Error()) }
+
+	// Points near the edges of a sub-box only use the nearest edge cells.
+	table := []struct {
+		v geom.Vec
+		val float64
+		ok bool
+	}{
+		{ geom.Vec{ 3.5, 4.5, 2.5 }, 1 + 10 + 100, true },
+		{ geom.Vec{ 2.1, 4.5, 2.5 }, 0 + 10 + 100, true },
+		{ geom.Vec{ 5.9, 4.5, 2.5 }, 3 + 10 + 100, true },
+		{ geom.Vec{ 3.5, 3.1, 2.5 }, 1 + 0 + 100, true },
+		{ geom.Vec{ 3.5, 5.9, 2.5 }, 1 + 20 + 100, true },
+		{ geom.Vec{ 3.5, 4.5, 1.1 }, 1 + 10 + 0, true },
+		{ geom.Vec{ 3.5, 4.5, 5.9 }, 1 + 10 + 400, true },
+		{ geom.Vec{ 1.9, 4.5, 2.5 }, 0, false },
+		{ geom.Vec{ 6.1, 4.5, 2.5 }, 0, false },
+	}
+
+	for i := range table {
+		val, ok := g.Value(table[i].v)
+		if ok != table[i].ok || math.Abs(val - table[i].val) > 1e-3 {
+			t.Errorf("%d) Value(%v) = %g, %v, expected %g, %v.",
+				i, table[i].v, val, ok, table[i].val, table[i].ok)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/phil-mansfield/gotetra/render"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// command is a gotetra subcommand, e.g. "gotetra render render.cfg box.cfg".
+type command struct {
+	usage, description string
+	// run parses the arguments which follow the name of the command.
+	run func(fs *flag.FlagSet, args []string)
+}
+
+var commands = map[string]*command{
+	"convert": {
+		"convert [flags] convert.cfg",
+		"Converts particle snapshots to gotetra sheet files.",
+		convertCommand,
+	},
+	"render": {
+		"render [flags] render.cfg bounds.cfg ...",
+		"Renders the boxes in the bounds files.",
+		renderCommand,
+	},
+	"hist": {
+		"hist [flags] hist.cfg bounds.cfg ...",
+		"Prints histograms of the properties of tetrahedra in the bounds " +
+			"files.",
+		histCommand,
+	},
+	"profile": {
+		"profile [flags] profile.cfg bounds.cfg ...",
+		"Computes radial density and velocity profiles around the Balls " +
+			"and halos in the bounds files.",
+		profileCommand,
+	},
+	"splashback": {
+		"splashback [flags] splashback.cfg bounds.cfg ...",
+		"Finds the splashback radii of the Balls and halos in the bounds " +
+			"files.",
+		splashbackCommand,
+	},
+	"lightcone": {
+		"lightcone [flags] light_cone.cfg",
+		"Renders an angular map of a light cone from multiple snapshots.",
+		lightConeCommand,
+	},
+	"inspect": {
+		"inspect file.gtet [Crop|Downsample|Stitch out.gtet ...]",
+		"Prints information about a .gtet file or writes a modified copy.",
+		inspectCommand,
+	},
+	"pyramid": {
+		"pyramid file.gtet [levels]",
+		"Writes a multi-resolution pyramid of a .gtet file.",
+		pyramidCommand,
+	},
+	"check": {
+		"check config.cfg [bounds.cfg ...]",
+		"Checks config and bounds files for errors without running anything.",
+		checkCommand,
+	},
+	"example": {
+		"example " + strings.Join(io.ConfigSections(), "|"),
+		"Prints an example config file of the given type.",
+		exampleCommand,
+	},
+	"describe": {
+		"describe " + strings.Join(io.ConfigSections(), "|"),
+		"Prints a reference for every variable in the given type of config " +
+			"file.",
+		describeCommand,
+	},
+}
+
+// isSubcommand returns true if the command line arguments start with the
+// name of a subcommand rather than one of the original mode flags.
+func isSubcommand(args []string) bool {
+	return len(args) > 0 && !strings.HasPrefix(args[0], "-")
+}
+
+// findCommand returns the subcommand with the given name.
+func findCommand(name string) (*command, error) {
+	cmd, ok := commands[name]
+	if !ok { return nil, fmt.Errorf("Unrecognized command '%s'.", name) }
+	return cmd, nil
+}
+
+// subcommandMain runs the subcommand named by args[0].
+func subcommandMain(args []string) {
+	name := args[0]
+	cmd, err := findCommand(name)
+	if err != nil {
+		commandsUsage()
+		log.Fatal(err.Error())
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gotetra %s\n\n%s\n\nFlags:\n",
+			cmd.usage, cmd.description)
+		fs.PrintDefaults()
+	}
+	cmd.run(fs, args[1:])
+}
+
+// commandsUsage prints the list of subcommands.
+func commandsUsage() {
+	names := []string{ }
+	for name := range commands { names = append(names, name) }
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: gotetra <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "    %-10s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun 'gotetra <command> -help' for the " +
+		"flags of each command. Every variable in a command's config file " +
+		"can be overridden with a flag of the same name.")
+}
+
+// threadsFlag adds the -Threads flag to fs.
+func threadsFlag(fs *flag.FlagSet) {
+	fs.IntVar(
+		&render.NumCores, "Threads", runtime.NumCPU(),
+		"Number of threads used. Default is the number of logical cores.",
+	)
+}
+
+// parseArgs parses the flags in args and checks that there are at least min
+// positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, min int) []string {
+	fs.Parse(args)
+	if fs.NArg() < min {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+func convertCommand(fs *flag.FlagSet, args []string) {
+	threadsFlag(fs)
+	over := configFlags(fs, &io.ConvertSnapshotConfig{ })
+	args = parseArgs(fs, args, 1)
+	if len(args) > 1 { log.Fatal("convert takes a single config file.") }
+	runConvertSnapshot(args[0], over)
+}
+
+func renderCommand(fs *flag.FlagSet, args []string) {
+	threadsFlag(fs)
+	dryRun := fs.Bool(
+		"DryRun", false, "Prints the estimated memory and time needed " +
+			"without rendering anything.",
+	)
+	resume := fs.Bool(
+		"Resume", false, "Resumes an interrupted run from the checkpoints " +
+			"given by CheckpointFile.",
+	)
+	over := configFlags(fs, &io.RenderConfig{ })
+	args = parseArgs(fs, args, 1)
+	runRender(args[0], args[1:], over, *dryRun, *resume)
+}
+
+func histCommand(fs *flag.FlagSet, args []string) {
+	threadsFlag(fs)
+	over := configFlags(fs, &io.TetraHistConfig{ })
+	args = parseArgs(fs, args, 1)
+	runTetraHist(args[0], args[1:], over)
+}
+
+func profileCommand(fs *flag.FlagSet, args []string) {
+	threadsFlag(fs)
+	over := configFlags(fs, &io.ProfileConfig{ })
+	args = parseArgs(fs, args, 1)
+	runProfile(args[0], args[1:], over)
+}
+
+func splashbackCommand(fs *flag.FlagSet, args []string) {
+	threadsFlag(fs)
+	over := configFlags(fs, &io.SplashbackConfig{ })
+	args = parseArgs(fs, args, 1)
+	runSplashback(args[0], args[1:], over)
+}
+
+func lightConeCommand(fs *flag.FlagSet, args []string) {
+	threadsFlag(fs)
+	over := configFlags(fs, &io.LightConeConfig{ })
+	args = parseArgs(fs, args, 1)
+	if len(args) > 1 { log.Fatal("lightcone takes a single config file.") }
+	runLightCone(args[0], over)
+}
+
+func inspectCommand(fs *flag.FlagSet, args []string) {
+	args = parseArgs(fs, args, 1)
+	inspectMain(args[0], args[1:])
+}
+
+func pyramidCommand(fs *flag.FlagSet, args []string) {
+	args = parseArgs(fs, args, 1)
+	runPyramid(args[0], args[1:])
+}
+
+func checkCommand(fs *flag.FlagSet, args []string) {
+	args = parseArgs(fs, args, 1)
+	checkMain(args[0], args[1:])
+}
+
+func exampleCommand(fs *flag.FlagSet, args []string) {
+	args = parseArgs(fs, args, 1)
+	if len(args) > 1 { log.Fatal("example takes a single config type.") }
+	exampleMain(args[0])
+}
+
+func describeCommand(fs *flag.FlagSet, args []string) {
+	args = parseArgs(fs, args, 1)
+	if len(args) > 1 { log.Fatal("describe takes a single config type.") }
+	describeMain(args[0])
+}
+
+// configOverrides contains config variables set by command line flags.
+type configOverrides struct {
+	vals map[string][]string
+}
+
+// overrideFlag is a flag.Value which records the values given for a single
+// config variable.
+type overrideFlag struct {
+	over *configOverrides
+	name string
+	isBool bool
+}
+
+func (f *overrideFlag) String() string { return "" }
+func (f *overrideFlag) IsBoolFlag() bool { return f.isBool }
+
+func (f *overrideFlag) Set(val string) error {
+	f.over.vals[f.name] = append(f.over.vals[f.name], val)
+	return nil
+}
+
+// configFlags adds a flag to fs for each variable in the config struct
+// pointed to by con. The returned configOverrides records the flags which
+// are set.
+func configFlags(fs *flag.FlagSet, con interface{}) *configOverrides {
+	over := &configOverrides{ vals: map[string][]string{ } }
+	for _, field := range configFields(reflect.TypeOf(con).Elem()) {
+		usage := fmt.Sprintf(
+			"Overrides the config variable '%s'.", field.Name,
+		)
+		if doc := field.Tag.Get("doc"); doc != "" && doc != "-" {
+			usage += " " + doc
+		}
+		if field.Type.Kind() == reflect.Slice {
+			usage += " May be given multiple times."
+		}
+		fs.Var(&overrideFlag{
+			over, field.Name, field.Type.Kind() == reflect.Bool,
+		}, field.Name, usage)
+	}
+	return over
+}
+
+// configFields returns the fields of a config struct, including the fields
+// of embedded structs.
+func configFields(t reflect.Type) []reflect.StructField {
+	fields := []reflect.StructField{ }
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(field.Type)...)
+		} else if field.PkgPath == "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Apply sets the overridden variables in the config struct pointed to by
+// con. It does nothing if over is nil.
+func (over *configOverrides) Apply(con interface{}) error {
+	if over == nil { return nil }
+
+	v := reflect.ValueOf(con).Elem()
+	for name, vals := range over.vals {
+		field := v.FieldByName(name)
+		if field.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(field.Type(), len(vals), len(vals))
+			for i, val := range vals {
+				if err := setValue(slice.Index(i), name, val); err != nil {
+					return err
+				}
+			}
+			field.Set(slice)
+		} else {
+			err := setValue(field, name, vals[len(vals) - 1])
+			if err != nil { return err }
+		}
+	}
+	return nil
+}
+
+// setValue parses val and stores it in v.
+func setValue(v reflect.Value, name, val string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(val)
+	case reflect.Int, reflect.Int64:
+		x, err := strconv.ParseInt(val, 10, 64)
+		if err != nil { return flagError(name, val, "an integer") }
+		v.SetInt(x)
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(val, 64)
+		if err != nil { return flagError(name, val, "a number") }
+		v.SetFloat(x)
+	case reflect.Bool:
+		x, err := strconv.ParseBool(val)
+		if err != nil { return flagError(name, val, "true or false") }
+		v.SetBool(x)
+	default:
+		return fmt.Errorf("The flag -%s cannot be set from the command line.", name)
+	}
+	return nil
+}
+
+func flagError(name, val, expected string) error {
+	return fmt.Errorf(
+		"The flag -%s must be %s, but is '%s'.", name, expected, val,
+	)
+}
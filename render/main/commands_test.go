@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+func TestConfigFlags(t *testing.T) {
+	render := func() *io.RenderConfig {
+		con := &io.DefaultRenderWrapper().Render
+		con.Input, con.Quantity, con.Particles = "sheets", "Density", 50
+		return con
+	}
+	hist := func() *io.TetraHistConfig {
+		con := &io.DefaultTetraHistWrapper().TetraHist
+		con.Input, con.Quantity = "sheets", []string{ "Density" }
+		return con
+	}
+
+	table := []struct {
+		args []string
+		con, expected interface{}
+		// parseErr and applyErr are true if parsing the flags or applying
+		// them to con should fail.
+		parseErr, applyErr bool
+	}{
+		{ []string{ "render.cfg" }, render(), render(), false, false },
+		{
+			[]string{ "-SubsampleLength", "4", "-Quantity=Velocity",
+				"-AutoParticles", "render.cfg" },
+			render(), func() *io.RenderConfig {
+				con := render()
+				con.SubsampleLength, con.Quantity = 4, "Velocity"
+				con.AutoParticles = true
+				return con
+			}(), false, false,
+		},
+		// The last value of a repeated flag wins.
+		{
+			[]string{ "-Particles", "10", "-Particles", "20", "render.cfg" },
+			render(), func() *io.RenderConfig {
+				con := render()
+				con.Particles = 20
+				return con
+			}(), false, false,
+		},
+		// Slices are replaced by every value given, and variables of
+		// embedded structs can be set.
+		{
+			[]string{ "-Quantity", "Radius", "-Quantity", "RadialVelocity",
+				"-Input", "other", "hist.cfg" },
+			hist(), func() *io.TetraHistConfig {
+				con := hist()
+				con.Quantity = []string{ "Radius", "RadialVelocity" }
+				con.Input = "other"
+				return con
+			}(), false, false,
+		},
+		{
+			[]string{ "-SubsampleLength", "two", "render.cfg" },
+			render(), nil, false, true,
+		},
+		{
+			[]string{ "-HistBins", "many", "hist.cfg" },
+			hist(), nil, false, true,
+		},
+		{
+			[]string{ "-NotAVariable", "1", "render.cfg" },
+			render(), nil, true, false,
+		},
+		// Flags for one command aren't accepted by another.
+		{
+			[]string{ "-HistBins", "10", "render.cfg" },
+			render(), nil, true, false,
+		},
+	}
+
+	for i := range table {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		over := configFlags(fs, table[i].con)
+
+		err := fs.Parse(table[i].args)
+		if (err != nil) != table[i].parseErr {
+			t.Errorf("%d) Parsing %v gave error %v.", i, table[i].args, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if fs.NArg() != 1 {
+			t.Errorf("%d) Parsing %v left arguments %v.",
+				i, table[i].args, fs.Args())
+		}
+
+		err = over.Apply(table[i].con)
+		if (err != nil) != table[i].applyErr {
+			t.Errorf("%d) Applying %v gave error %v.", i, table[i].args, err)
+		} else if err == nil &&
+			!reflect.DeepEqual(table[i].con, table[i].expected) {
+			t.Errorf("%d) Applying %v gave %+v, expected %+v.",
+				i, table[i].args, table[i].con, table[i].expected)
+		}
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	for _, name := range []string{ "render", "hist", "describe" } {
+		if cmd, err := findCommand(name); err != nil || cmd == nil {
+			t.Errorf("Command '%s' wasn't found: %v.", name, err)
+		}
+	}
+	for _, name := range []string{ "Render", "-render", "renders", "" } {
+		if _, err := findCommand(name); err == nil {
+			t.Errorf("Unknown command '%s' was found.", name)
+		}
+	}
+}
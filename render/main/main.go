@@ -1,5 +1,6 @@
 package main
 import (
+	"context"
 	"flag"
 	"fmt"
 	"path"
@@ -11,12 +12,14 @@ import (
 	"runtime/pprof"
 	"os"
 	"io/ioutil"
+	"strconv"
 
 	"gopkg.in/gcfg.v1"
 
 	"github.com/phil-mansfield/gotetra/render"
 	"github.com/phil-mansfield/gotetra/render/density"
 	"github.com/phil-mansfield/gotetra/render/geom"
+	"github.com/phil-mansfield/gotetra/render/halo"
 	"github.com/phil-mansfield/gotetra/render/io"
 
 	"unsafe"
@@ -28,7 +31,18 @@ const (
 
 // FileGroup contains utility files for logging and writing profiles to.
 type FileGroup struct {
-	log, prof *os.File
+	log, prof, events *os.File
+	// el writes to events. It's nil if no EventFile was given.
+	el *render.EventLog
+}
+
+// openEvents opens the event log given by a config file's EventFile.
+func (fg *FileGroup) openEvents(con *io.SharedConfig) {
+	if !con.ValidEventFile() { return }
+	var err error
+	fg.events, err = os.Create(con.EventFile)
+	if err != nil { log.Fatal(err.Error()) }
+	fg.el = render.NewEventLog(fg.events)
 }
 
 // Close closes the files inside FileGroup.
@@ -43,6 +57,11 @@ func (fg *FileGroup) Close() {
 		err := fg.prof.Close()
 		if err != nil { log.Fatal(err.Error()) }
 	}
+
+	if fg.events != nil {
+		err := fg.events.Close()
+		if err != nil { log.Fatal(err.Error()) }
+	}
 }
 
 var (
@@ -56,21 +75,48 @@ func main() {
 	// user provides incorrect input. This takes a lot more code than you would
 	// think.
 
+	// New-style subcommands, e.g. "gotetra render render.cfg box.cfg", have
+	// their own flags. The original mode flags below are still supported.
+	if isSubcommand(os.Args[1:]) {
+		subcommandMain(os.Args[1:])
+		return
+	}
+
 	var (
-		renderStr, convertSnapshot, tetraHistStr string
-		exampleConfig string
+		renderStr, convertSnapshot, tetraHistStr, profileStr string
+		splashbackStr string
+		exampleConfig, inspectStr, pyramidStr, lightConeStr string
+		checkStr, describeStr string
+		dryRun, resume bool
 	)
 	vars := map[string]*string {
 		"Render": &renderStr,
 		"ConvertSnapshot": &convertSnapshot,
 		"ExampleConfig": &exampleConfig,
 		"TetraHist": &tetraHistStr,
+		"Profile": &profileStr,
+		"Splashback": &splashbackStr,
+		"Inspect": &inspectStr,
+		"Pyramid": &pyramidStr,
+		"LightCone": &lightConeStr,
+		"Check": &checkStr,
+		"DescribeConfig": &describeStr,
 	}
 
 	flag.IntVar(
 		&render.NumCores, "Threads", runtime.NumCPU(),
 		"Number of threads used. Default is the number of logical cores.",
 	)
+	flag.BoolVar(
+		&dryRun, "DryRun", false,
+		"Prints the estimated memory and time needed by [Render] mode " +
+			"without rendering anything.",
+	)
+	flag.BoolVar(
+		&resume, "Resume", false,
+		"Resumes an interrupted [Render] mode run from the checkpoints " +
+			"given by its CheckpointFile.",
+	)
 	flag.StringVar(
 		&renderStr, "Render", "",
 		"Configuration file for [Render] mode, along with at least one " + 
@@ -83,14 +129,53 @@ func main() {
 	flag.StringVar(
 		&exampleConfig,
 		"ExampleConfig", "", "Prints an example configuration file of the " + 
-			"specified type to stdout. Accepted arguments are 'Render', " +
-			"'ConvertSnapshot', and 'Bounds'.",
+			"specified type to stdout. Accepted arguments are " +
+			strings.Join(io.ConfigSections(), ", ") + ".",
+	)
+	flag.StringVar(
+		&describeStr, "DescribeConfig", "", "Prints the type, default " +
+			"value, and allowed values of every variable in the specified " +
+			"type of configuration file.",
 	)
 	flag.StringVar(
 		&tetraHistStr, "TetraHist", "", 
 		"Prints a histogram of the mass-weighted properties of tetrahedra " + 
 			"within a given bounding box.",
 	)
+	flag.StringVar(
+		&profileStr, "Profile", "",
+		"Configuration file for [Profile] mode, along with at least one " +
+			"Bounds file that gives the centers and radii of the profiles.",
+	)
+	flag.StringVar(
+		&splashbackStr, "Splashback", "",
+		"Configuration file for [Splashback] mode, along with at least one " +
+			"Bounds file that gives the halos whose splashback radii are " +
+			"found.",
+	)
+	flag.StringVar(
+		&inspectStr, "Inspect", "",
+		"Prints the header and summary statistics of a .gtet file. May be " +
+			"followed by one of the sub-commands 'Crop out.gtet x y z dx dy " +
+			"dz', 'Downsample out.gtet factor', or 'Stitch out.gtet " +
+			"tile.gtet ...'.",
+	)
+	flag.StringVar(
+		&pyramidStr, "Pyramid", "",
+		"Writes a multi-resolution pyramid of the given .gtet file, where " +
+			"each level is downsampled by a factor of two from the previous " +
+			"one. May be followed by the number of levels.",
+	)
+	flag.StringVar(
+		&lightConeStr, "LightCone", "",
+		"Configuration file for [LightCone] mode, which renders an " +
+			"angular map of a light cone from multiple snapshots.",
+	)
+	flag.StringVar(
+		&checkStr, "Check", "",
+		"Checks a configuration file, along with any bounds files that " +
+			"follow it, for errors without running anything.",
+	)
 	
 	flag.Parse()
 
@@ -99,121 +184,158 @@ func main() {
 	modeName, err := getModeName(vars)
 	if err != nil { log.Fatal(err.Error()) }
 	
-	// Based on the mode being run, do some basic input sanitization and 
-	// run the econdary main function.
+	// Based on the mode being run, run the secondary main function.
 	switch modeName {
 	case "Render":
-		wrap := io.DefaultRenderWrapper()
-		err := gcfg.ReadFileInto(wrap, renderStr)
+		runRender(renderStr, flag.Args(), nil, dryRun, resume)
+	case "TetraHist":
+		runTetraHist(tetraHistStr, flag.Args(), nil)
+	case "Profile":
+		runProfile(profileStr, flag.Args(), nil)
+	case "Splashback":
+		runSplashback(splashbackStr, flag.Args(), nil)
+	case "ConvertSnapshot":
+		runConvertSnapshot(convertSnapshot, nil)
+	case "Inspect":
+		inspectMain(inspectStr, flag.Args())
+	case "Pyramid":
+		runPyramid(pyramidStr, flag.Args())
+	case "LightCone":
+		runLightCone(lightConeStr, nil)
+	case "Check":
+		checkMain(checkStr, flag.Args())
+	case "ExampleConfig":
+		exampleMain(exampleConfig)
+	case "DescribeConfig":
+		describeMain(describeStr)
+	default:
+		panic("Impossible")
+	}
+}
 
-		if err != nil { log.Fatal(err.Error()) }
-		con := &wrap.Render
+// runRender reads and checks the config file and bounds files for [Render]
+// mode, applies any overrides, and renders them. The other run* functions
+// are the same for the other modes.
+func runRender(
+	file string, bounds []string, over *configOverrides, dryRun, resume bool,
+) {
+	wrap := io.DefaultRenderWrapper()
+	err := gcfg.ReadFileInto(wrap, file)
+	if err != nil { log.Fatal(err.Error()) }
+	con := &wrap.Render
+	if err = over.Apply(con); err != nil { log.Fatal(err.Error()) }
+	checkConfig(file, con.Validate())
 
-		if !con.ValidInput() {
-			log.Fatalf("Invalid/non-existent 'Input' value, %s.", con.Input)
-		} else if !con.ValidOutput() {
-			log.Fatalf("Invalid/non-existent 'Output' value, %s.", con.Output)
-		} else if !con.ValidSubsampleLength() {
-			log.Fatalf("Invalid 'SubsampleLength' value, %d.",
-				con.SubsampleLength)
-		}
+	if len(bounds) < 1 {
+		log.Fatal("Must supply at least one bounds file.")
+	}
+	for _, b := range bounds { checkConfig(b, io.ValidateBoundsFile(b)) }
+	if resume && !con.IsCheckpointed() {
+		log.Fatal("-Resume can only be used if CheckpointFile is set.")
+	}
+	renderMain(con, bounds, dryRun, resume)
+}
 
-		if !con.ValidImagePixels() && !con.ValidTotalPixels() {
-			log.Fatal(
-				"You must set either a valid 'ImagePixels' " + 
-					"or a valid 'TotalPixels'.",
-			)
-		} else if !con.ValidParticles() &&
-			!con.ValidProjectionDepth() &&
-			!con.AutoParticles {
-			log.Fatal(
-				"You must set either a valid 'Particles' or a valid " + 
-					"'ProjectionDepth' or must set 'AutoParticles' to " +
-					"true.",
-			)
-		}
+func runTetraHist(file string, bounds []string, over *configOverrides) {
+	wrap := io.DefaultTetraHistWrapper()
+	err := gcfg.ReadFileInto(wrap, file)
+	if err != nil { log.Fatal(err.Error()) }
+	con := &wrap.TetraHist
+	if err = over.Apply(con); err != nil { log.Fatal(err.Error()) }
+	checkConfig(file, con.Validate())
 
-		bounds := flag.Args()
-		if len(bounds) < 1 {
-			log.Fatal("Must supply at least one bounds file.")
-		}
-		renderMain(con, bounds)
+	if len(bounds) < 1 {
+		log.Fatal("Must supply at least one bounds file.")
+	}
+	for _, b := range bounds { checkConfig(b, io.ValidateBoundsFile(b)) }
 
-	case "TetraHist":
-		wrap := io.DefaultTetraHistWrapper()
-		err := gcfg.ReadFileInto(wrap, tetraHistStr)
-		if err != nil { log.Fatal(err.Error()) }
-		con := &wrap.TetraHist
-		
-		if !con.ValidInput() {
-			log.Fatalf("Invalid/non-existent 'Input' value, %s.", con.Input)
-		} else if !con.ValidOutput() {
-			log.Fatalf("Invalid/non-existent 'Output' value, %s.", con.Output)
-		} else if !con.ValidSubsampleLength() {
-			log.Fatalf("Invalid 'SubsampleLength' value, %d.",
-				con.SubsampleLength)
-		} else if !con.ValidHistScale() {
-			log.Fatalf("Invalid 'HistScale' value, %s.", con.HistScale)
-		} else if !con.ValidHistMin() || !con.ValidHistMax() {
-			log.Fatalf("Invalid ('HistMin', 'HistMax'), (%g, %g).",
-				con.HistMin, con.HistMax)
-		}
-
-		bounds := flag.Args()
-		if len(bounds) < 1 {
-			log.Fatal("Must supply at least one bounds file.")
-		}
-
-		tetraHistMain(con, bounds)
-	case "ConvertSnapshot":
-		wrap := io.DefaultConvertSnapshotWrapper()
-		err := gcfg.ReadFileInto(wrap, convertSnapshot)
-		if err != nil { log.Fatal(err.Error()) }
-		con := &wrap.ConvertSnapshot
+	tetraHistMain(con, bounds)
+}
 
-		if !con.ValidInput() && !con.ValidIteratedInput() {
-			log.Fatal("Invalid/non-existent 'Input' value.")
-		} else if !con.ValidOutput() && !con.ValidIteratedOutput() {
-			log.Fatal("Invalid/non-existent 'Output' value.")
-		} else if !con.ValidCells() {
-			log.Fatal("Invalid/non-existent 'Cells' value.")
-		} else if con.ValidIteratedInput() != con.ValidIteratedOutput() {
-			log.Fatal("Only one of IteratedInput and IteratedOutput is set.")
-		} else if !con.ValidGadget2IDSize() {
-			log.Fatal("Gadget2IDSize must be set to 32 or 64.")
-		}
+func runProfile(file string, bounds []string, over *configOverrides) {
+	wrap := io.DefaultProfileWrapper()
+	err := gcfg.ReadFileInto(wrap, file)
+	if err != nil { log.Fatal(err.Error()) }
+	con := &wrap.Profile
+	if err = over.Apply(con); err != nil { log.Fatal(err.Error()) }
+	checkConfig(file, con.Validate())
 
-		switch con.InputFormat {
-		case "LGadget-2":
-			lGadget2Main(con)
-		default:
-			log.Fatalf("Only LGadget-2 snapshots can be read at this time.")
-		}
+	if len(bounds) < 1 {
+		log.Fatal("Must supply at least one bounds file.")
+	}
+	for _, b := range bounds { checkConfig(b, io.ValidateBoundsFile(b)) }
 
-	case "ExampleConfig":
-		switch exampleConfig {
-		case "ConvertSnapshot":
-			fmt.Println(io.ExampleConvertSnapshotFile)
-		case "Render":
-			fmt.Println(io.ExampleRenderFile)
-		case "TetraHist":
-			fmt.Println(io.ExampleTetraHistFile)
-		case "Box":
-			fmt.Println(io.ExampleBoxFile)
-		case "Ball":
-			fmt.Println(io.ExampleBallFile)
-		default:
-			log.Fatal(
-				"Unrecognized 'ExampleConfig' argument. Only recognized " +
-					"arguments are 'Render', 'Box', 'Ball', 'TetraHist', " + 
-					"and 'ConvertSnapshot'.",
-			)
-		}
+	profileMain(con, bounds)
+}
+
+func runSplashback(file string, bounds []string, over *configOverrides) {
+	wrap := io.DefaultSplashbackWrapper()
+	err := gcfg.ReadFileInto(wrap, file)
+	if err != nil { log.Fatal(err.Error()) }
+	con := &wrap.Splashback
+	if err = over.Apply(con); err != nil { log.Fatal(err.Error()) }
+	checkConfig(file, con.Validate())
+
+	if len(bounds) < 1 {
+		log.Fatal("Must supply at least one bounds file.")
+	}
+	for _, b := range bounds { checkConfig(b, io.ValidateBoundsFile(b)) }
+
+	splashbackMain(con, bounds)
+}
+
+func runConvertSnapshot(file string, over *configOverrides) {
+	wrap := io.DefaultConvertSnapshotWrapper()
+	err := gcfg.ReadFileInto(wrap, file)
+	if err != nil { log.Fatal(err.Error()) }
+	con := &wrap.ConvertSnapshot
+	if err = over.Apply(con); err != nil { log.Fatal(err.Error()) }
+	checkConfig(file, con.Validate())
+
+	switch con.InputFormat {
+	case "LGadget-2":
+		lGadget2Main(con)
 	default:
-		panic("Impossible")
+		log.Fatalf("Only LGadget-2 snapshots can be read at this time.")
 	}
 }
 
+func runLightCone(file string, over *configOverrides) {
+	wrap := io.DefaultLightConeWrapper()
+	err := gcfg.ReadFileInto(wrap, file)
+	if err != nil { log.Fatal(err.Error()) }
+	con := &wrap.LightCone
+	if err = over.Apply(con); err != nil { log.Fatal(err.Error()) }
+	checkConfig(file, con.Validate())
+
+	lightConeMain(con)
+}
+
+func runPyramid(file string, args []string) {
+	levels := 0
+	if len(args) == 1 {
+		levels = parseInts(args)[0]
+	} else if len(args) > 1 {
+		log.Fatal("Pyramid takes at most one argument: levels.")
+	}
+	pyramidMain(file, levels)
+}
+
+// exampleMain prints an example config file of the given type.
+func exampleMain(name string) {
+	text, err := io.ExampleConfig(name)
+	if err != nil { log.Fatal(err.Error()) }
+	fmt.Println(text)
+}
+
+// describeMain prints a reference for every variable in the given type of
+// config file.
+func describeMain(name string) {
+	text, err := io.DescribeConfig(name)
+	if err != nil { log.Fatal(err.Error()) }
+	fmt.Println(text)
+}
+
 // getModeName returns the name of the mode and fails with a descriptive error 
 // if the user provided less or more than one mode flag.
 func getModeName(vars map[string]*string) (string, error) {
@@ -238,6 +360,122 @@ func getModeName(vars map[string]*string) (string, error) {
 	return setNames[0], nil
 }
 
+// checkConfig fails with every problem in errs, if there are any. fname is
+// the config file that errs came from.
+func checkConfig(fname string, errs []error) {
+	if len(errs) == 0 { return }
+	for _, err := range io.LocateErrors(fname, errs) {
+		log.Println(err.Error())
+	}
+	log.Fatalf("Found %d problem(s) in '%s'.", len(errs), fname)
+}
+
+// checkMain validates a config file and the bounds files which follow it
+// without rendering anything. If the config file has an Input directory,
+// the bounds files are also checked against the sheets in it.
+func checkMain(file string, bounds []string) {
+	section, err := io.ConfigSection(file)
+	if err != nil { log.Fatal(err.Error()) }
+
+	errs := []error{ }
+	input := ""
+	// renderCon is only set for [Render] files, whose boxes can override
+	// its settings.
+	var renderCon *io.RenderConfig
+	switch strings.ToLower(section) {
+	case "render":
+		wrap := io.DefaultRenderWrapper()
+		if err := gcfg.ReadFileInto(wrap, file); err != nil {
+			log.Fatal(err.Error())
+		}
+		errs, input = wrap.Render.Validate(), wrap.Render.Input
+		renderCon = &wrap.Render
+	case "tetrahist":
+		wrap := io.DefaultTetraHistWrapper()
+		if err := gcfg.ReadFileInto(wrap, file); err != nil {
+			log.Fatal(err.Error())
+		}
+		errs, input = wrap.TetraHist.Validate(), wrap.TetraHist.Input
+	case "profile":
+		wrap := io.DefaultProfileWrapper()
+		if err := gcfg.ReadFileInto(wrap, file); err != nil {
+			log.Fatal(err.Error())
+		}
+		errs, input = wrap.Profile.Validate(), wrap.Profile.Input
+	case "splashback":
+		wrap := io.DefaultSplashbackWrapper()
+		if err := gcfg.ReadFileInto(wrap, file); err != nil {
+			log.Fatal(err.Error())
+		}
+		errs, input = wrap.Splashback.Validate(), wrap.Splashback.Input
+	case "convertsnapshot":
+		wrap := io.DefaultConvertSnapshotWrapper()
+		if err := gcfg.ReadFileInto(wrap, file); err != nil {
+			log.Fatal(err.Error())
+		}
+		errs = wrap.ConvertSnapshot.Validate()
+	case "lightcone":
+		wrap := io.DefaultLightConeWrapper()
+		if err := gcfg.ReadFileInto(wrap, file); err != nil {
+			log.Fatal(err.Error())
+		}
+		errs = wrap.LightCone.Validate()
+	case "box", "ball", "catalog":
+		// The "config file" is actually a bounds file.
+		bounds = append([]string{ file }, bounds...)
+		file = ""
+	default:
+		log.Fatalf("Unrecognized config section, [%s].", section)
+	}
+
+	if file != "" { errs = io.LocateErrors(file, errs) }
+	for _, b := range bounds {
+		errs = append(errs, io.ValidateBoundsFile(b)...)
+	}
+
+	// Boxes can only be compared against the simulation once we know
+	// everything else is okay.
+	if len(errs) == 0 && input != "" && len(bounds) > 0 {
+		hd, err := inputHeader(input)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			for _, b := range bounds {
+				boxes, err := io.ReadBoundsConfig(
+					b, hd, halo.RockstarCatalog{ },
+				)
+				if err != nil {
+					errs = append(errs, err)
+				} else if renderCon != nil {
+					errs = append(errs, io.LocateErrors(
+						b, io.ValidateBoxOverrides(renderCon, boxes, hd),
+					)...)
+				}
+			}
+		}
+	}
+
+	for _, err := range errs { fmt.Println(err.Error()) }
+	if len(errs) > 0 {
+		log.Fatalf("Found %d problem(s).", len(errs))
+	}
+	fmt.Println("No problems found.")
+}
+
+// inputHeader reads the header of one of the sheet files in dir.
+func inputHeader(dir string) (*io.SheetHeader, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil { return nil, err }
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("Input directory '%s' is empty.", dir)
+	}
+
+	hd := &io.SheetHeader{}
+	err = io.ReadSheetHeaderAt(path.Join(dir, infos[0].Name()), hd)
+	if err != nil { return nil, err }
+	return hd, nil
+}
+
 // lGadget2Main converts a set of LGadget-2 snapshots to gotetra files
 // based on the input config file.
 func lGadget2Main(con *io.ConvertSnapshotConfig) {
@@ -246,6 +484,10 @@ func lGadget2Main(con *io.ConvertSnapshotConfig) {
 		con.IterationEnd = 0
 	}
 
+	fg := new(FileGroup)
+	fg.openEvents(&con.SharedConfig)
+	defer fg.Close()
+
 	// If the user supplied format strings for iterated output, loop over the
 	// iteration range. Otherwise, just use the supplied snapshot.
 	for i := con.IterationStart; i <= con.IterationEnd; i++ {
@@ -263,22 +505,31 @@ func lGadget2Main(con *io.ConvertSnapshotConfig) {
 			files[i] = path.Join(input, info.Name())
 		}
 
+		fg.el.Emit("snapshot_start", render.Event{
+			"input": input, "output": output, "iteration": i,
+			"files": len(files),
+		})
+
 		// Part 1: read data into memory and put it into a single in-memory
 		// grid.
-		hd, xs, vs := createGrids(files, con.Gadget2IDSize)
+		hd, xs, vs := createGrids(files, con.Gadget2IDSize, fg.el)
 
 		if err = os.MkdirAll(output, 0777); err != nil {
 			log.Fatalf(err.Error())
 		}
 
 		// Part 2: write that grid into gtet files.
-		writeGrids(output, hd, con.Cells, xs, vs)
+		writeGrids(output, hd, con.Cells, xs, vs, fg.el)
+
+		fg.el.Emit("snapshot_finish", render.Event{
+			"input": input, "output": output, "iteration": i,
+		})
 	}
 }
 
 // createGrids reads reads snapshot data into memory.
 func createGrids(
-	catalogs []string, idSize int,
+	catalogs []string, idSize int, el *render.EventLog,
 ) (hd *io.CatalogHeader, xs, vs []geom.Vec) {
 	hs := make([]io.CatalogHeader, len(catalogs))
 	for i := range hs {
@@ -318,6 +569,9 @@ func createGrids(
 			log.Printf("Read %d/%d catalogs", i, len(catalogs))
 		}
 
+		el.Emit("file_start", render.Event{
+			"file": cat, "index": i, "files": len(catalogs),
+		})
 		N := hs[i].Count
 
 		idBuf = idBuf[0: N]
@@ -330,6 +584,13 @@ func createGrids(
 
 		runtime.GC()
 		buf.Append(xBuf, vBuf, idBuf)
+
+		bytesRead := int64(0)
+		if info, err := os.Stat(cat); err == nil { bytesRead = info.Size() }
+		el.Emit("file_finish", render.Event{
+			"file": cat, "index": i, "files": len(catalogs),
+			"files_done": i + 1, "bytes_read": bytesRead,
+		})
 	}
 	buf.Flush()
 
@@ -351,7 +612,7 @@ func intCubeRoot(x int64) int64 {
 
 // writeGrids writes the in-memory grids to disk as gtet files.
 func writeGrids(outDir string, hd *io.CatalogHeader,
-	cells int, xs, vs []geom.Vec) {
+	cells int, xs, vs []geom.Vec, el *render.EventLog) {
 
 	log.Println("Writing to directory", outDir)
 
@@ -385,6 +646,12 @@ func writeGrids(outDir string, hd *io.CatalogHeader,
 				io.WriteSheet(file, shd, xsSeg, vsSeg)
 				runtime.GC()
 
+				el.Emit("segment_finish", render.Event{
+					"file": file, "index": shd.Idx,
+					"segments": shd.Cells * shd.Cells * shd.Cells,
+					"bytes_written": 2 * 12 * shd.GridCount,
+				})
+
 				if shd.Idx % 25 == 0 {
 					log.Printf("Wrote %d/%d sheet segments.",
 						shd.Idx, shd.Cells * shd.Cells * shd.Cells,
@@ -513,73 +780,323 @@ func validCellNum(cells int) bool {
 }
 
 // renderMain is the main function for rendering density fields.
-func renderMain(con *io.RenderConfig, bounds []string) {
+func renderMain(
+	con *io.RenderConfig, bounds []string, dryRun, resume bool,
+) {
 	// Get the I/O essentials.
-	fileNames, hd, fg := densitySetupIO(con)
+	hd, fg := densitySetupIO(con)
 	defer fg.Close()
 
 	// Generate bounds files.
 	configBoxes := make([]io.BoxConfig, 0)
 	for _, boundsFile := range bounds {
-		boxes, err := io.ReadBoundsConfig(boundsFile, hd.TotalWidth)
+		boxes, err := io.ReadBoundsConfig(boundsFile, hd, halo.RockstarCatalog{ })
 		if err != nil { log.Fatal(err.Error()) }
+		checkConfig(boundsFile, io.ValidateBoxOverrides(con, boxes, hd))
 		configBoxes = append(configBoxes, boxes...)
 	}
 
-	// Figure out which quantity we're rendering.
-	q, ok := density.QuantityFromString(con.Quantity)
-	if !ok {
-		log.Fatalf("Invalid quantity, '%s'", con.Quantity)
+	// Boxes can override the settings in con.
+	specs := make([]render.BoxSpec, len(configBoxes))
+	for i, box := range configBoxes {
+		specs[i] = render.BoxSpec{
+			Name: box.Name, X: box.X, Y: box.Y, Z: box.Z,
+			XWidth: box.XWidth, YWidth: box.YWidth, ZWidth: box.ZWidth,
+			ProjectionAxis: box.ProjectionAxis,
+			Options: renderOptions(con.Override(&box.BoxRenderConfig)),
+		}
 	}
-	
-	// Figure out cell sizes, pixel sizes, and particle counts.
-	boxes := make([]render.Box, len(configBoxes))
-	for i := range boxes {
-		cells := totalPixels(con, &configBoxes[i], hd.TotalWidth)
-		pts := particles(con, &configBoxes[i], hd.TotalWidth)
-		boxes[i] = render.NewBox(
-			hd.TotalWidth, pts, cells, q, &configBoxes[i],
-		)
-		log.Println(
-			"Rendering to box:", boxes[i].CellSpan(),
-			"pixels,", pts, "particles per tetrahedron",
-		)
+
+	opts := renderOptions(con)
+	opts.TileWidth, opts.TilesPerPass = con.TileWidth, con.TilesPerPass
+	opts.MemoryLimitMB = con.MemoryLimitMB
+	opts.CheckpointFile = con.CheckpointFile
+	opts.CheckpointInterval = con.CheckpointInterval
+	opts.Resume = resume
+	opts.Events = fg.el
+	opts.Log = true
+
+	if dryRun {
+		rs, err := render.EstimateBoxes(con.Input, specs, *opts)
+		if err != nil { log.Fatal(err.Error()) }
+		printResources(con, rs)
+		return
 	}
 
-	// Interpolate.
-	man, err := render.NewManager(fileNames, boxes, true, q)
+	out := newRenderOutput(con, configBoxes, resume)
+	defer out.Close()
+	opts.Write = out.Write
+
+	_, err := render.RenderBoxes(context.Background(), con.Input, specs, *opts)
 	if err != nil { log.Fatal(err.Error()) }
-	man.Subsample(con.SubsampleLength)
-	err = man.RenderDensity() // This actually means "render quantity"
-	if err != nil { log.Fatalf(err.Error()) }
+}
 
-	// Write output.
-	for i, cBox := range configBoxes {
-		box := boxes[i]
+// renderOptions converts the render settings in con to render.Options.
+func renderOptions(con *io.RenderConfig) *render.Options {
+	q, ok := density.QuantityFromString(con.Quantity)
+	if !ok { log.Fatalf("Invalid quantity, '%s'", con.Quantity) }
+
+	return &render.Options{
+		Quantity: q,
+		TotalPixels: con.TotalPixels, ImagePixels: con.ImagePixels,
+		Particles: con.Particles, AutoParticles: con.AutoParticles,
+		ProjectionDepth: con.ProjectionDepth,
+		SubsampleLength: con.SubsampleLength,
+	}
+}
 
-		out := path.Join(con.Output, fmt.Sprintf("%s%s%s.gtet",
-			con.PrependName, cBox.Name, con.AppendName))
+// printResources prints the estimated resources needed by each pass. It
+// fails if the peak memory usage is larger than con.MemoryLimitMB.
+func printResources(con *io.RenderConfig, rs []*render.Resources) {
+	for i, r := range rs { fmt.Printf("Pass %d/%d: %s\n", i + 1, len(rs), r) }
+	peak, seconds := render.PeakResources(rs)
+	fmt.Printf(
+		"Estimated peak memory: %d MB, estimated time: ~%.1f hours\n",
+		peak >> 20, seconds / 3600,
+	)
 
-		log.Printf("Writing to %s", out)
-		f, err := os.Create(out)
-		defer f.Close()
-		if err != nil { log.Fatalf("Could not create %s.", out) }
-		
-		loc := io.NewLocationInfo(
-			box.CellOrigin(), box.CellSpan(), box.CellWidth(),
-		)
-		cos := io.NewCosmoInfo(
-			hd.Cosmo.H100 * 100, hd.Cosmo.OmegaM,
-			hd.Cosmo.OmegaL, hd.Cosmo.Z, hd.TotalWidth,
+	if con.MemoryLimitMB > 0 && peak > int64(con.MemoryLimitMB) << 20 {
+		log.Fatalf(
+			"Estimated peak memory, %d MB, is larger than MemoryLimitMB, " +
+				"%d MB. Try setting a smaller TileWidth or TilesPerPass.",
+			peak >> 20, con.MemoryLimitMB,
 		)
+	}
+}
 
-		renderInfo := io.NewRenderInfo(
-			con.Particles, con.TotalPixels, con.SubsampleLength,
-			cBox.ProjectionAxis,
-		)
+// renderOutput handles writing rendered boxes and tiles to disk.
+type renderOutput struct {
+	con *io.RenderConfig
+	configBoxes []io.BoxConfig
+
+	// Indexed by the parent box. remaining is the number of tiles which
+	// haven't been written yet.
+	remaining []int
+	writers []*io.TiledGridWriter
+	manifests []*os.File
+
+	// If resume is true, the output of an interrupted run is added to
+	// instead of being overwritten. manifestTiles contains the tiles already
+	// listed in each manifest.
+	resume bool
+	manifestTiles []map[string]bool
+}
+
+func newRenderOutput(
+	con *io.RenderConfig, configBoxes []io.BoxConfig, resume bool,
+) *renderOutput {
+	return &renderOutput{
+		con: con, configBoxes: configBoxes,
+		remaining: make([]int, len(configBoxes)),
+		writers: make([]*io.TiledGridWriter, len(configBoxes)),
+		manifests: make([]*os.File, len(configBoxes)),
+		resume: resume,
+		manifestTiles: make([]map[string]bool, len(configBoxes)),
+	}
+}
+
+// gtetName returns the name of the output file for a box.
+func (out *renderOutput) gtetName(name string) string {
+	return path.Join(out.con.Output, fmt.Sprintf("%s%s%s.gtet",
+		out.con.PrependName, name, out.con.AppendName))
+}
+
+// Write writes a rendered box or tile to disk.
+func (out *renderOutput) Write(res *render.Result) error {
+	if res.Tile == nil { return out.writeBox(res) }
 
-		io.WriteBuffer(box.Vals(), cos, renderInfo, loc, f)
+	if out.remaining[res.Index] == 0 { out.remaining[res.Index] = res.Tiles }
+	var err error
+	if out.con.TileOutput == "Assembled" {
+		err = out.writeAssembledTile(res)
+	} else {
+		err = out.writeBox(res)
 	}
+	if err != nil { return err }
+
+	out.remaining[res.Index]--
+	if out.remaining[res.Index] == 0 { return out.closeParent(res.Index) }
+	return nil
+}
+
+// writeBox writes a box, or a tile which is stored in its own file.
+func (out *renderOutput) writeBox(res *render.Result) error {
+	name := out.gtetName(res.Name)
+	log.Printf("Writing to %s", name)
+	f, err := os.Create(name)
+	if err != nil { return fmt.Errorf("Could not create %s.", name) }
+	io.WriteBuffer(res.Grid, res.Cosmo, res.Render, res.Loc, f)
+	f.Close()
+
+	if out.con.NpyOutput {
+		err := writeNpy(name, res.Grid, res.Cosmo, res.Render, res.Loc)
+		if err != nil { return err }
+	}
+
+	if res.Tile != nil { return out.writeManifestLine(res, name) }
+	return nil
+}
+
+// writeAssembledTile writes a tile into the output file of its parent box,
+// creating that file if needed.
+func (out *renderOutput) writeAssembledTile(res *render.Result) error {
+	name := out.gtetName(out.configBoxes[res.Index].Name)
+
+	if out.writers[res.Index] == nil {
+		log.Printf("Writing to %s", name)
+		var w *io.TiledGridWriter
+		var err error
+		if _, statErr := os.Stat(name); out.resume && statErr == nil {
+			w, err = io.OpenTiledGridWriter(name)
+		} else {
+			w, err = io.NewTiledGridWriter(
+				name, res.Quantity, res.Cosmo, res.Render, res.BoxLoc,
+			)
+		}
+		if err != nil { return err }
+		out.writers[res.Index] = w
+
+		if out.con.NpyOutput {
+			log.Printf(
+				"NpyOutput is not supported for assembled tiles. " +
+					"Skipping .npy output for %s.", name,
+			)
+		}
+	}
+
+	log.Printf("Writing %s to %s", res.Name, name)
+	return out.writers[res.Index].WriteTile(res.Grid, res.Loc)
+}
+
+// writeManifestLine records the location of a tile in the manifest of its
+// parent box, creating the manifest if needed.
+func (out *renderOutput) writeManifestLine(
+	res *render.Result, tileName string,
+) error {
+	parent := &out.configBoxes[res.Index]
+	if out.manifests[res.Index] == nil {
+		name := path.Join(out.con.Output, fmt.Sprintf("%s%s%s_tiles.txt",
+			out.con.PrependName, parent.Name, out.con.AppendName))
+		log.Printf("Writing to %s", name)
+		ok, err := false, error(nil)
+		if out.resume { ok, err = out.reopenManifest(res.Index, name) }
+		if err != nil { return err }
+		if !ok {
+			if err := out.createManifest(res, name); err != nil { return err }
+		}
+	}
+
+	// Tiles which were written before a run was interrupted may be
+	// written again after resuming.
+	if out.manifestTiles[res.Index][path.Base(tileName)] { return nil }
+	out.manifestTiles[res.Index][path.Base(tileName)] = true
+
+	f := out.manifests[res.Index]
+	fmt.Fprintf(f, "%s %d %d %d", path.Base(tileName),
+		res.Tile[0], res.Tile[1], res.Tile[2])
+	origin := pixelInts(res.BoxLoc.PixelOrigin)
+	tileOrigin := pixelInts(res.Loc.PixelOrigin)
+	for k := 0; k < 3; k++ {
+		fmt.Fprintf(f, " %d", tileOrigin[k] - origin[k])
+	}
+	tileSpan := pixelInts(res.Loc.PixelSpan)
+	_, err := fmt.Fprintf(
+		f, " %d %d %d\n", tileSpan[0], tileSpan[1], tileSpan[2],
+	)
+	return err
+}
+
+// createManifest creates the manifest of a tiled box and writes its header.
+func (out *renderOutput) createManifest(
+	res *render.Result, name string,
+) error {
+	f, err := os.Create(name)
+	if err != nil { return fmt.Errorf("Could not create %s.", name) }
+	out.manifests[res.Index] = f
+	out.manifestTiles[res.Index] = map[string]bool{ }
+
+	origin := pixelInts(res.BoxLoc.PixelOrigin)
+	span := pixelInts(res.BoxLoc.PixelSpan)
+	fmt.Fprintf(f, "# Tiles of %s\n", out.configBoxes[res.Index].Name)
+	fmt.Fprintf(f, "# PixelOrigin: %d %d %d\n",
+		origin[0], origin[1], origin[2])
+	fmt.Fprintf(f, "# PixelSpan: %d %d %d\n", span[0], span[1], span[2])
+	fmt.Fprintf(f, "# TotalPixels: %d\n", res.Cells)
+	fmt.Fprintln(f, "# Column 0 - tile file")
+	fmt.Fprintln(f, "# Columns 1-3 - tile index")
+	fmt.Fprintln(f, "# Columns 4-6 - pixel offset within the full box")
+	fmt.Fprintln(f, "# Columns 7-9 - pixel span")
+	return nil
+}
+
+// reopenManifest opens an existing manifest written before a run was
+// interrupted so that more tiles can be added to it. It returns false if
+// there is no such manifest.
+func (out *renderOutput) reopenManifest(
+	parent int, name string,
+) (bool, error) {
+	text, err := ioutil.ReadFile(name)
+	if err != nil { return false, nil }
+
+	tiles := map[string]bool{ }
+	for _, line := range strings.Split(string(text), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") { continue }
+		tiles[fields[0]] = true
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY | os.O_APPEND, 0644)
+	if err != nil { return false, fmt.Errorf("Could not open %s.", name) }
+	out.manifests[parent], out.manifestTiles[parent] = f, tiles
+	return true, nil
+}
+
+// pixelInts converts a header's pixel vector to ints.
+func pixelInts(xs [3]int64) [3]int {
+	return [3]int{ int(xs[0]), int(xs[1]), int(xs[2]) }
+}
+
+// closeParent closes the files associated with a fully written box.
+func (out *renderOutput) closeParent(i int) error {
+	if f := out.manifests[i]; f != nil {
+		f.Close()
+		out.manifests[i] = nil
+	}
+	if w := out.writers[i]; w != nil {
+		out.writers[i] = nil
+		return w.Close()
+	}
+	return nil
+}
+
+// Close closes any files which are still open.
+func (out *renderOutput) Close() {
+	for i := range out.configBoxes {
+		if err := out.closeParent(i); err != nil { log.Fatal(err.Error()) }
+	}
+}
+
+// writeNpy writes a .npy version of the grid which was written to the .gtet
+// file gtetName along with a .json file containing its header.
+func writeNpy(
+	gtetName string, buf density.Buffer,
+	cos io.CosmoInfo, renderInfo io.RenderInfo, loc io.LocationInfo,
+) error {
+	base := strings.TrimSuffix(gtetName, ".gtet")
+	npyName, jsonName := base + ".npy", base + ".json"
+
+	log.Printf("Writing to %s", npyName)
+	f, err := os.Create(npyName)
+	if err != nil { return fmt.Errorf("Could not create %s.", npyName) }
+	defer f.Close()
+	err = io.WriteNpy(buf, renderInfo, loc, f)
+	if err != nil { return err }
+
+	log.Printf("Writing to %s", jsonName)
+	jf, err := os.Create(jsonName)
+	if err != nil { return fmt.Errorf("Could not create %s.", jsonName) }
+	defer jf.Close()
+	return io.WriteNpySidecar(buf, cos, renderInfo, loc, jf)
 }
 
 // toFloat32 converts a float64 array to a float32 array.
@@ -589,18 +1106,15 @@ func toFloat32(xs []float64) []float32 {
 	return ys
 }
 
-// densitySetupIO sets up the I/O for a routine which reads gotetra sheet files.
-// It gets the relevant filenames, a header for the sheet (i.e. the header of
-// an arbitrary file to be read), and a FileGroup struct which handles logging
-// and profiling. The filenames have not been filtered by location yet.
+// densitySetupIO sets up the I/O for [Render] mode. It gets a header for the
+// sheet (i.e. the header of an arbitrary file to be read), and a FileGroup
+// struct which handles logging and profiling.
 func densitySetupIO(con *io.RenderConfig) (
-	files []string,
 	hd *io.SheetHeader,
 	fg *FileGroup,
 ) {
 	var err error
 	fg = new(FileGroup)
-	hd = new(io.SheetHeader)
 
 	// Set up log file.
 	if con.ValidLogFile() {
@@ -617,21 +1131,17 @@ func densitySetupIO(con *io.RenderConfig) (
 		if err != nil { log.Fatal(err.Error()) }
 	}
 
-	// Get file names.
-	infos, err := ioutil.ReadDir(con.Input)
-	if err != nil { log.Fatal(err.Error()) }
-	files = make([]string, len(infos))
-	for i := range infos { files[i] = path.Join(con.Input, infos[i].Name()) }
+	fg.openEvents(&con.SharedConfig)
 
-	io.ReadSheetHeaderAt(files[0], hd)
+	hd, err = inputHeader(con.Input)
+	if err != nil { log.Fatal(err.Error()) }
 
-	return files, hd, fg
+	return hd, fg
 }
 
-
-// tetraHisSetupIO is similar to densitySetupIO, except for the TetraHist config
-// file.
-func tetraHistSetupIO(con *io.TetraHistConfig) (
+// tetraHisSetupIO is similar to densitySetupIO, except for the TetraHist and
+// Profile config files.
+func tetraHistSetupIO(con *io.SharedConfig) (
 	files []string,
 	hd *io.SheetHeader,
 	fg *FileGroup,
@@ -655,6 +1165,8 @@ func tetraHistSetupIO(con *io.TetraHistConfig) (
 		if err != nil { log.Fatal(err.Error()) }
 	}
 
+	fg.openEvents(con)
+
 	// Get file names.
 	infos, err := ioutil.ReadDir(con.Input)
 	if err != nil { log.Fatal(err.Error()) }
@@ -677,133 +1189,737 @@ func round(x float64) int {
 	}
 }
 
-// totalPixels counts the number of pixels implied by the 
-func totalPixels(
-	con *io.RenderConfig, box *io.BoxConfig, boxWidth float64,
-) int {
-	if con.ValidImagePixels() {
-		w := maxWidth(box)
-		if w > boxWidth {
-			log.Fatalf(
-				"Requested dimensions of '%s' are larger than the " + 
-					"simulation box.", box.Name,
-			) 
-		}
+func tetraHistMain(con *io.TetraHistConfig, bounds []string) {
+	// Get the I/O essentials.
+	fileNames, hd, fg := tetraHistSetupIO(&con.SharedConfig)
+	defer fg.Close()
+
+	// Generate bounds files.
+	configBoxes := make([]io.BoxConfig, 0)
+	for _, boundsFile := range bounds {
+		boxes, err := io.ReadBoundsConfig(boundsFile, hd, halo.RockstarCatalog{ })
+		if err != nil { log.Fatal(err.Error()) }
+		configBoxes = append(configBoxes, boxes...)
+	}
+
+	// Figure out cell sizes, pixel sizes, and particle counts.
+	boxes := make([]render.HistBox, len(configBoxes))
+	for i := range boxes {
+		pts := con.Particles
+		var err error
+		boxes[i], err = render.NewHistBox(&configBoxes[i])
+		if err != nil { log.Fatal(err.Error()) }
+		log.Println(
+			"Computing statistics in box:", boxes[i].Origin, boxes[i].Span,
+			pts, "particles per tetrahedron",
+		)
+	}
+
+	// Interpolate.
+	man, err := render.NewHistManager(
+		fileNames, boxes, con.Particles, con.Quantity, con.GridFile,
+	)
 
-		return round(boxWidth / w * float64(con.ImagePixels))
+	if err != nil { log.Fatal(err.Error()) }
+	man.SetEventLog(fg.el)
+	man.SetIndexMemory(con.IndexMemoryMB)
+	err = man.Subsample(con.SubsampleLength)
+	if err != nil { log.Fatal(err.Error()) }
+	if con.GridInterpolation != "" {
+		err = man.SetGridInterpolation(con.GridInterpolation)
+		if err != nil { log.Fatal(err.Error()) }
+	}
+	if con.Normalization == "VolumePDF" {
+		if err = man.WeightByVolume(); err != nil { log.Fatal(err.Error()) }
+	}
+	info := make([]render.HistInfo, len(con.Quantity))
+	for k := range info {
+		info[k] = render.HistInfo{
+			con.HistMin[k], con.HistMax[k], con.HistBins[k], con.HistScale[k],
+		}
 	}
-	return con.TotalPixels
+	err = man.Hist(info)
+	if err != nil { log.Fatalf(err.Error()) }
+
+	// Write output.
+	for i, cBox := range configBoxes {
+		base := path.Join(con.Output, fmt.Sprintf("%s%s%s",
+			con.PrependName, cBox.Name, con.AppendName))
+
+		err = writeHistText(base + ".txt", con, info, &boxes[i])
+		if err != nil { log.Fatal(err.Error()) }
+		if con.BinaryOutput {
+			err = writeHistBinary(base + ".ghist", con, hd, &boxes[i])
+			if err != nil { log.Fatal(err.Error()) }
+		}
+	}	
 }
 
-// maxWidth returns the dimension of box width the largest width.
-func maxWidth(box *io.BoxConfig) float64 {
-	var max float64
-	if box.XWidth > box.YWidth {
-		max = box.XWidth
-	} else {
-		max = box.YWidth
+// writeHistText writes a histogram as a text table with one row per bin. The
+// first columns give the bin centers of each axis, with the first axis
+// varying fastest, and the next column gives the bin counts. These are
+// followed by the normalized bin values and their Poisson errors if con asks
+// for them.
+func writeHistText(
+	fname string, con *io.TetraHistConfig,
+	info []render.HistInfo, box *render.HistBox,
+) error {
+	vals, errs, err := box.Normalize(info, con.Normalization, con.Cumulative)
+	if err != nil { return err }
+
+	log.Printf("Writing to %s", fname)
+	f, err := os.Create(fname)
+	if err != nil { return fmt.Errorf("Could not create %s.", fname) }
+	defer f.Close()
+
+	dims := len(con.Quantity)
+	for k := range con.Quantity {
+		fmt.Fprintf(f, "# %s histogram ranging from %g to %g " +
+			"# with %d bins (%s scaled).\n", con.Quantity[k], con.HistMin[k],
+			con.HistMax[k], con.HistBins[k], strings.ToLower(con.HistScale[k]))
+	}
+	fmt.Fprintf(f, "# Region origin: (%g, %g, %g) Mpc/h, span: " +
+		"(%g, %g, %g) Mpc/h.\n", box.Origin[0], box.Origin[1], box.Origin[2],
+		box.Span[0], box.Span[1], box.Span[2])
+	total := 0
+	for _, n := range box.Counts { total += n }
+	fmt.Fprintf(f, "# %d points inside the histogram range, from %d points " +
+		"per tetrahedron.\n", total, con.Particles)
+	for _, line := range histNormalizationNotes(con) {
+		fmt.Fprintf(f, "# %s\n", line)
 	}
 
-	if max > box.ZWidth {
-		return max
-	} else {
-		return box.ZWidth
+	for k := range con.Quantity {
+		if dims == 1 {
+			fmt.Fprintf(f, "# Column %d - bin centers.\n", k)
+		} else {
+			fmt.Fprintf(f, "# Column %d - %s bin centers.\n", k, con.Quantity[k])
+		}
+	}
+	fmt.Fprintf(f, "# Column %d - bin counts.\n", dims)
+	col := dims + 1
+	normalized := con.Normalization != "Counts" || con.Cumulative
+	if normalized {
+		fmt.Fprintf(f, "# Column %d - %s.\n", col, histValueName(con))
+		col++
 	}
+	if con.PoissonErrors {
+		fmt.Fprintf(f, "# Column %d - Poisson errors.\n", col)
+	}
+
+	idx := make([]int, dims)
+	for j := range box.Counts {
+		for k := 0; k < dims; k++ {
+			fmt.Fprintf(f, "%8.4g ", box.Centers[k][idx[k]])
+		}
+		fmt.Fprintf(f, "%d", box.Counts[j])
+		if normalized { fmt.Fprintf(f, " %.6g", vals[j]) }
+		if con.PoissonErrors { fmt.Fprintf(f, " %.6g", errs[j]) }
+		fmt.Fprintln(f)
+
+		// Advance to the next bin, with the first axis varying fastest.
+		for k := 0; k < dims; k++ {
+			idx[k]++
+			if idx[k] < con.HistBins[k] { break }
+			idx[k] = 0
+		}
+	}
+	return nil
 }
 
-// particles computes the number of particles (Monte Carlo samples) which will
-// be used per tetrahedron.
-func particles(con *io.RenderConfig, box *io.BoxConfig, boxWidth float64) int {
+// histValueName returns a description of the normalized values written by
+// writeHistText.
+func histValueName(con *io.TetraHistConfig) string {
+	name := ""
+	switch con.Normalization {
+	case "Counts":
+		name = "counts"
+	case "MassPDF":
+		name = "mass-weighted PDF"
+	case "VolumePDF":
+		name = "volume-weighted PDF"
+	}
+	if con.Cumulative {
+		if con.Normalization == "Counts" { return "cumulative counts" }
+		return "cumulative " + strings.Replace(name, "PDF", "distribution", 1)
+	}
+	return name
+}
 
-	if con.AutoParticles {
-		cells := totalPixels(con, box, boxWidth)
-		cellWidth := boxWidth / float64(cells)
+// histNormalizationNotes returns header lines explaining how the values
+// written by writeHistText are normalized.
+func histNormalizationNotes(con *io.TetraHistConfig) []string {
+	lines := []string{ }
+	switch con.Normalization {
+	case "Counts":
+		lines = append(lines, "Normalization: Counts. Bins contain the " +
+			"number of points, which is proportional to mass.")
+	case "MassPDF":
+		lines = append(lines, "Normalization: MassPDF. Bins are normalized " +
+			"by the total number of points in the histogram range.")
+	case "VolumePDF":
+		lines = append(lines, "Normalization: VolumePDF. Each point is " +
+			"weighted by the inverse of the total density at its position " +
+			"and bins are normalized by the total weight in the histogram " +
+			"range.")
+	}
 
-		if box.ProjectionAxis == "X" {
-			con.ProjectionDepth = int(math.Ceil(box.XWidth / cellWidth))
-		} else if box.ProjectionAxis == "Y" {
-			con.ProjectionDepth = int(math.Ceil(box.YWidth / cellWidth))
-		} else if box.ProjectionAxis == "Z" {
-			con.ProjectionDepth = int(math.Ceil(box.ZWidth / cellWidth))
+	if con.Normalization != "Counts" {
+		if con.Cumulative {
+			lines = append(lines, "Cumulative distributions go from 0 to 1.")
 		} else {
-			con.ProjectionDepth = 1
+			lines = append(lines, "PDFs are divided by the bin volume and " +
+				"integrate to 1 over the histogram range. Log-scaled axes " +
+				"are measured in log10 of their quantity.")
 		}
 	}
+	if con.Cumulative {
+		lines = append(lines, "Each bin contains the total of every bin at " +
+			"or below it along every axis.")
+	}
+	if con.PoissonErrors {
+		lines = append(lines, "Poisson errors are the square root of the " +
+			"summed squared weights in each bin, normalized like the bins.")
+	}
+	return lines
+}
 
-	if con.ValidProjectionDepth() {
-		// We're garuanteed that con.ValidImagePixels() is also true.
-		pixels := totalPixels(con, box, boxWidth)
+// writeHistBinary writes a histogram as a .ghist file.
+func writeHistBinary(
+	fname string, con *io.TetraHistConfig,
+	hd *io.SheetHeader, box *render.HistBox,
+) error {
+	h := &io.Hist{ }
+	h.Header.Cosmo = io.NewCosmoInfo(
+		hd.Cosmo.H100 * 100, hd.Cosmo.OmegaM,
+		hd.Cosmo.OmegaL, hd.Cosmo.Z, hd.TotalWidth,
+	)
+	h.Header.Particles = int64(con.Particles)
+	h.Header.SubsampleLength = int64(con.SubsampleLength)
+	h.Header.Origin, h.Header.Span = box.Origin, box.Span
+
+	h.Axes = make([]io.HistAxisHeader, len(con.Quantity))
+	for k := range h.Axes {
+		ax := &h.Axes[k]
+		ax.Quantity = int64(io.HistQuantityIndex(con.Quantity[k]))
+		ax.Min, ax.Max = con.HistMin[k], con.HistMax[k]
+		ax.Bins = int64(con.HistBins[k])
+		if con.HistScale[k] == "Log" { ax.IsLog = 1 }
+	}
+	h.Header.Normalization = int64(io.HistNormalizationIndex(con.Normalization))
+	if con.Cumulative { h.Header.Cumulative = 1 }
+	if con.PoissonErrors { h.Header.PoissonErrors = 1 }
+
+	h.Counts = make([]int64, len(box.Counts))
+	for j := range box.Counts { h.Counts[j] = int64(box.Counts[j]) }
+	h.Weights, h.Weights2 = box.Weights, box.Weights2
+
+	log.Printf("Writing to %s", fname)
+	f, err := os.Create(fname)
+	if err != nil { return err }
+	if err = h.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-		refPixels := 500.0
-		refParticles := 5.0
-		refDepth := 1.0
-		refSubsample := 1.0
-		return int(math.Ceil(
-			refParticles * math.Pow(float64(pixels) / refPixels, 3) * 
-			math.Pow(float64(con.SubsampleLength) / refSubsample, 3) *
-			(refDepth / float64(con.ProjectionDepth)),
-		))
+func profileMain(con *io.ProfileConfig, bounds []string) {
+	// Get the I/O essentials.
+	fileNames, hd, fg := tetraHistSetupIO(&con.SharedConfig)
+	defer fg.Close()
+
+	configBoxes := make([]io.BoxConfig, 0)
+	for _, boundsFile := range bounds {
+		boxes, err := io.ReadBoundsConfig(boundsFile, hd, halo.RockstarCatalog{ })
+		if err != nil { log.Fatal(err.Error()) }
+		configBoxes = append(configBoxes, boxes...)
 	}
 
-	return con.Particles
+	exclusions := []render.Sphere{ }
+	if con.ExclusionFile != "" {
+		var err error
+		exclusions, err = readSpheres(con.ExclusionFile)
+		if err != nil { log.Fatal(err.Error()) }
+	}
+
+	// Profiles are centered on Balls and Catalog halos.
+	profiles := make([]*render.Profile, len(configBoxes))
+	for i, cBox := range configBoxes {
+		rMin, rMax, ok := cBox.Shell()
+		if !ok {
+			log.Fatalf("Profile mode can only be used with Balls and " +
+				"Catalogs, but '%s' is a Box.", cBox.Name)
+		}
+
+		origin := [3]float64{ cBox.X, cBox.Y, cBox.Z }
+		span := [3]float64{ cBox.XWidth, cBox.YWidth, cBox.ZWidth }
+		center := [3]float64{ }
+		for k := 0; k < 3; k++ {
+			center[k] = origin[k] + span[k]/2
+			if center[k] >= hd.TotalWidth { center[k] -= hd.TotalWidth }
+		}
+
+		if rMin <= 0 { rMin = con.MinRadiusFraction * rMax }
+
+		var err error
+		profiles[i], err = render.NewProfile(center, rMin, rMax, con.Bins)
+		if err != nil { log.Fatal(err.Error()) }
+		profiles[i].Exclude(exclusions, hd.TotalWidth)
+		log.Println(
+			"Computing profile around:", center, "from", rMin, "to",
+			rMax, "with", profiles[i].Exclusions(), "exclusions",
+		)
+	}
+
+	man, err := render.NewProfileManager(
+		fileNames, profiles, con.Particles, con.Velocity,
+	)
+	if err != nil { log.Fatal(err.Error()) }
+	man.SetEventLog(fg.el)
+	err = man.Subsample(con.SubsampleLength)
+	if err != nil { log.Fatal(err.Error()) }
+	if err = man.Profile(); err != nil { log.Fatal(err.Error()) }
+
+	// Write output.
+	for i, cBox := range configBoxes {
+		fname := path.Join(con.Output, fmt.Sprintf("%s%s%s.txt",
+			con.PrependName, cBox.Name, con.AppendName))
+		err = writeProfile(fname, con, hd, profiles[i])
+		if err != nil { log.Fatal(err.Error()) }
+	}
 }
 
-func tetraHistMain(con *io.TetraHistConfig, bounds []string) {
+// writeProfile writes a profile as a text table with one row per radial
+// bin.
+func writeProfile(
+	fname string, con *io.ProfileConfig,
+	hd *io.SheetHeader, p *render.Profile,
+) error {
+	edges := p.Edges()
+	rhos := p.Density(hd.TotalWidth)
+	vr, sigmaVr := p.RadialVelocity()
+
+	log.Printf("Writing to %s", fname)
+	f, err := os.Create(fname)
+	if err != nil { return fmt.Errorf("Could not create %s.", fname) }
+	defer f.Close()
+
+	fmt.Fprintf(f, "# Profile centered on (%g, %g, %g) Mpc/h with %d " +
+		"log-spaced bins from %g to %g Mpc/h.\n", p.Center[0], p.Center[1],
+		p.Center[2], p.Bins, p.RMin, p.RMax)
+	fmt.Fprintf(f, "# %d points per tetrahedron, subsample length %d.\n",
+		con.Particles, con.SubsampleLength)
+	if p.Exclusions() > 0 {
+		fmt.Fprintf(f, "# %d spheres from %s are excluded.\n",
+			p.Exclusions(), con.ExclusionFile)
+	}
+	fmt.Fprintln(f, "# Column 0 - inner bin edge [Mpc/h].")
+	fmt.Fprintln(f, "# Column 1 - outer bin edge [Mpc/h].")
+	fmt.Fprintln(f, "# Column 2 - geometric bin center [Mpc/h].")
+	fmt.Fprintln(f, "# Column 3 - density [mean density].")
+	fmt.Fprintln(f, "# Column 4 - number of points in the bin.")
+	if con.Velocity {
+		fmt.Fprintln(f, "# Column 5 - mean radial velocity.")
+		fmt.Fprintln(f, "# Column 6 - radial velocity dispersion.")
+	}
+
+	for j := 0; j < p.Bins; j++ {
+		fmt.Fprintf(f, "%8.4g %8.4g %8.4g %.6g %d", edges[j], edges[j + 1],
+			math.Sqrt(edges[j] * edges[j + 1]), rhos[j], p.Counts[j])
+		if con.Velocity { fmt.Fprintf(f, " %.6g %.6g", vr[j], sigmaVr[j]) }
+		fmt.Fprintln(f)
+	}
+	return nil
+}
+
+// readSpheres reads a text file where each line gives the x, y, and z
+// coordinates and the radius of a sphere. Blank lines and lines starting
+// with '#' are skipped.
+func readSpheres(fname string) ([]render.Sphere, error) {
+	text, err := ioutil.ReadFile(fname)
+	if err != nil { return nil, err }
+
+	spheres := []render.Sphere{ }
+	for i, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' { continue }
+
+		tokens := strings.Fields(line)
+		if len(tokens) != 4 {
+			return nil, fmt.Errorf(
+				"Line %d of '%s' has %d columns, but it must have four: " +
+					"x, y, z, and radius.", i + 1, fname, len(tokens),
+			)
+		}
+		vals := [4]float64{ }
+		for k := range vals {
+			vals[k], err = strconv.ParseFloat(tokens[k], 64)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"Could not parse '%s' on line %d of '%s'.",
+					tokens[k], i + 1, fname,
+				)
+			}
+		}
+		spheres = append(spheres, render.Sphere{
+			Center: [3]float64{ vals[0], vals[1], vals[2] }, R: vals[3],
+		})
+	}
+	return spheres, nil
+}
+
+func splashbackMain(con *io.SplashbackConfig, bounds []string) {
 	// Get the I/O essentials.
-	fileNames, hd, fg := tetraHistSetupIO(con)
+	fileNames, hd, fg := tetraHistSetupIO(&con.SharedConfig)
 	defer fg.Close()
 
-	// Generate bounds files.
 	configBoxes := make([]io.BoxConfig, 0)
 	for _, boundsFile := range bounds {
-		boxes, err := io.ReadBoundsConfig(boundsFile, hd.TotalWidth)
+		boxes, err := io.ReadBoundsConfig(boundsFile, hd, halo.RockstarCatalog{ })
 		if err != nil { log.Fatal(err.Error()) }
 		configBoxes = append(configBoxes, boxes...)
 	}
 
-	// Figure out cell sizes, pixel sizes, and particle counts.
+	// Lines of sight run from the center of each Ball and Catalog halo out
+	// to its radius.
 	boxes := make([]render.HistBox, len(configBoxes))
-	for i := range boxes {
-		pts := con.Particles
-		boxes[i] = render.NewHistBox(&configBoxes[i], con.HistBins)
+	for i := range configBoxes {
+		cBox := &configBoxes[i]
+		rMin, rMax, ok := cBox.Shell()
+		if !ok {
+			log.Fatalf("Splashback mode can only be used with Balls and " +
+				"Catalogs, but '%s' is a Box.", cBox.Name)
+		}
+		if rMin <= 0 { cBox.SetShell(con.MinRadiusFraction * rMax, rMax) }
+
+		var err error
+		boxes[i], err = render.NewHistBox(cBox)
+		if err != nil { log.Fatal(err.Error()) }
 		log.Println(
-			"Computing statistics in box:", boxes[i].Origin, boxes[i].Span,
-			pts, "particles per tetrahedron",
+			"Finding splashback radius in:", boxes[i].Origin, boxes[i].Span,
+			"from", boxes[i].RMin, "to", boxes[i].RMax,
 		)
 	}
 
-	// Interpolate.
-	man, err := render.NewHistManager(
-		fileNames, boxes, con.Particles, con.Quantity, con.GridFile,
+	man, err := render.NewSplashbackManager(
+		fileNames, boxes, con.Lines, con.Samples,
+		con.SavGolOrder, con.SavGolWindow,
 	)
-
 	if err != nil { log.Fatal(err.Error()) }
-	man.Subsample(con.SubsampleLength)
-	info := &render.HistInfo{
-		con.HistMin, con.HistMax, con.HistBins, con.HistScale,
-	}
-	err = man.Hist(info)
-	if err != nil { log.Fatalf(err.Error()) }
+	man.SetEventLog(fg.el)
+	man.SetIndexMemory(con.IndexMemoryMB)
+	err = man.Subsample(con.SubsampleLength)
+	if err != nil { log.Fatal(err.Error()) }
+	sps, err := man.Find()
+	if err != nil { log.Fatal(err.Error()) }
 
 	// Write output.
+	fname := path.Join(con.Output, fmt.Sprintf("%ssplashback%s.txt",
+		con.PrependName, con.AppendName))
+	err = writeSplashbackRadii(fname, con, configBoxes, sps)
+	if err != nil { log.Fatal(err.Error()) }
 	for i, cBox := range configBoxes {
-		box := boxes[i]
-
-		out := path.Join(con.Output, fmt.Sprintf("%s%s%s.txt",
+		fname := path.Join(con.Output, fmt.Sprintf("%s%s%s_shell.txt",
 			con.PrependName, cBox.Name, con.AppendName))
+		err = writeSplashbackShell(fname, con, hd, sps[i])
+		if err != nil { log.Fatal(err.Error()) }
+	}
+}
+
+// writeSplashbackRadii writes a text table with the splashback radius of
+// each halo.
+func writeSplashbackRadii(
+	fname string, con *io.SplashbackConfig,
+	boxes []io.BoxConfig, sps []*render.Splashback,
+) error {
+	log.Printf("Writing to %s", fname)
+	f, err := os.Create(fname)
+	if err != nil { return fmt.Errorf("Could not create %s.", fname) }
+	defer f.Close()
+
+	fmt.Fprintf(f, "# Splashback radii from %d lines of sight with %d " +
+		"log-spaced points each.\n", con.Lines, con.Samples)
+	fmt.Fprintf(f, "# Lines are smoothed with an order %d Savitzky-Golay " +
+		"filter %d points wide.\n", con.SavGolOrder, con.SavGolWindow)
+	fmt.Fprintln(f, "# Column 0 - name.")
+	fmt.Fprintln(f, "# Columns 1-3 - center [Mpc/h].")
+	fmt.Fprintln(f, "# Column 4 - inner end of the lines of sight [Mpc/h].")
+	fmt.Fprintln(f, "# Column 5 - outer end of the lines of sight [Mpc/h].")
+	fmt.Fprintln(f, "# Column 6 - median splashback radius [Mpc/h].")
+	fmt.Fprintln(f, "# Column 7 - number of valid lines of sight.")
+
+	for i, sp := range sps {
+		fmt.Fprintf(f, "%s %8.4f %8.4f %8.4f %8.4g %8.4g %8.4g %d\n",
+			boxes[i].Name, sp.Center[0], sp.Center[1], sp.Center[2],
+			sp.RMin, sp.RMax, sp.Radius(), sp.Valid())
+	}
+	return nil
+}
+
+// writeSplashbackShell writes a text table with the point where each line
+// of sight through a halo crosses its splashback shell.
+func writeSplashbackShell(
+	fname string, con *io.SplashbackConfig,
+	hd *io.SheetHeader, sp *render.Splashback,
+) error {
+	log.Printf("Writing to %s", fname)
+	f, err := os.Create(fname)
+	if err != nil { return fmt.Errorf("Could not create %s.", fname) }
+	defer f.Close()
+
+	fmt.Fprintf(f, "# Splashback shell centered on (%.4f, %.4f, %.4f) Mpc/h " +
+		"with median radius %.4g Mpc/h.\n", sp.Center[0], sp.Center[1],
+		sp.Center[2], sp.Radius())
+	fmt.Fprintf(f, "# %d of %d lines of sight are valid.\n",
+		sp.Valid(), len(sp.Radii))
+	fmt.Fprintln(f, "# Columns 0-2 - position [Mpc/h].")
+	fmt.Fprintln(f, "# Column 3 - radius [Mpc/h].")
+	fmt.Fprintln(f, "# Column 4 - logarithmic slope of the density.")
+
+	pts := sp.Points(hd.TotalWidth)
+	j := 0
+	for i, r := range sp.Radii {
+		if math.IsNaN(r) { continue }
+		fmt.Fprintf(f, "%8.4f %8.4f %8.4f %8.4g %8.4g\n",
+			pts[j][0], pts[j][1], pts[j][2], r, sp.Slopes[i])
+		j++
+	}
+	return nil
+}
+
+// inspectMain prints information about a .gtet file, or, if a sub-command
+// is given, writes a modified version of it to a new file.
+func inspectMain(file string, args []string) {
+	g, err := io.ReadGridFile(file)
+	if err != nil { log.Fatal(err.Error()) }
+
+	if len(args) == 0 {
+		printGridHeader(&g.Header)
+		printGridStats(g)
+		return
+	}
+
+	if len(args) < 2 {
+		log.Fatalf("Sub-command '%s' requires an output file.", args[0])
+	}
+	cmd, out, args := args[0], args[1], args[2:]
+
+	var outGrid *io.Grid
+	switch cmd {
+	case "Crop":
+		if len(args) != 6 {
+			log.Fatal("Crop requires six arguments: x y z dx dy dz.")
+		}
+		vals := parseInts(args)
+		origin := [3]int{ vals[0], vals[1], vals[2] }
+		span := [3]int{ vals[3], vals[4], vals[5] }
+		outGrid, err = g.Crop(origin, span)
+	case "Downsample":
+		if len(args) != 1 {
+			log.Fatal("Downsample requires a single argument: factor.")
+		}
+		outGrid, err = g.Downsample(parseInts(args)[0])
+	case "Stitch":
+		tiles := []*io.Grid{ g }
+		for _, tileFile := range args {
+			tile, err := io.ReadGridFile(tileFile)
+			if err != nil { log.Fatal(err.Error()) }
+			tiles = append(tiles, tile)
+		}
+		outGrid, err = io.Stitch(tiles)
+	default:
+		log.Fatalf(
+			"Unrecognized sub-command '%s'. Only recognized sub-commands " +
+				"are 'Crop', 'Downsample', and 'Stitch'.", cmd,
+		)
+	}
+	if err != nil { log.Fatal(err.Error()) }
+
+	log.Printf("Writing to %s", out)
+	f, err := os.Create(out)
+	if err != nil { log.Fatalf("Could not create %s.", out) }
+	defer f.Close()
+	if err = outGrid.Write(f); err != nil { log.Fatal(err.Error()) }
+}
+
+// lightConeMain renders the light cone described by con.
+func lightConeMain(con *io.LightConeConfig) {
+	fg := new(FileGroup)
+	defer fg.Close()
+
+	var err error
+	if con.ValidLogFile() {
+		fg.log, err = os.Create(con.LogFile)
+		if err != nil { log.Fatal(err.Error()) }
+		log.SetOutput(fg.log)
+	}
+	if con.ValidProfileFile() {
+		fg.prof, err = os.Create(con.ProfileFile)
+		if err != nil { log.Fatal(err.Error()) }
+		err = pprof.StartCPUProfile(fg.prof)
+		if err != nil { log.Fatal(err.Error()) }
+	}
+
+	// Read the redshift and cosmology of each snapshot.
+	files := make([][]string, len(con.Input))
+	zs := make([]float64, len(con.Input))
+	hd := new(io.SheetHeader)
+	for i, dir := range con.Input {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil { log.Fatal(err.Error()) }
+		if len(infos) == 0 { log.Fatalf("Input directory %s is empty.", dir) }
+		files[i] = make([]string, len(infos))
+		for j := range infos { files[i][j] = path.Join(dir, infos[j].Name()) }
+
+		snapHd := new(io.SheetHeader)
+		err = io.ReadSheetHeaderAt(files[i][0], snapHd)
+		if err != nil { log.Fatal(err.Error()) }
+		zs[i] = snapHd.Cosmo.Z
+		log.Printf("Snapshot %s is at z = %.4f", dir, zs[i])
+
+		if i == 0 {
+			*hd = *snapHd
+		} else if snapHd.TotalWidth != hd.TotalWidth ||
+			snapHd.Cosmo.OmegaM != hd.Cosmo.OmegaM ||
+			snapHd.Cosmo.OmegaL != hd.Cosmo.OmegaL {
+			log.Fatalf(
+				"Snapshot %s is from a different simulation than %s.",
+				dir, con.Input[0],
+			)
+		}
+	}
+
+	shells := render.LightConeShells(
+		files, zs, hd.Cosmo.OmegaM, hd.Cosmo.OmegaL,
+		con.MinRedshift, con.MaxRedshift,
+	)
+	if len(shells) == 0 { log.Fatal("No snapshots overlap the light cone.") }
+
+	observer := [3]float64{ con.ObserverX, con.ObserverY, con.ObserverZ }
+	man, err := render.NewLightConeManager(
+		shells, observer, con.Axis(), con.OpeningAngle,
+		con.ImagePixels, con.Particles,
+	)
+	if err != nil { log.Fatal(err.Error()) }
+	err = man.Subsample(con.SubsampleLength)
+	if err != nil { log.Fatal(err.Error()) }
+	if err = man.Render(); err != nil { log.Fatal(err.Error()) }
+
+	// The map is stored as a projection along the line of sight. Angular
+	// dimensions are in degrees and the line of sight is in Mpc/h, so the
+	// header is marked as angular (see io.GridHeader.IsAngular). TotalPixels
+	// is the width of the map.
+	rMin, rMax := shells[0].RMin, shells[len(shells) - 1].RMax
+	g := &io.Grid{ Vals: [][]float32{ man.Map(rMin, rMax) } }
+	g.Header.Type.GridType = int64(density.Density)
+	g.Header.Type.IsAngular = 1
+	g.Header.Cosmo = io.NewCosmoInfo(
+		hd.Cosmo.H100 * 100, hd.Cosmo.OmegaM,
+		hd.Cosmo.OmegaL, con.MinRedshift, hd.TotalWidth,
+	)
+	g.Header.Render = io.NewRenderInfo(
+		con.Particles, con.ImagePixels, con.SubsampleLength, con.LineOfSight,
+	)
 
+	loc := &g.Header.Loc
+	loc.PixelWidth = con.OpeningAngle / float64(con.ImagePixels)
+	for k := 0; k < 3; k++ {
+		if k == con.Axis() {
+			loc.Origin[k], loc.Span[k] = rMin, rMax - rMin
+			loc.PixelSpan[k] = 1
+		} else {
+			loc.Origin[k], loc.Span[k] = -con.OpeningAngle / 2, con.OpeningAngle
+			loc.PixelSpan[k] = int64(con.ImagePixels)
+		}
+	}
+
+	out := path.Join(con.Output, fmt.Sprintf("%slight_cone%s.gtet",
+		con.PrependName, con.AppendName))
+	log.Printf("Writing to %s", out)
+	f, err := os.Create(out)
+	if err != nil { log.Fatalf("Could not create %s.", out) }
+	defer f.Close()
+	if err = g.Write(f); err != nil { log.Fatal(err.Error()) }
+}
+
+// pyramidMain writes every level of the pyramid of a .gtet file other than
+// the file itself. The level i file is written to <name>_level<i>.gtet.
+func pyramidMain(file string, levels int) {
+	g, err := io.ReadGridFile(file)
+	if err != nil { log.Fatal(err.Error()) }
+
+	pyr, err := g.Pyramid(levels)
+	if err != nil { log.Fatal(err.Error()) }
+
+	base := strings.TrimSuffix(file, ".gtet")
+	for i := 1; i < len(pyr); i++ {
+		out := fmt.Sprintf("%s_level%d.gtet", base, i)
 		log.Printf("Writing to %s", out)
 		f, err := os.Create(out)
-		defer f.Close()
 		if err != nil { log.Fatalf("Could not create %s.", out) }
-		
-		fmt.Fprintf(f, "# %s histogram ranging from %g to %g " +
-			"# with %d bins (%s scaled).\n", con.Quantity, con.HistMin,
-			con.HistMax, con.HistBins, strings.ToLower(con.HistScale))
-		fmt.Fprintf(f, "# Column 0 - bin centers.\n")
-		fmt.Fprintf(f, "# Column 1 - bin counts.\n")
-		for j := range box.Counts {
-			fmt.Fprintf(f, "%8.4g %d\n", box.Centers[j], box.Counts[j])
-		}
-	}	
+		err = pyr[i].Write(f)
+		f.Close()
+		if err != nil { log.Fatal(err.Error()) }
+	}
+}
+
+// parseInts converts a list of command line arguments to integers.
+func parseInts(args []string) []int {
+	out := make([]int, len(args))
+	for i := range args {
+		var err error
+		out[i], err = strconv.Atoi(args[i])
+		if err != nil { log.Fatalf("'%s' is not an integer.", args[i]) }
+	}
+	return out
+}
+
+// printGridHeader prints a human-readable version of a .gtet header.
+func printGridHeader(hd *io.GridHeader) {
+	axis := "None"
+	if a := hd.Render.ProjectionAxis; a >= 0 && a < 3 {
+		axis = []string{ "X", "Y", "Z" }[a]
+	}
+
+	fmt.Println("Type:")
+	fmt.Printf("    Quantity:           %s\n",
+		density.Quantity(hd.Type.GridType).String())
+	fmt.Printf("    IsVectorGrid:       %v\n", hd.Type.IsVectorGrid == 1)
+	fmt.Printf("    IsAngular:          %v\n", hd.IsAngular())
+	fmt.Println("Cosmo:")
+	fmt.Printf("    Redshift:           %g\n", hd.Cosmo.Redshift)
+	fmt.Printf("    ScaleFactor:        %g\n", hd.Cosmo.ScaleFactor)
+	fmt.Printf("    OmegaM:             %g\n", hd.Cosmo.OmegaM)
+	fmt.Printf("    OmegaL:             %g\n", hd.Cosmo.OmegaL)
+	fmt.Printf("    Hubble:             %g\n", hd.Cosmo.Hubble)
+	fmt.Printf("    RhoMean:            %g\n", hd.Cosmo.RhoMean)
+	fmt.Printf("    RhoCritical:        %g\n", hd.Cosmo.RhoCritical)
+	fmt.Printf("    BoxWidth:           %g\n", hd.Cosmo.BoxWidth)
+	fmt.Println("Render:")
+	fmt.Printf("    Particles:          %d\n", hd.Render.Particles)
+	fmt.Printf("    TotalPixels:        %d\n", hd.Render.TotalPixels)
+	fmt.Printf("    SubsampleLength:    %d\n", hd.Render.SubsampleLength)
+	fmt.Printf("    MinProjectionDepth: %d\n", hd.Render.MinProjectionDepth)
+	fmt.Printf("    ProjectionAxis:     %s\n", axis)
+	fmt.Println("Location:")
+	fmt.Printf("    Origin:             %g\n", hd.Loc.Origin)
+	fmt.Printf("    Span:               %g\n", hd.Loc.Span)
+	fmt.Printf("    PixelOrigin:        %d\n", hd.Loc.PixelOrigin)
+	fmt.Printf("    PixelSpan:          %d\n", hd.Loc.PixelSpan)
+	fmt.Printf("    PixelWidth:         %g\n", hd.Loc.PixelWidth)
+}
+
+// printGridStats prints summary statistics of a grid.
+func printGridStats(g *io.Grid) {
+	st := g.Stats()
+	fmt.Println("Statistics:")
+	fmt.Printf("    Min:                %g\n", st.Min)
+	fmt.Printf("    Max:                %g\n", st.Max)
+	fmt.Printf("    Mean:               %g\n", st.Mean)
+	if g.Header.Type.GridType == int64(density.Density) &&
+		!g.Header.IsAngular() {
+		fmt.Printf("    TotalMass:          %g\n", st.Mass)
+	}
+	fmt.Printf("    NaNs:               %d\n", st.NaNs)
 }
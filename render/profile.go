@@ -0,0 +1,389 @@
+package render
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+
+	"github.com/phil-mansfield/gotetra/math/rand"
+	"github.com/phil-mansfield/gotetra/render/geom"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// profileVolumeSamples is the number of Monte Carlo points used to measure
+// the volume of each radial bin which isn't excluded.
+const profileVolumeSamples = 1 << 14
+
+// Sphere is a sphere within a periodic box. Positions and radii are in
+// comoving Mpc/h.
+type Sphere struct {
+	Center [3]float64
+	R float64
+}
+
+// Profile is a spherically averaged profile around a single center with
+// log-spaced radial bins between RMin and RMax. Masses are in units of the
+// mean density of the box times (Mpc/h)^3, so densities are in units of the
+// mean density.
+type Profile struct {
+	Center [3]float64
+	RMin, RMax float64
+	Bins int
+
+	// Mass and Counts are the mass and the number of Monte Carlo samples in
+	// each bin. VrSum and Vr2Sum are the mass-weighted sums of the radial
+	// velocity and its square. They're only computed if the ProfileManager
+	// reads velocities.
+	Mass, VrSum, Vr2Sum []float64
+	Counts []int
+
+	// exclusions are spheres whose points are left out of the profile.
+	exclusions []Sphere
+	lrMin, dlr float64
+}
+
+// NewProfile creates an empty profile with bins radial bins between rMin and
+// rMax of center.
+func NewProfile(
+	center [3]float64, rMin, rMax float64, bins int,
+) (*Profile, error) {
+	if rMin <= 0 || rMax <= rMin {
+		return nil, fmt.Errorf(
+			"Profile radii must satisfy 0 < RMin < RMax, but they're " +
+				"(%g, %g).", rMin, rMax,
+		)
+	} else if bins <= 0 {
+		return nil, fmt.Errorf("Profiles must have at least one bin.")
+	}
+
+	p := &Profile{
+		Center: center, RMin: rMin, RMax: rMax, Bins: bins,
+		Mass: make([]float64, bins), Counts: make([]int, bins),
+		VrSum: make([]float64, bins), Vr2Sum: make([]float64, bins),
+	}
+	p.lrMin = math.Log(rMin)
+	p.dlr = (math.Log(rMax) - p.lrMin) / float64(bins)
+	return p, nil
+}
+
+// Exclude leaves every point inside the given spheres out of the profile,
+// except for spheres which contain the center of the profile, such as its
+// host halo. L is the width of the periodic box.
+func (p *Profile) Exclude(spheres []Sphere, L float64) {
+	for _, s := range spheres {
+		d := periodicDistance(s.Center, p.Center, L)
+		if d < s.R || d - s.R >= p.RMax { continue }
+		p.exclusions = append(p.exclusions, s)
+	}
+}
+
+// Exclusions returns the number of spheres which are excluded from the
+// profile.
+func (p *Profile) Exclusions() int { return len(p.exclusions) }
+
+// Edges returns the edges of the radial bins. It has one more element than
+// the number of bins.
+func (p *Profile) Edges() []float64 {
+	edges := make([]float64, p.Bins + 1)
+	for i := range edges {
+		edges[i] = math.Exp(p.lrMin + p.dlr*float64(i))
+	}
+	edges[0], edges[p.Bins] = p.RMin, p.RMax
+	return edges
+}
+
+// bin returns the bin containing the radius r or -1 if r is outside the
+// profile.
+func (p *Profile) bin(r float64) int {
+	if r < p.RMin || r >= p.RMax { return -1 }
+	i := int((math.Log(r) - p.lrMin) / p.dlr)
+	if i >= p.Bins { i = p.Bins - 1 }
+	return i
+}
+
+// excluded returns true if x is inside one of the profile's exclusion
+// spheres.
+func (p *Profile) excluded(x [3]float64, L float64) bool {
+	for i := range p.exclusions {
+		s := &p.exclusions[i]
+		if periodicDistance(x, s.Center, L) < s.R { return true }
+	}
+	return false
+}
+
+// Volumes returns the volume of each bin which isn't excluded in (Mpc/h)^3.
+// The excluded volume is found by Monte Carlo integration with a fixed seed,
+// so repeated calls give the same result.
+func (p *Profile) Volumes(L float64) []float64 {
+	edges := p.Edges()
+	vols := make([]float64, p.Bins)
+	for i := range vols {
+		r0, r1 := edges[i], edges[i + 1]
+		vols[i] = 4 * math.Pi / 3 * (r1*r1*r1 - r0*r0*r0)
+	}
+	if len(p.exclusions) == 0 { return vols }
+
+	gen := rand.New(rand.Tausworthe, uint64(p.Bins))
+	for i := range vols {
+		r0, r1 := edges[i], edges[i + 1]
+		kept := 0
+		for j := 0; j < profileVolumeSamples; j++ {
+			// Points are uniformly distributed within the shell.
+			r := math.Cbrt(
+				r0*r0*r0 + gen.Uniform(0, 1)*(r1*r1*r1 - r0*r0*r0),
+			)
+			unit := randomUnit(gen)
+			x := [3]float64{
+				p.Center[0] + r*unit[0],
+				p.Center[1] + r*unit[1],
+				p.Center[2] + r*unit[2],
+			}
+			if !p.excluded(x, L) { kept++ }
+		}
+		vols[i] *= float64(kept) / profileVolumeSamples
+	}
+	return vols
+}
+
+// Density returns the density of each bin in units of the mean density. Bins
+// which are entirely excluded have a density of zero.
+func (p *Profile) Density(L float64) []float64 {
+	rhos := p.Volumes(L)
+	for i := range rhos {
+		if rhos[i] > 0 { rhos[i] = p.Mass[i] / rhos[i] }
+	}
+	return rhos
+}
+
+// RadialVelocity returns the mass-weighted mean and dispersion of the radial
+// velocity in each bin.
+func (p *Profile) RadialVelocity() (mean, sigma []float64) {
+	mean, sigma = make([]float64, p.Bins), make([]float64, p.Bins)
+	for i := range mean {
+		if p.Mass[i] == 0 { continue }
+		mean[i] = p.VrSum[i] / p.Mass[i]
+		sigma2 := p.Vr2Sum[i] / p.Mass[i] - mean[i]*mean[i]
+		if sigma2 > 0 { sigma[i] = math.Sqrt(sigma2) }
+	}
+	return mean, sigma
+}
+
+// intersects returns true if the bounding box of the profile intersects the
+// box starting at origin with the given span within a periodic box of
+// width L.
+func (p *Profile) intersects(origin, span geom.Vec, L float64) bool {
+	for k := 0; k < 3; k++ {
+		lo := p.Center[k] - p.RMax
+		if lo < 0 { lo += L }
+		if !intersect1D(
+			lo, 2*p.RMax, float64(origin[k]), float64(span[k]), L,
+		) {
+			return false
+		}
+	}
+	return true
+}
+
+// periodicDistance returns the distance between x and y within a periodic
+// box of width L.
+func periodicDistance(x, y [3]float64, L float64) float64 {
+	r2 := 0.0
+	for k := 0; k < 3; k++ {
+		dx := x[k] - y[k]
+		if dx > L/2 { dx -= L }
+		if dx < -L/2 { dx += L }
+		r2 += dx*dx
+	}
+	return math.Sqrt(r2)
+}
+
+// ProfileManager computes profiles by depositing Monte Carlo samples of the
+// tetrahedra in a set of sheet files into the radial bins of each profile.
+type ProfileManager struct {
+	xs, vs []geom.Vec
+	hd io.SheetHeader
+	files []string
+
+	profiles []*Profile
+	unitBufs [][]geom.Vec
+	skip int
+	workers int
+	workspaces []profileWorkspace
+
+	events *EventLog
+	bytesRead int64
+}
+
+// profileWorkspace contains the buffers used by a single profile worker.
+type profileWorkspace struct {
+	mass, vr, vr2 []float64
+	counts []int
+
+	vecBuf []geom.Vec
+	velBuf [][3]float64
+	gen *rand.Generator
+}
+
+// NewProfileManager creates a ProfileManager which computes the given
+// profiles from files using points Monte Carlo samples per tetrahedron. If
+// velocity is true, radial velocities are also computed.
+func NewProfileManager(
+	files []string, profiles []*Profile, points int, velocity bool,
+) (*ProfileManager, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No input files were given.")
+	}
+
+	man := &ProfileManager{ files: files, profiles: profiles, skip: 1 }
+	err := io.ReadSheetHeaderAt(files[0], &man.hd)
+	if err != nil { return nil, err }
+	man.xs = make([]geom.Vec, man.hd.GridCount)
+	if velocity { man.vs = make([]geom.Vec, man.hd.GridCount) }
+
+	man.unitBufs = unitBufs(UnitBufCount, points)
+
+	man.workers = NumCores
+	if man.workers <= 0 { man.workers = runtime.NumCPU() }
+	runtime.GOMAXPROCS(man.workers)
+
+	maxBins := 0
+	for _, p := range profiles {
+		if p.Bins > maxBins { maxBins = p.Bins }
+	}
+	man.workspaces = make([]profileWorkspace, man.workers)
+	for id := range man.workspaces {
+		w := &man.workspaces[id]
+		w.mass = make([]float64, maxBins)
+		w.vr = make([]float64, maxBins)
+		w.vr2 = make([]float64, maxBins)
+		w.counts = make([]int, maxBins)
+		w.vecBuf = make([]geom.Vec, points)
+		w.velBuf = make([][3]float64, points)
+		w.gen = rand.NewTimeSeed(rand.Xorshift)
+	}
+
+	return man, nil
+}
+
+// Subsample makes the ProfileManager only use every skip-th particle along
+// each axis. skip must be a power of two which evenly divides the segment
+// width of the sheets.
+func (man *ProfileManager) Subsample(skip int) error {
+	if err := checkSubsample(&man.hd, skip); err != nil { return err }
+	man.skip = skip
+	return nil
+}
+
+// SetEventLog makes the ProfileManager write progress events to events.
+func (man *ProfileManager) SetEventLog(events *EventLog) {
+	man.events = events
+}
+
+// Profile adds the tetrahedra in every file to the profiles.
+func (man *ProfileManager) Profile() error {
+	man.events.Emit("profile_start", Event{
+		"files": len(man.files), "profiles": len(man.profiles),
+	})
+	err := analyzeFiles(man.files, man.events, &man.bytesRead, man.profileFile)
+	if err != nil { return err }
+	man.events.Emit("profile_finish", Event{
+		"files": len(man.files), "profiles": len(man.profiles),
+		"total_bytes_read": man.bytesRead,
+	})
+	return nil
+}
+
+// profileFile adds the tetrahedra in a single file to every profile which
+// intersects it. The file is only read if at least one profile does.
+func (man *ProfileManager) profileFile(file string) error {
+	err := io.ReadSheetHeaderAt(file, &man.hd)
+	if err != nil { return err }
+
+	profiles := []*Profile{ }
+	for _, p := range man.profiles {
+		if p.intersects(man.hd.Origin, man.hd.Width, man.hd.TotalWidth) {
+			profiles = append(profiles, p)
+		}
+	}
+	if len(profiles) == 0 { return nil }
+
+	bytes, err := loadSheet(file, &man.hd, man.xs, man.vs)
+	man.bytesRead += bytes
+	if err != nil { return err }
+
+	for _, p := range profiles {
+		runWorkers(man.workers, func(id int) {
+			man.workerProfile(id, p)
+		}, func(id int) {
+			// Merge worker profiles into the profile.
+			w := &man.workspaces[id]
+			for j := 0; j < p.Bins; j++ {
+				p.Mass[j] += w.mass[j]
+				p.VrSum[j] += w.vr[j]
+				p.Vr2Sum[j] += w.vr2[j]
+				p.Counts[j] += w.counts[j]
+			}
+		})
+	}
+	return nil
+}
+
+// workerProfile is a worker function run on a single thread which adds a
+// subset of the tetrahedra in the currently loaded file to the buffers of
+// the worker's workspace.
+func (man *ProfileManager) workerProfile(id int, p *Profile) {
+	w := &man.workspaces[id]
+	for j := 0; j < p.Bins; j++ {
+		w.mass[j], w.vr[j], w.vr2[j], w.counts[j] = 0, 0, 0, 0
+	}
+
+	L := float32(man.hd.TotalWidth)
+	center := geom.Vec{
+		float32(p.Center[0]), float32(p.Center[1]), float32(p.Center[2]),
+	}
+	weight := lagrangianWeight(&man.hd, man.skip, len(w.vecBuf))
+	tet, vtet, idxBuf := geom.Tetra{ }, geom.Tetra{ }, geom.TetraIdxs{ }
+
+	forCubes(&man.hd, man.skip, id, man.workers, func(idx, x, y, z int) {
+		origin, span := cubeBoundingBox(&man.hd, man.xs, man.skip, x, y, z)
+		if !p.intersects(origin, span, man.hd.TotalWidth) { return }
+
+		for dir := 0; dir < geom.TetraDirCount; dir++ {
+			idxBuf.Init(int64(idx), man.hd.GridWidth, int64(man.skip), dir)
+			tet.Init(
+				&man.xs[idxBuf[0]], &man.xs[idxBuf[1]],
+				&man.xs[idxBuf[2]], &man.xs[idxBuf[3]],
+			)
+			periodizeTetra(&tet, L)
+
+			bufIdx := w.gen.UniformInt(0, len(man.unitBufs))
+			tet.DistributeTetra(man.unitBufs[bufIdx], w.vecBuf)
+			if man.vs != nil {
+				vtet.Init(
+					&man.vs[idxBuf[0]], &man.vs[idxBuf[1]],
+					&man.vs[idxBuf[2]], &man.vs[idxBuf[3]],
+				)
+				vtet.DistributeTetra64(man.unitBufs[bufIdx], w.velBuf)
+			}
+
+			for i, pt := range w.vecBuf {
+				b := p.bin(radius(pt, center, L))
+				if b == -1 { continue }
+				if len(p.exclusions) > 0 {
+					x := [3]float64{
+						float64(pt[0]), float64(pt[1]), float64(pt[2]),
+					}
+					if p.excluded(x, man.hd.TotalWidth) { continue }
+				}
+
+				w.mass[b] += weight
+				w.counts[b]++
+				if man.vs != nil {
+					vr := radialVelocity(pt, center, w.velBuf[i], L)
+					w.vr[b] += weight * vr
+					w.vr2[b] += weight * vr*vr
+				}
+			}
+		}
+	})
+}
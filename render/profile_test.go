@@ -0,0 +1,111 @@
+package render
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+func TestProfileBins(t *testing.T) {
+	p, err := NewProfile([3]float64{ 0, 0, 0 }, 1, 100, 2)
+	if err != nil { t.Fatal(err.Error()) }
+
+	edges := p.Edges()
+	if len(edges) != 3 || math.Abs(edges[1] - 10) > 1e-10 {
+		t.Errorf("Edges are %v, expected [1 10 100].", edges)
+	}
+
+	table := []struct {
+		r float64
+		bin int
+	}{
+		{ 0.5, -1 }, { 1, 0 }, { 9.9, 0 }, { 10.1, 1 }, { 99, 1 }, { 100, -1 },
+	}
+	for i := range table {
+		if b := p.bin(table[i].r); b != table[i].bin {
+			t.Errorf("bin(%g) = %d, expected %d.", table[i].r, b, table[i].bin)
+		}
+	}
+
+	for _, args := range [][2]float64{ { 0, 1 }, { 2, 1 }, { -1, 1 } } {
+		_, err := NewProfile([3]float64{ }, args[0], args[1], 10)
+		if err == nil {
+			t.Errorf("Expected an error for radii %g and %g.", args[0], args[1])
+		}
+	}
+}
+
+func TestProfileExclude(t *testing.T) {
+	L := 100.0
+	p, err := NewProfile([3]float64{ 1, 1, 1 }, 1, 10, 5)
+	if err != nil { t.Fatal(err.Error()) }
+
+	p.Exclude([]Sphere{
+		// Wraps around the box to overlap the profile.
+		{ [3]float64{ 93, 1, 1 }, 1 },
+		// Contains the center.
+		{ [3]float64{ 2, 1, 1 }, 2 },
+		// Too far away.
+		{ [3]float64{ 50, 50, 50 }, 5 },
+	}, L)
+	if p.Exclusions() != 1 {
+		t.Fatalf("Profile has %d exclusions, expected 1.", p.Exclusions())
+	}
+
+	vols := p.Volumes(L)
+	p.exclusions = nil
+	full := p.Volumes(L)
+	// The excluded sphere is entirely within the outer bin.
+	expected := full[4] - 4*math.Pi/3
+	if math.Abs(vols[4] - expected) > 0.05*expected {
+		t.Errorf("Outer bin has volume %g, expected %g.", vols[4], expected)
+	}
+	for j := 0; j < 4; j++ {
+		if vols[j] != full[j] {
+			t.Errorf("Bin %d has volume %g, expected %g.", j, vols[j], full[j])
+		}
+	}
+}
+
+func TestProfileLattice(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	// dx = 2 Mpc/h.
+	L := 32.0
+	files := writeLatticeSheets(dir, 16, 2, float32(L))
+
+	defer func(n int) { NumCores = n }(NumCores)
+	NumCores = 3
+
+	// The second profile wraps around the edge of the box and excludes
+	// part of its outer bin.
+	profiles := make([]*Profile, 2)
+	centers := [][3]float64{ { 16, 16, 16 }, { 1, 31, 2 } }
+	for i := range profiles {
+		var err error
+		profiles[i], err = NewProfile(centers[i], 4, 12, 3)
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	profiles[1].Exclude([]Sphere{ { [3]float64{ 1, 21, 2 }, 2 } }, L)
+
+	man, err := NewProfileManager(files, profiles, 50, true)
+	if err != nil { t.Fatal(err.Error()) }
+	if err = man.Subsample(2); err != nil { t.Fatal(err.Error()) }
+	if err = man.Profile(); err != nil { t.Fatal(err.Error()) }
+
+	for i, p := range profiles {
+		rhos := p.Density(L)
+		vr, _ := p.RadialVelocity()
+		for j := range rhos {
+			if math.Abs(rhos[j] - 1) > 0.05 {
+				t.Errorf("Profile %d has densities %v, expected 1.", i, rhos)
+				break
+			}
+			if vr[j] != 0 {
+				t.Errorf("Profile %d has radial velocities %v, expected 0.",
+					i, vr)
+				break
+			}
+		}
+	}
+}
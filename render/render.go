@@ -1,6 +1,8 @@
 package render
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"path"
 	"runtime"
@@ -14,6 +16,8 @@ import (
 const (
 	UnitBufCount = 1 << 6
 	tetraIntr = true
+	// vecBytes is the size of a geom.Vec.
+	vecBytes = 12
 )
 
 var (
@@ -36,9 +40,25 @@ type Manager struct {
 	ms runtime.MemStats
 
 	// workspaces
-	q density.Quantity
+	loadVelocities bool
 	workers int
 	workspaces []workspace
+	maxPoints int
+	maxBufSizes map[density.Quantity]int
+
+	// flush is called on each box once it's finished.
+	flush func(i int) error
+
+	// checkpointing
+	checkpointFile string
+	checkpointInterval int
+	processed map[string]bool
+	resumed bool
+
+	// events is an optional machine-readable log and bytesRead is the
+	// number of bytes read from sheet files so far.
+	events *EventLog
+	bytesRead int64
 }
 
 type renderer struct {
@@ -47,29 +67,39 @@ type renderer struct {
 	cb geom.CellBounds
 	over Overlap
 	validSegs map[string]bool
+	skip int
+	// touched is true once anything has been added to the box's grid.
+	touched bool
 }
 
 type workspace struct {
+	// bufs contains one buffer for each quantity being rendered and buf is
+	// the buffer of the current renderer's quantity.
+	bufs map[density.Quantity]density.Buffer
 	buf density.Buffer
 	intr density.Interpolator
 	lowX, highX int
 }
 
+// NewManager creates a Manager which renders the given boxes from the given
+// sheet files. Boxes may render different quantities with different point
+// counts and subsample lengths while sharing the same pass through files.
 func NewManager(
-	files []string, boxes []Box, logFlag bool, q density.Quantity,
+	files []string, boxes []Box, logFlag bool,
 ) (*Manager, error) {
+	var err error
 	man := new(Manager)
 	man.log = logFlag
+	man.processed = make(map[string]bool)
 
-	maxPoints := 0
 	for _, b := range boxes {
-		if b.Points() > maxPoints { maxPoints = b.Points() }
+		if b.Points() > man.maxPoints { man.maxPoints = b.Points() }
 	}
-	man.unitBufs = unitBufs(UnitBufCount, maxPoints)
 	
 	man.skip = 1
 
 	man.workers = NumCores
+	if man.workers <= 0 { man.workers = runtime.NumCPU() }
 	runtime.GOMAXPROCS(man.workers)
 	man.workspaces = make([]workspace, man.workers)
 
@@ -80,6 +110,7 @@ func NewManager(
 			boxes[i].CellOrigin(), boxes[i].CellSpan(),
 		}
 		man.renderers[i].validSegs = make(map[string]bool)
+		man.renderers[i].skip = 1
 		g := geom.NewGridLocation(
 			boxes[i].CellOrigin(), boxes[i].CellSpan(),
 			boxes[i].CellWidth() * float64(boxes[i].Cells()), boxes[i].Cells(),
@@ -88,8 +119,78 @@ func NewManager(
 		
 	}
 
+	man.maxBufSizes, err = man.intersectFiles(files, boxes)
+	if err != nil { return nil, err }
+	for _, b := range boxes {
+		if b.Quantity().RequiresVelocity() { man.loadVelocities = true }
+	}
+	man.scheduleFiles()
+
+	err = io.ReadSheetHeaderAt(files[0], &man.hd)
+	if err != nil { return nil, err }
+
+	if man.log {
+		for q, size := range man.maxBufSizes {
+			log.Printf(
+				"%s workspace buffer size: %d. Number of workers: %d",
+				q, size, man.workers,
+			)
+		}
+	}
+
+	return man, nil
+}
+
+// alloc allocates the Manager's sheet buffers and workspaces. This is put
+// off until rendering starts so that Resources can be called first.
+func (man *Manager) alloc() {
+	man.unitBufs = unitBufs(UnitBufCount, man.maxPoints)
+
+	man.xs = make([]geom.Vec, man.hd.GridCount)
+	man.scaledXs = make([]geom.Vec, man.hd.GridCount)
+	if man.loadVelocities {
+		man.vs = make([]geom.Vec, man.hd.GridCount)
+	} else {
+		man.vs = nil
+	}
+
+	// Ugh. This feature is way more trouble than it's worth.
+	for i := range man.workspaces {
+		man.workspaces[i].bufs = make(map[density.Quantity]density.Buffer)
+		for q, size := range man.maxBufSizes {
+			man.workspaces[i].bufs[q] = density.NewBuffer(
+				q, size, man.maxPoints, man.renderers[0].g,
+			)
+		}
+	}
+
+	if man.log {
+		runtime.ReadMemStats(&man.ms)
+		log.Printf(
+			"Alloc: %5d MB, Sys: %5d MB",
+			man.ms.Alloc >> 20, man.ms.Sys >> 20,
+		)
+	}
+}
+
+// free releases everything allocated by alloc.
+func (man *Manager) free() {
+	man.unitBufs = nil
+	man.xs, man.scaledXs, man.vs = nil, nil, nil
+	for i := range man.workspaces {
+		man.workspaces[i].bufs = nil
+		man.workspaces[i].buf = nil
+	}
+}
+
+// intersectFiles finds the files which intersect each renderer and returns
+// the largest workspace buffer needed for each quantity.
+func (man *Manager) intersectFiles(
+	files []string, boxes []Box,
+) (map[density.Quantity]int, error) {
 	man.files = make([]string, 0)
-	maxBufSize := 0
+	maxBufSizes := make(map[density.Quantity]int)
+	for _, b := range boxes { maxBufSizes[b.Quantity()] = 0 }
 
 	for _, file := range files {
 		err := io.ReadSheetHeaderAt(file, &man.hd)
@@ -102,7 +203,8 @@ func NewManager(
 
 			if hCb.Intersect(&man.renderers[i].cb, cells) {
 				bufSize := boxes[i].Overlap(&man.hd).BufferSize()
-				if bufSize > maxBufSize { maxBufSize = bufSize }
+				q := boxes[i].Quantity()
+				if bufSize > maxBufSizes[q] { maxBufSizes[q] = bufSize }
 				
 				man.renderers[i].validSegs[file] = true
 				intersect = true
@@ -114,40 +216,75 @@ func NewManager(
 		}
 	}
 
-	err := io.ReadSheetHeaderAt(files[0], &man.hd)
-	if err != nil { return nil, err }
-	man.xs = make([]geom.Vec, man.hd.GridCount)
-	man.scaledXs = make([]geom.Vec, man.hd.GridCount)
-	if q.RequiresVelocity() {
-		man.vs = make([]geom.Vec, man.hd.GridCount)
-	} else {
-		man.vs = nil
-	}
+	return maxBufSizes, nil
+}
 
-	if man.log {
-		log.Printf(
-			"Workspace buffer size: %d. Number of workers: %d",
-			maxBufSize, man.workers,
-		)
+// scheduleFiles orders the intersecting files so that boxes are finished as
+// early as possible, which lets them be flushed and freed early. The
+// unfinished box with the fewest unscheduled files is repeatedly chosen and
+// all of its remaining files are scheduled.
+func (man *Manager) scheduleFiles() {
+	fileBoxes := make(map[string][]int)
+	unscheduled := make([]int, len(man.renderers))
+	for _, file := range man.files {
+		for ri := range man.renderers {
+			if !man.renderers[ri].requiresFile(file) { continue }
+			fileBoxes[file] = append(fileBoxes[file], ri)
+			unscheduled[ri]++
+		}
 	}
 
-	man.q = q
-	// Ugh. This feature is way more trouble than it's worth.
-	for i := range man.workspaces {
-		man.workspaces[i].buf = density.NewBuffer(
-			q, maxBufSize, maxPoints, man.renderers[0].g,
-		)
+	scheduled := make(map[string]bool)
+	order := make([]string, 0, len(man.files))
+	for {
+		best := -1
+		for ri := range unscheduled {
+			if unscheduled[ri] > 0 &&
+				(best == -1 || unscheduled[ri] < unscheduled[best]) {
+				best = ri
+			}
+		}
+		if best == -1 { break }
+
+		for _, file := range man.files {
+			if scheduled[file] || !man.renderers[best].requiresFile(file) {
+				continue
+			}
+			scheduled[file] = true
+			order = append(order, file)
+			for _, ri := range fileBoxes[file] { unscheduled[ri]-- }
+		}
 	}
 
+	man.files = order
+}
+
+// SetFlush sets a function which is called on the index of each box as soon
+// as the last file which intersects it has been rendered. The box's grid is
+// freed after flush returns, so flush should write it to disk.
+func (man *Manager) SetFlush(flush func(i int) error) {
+	man.flush = flush
+}
+
+// finish flushes and frees the ith box.
+func (man *Manager) finish(i, done int) error {
 	if man.log {
-		runtime.ReadMemStats(&man.ms)
 		log.Printf(
-			"Alloc: %5d MB, Sys: %5d MB",
-			man.ms.Alloc >> 20, man.ms.Sys >> 20,
+			"Finished box %d (%d/%d boxes done)",
+			i, done, len(man.renderers),
 		)
 	}
 
-	return man, nil
+	man.events.Emit("box_finish", Event{
+		"box": i, "boxes_done": done, "boxes": len(man.renderers),
+	})
+
+	box := man.renderers[i].box
+	if man.flush != nil {
+		if err := man.flush(i); err != nil { return err }
+		box.Free()
+	}
+	return nil
 }
 
 // unitBufs generates nUnit collections of vectors distributed uniformly over
@@ -180,7 +317,7 @@ func (r *renderer) scaleXs(man *Manager) {
 }
 
 func (r *renderer) ptVal(man *Manager) float64 {
-	if man.q.RequiresVelocity() {
+	if r.box.Quantity().RequiresVelocity() {
 		return 1
 	} else {
 		frac := float64(r.box.Cells()) / float64(man.hd.CountWidth)
@@ -189,7 +326,7 @@ func (r *renderer) ptVal(man *Manager) float64 {
 }
 
 func (r *renderer) initWorkspaces(man *Manager) {
-	segFrac := int(man.hd.SegmentWidth) / man.skip
+	segFrac := int(man.hd.SegmentWidth) / r.skip
 	segLen := segFrac * segFrac * segFrac
 
 	for i := range man.unitBufs {
@@ -200,9 +337,10 @@ func (r *renderer) initWorkspaces(man *Manager) {
 		// TODO: fix this int64 silliness
 		man.workspaces[id].intr = density.MonteCarlo(
 			man.hd.SegmentWidth, r.box.Points(), r.box.Cells(),
-			int64(man.skip), man.unitBufs, r.over,
+			int64(r.skip), man.unitBufs, r.over,
 		)
 
+		man.workspaces[id].buf = man.workspaces[id].bufs[r.box.Quantity()]
 		man.workspaces[id].buf.Slice(0, r.over.BufferSize())
 		man.workspaces[id].buf.SetGridLocation(r.g)
 		man.workspaces[id].buf.Clear()
@@ -214,12 +352,37 @@ func (r *renderer) initWorkspaces(man *Manager) {
 
 func (man *Manager) Log(flag bool) { man.log = flag }
 
-func (man *Manager) Subsample(subsampleLength int) {
-	if !isPowTwo(man.skip) {
-		log.Fatalf("Skip ingrement is %d, must be power of two.", man.skip)
-	}
+// SetEventLog makes the Manager write progress events to events.
+func (man *Manager) SetEventLog(events *EventLog) { man.events = events }
+
+// Subsample makes every box use only every subsampleLength-th particle along
+// each axis. subsampleLength must be a power of two which evenly divides the
+// segment width of the sheets.
+func (man *Manager) Subsample(subsampleLength int) error {
+	err := checkSubsample(&man.hd, subsampleLength)
+	if err != nil { return err }
 
 	man.skip = subsampleLength
+	for i := range man.renderers { man.renderers[i].skip = subsampleLength }
+	return nil
+}
+
+// SubsampleBox overrides the subsample length of the ith box. It must be
+// called after Subsample and can't be smaller than the subsample length
+// given to it.
+func (man *Manager) SubsampleBox(i, subsampleLength int) error {
+	err := checkSubsample(&man.hd, subsampleLength)
+	if err != nil { return err }
+	if subsampleLength < man.skip {
+		return fmt.Errorf(
+			"Subsample length of box %d is %d, but it can't be smaller " +
+				"than the subsample length of every box, %d.",
+			i, subsampleLength, man.skip,
+		)
+	}
+
+	man.renderers[i].skip = subsampleLength
+	return nil
 }
 
 func isPowTwo(x int) bool {
@@ -227,11 +390,92 @@ func isPowTwo(x int) bool {
 	return x == 1
 }
 
+// RenderDensity renders every box.
 func (man *Manager) RenderDensity() error {
+	return man.RenderDensityContext(context.Background())
+}
+
+// RenderDensityContext is the same as RenderDensity, except that it stops
+// after the current file and returns ctx.Err() if ctx is cancelled.
+func (man *Manager) RenderDensityContext(ctx context.Context) error {
+	man.alloc()
+	defer man.free()
+
+	remaining := make([]int, len(man.renderers))
 	for _, file := range man.files {
+		if man.processed[file] { continue }
+		for ri := range man.renderers {
+			if man.renderers[ri].requiresFile(file) { remaining[ri]++ }
+		}
+	}
+
+	// Boxes which don't intersect any files are already finished. If we're
+	// resuming from a checkpoint, they were flushed before it was written.
+	done := 0
+	for ri := range man.renderers {
+		if remaining[ri] > 0 { continue }
+		done++
+		if man.resumed { continue }
+		if err := man.finish(ri, done); err != nil { return err }
+	}
+
+	man.events.Emit("render_start", Event{
+		"files": len(man.files), "files_done": len(man.processed),
+		"boxes": len(man.renderers), "boxes_done": done,
+	})
+
+	sinceCheckpoint := 0
+	for fi, file := range man.files {
+		if man.processed[file] { continue }
+		if err := ctx.Err(); err != nil { return err }
+		man.events.Emit("file_start", Event{
+			"file": file, "index": fi, "files": len(man.files),
+		})
+		bytesRead := man.bytesRead
+		if man.log {
+			log.Printf(
+				"File %d/%d, %d/%d boxes done",
+				fi + 1, len(man.files), done, len(man.renderers),
+			)
+		}
+
 		err := man.RenderDensityFromFile(file)
 		if err != nil { return err }
+
+		for ri := range man.renderers {
+			if !man.renderers[ri].requiresFile(file) { continue }
+			remaining[ri]--
+			if remaining[ri] == 0 {
+				done++
+				if err := man.finish(ri, done); err != nil { return err }
+			}
+		}
+		man.processed[file] = true
+		man.events.Emit("file_finish", Event{
+			"file": file, "index": fi, "files": len(man.files),
+			"files_done": len(man.processed),
+			"bytes_read": man.bytesRead - bytesRead,
+			"total_bytes_read": man.bytesRead,
+			"boxes_done": done, "boxes": len(man.renderers),
+		})
+
+		// A checkpoint is always written after the last file so that a
+		// finished pass isn't repeated when resuming.
+		sinceCheckpoint++
+		if man.checkpointFile != "" &&
+			(sinceCheckpoint >= man.checkpointInterval ||
+			len(man.processed) == len(man.files)) {
+			if err := man.writeCheckpoint(remaining); err != nil {
+				return err
+			}
+			sinceCheckpoint = 0
+		}
 	}
+
+	man.events.Emit("render_finish", Event{
+		"files": len(man.files), "boxes": len(man.renderers),
+		"total_bytes_read": man.bytesRead,
+	})
 	return nil
 }
 
@@ -275,6 +519,7 @@ func (man *Manager) RenderDensityFromFile(file string) error {
 			id := <-out
 			r.over.Add(man.workspaces[id].buf, r.box.Vals())
 		}
+		r.touched = true
 	}
 	
 	if man.log {
@@ -293,9 +538,11 @@ func (man *Manager) loadFile(file string) error {
 	if err != nil { return err }
 	err = io.ReadSheetPositionsAt(file, man.xs)
 	if err != nil { return err }
-	if man.q.RequiresVelocity() {
+	man.bytesRead += man.hd.GridCount * vecBytes
+	if man.loadVelocities {
 		err = io.ReadSheetVelocitiesAt(file, man.vs)
 		if err != nil { return err }
+		man.bytesRead += man.hd.GridCount * vecBytes
 	}
 	runtime.GC()
 
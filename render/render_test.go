@@ -0,0 +1,101 @@
+package render
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+func TestScheduleFiles(t *testing.T) {
+	files := []string{ "f0", "f1", "f2", "f3", "f4", "f5" }
+	// required[i] lists the files which box i intersects.
+	required := [][]string{
+		{ "f0", "f1", "f2", "f3" },
+		{ "f4" },
+		{ "f1", "f5" },
+	}
+
+	man := &Manager{ files: files, renderers: make([]renderer, 3) }
+	for i := range required {
+		man.renderers[i].validSegs = make(map[string]bool)
+		for _, f := range required[i] { man.renderers[i].validSegs[f] = true }
+	}
+	man.scheduleFiles()
+
+	// Box 1 needs one file and box 2 needs two, so they're finished before
+	// box 0 starts. f1 is shared by boxes 0 and 2.
+	order := []string{ "f4", "f1", "f5", "f0", "f2", "f3" }
+	if !reflect.DeepEqual(man.files, order) {
+		t.Errorf("Files scheduled as %v, expected %v.", man.files, order)
+	}
+
+	// finished[i] is the number of files read before box i is finished.
+	finished := []int{ 6, 1, 3 }
+	for i := range required {
+		last := 0
+		for fi, f := range man.files {
+			if man.renderers[i].requiresFile(f) { last = fi + 1 }
+		}
+		if last != finished[i] {
+			t.Errorf("Box %d is finished after %d files, expected %d.",
+				i, last, finished[i])
+		}
+	}
+}
+
+func TestFlushAfterLastFile(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	files := writeLatticeSheets(dir, 16, 2, 16)
+
+	configs := []io.BoxConfig{
+		// Covers every file.
+		{ X: 0, Y: 0, Z: 0, XWidth: 15, YWidth: 15, ZWidth: 15 },
+		{ X: 2, Y: 2, Z: 2, XWidth: 3, YWidth: 3, ZWidth: 3 },
+		{ X: 6, Y: 10, Z: 3, XWidth: 4, YWidth: 2, ZWidth: 2 },
+	}
+	boxes := make([]Box, len(configs))
+	for i := range configs {
+		configs[i].Name = fmt.Sprintf("box%d", i)
+		boxes[i] = NewBox(16, 10, 16, density.Density, &configs[i])
+	}
+	man, err := NewManager(files, boxes, false)
+	if err != nil { t.Fatal(err.Error()) }
+
+	// last[i] is the index of the last file which box i needs.
+	last := make([]int, len(boxes))
+	for i := range man.renderers {
+		for fi, f := range man.files {
+			if man.renderers[i].requiresFile(f) { last[i] = fi }
+		}
+	}
+	if last[0] != len(man.files) - 1 || last[1] >= last[0] {
+		t.Fatalf("Boxes need files up to %v of %d.", last, len(man.files))
+	}
+
+	flushed := make([]int, len(boxes))
+	for i := range flushed { flushed[i] = -1 }
+	man.SetFlush(func(i int) error {
+		// The file being rendered hasn't been marked as processed yet.
+		flushed[i] = len(man.processed)
+		if man.renderers[i].box.(*box3D).bvals == nil {
+			t.Errorf("Box %d has no grid when it's flushed.", i)
+		}
+		return nil
+	})
+	if err = man.RenderDensity(); err != nil { t.Fatal(err.Error()) }
+
+	if !reflect.DeepEqual(flushed, last) {
+		t.Errorf("Boxes were flushed after files %v, expected %v.",
+			flushed, last)
+	}
+	for i := range man.renderers {
+		if man.renderers[i].box.(*box3D).bvals != nil {
+			t.Errorf("Box %d wasn't freed after being flushed.", i)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package render
+
+import (
+	"fmt"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+)
+
+// Rough per-operation costs used to estimate run times. These are only
+// meant to give the right order of magnitude.
+const (
+	secondsPerTetra = 2e-7
+	secondsPerPoint = 2e-8
+	secondsPerByteRead = 1e-8
+)
+
+// Resources is an estimate of the memory and time needed by a Manager.
+type Resources struct {
+	// Memory in bytes used by box grids, worker workspaces, the loaded sheet
+	// segment, and the unit buffers used for sampling tetrahedra.
+	GridBytes, WorkspaceBytes, SheetBytes, UnitBufBytes int64
+
+	// Segments is the number of sheet segments which need to be loaded and
+	// Tetrahedra and Points are the number of tetrahedra and points which
+	// will be interpolated.
+	Segments int
+	Tetrahedra, Points int64
+
+	// Seconds is a rough estimate of the wall-clock run time.
+	Seconds float64
+}
+
+// Bytes returns the total estimated memory usage.
+func (r *Resources) Bytes() int64 {
+	return r.GridBytes + r.WorkspaceBytes + r.SheetBytes + r.UnitBufBytes
+}
+
+func (r *Resources) String() string {
+	return fmt.Sprintf(
+		"%d MB (grids: %d MB, workspaces: %d MB, sheets: %d MB, " +
+			"unit buffers: %d MB), %d segments, %d tetrahedra, %d points, " +
+			"~%.0f s",
+		r.Bytes() >> 20, r.GridBytes >> 20, r.WorkspaceBytes >> 20,
+		r.SheetBytes >> 20, r.UnitBufBytes >> 20, r.Segments, r.Tetrahedra,
+		r.Points, r.Seconds,
+	)
+}
+
+// Resources estimates the resources used by RenderDensity. It should be
+// called after Subsample and SubsampleBox. The estimate of GridBytes assumes
+// every box is allocated at once, which is an upper bound when a flush
+// function has been set.
+func (man *Manager) Resources() *Resources {
+	r := &Resources{ }
+
+	for _, rend := range man.renderers {
+		r.GridBytes += rend.box.ValsBytes()
+	}
+	for q, size := range man.maxBufSizes {
+		r.WorkspaceBytes += density.BufferBytes(q, size, man.maxPoints)
+	}
+	r.WorkspaceBytes *= int64(man.workers)
+
+	vecs := int64(2)
+	if man.loadVelocities { vecs = 3 }
+	r.SheetBytes = vecs * vecBytes * man.hd.GridCount
+	r.UnitBufBytes = UnitBufCount * vecBytes * int64(man.maxPoints)
+
+	r.Segments = len(man.files)
+	for _, file := range man.files {
+		for _, rend := range man.renderers {
+			if !rend.requiresFile(file) { continue }
+			segWidth := man.hd.SegmentWidth / int64(rend.skip)
+			tetra := 6 * segWidth * segWidth * segWidth
+			r.Tetrahedra += tetra
+			r.Points += tetra * int64(rend.box.Points())
+		}
+	}
+
+	workers := float64(man.workers)
+	r.Seconds = float64(r.Tetrahedra) * secondsPerTetra / workers +
+		float64(r.Points) * secondsPerPoint / workers +
+		float64(int64(r.Segments) * man.hd.GridCount * vecBytes * (vecs - 1)) *
+		secondsPerByteRead
+
+	return r
+}
@@ -0,0 +1,87 @@
+package render
+
+import (
+	"os"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/render/density"
+)
+
+func TestBufferBytes(t *testing.T) {
+	table := []struct {
+		q density.Quantity
+		len, wlen int
+		bytes int64
+	}{
+		// Scalar grids hold one float64 per pixel.
+		{ density.Density, 1000, 50, 8000 },
+		{ density.DensityGradient, 1000, 50, 8000 },
+		// Vector grids hold three float64s and a count per pixel, plus
+		// three float64 weights per point.
+		{ density.Velocity, 1000, 50, 32000 + 1200 },
+		{ density.VelocityDivergence, 1000, 50, 32000 + 1200 },
+		{ density.VelocityCurl, 1000, 0, 32000 },
+	}
+
+	for i := range table {
+		bytes := density.BufferBytes(table[i].q, table[i].len, table[i].wlen)
+		if bytes != table[i].bytes {
+			t.Errorf(
+				"%d) BufferBytes(%s, %d, %d) = %d, expected %d.", i,
+				table[i].q, table[i].len, table[i].wlen, bytes, table[i].bytes,
+			)
+		}
+	}
+}
+
+func TestEstimateBoxes(t *testing.T) {
+	sheetDir := latticeDir(t)
+	defer os.RemoveAll(sheetDir)
+	writeLatticeSheets(sheetDir, 16, 2, 16)
+
+	box := BoxSpec{
+		Name: "a", X: 1, Y: 2, Z: 3, XWidth: 3, YWidth: 3, ZWidth: 3,
+	}
+	opts := Options{
+		Quantity: density.Density, TotalPixels: 16, Particles: 10,
+	}
+	estimate := func(specs []BoxSpec, opts Options) *Resources {
+		rs, err := EstimateBoxes(sheetDir, specs, opts)
+		if err != nil { t.Fatal(err.Error()) }
+		if len(rs) != 1 { t.Fatalf("Boxes need %d passes, not 1.", len(rs)) }
+		return rs[0]
+	}
+
+	// A 3 Mpc/h box covers 4^3 pixels at 16 pixels across the simulation and
+	// 7^3 pixels at 32.
+	one := estimate([]BoxSpec{ box }, opts)
+	if one.GridBytes != 8 * 4*4*4 {
+		t.Errorf("GridBytes of one box is %d, expected %d.",
+			one.GridBytes, 8 * 4*4*4)
+	}
+	fine := opts
+	fine.TotalPixels = 32
+	if r := estimate([]BoxSpec{ box }, fine); r.GridBytes != 8 * 7*7*7 {
+		t.Errorf("GridBytes with twice the pixels is %d, expected %d.",
+			r.GridBytes, 8 * 7*7*7)
+	}
+
+	// A second box in the same files doubles the grids and the work, but
+	// doesn't read any more sheets.
+	b := box
+	b.Name = "b"
+	two := estimate([]BoxSpec{ box, b }, opts)
+	if two.GridBytes != 2 * one.GridBytes ||
+		two.Tetrahedra != 2 * one.Tetrahedra ||
+		two.Points != 2 * one.Points {
+		t.Errorf("Two boxes need %s, but one box needs %s.", two, one)
+	}
+	if two.SheetBytes != one.SheetBytes || two.Segments != one.Segments ||
+		two.WorkspaceBytes != one.WorkspaceBytes {
+		t.Errorf("Two boxes need %s, but one box needs %s.", two, one)
+	}
+	if two.Seconds <= one.Seconds {
+		t.Errorf("Two boxes take %g s, but one box takes %g s.",
+			two.Seconds, one.Seconds)
+	}
+}
@@ -0,0 +1,285 @@
+package render
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/phil-mansfield/gotetra/math/interpolate"
+	"github.com/phil-mansfield/gotetra/math/rand"
+	"github.com/phil-mansfield/gotetra/render/geom"
+)
+
+// Splashback contains the lines of sight sampled around a single halo and
+// the splashback radius found along each of them.
+type Splashback struct {
+	Center [3]float64
+	RMin, RMax float64
+
+	// Units are the directions of the lines of sight. Radii is the radius of
+	// the steepest logarithmic slope along each line, and Slopes is that
+	// slope. Both are NaN for lines where no density could be measured.
+	Units [][3]float64
+	Radii, Slopes []float64
+}
+
+// Valid returns the number of lines of sight with a splashback radius.
+func (sp *Splashback) Valid() int {
+	n := 0
+	for _, r := range sp.Radii {
+		if !math.IsNaN(r) { n++ }
+	}
+	return n
+}
+
+// Radius returns the median splashback radius of every line of sight. It
+// returns NaN if there are no valid lines.
+func (sp *Splashback) Radius() float64 {
+	rs := make([]float64, 0, len(sp.Radii))
+	for _, r := range sp.Radii {
+		if !math.IsNaN(r) { rs = append(rs, r) }
+	}
+	if len(rs) == 0 { return math.NaN() }
+
+	sort.Float64s(rs)
+	n := len(rs)
+	if n % 2 == 1 { return rs[n/2] }
+	return (rs[n/2 - 1] + rs[n/2]) / 2
+}
+
+// Points returns the point where each valid line of sight crosses the
+// splashback shell within a periodic box of width L.
+func (sp *Splashback) Points(L float64) [][3]float64 {
+	pts := make([][3]float64, 0, len(sp.Radii))
+	for i, r := range sp.Radii {
+		if math.IsNaN(r) { continue }
+		pt := [3]float64{ }
+		for k := 0; k < 3; k++ {
+			pt[k] = sp.Center[k] + r*sp.Units[i][k]
+			if pt[k] < 0 { pt[k] += L }
+			if pt[k] >= L { pt[k] -= L }
+		}
+		pts = append(pts, pt)
+	}
+	return pts
+}
+
+// SplashbackManager finds splashback radii by sampling the density along
+// lines of sight through each halo. Densities are found by summing every
+// tetrahedron which contains each point, so no density grid is needed.
+type SplashbackManager struct {
+	hist *HistManager
+	lines, samples int
+	order, window int
+	events *EventLog
+}
+
+// NewSplashbackManager creates a SplashbackManager which samples lines lines
+// of sight with samples log-spaced points each through the given boxes. The
+// boxes must be spherical shells. Each line is smoothed by a Savitzky-Golay
+// filter with the given polynomial order and window width in points.
+func NewSplashbackManager(
+	files []string, boxes []HistBox, lines, samples, order, window int,
+) (*SplashbackManager, error) {
+	for i := range boxes {
+		if !boxes[i].Spherical || boxes[i].RMin <= 0 {
+			return nil, fmt.Errorf(
+				"Splashback radii can only be found in spherical shells, " +
+					"but region %d isn't one.", i,
+			)
+		}
+	}
+	if lines <= 0 || samples <= 0 {
+		return nil, fmt.Errorf(
+			"Splashback needs a positive number of lines and samples, but " +
+				"was given %d and %d.", lines, samples,
+		)
+	} else if order < 1 {
+		return nil, fmt.Errorf(
+			"Savitzky-Golay order is %d, but it must be positive.", order,
+		)
+	} else if window % 2 != 1 || window <= order {
+		return nil, fmt.Errorf(
+			"Savitzky-Golay window is %d, but it must be odd and larger " +
+				"than the order, %d.", window, order,
+		)
+	} else if window > samples {
+		return nil, fmt.Errorf(
+			"Savitzky-Golay window is %d, but lines of sight only have %d " +
+				"points.", window, samples,
+		)
+	}
+
+	hist, err := NewHistManager(files, boxes, 1, []string{ "Density" }, "")
+	if err != nil { return nil, err }
+
+	return &SplashbackManager{
+		hist: hist, lines: lines, samples: samples,
+		order: order, window: window,
+	}, nil
+}
+
+// Subsample makes the SplashbackManager only use every skip-th particle
+// along each axis. skip must be a power of two which evenly divides the
+// segment width of the sheets.
+func (man *SplashbackManager) Subsample(skip int) error {
+	return man.hist.Subsample(skip)
+}
+
+// SetEventLog makes the SplashbackManager write progress events to events.
+func (man *SplashbackManager) SetEventLog(events *EventLog) {
+	man.events = events
+	man.hist.SetEventLog(events)
+}
+
+// SetIndexMemory limits the memory used by the tetrahedron indices of the
+// boxes to mb megabytes. Boxes are indexed and processed in batches which
+// fit in this limit. If mb is zero, every box is indexed at once.
+func (man *SplashbackManager) SetIndexMemory(mb int) {
+	man.hist.SetIndexMemory(mb)
+}
+
+// Find reads every file and returns the splashback radii of every box.
+func (man *SplashbackManager) Find() ([]*Splashback, error) {
+	hist := man.hist
+	boxes := hist.boxes
+	man.events.Emit("splashback_start", Event{
+		"files": len(hist.files), "boxes": len(boxes),
+	})
+	batches, err := hist.indexBatches()
+	if err != nil { return nil, err }
+
+	// Each batch of boxes is indexed and then searched, with hist.boxes
+	// temporarily set to the batch.
+	defer func() { hist.boxes = boxes }()
+	L := hist.hd.TotalWidth
+	sps := make([]*Splashback, len(boxes))
+	for bi, batch := range batches {
+		hist.boxes = boxes[batch[0]:batch[1]]
+		if len(batches) > 1 {
+			log.Printf(
+				"Finding splashback radii %d-%d (batch %d/%d)",
+				batch[0], batch[1] - 1, bi + 1, len(batches),
+			)
+		}
+		if err := hist.indexFiles(); err != nil { return nil, err }
+
+		for i := batch[0]; i < batch[1]; i++ {
+			log.Printf("Finding splashback radius %d/%d", i, len(boxes))
+			sps[i] = man.findBox(&boxes[i], int64(i), L)
+			boxes[i].index = nil
+			man.events.Emit("box_finish", Event{
+				"box": i, "boxes": len(boxes),
+				"radius": sps[i].Radius(), "valid_lines": sps[i].Valid(),
+			})
+		}
+	}
+
+	man.events.Emit("splashback_finish", Event{
+		"files": len(hist.files), "boxes": len(boxes),
+		"total_bytes_read": hist.bytesRead,
+	})
+	return sps, nil
+}
+
+// findBox finds the splashback radius along every line of sight through a
+// single indexed box. Lines of sight are split between workers.
+func (man *SplashbackManager) findBox(
+	box *HistBox, seed int64, L float64,
+) *Splashback {
+	center := box.Center(L)
+	sp := &Splashback{
+		Center: [3]float64{
+			float64(center[0]), float64(center[1]), float64(center[2]),
+		},
+		RMin: box.RMin, RMax: box.RMax,
+		Units: make([][3]float64, man.lines),
+		Radii: make([]float64, man.lines),
+		Slopes: make([]float64, man.lines),
+	}
+
+	// Directions are drawn with a fixed seed so that results are
+	// reproducible.
+	gen := rand.New(rand.Tausworthe, uint64(seed))
+	for i := range sp.Units { sp.Units[i] = randomUnit(gen) }
+
+	workers := man.hist.workers
+	runWorkers(workers, func(id int) {
+		man.workerFindLines(id, workers, box, sp)
+	}, nil)
+
+	return sp
+}
+
+// workerFindLines is a worker function run on a single thread which finds
+// the splashback radius along every workers-th line of sight.
+func (man *SplashbackManager) workerFindLines(
+	id, workers int, box *HistBox, sp *Splashback,
+) {
+	dlr := math.Log(sp.RMax / sp.RMin) / float64(man.samples)
+	kernel := interpolate.NewSavGolDerivKernel(dlr, 1, man.order, man.window)
+
+	rs := make([]float64, man.samples)
+	for j := range rs {
+		rs[j] = sp.RMin * math.Exp(dlr*(float64(j) + 0.5))
+	}
+	lrhos := make([]float64, man.samples)
+	slopes := make([]float64, man.samples)
+	tet := geom.Tetra{ }
+
+	for i := id; i < man.lines; i += workers {
+		sp.Radii[i], sp.Slopes[i] = math.NaN(), math.NaN()
+		if !lineDensities(box.index, sp.Center, sp.Units[i], rs, lrhos, &tet) {
+			continue
+		}
+
+		kernel.ConvolveAt(lrhos, interpolate.Extension, slopes)
+		j, offset := steepestSlope(slopes, man.window/2)
+		sp.Radii[i] = sp.RMin * math.Exp(dlr*(float64(j) + 0.5 + offset))
+		sp.Slopes[i] = slopes[j]
+	}
+}
+
+// lineDensities writes the log of the density at each radius in rs along
+// the line of sight leaving center in the direction unit to lrhos. It
+// returns false if any point along the line has no density.
+func lineDensities(
+	idx *tetraIndex, center, unit [3]float64,
+	rs, lrhos []float64, tet *geom.Tetra,
+) bool {
+	for j, r := range rs {
+		x := geom.Vec{ }
+		for k := 0; k < 3; k++ { x[k] = float32(center[k] + r*unit[k]) }
+		rho, _ := idx.Streams(x, tet)
+		if rho <= 0 { return false }
+		lrhos[j] = math.Log(rho)
+	}
+	return true
+}
+
+// steepestSlope returns the index of the most negative element of slopes,
+// ignoring edge elements at either end, and the fractional offset of the
+// minimum of a parabola fit through it and its neighbors.
+func steepestSlope(slopes []float64, edge int) (int, float64) {
+	lo, hi := edge, len(slopes) - edge
+	if hi <= lo { lo, hi = 0, len(slopes) }
+
+	j := lo
+	for i := lo; i < hi; i++ {
+		if slopes[i] < slopes[j] { j = i }
+	}
+	if j == 0 || j == len(slopes) - 1 { return j, 0 }
+
+	s0, s1, s2 := slopes[j - 1], slopes[j], slopes[j + 1]
+	curv := s0 - 2*s1 + s2
+	if curv <= 0 { return j, 0 }
+	return j, (s0 - s2) / (2 * curv)
+}
+
+// randomUnit returns a unit vector drawn uniformly from the sphere.
+func randomUnit(gen *rand.Generator) [3]float64 {
+	cosTh, phi := gen.Uniform(-1, 1), gen.Uniform(0, 2*math.Pi)
+	sinTh := math.Sqrt(1 - cosTh*cosTh)
+	return [3]float64{ sinTh*math.Cos(phi), sinTh*math.Sin(phi), cosTh }
+}
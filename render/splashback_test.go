@@ -0,0 +1,171 @@
+package render
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/phil-mansfield/gotetra/math/interpolate"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+func TestSteepestSlope(t *testing.T) {
+	// The slope of this profile is -2 - 3 sech^2((ln r - ln rsp) / 0.2) / 0.2,
+	// which is steepest at rsp.
+	rMin, rMax, samples := 0.5, 8.0, 100
+	dlr := math.Log(rMax / rMin) / float64(samples)
+	for _, rsp := range []float64{ 1.3, 2, 3.7 } {
+		lrhos := make([]float64, samples)
+		for j := range lrhos {
+			lr := math.Log(rMin) + dlr*(float64(j) + 0.5)
+			lrhos[j] = -2*lr - 3*math.Tanh((lr - math.Log(rsp)) / 0.2)
+		}
+
+		kernel := interpolate.NewSavGolDerivKernel(dlr, 1, 4, 11)
+		slopes := kernel.Convolve(lrhos, interpolate.Extension)
+		j, offset := steepestSlope(slopes, 5)
+		r := rMin * math.Exp(dlr*(float64(j) + 0.5 + offset))
+
+		if math.Abs(r - rsp) > 0.01*rsp {
+			t.Errorf("Found splashback radius %g, expected %g.", r, rsp)
+		}
+		if slopes[j] > -10 {
+			t.Errorf("Steepest slope at %g is %g, expected about -17.",
+				rsp, slopes[j])
+		}
+	}
+}
+
+func TestSplashbackLattice(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	L := 32.0
+	files := writeLatticeSheets(dir, 16, 2, float32(L))
+
+	defer func(n int) { NumCores = n }(NumCores)
+	NumCores = 3
+
+	// The second ball wraps around the edge of the box.
+	balls := []io.BallConfig{
+		{ X: 15.3, Y: 16.7, Z: 15.9, Radius: 8, RadiusMin: 1 },
+		{ X: 1.3, Y: 30.7, Z: 0.9, Radius: 8, RadiusMin: 1 },
+	}
+	boxes := make([]HistBox, len(balls))
+	for i := range balls {
+		balls[i].RadiusMultiplier = 1
+		var err error
+		boxes[i], err = NewHistBox(balls[i].Box(L))
+		if err != nil { t.Fatal(err.Error()) }
+	}
+
+	lines := 20
+	_, err := NewSplashbackManager(files, boxes, lines, 10, 4, 11)
+	if err == nil {
+		t.Errorf("Expected an error for a window larger than the lines.")
+	}
+	man, err := NewSplashbackManager(files, boxes, lines, 50, 4, 11)
+	if err != nil { t.Fatal(err.Error()) }
+	sps, err := man.Find()
+	if err != nil { t.Fatal(err.Error()) }
+
+	for i, sp := range sps {
+		// A lattice has a density of one everywhere.
+		if sp.Valid() != lines {
+			t.Errorf("%d: %d of %d lines of sight are valid.",
+				i, sp.Valid(), lines)
+		}
+
+		center := [3]float64{ balls[i].X, balls[i].Y, balls[i].Z }
+		for j, pt := range sp.Points(L) {
+			r := periodicDistance(pt, center, L)
+			if math.Abs(r - sp.Radii[j]) > 1e-6 {
+				t.Errorf("%d: point %d is at radius %g, expected %g.",
+					i, j, r, sp.Radii[j])
+			}
+			if r < sp.RMin || r > sp.RMax {
+				t.Errorf("%d: point %d is at radius %g, outside (%g, %g).",
+					i, j, r, sp.RMin, sp.RMax)
+			}
+			if math.Abs(sp.Slopes[j]) > 0.1 {
+				t.Errorf("%d: line %d has slope %g, expected 0.",
+					i, j, sp.Slopes[j])
+			}
+		}
+	}
+}
+
+func TestSplashbackBatches(t *testing.T) {
+	dir := latticeDir(t)
+	defer os.RemoveAll(dir)
+	L := 32.0
+	files := writeLatticeSheets(dir, 16, 2, float32(L))
+
+	balls := []io.BallConfig{
+		{ X: 15.3, Y: 16.7, Z: 15.9, Radius: 8, RadiusMin: 1 },
+		{ X: 1.3, Y: 30.7, Z: 0.9, Radius: 6, RadiusMin: 1 },
+		{ X: 24.1, Y: 8.2, Z: 20.5, Radius: 4, RadiusMin: 1 },
+	}
+	newManager := func() *SplashbackManager {
+		boxes := make([]HistBox, len(balls))
+		for i := range balls {
+			balls[i].RadiusMultiplier = 1
+			var err error
+			boxes[i], err = NewHistBox(balls[i].Box(L))
+			if err != nil { t.Fatal(err.Error()) }
+		}
+		man, err := NewSplashbackManager(files, boxes, 20, 50, 4, 11)
+		if err != nil { t.Fatal(err.Error()) }
+		return man
+	}
+
+	// Measure the largest index.
+	man := newManager()
+	man.hist.newIndices()
+	for _, file := range files {
+		err := man.hist.indexFile(file, true)
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	max := int64(0)
+	for i := range man.hist.boxes {
+		if b := man.hist.boxes[i].index.Bytes(); b > max { max = b }
+	}
+
+	man = newManager()
+	man.SetIndexMemory(0)
+	expected, err := man.Find()
+	if err != nil { t.Fatal(err.Error()) }
+
+	man = newManager()
+	man.hist.indexBytes = max
+	batches, err := man.hist.indexBatches()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(batches) < 2 {
+		t.Errorf("Halos were split into batches %v, expected at least two.",
+			batches)
+	}
+	sps, err := man.Find()
+	if err != nil { t.Fatal(err.Error()) }
+	if len(man.hist.boxes) != len(balls) {
+		t.Fatalf("Manager has %d boxes after Find, expected %d.",
+			len(man.hist.boxes), len(balls))
+	}
+
+	// Lines of sight are seeded by halo, so batching doesn't change them.
+	for i := range sps {
+		for j := range sps[i].Radii {
+			if sps[i].Radii[j] != expected[i].Radii[j] {
+				t.Errorf("%d: line %d has radius %g in batches, but %g " +
+					"without.", i, j, sps[i].Radii[j], expected[i].Radii[j])
+			}
+		}
+		if man.hist.boxes[i].index != nil {
+			t.Errorf("Index of halo %d wasn't freed.", i)
+		}
+	}
+
+	man = newManager()
+	man.hist.indexBytes = max - 1
+	if _, err = man.Find(); err == nil {
+		t.Errorf("Expected an error when a halo's index is over the limit.")
+	}
+}
@@ -0,0 +1,176 @@
+package render
+
+import (
+	"math"
+
+	"github.com/phil-mansfield/gotetra/render/geom"
+)
+
+// maxIndexCells is the maximum number of cells along each side of a
+// tetraIndex.
+const maxIndexCells = 256
+
+// tetraIndex is a spatial index of the tetrahedra which intersect a HistBox.
+// It's used to find every stream passing through a point without a rendered
+// density grid. Coordinates are stored relative to the center of the box.
+type tetraIndex struct {
+	center geom.Vec
+	L float32
+
+	// lo is the lowermost corner of the indexed region.
+	lo geom.Vec
+	cellWidth [3]float32
+	cells [3]int
+
+	corners [][4]geom.Vec
+	rhos []float64
+	// cellTets contains the indices of the tetrahedra whose bounding boxes
+	// overlap each cell. It's nil until the index is allocated.
+	cellTets [][]int32
+
+	// tets and entries are the number of tetrahedra which have been added
+	// or counted and the number of cells they overlap.
+	tets, entries int64
+}
+
+// Approximate sizes of the parts of a tetraIndex in bytes.
+const (
+	indexTetBytes = 4*3*4 + 8
+	indexEntryBytes = 4
+	indexCellBytes = 24
+)
+
+// newTetraIndex creates an empty index covering box within a periodic box of
+// width L. cellWidth is the approximate width of the index's cells. The
+// index's cells aren't allocated, so tetrahedra can be counted, but not
+// added, until Allocate is called.
+func newTetraIndex(box *HistBox, L, cellWidth float64) *tetraIndex {
+	idx := &tetraIndex{ center: box.Center(L), L: float32(L) }
+	for k := 0; k < 3; k++ {
+		cells := int(math.Ceil(box.Span[k] / cellWidth))
+		if cells < 1 { cells = 1 }
+		if cells > maxIndexCells { cells = maxIndexCells }
+
+		idx.cells[k] = cells
+		idx.lo[k] = float32(-box.Span[k] / 2)
+		idx.cellWidth[k] = float32(box.Span[k] / float64(cells))
+	}
+	return idx
+}
+
+// Allocate allocates the cells of the index so that tetrahedra can be added
+// to it.
+func (idx *tetraIndex) Allocate() {
+	idx.cellTets = make([][]int32, idx.cells[0]*idx.cells[1]*idx.cells[2])
+	idx.tets, idx.entries = 0, 0
+}
+
+// Bytes returns the approximate memory used by the tetrahedra which have
+// been added to or counted by the index.
+func (idx *tetraIndex) Bytes() int64 {
+	cells := int64(idx.cells[0]*idx.cells[1]*idx.cells[2])
+	return idx.tets*indexTetBytes + idx.entries*indexEntryBytes +
+		cells*indexCellBytes
+}
+
+// local moves x into coordinates relative to the center of the index.
+func (idx *tetraIndex) local(x geom.Vec) geom.Vec {
+	L := idx.L
+	for k := 0; k < 3; k++ {
+		x[k] -= idx.center[k]
+		if x[k] >= L/2 { x[k] -= L }
+		if x[k] < -L/2 { x[k] += L }
+	}
+	return x
+}
+
+// cell returns the index of the cell containing the local coordinate x
+// along axis k. The result may be out of range.
+func (idx *tetraIndex) cell(x float32, k int) int {
+	return int(math.Floor(float64((x - idx.lo[k]) / idx.cellWidth[k])))
+}
+
+// bounds returns the corners of tet in local coordinates and the range of
+// cells which its bounding box overlaps. ok is false if tet doesn't
+// intersect the indexed region. tet must already be periodized.
+func (idx *tetraIndex) bounds(
+	tet *geom.Tetra,
+) (corners [4]geom.Vec, lo, hi [3]int, ok bool) {
+	c0 := idx.local(tet.Corners[0])
+	for k := 0; k < 3; k++ {
+		shift := c0[k] - tet.Corners[0][k]
+		min, max := c0[k], c0[k]
+		for i := 0; i < 4; i++ {
+			corners[i][k] = tet.Corners[i][k] + shift
+			if corners[i][k] < min { min = corners[i][k] }
+			if corners[i][k] > max { max = corners[i][k] }
+		}
+
+		lo[k], hi[k] = idx.cell(min, k), idx.cell(max, k)
+		if hi[k] < 0 || lo[k] >= idx.cells[k] {
+			return corners, lo, hi, false
+		}
+		if lo[k] < 0 { lo[k] = 0 }
+		if hi[k] >= idx.cells[k] { hi[k] = idx.cells[k] - 1 }
+	}
+	return corners, lo, hi, true
+}
+
+// Count records the memory which adding tet would use without adding it.
+func (idx *tetraIndex) Count(tet *geom.Tetra) {
+	_, lo, hi, ok := idx.bounds(tet)
+	if ok { idx.record(lo, hi) }
+}
+
+// record updates the counts of tetrahedra and cell entries for a
+// tetrahedron which overlaps the cells in [lo, hi].
+func (idx *tetraIndex) record(lo, hi [3]int) {
+	idx.tets++
+	idx.entries += int64((hi[0] - lo[0] + 1) * (hi[1] - lo[1] + 1) *
+		(hi[2] - lo[2] + 1))
+}
+
+// Add adds a tetrahedron with the given density to the index if it
+// intersects the indexed region. tet must already be periodized.
+func (idx *tetraIndex) Add(tet *geom.Tetra, rho float64) {
+	corners, lo, hi, ok := idx.bounds(tet)
+	if !ok { return }
+	idx.record(lo, hi)
+
+	id := int32(len(idx.rhos))
+	idx.corners = append(idx.corners, corners)
+	idx.rhos = append(idx.rhos, rho)
+
+	nx, ny := idx.cells[0], idx.cells[1]
+	for z := lo[2]; z <= hi[2]; z++ {
+		for y := lo[1]; y <= hi[1]; y++ {
+			for x := lo[0]; x <= hi[0]; x++ {
+				i := x + y*nx + z*nx*ny
+				idx.cellTets[i] = append(idx.cellTets[i], id)
+			}
+		}
+	}
+}
+
+// Streams returns the summed density of every tetrahedron in the index which
+// contains x and the number of such tetrahedra. tet is used as a workspace.
+func (idx *tetraIndex) Streams(x geom.Vec, tet *geom.Tetra) (float64, int) {
+	u := idx.local(x)
+	c := [3]int{ }
+	for k := 0; k < 3; k++ {
+		c[k] = idx.cell(u[k], k)
+		if c[k] < 0 || c[k] >= idx.cells[k] { return 0, 0 }
+	}
+
+	rho, n := 0.0, 0
+	i := c[0] + c[1]*idx.cells[0] + c[2]*idx.cells[0]*idx.cells[1]
+	for _, j := range idx.cellTets[i] {
+		corners := &idx.corners[j]
+		tet.Init(&corners[0], &corners[1], &corners[2], &corners[3])
+		if tet.Contains(&u) {
+			rho += idx.rhos[j]
+			n++
+		}
+	}
+	return rho, n
+}
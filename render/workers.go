@@ -0,0 +1,124 @@
+package render
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/phil-mansfield/gotetra/render/geom"
+	"github.com/phil-mansfield/gotetra/render/io"
+)
+
+// checkSubsample returns an error if skip can't be used as the subsample
+// length of the sheet segments described by hd. skip must be a power of two
+// which evenly divides the segment width.
+func checkSubsample(hd *io.SheetHeader, skip int) error {
+	if !isPowTwo(skip) {
+		return fmt.Errorf(
+			"Subsample length is %d, but it must be a power of two.", skip,
+		)
+	} else if hd.SegmentWidth % int64(skip) != 0 {
+		return fmt.Errorf(
+			"Subsample length is %d, but it must evenly divide the sheet " +
+				"segment width, %d.", skip, hd.SegmentWidth,
+		)
+	}
+	return nil
+}
+
+// runWorkers runs work on workers threads, one of which is the calling
+// thread, and calls merge with the ID of each worker as it finishes. merge
+// is only ever called from the calling thread.
+func runWorkers(workers int, work func(id int), merge func(id int)) {
+	out := make(chan int, workers)
+	for id := 0; id < workers - 1; id++ {
+		go func(id int) {
+			work(id)
+			out <- id
+		}(id)
+	}
+	work(workers - 1)
+	out <- workers - 1
+
+	for i := 0; i < workers; i++ {
+		id := <-out
+		if merge != nil { merge(id) }
+	}
+}
+
+// forCubes calls f with the index and grid coordinates of the lowermost
+// particle of every workers-th Lagrangian cube of width skip in the sheet
+// segment described by hd, starting with the id-th.
+func forCubes(
+	hd *io.SheetHeader, skip, id, workers int, f func(idx, x, y, z int),
+) {
+	gridWidth := int(hd.GridWidth)
+	segFrac := int(hd.SegmentWidth) / skip
+
+	for j := id; j < segFrac*segFrac*segFrac; j += workers {
+		x := (j % segFrac) * skip
+		y := ((j / segFrac) % segFrac) * skip
+		z := (j / (segFrac * segFrac)) * skip
+		f(x + y*gridWidth + z*gridWidth*gridWidth, x, y, z)
+	}
+}
+
+// periodizeTetra moves the corners of tet into the same periodic image as
+// its first corner.
+func periodizeTetra(tet *geom.Tetra, L float32) {
+	for i := 1; i < 4; i++ {
+		for k := 0; k < 3; k++ {
+			delta := tet.Corners[i][k] - tet.Corners[0][k]
+			if delta > L/2 { tet.Corners[i][k] -= L }
+			if delta < -L/2 { tet.Corners[i][k] += L }
+		}
+	}
+}
+
+// lagrangianWeight returns the mass of each of points Monte Carlo samples of
+// a tetrahedron in units of the mean density of the box times (Mpc/h)^3.
+// Every point gets an equal share of the Lagrangian volume of its
+// tetrahedron, so the mean density of the box is one.
+func lagrangianWeight(hd *io.SheetHeader, skip, points int) float64 {
+	lagWidth := hd.TotalWidth / float64(hd.CountWidth) * float64(skip)
+	return lagWidth * lagWidth * lagWidth / 6 / float64(points)
+}
+
+// loadSheet reads the positions of the particles in file into xs and their
+// velocities into vs if vs isn't nil. It returns the number of bytes read.
+func loadSheet(file string, hd *io.SheetHeader, xs, vs []geom.Vec) (int64, error) {
+	err := io.ReadSheetPositionsAt(file, xs)
+	if err != nil { return 0, err }
+	bytes := hd.GridCount * vecBytes
+	if vs != nil {
+		err = io.ReadSheetVelocitiesAt(file, vs)
+		if err != nil { return bytes, err }
+		bytes += hd.GridCount * vecBytes
+	}
+	return bytes, nil
+}
+
+// analyzeFiles calls f on each file in order, logging progress and emitting
+// file_start and file_finish events to events. bytesRead is the caller's
+// running count of bytes read, which f should update.
+func analyzeFiles(
+	files []string, events *EventLog, bytesRead *int64,
+	f func(file string) error,
+) error {
+	for i, file := range files {
+		log.Printf("Analyzed files %d/%d", i, len(files))
+		events.Emit("file_start", Event{
+			"file": file, "index": i, "files": len(files),
+		})
+		start := *bytesRead
+
+		if err := f(file); err != nil { return err }
+
+		events.Emit("file_finish", Event{
+			"file": file, "index": i, "files": len(files),
+			"files_done": i + 1,
+			"bytes_read": *bytesRead - start,
+			"total_bytes_read": *bytesRead,
+		})
+	}
+	return nil
+}